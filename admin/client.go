@@ -0,0 +1,115 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+type Client struct {
+	http  *http.Client
+	base  string
+	token string
+}
+
+func NewClient(addr, token string) *Client {
+	network, address := splitAddr(addr)
+
+	base := "http://" + address
+	if network == "unix" {
+		// host is ignored, dialer always connects to socket
+		base = "http://unix"
+	}
+
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, network, address)
+				},
+			},
+			Timeout: 120 * time.Second,
+		},
+		base:  base,
+		token: token,
+	}
+}
+
+func (c *Client) GetStats(ctx context.Context) (*StatsResponse, error) {
+	var res StatsResponse
+	return &res, c.do(ctx, http.MethodGet, "/v1/stats", nil, &res)
+}
+
+func (c *Client) GetPeers(ctx context.Context) (*PeersResponse, error) {
+	var res PeersResponse
+	return &res, c.do(ctx, http.MethodGet, "/v1/peers", nil, &res)
+}
+
+func (c *Client) GetSections(ctx context.Context) (*SectionsResponse, error) {
+	var res SectionsResponse
+	return &res, c.do(ctx, http.MethodGet, "/v1/sections", nil, &res)
+}
+
+func (c *Client) CloseSection(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodPost, "/v1/sections/close", CloseSectionRequest{Key: key}, &OkResponse{})
+}
+
+func (c *Client) GetChannelsBalance(ctx context.Context) (*ChannelsBalanceResponse, error) {
+	var res ChannelsBalanceResponse
+	return &res, c.do(ctx, http.MethodGet, "/v1/channels/balance", nil, &res)
+}
+
+func (c *Client) GetWalletBalance(ctx context.Context) (*WalletBalanceResponse, error) {
+	var res WalletBalanceResponse
+	return &res, c.do(ctx, http.MethodGet, "/v1/wallet/balance", nil, &res)
+}
+
+func (c *Client) WalletTransfer(ctx context.Context, req WalletTransferRequest) (*WalletTransferResponse, error) {
+	var res WalletTransferResponse
+	return &res, c.do(ctx, http.MethodPost, "/v1/wallet/transfer", req, &res)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, req, res any) error {
+	var body io.Reader
+	if req != nil {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return fmt.Errorf("failed to serialize request: %w", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, c.base+path, body)
+	if err != nil {
+		return fmt.Errorf("failed to build request: %w", err)
+	}
+	r.Header.Set("Authorization", "Bearer "+c.token)
+	if body != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(r)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e ErrorResponse
+		if err = json.NewDecoder(resp.Body).Decode(&e); err != nil || e.Error == "" {
+			return fmt.Errorf("request failed with status %d", resp.StatusCode)
+		}
+		return fmt.Errorf("request failed with status %d: %s", resp.StatusCode, e.Error)
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(res); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	return nil
+}
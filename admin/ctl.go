@@ -0,0 +1,181 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+const CtlUsage = `Usage: tunnel-node ctl [-config config.json] <command> [args]
+
+Commands:
+  stats                                    packets stats per inbound section
+  speed                                    packets per second per inbound section, until interrupted
+  peers                                    active peers
+  sections                                 inbound sections with routes and outs
+  close-section <key>                      close inbound section, key is in hex or base64
+  balance                                  summarized balance of payment channels
+  capacity                                 capacity left in payment channels
+  wallet-ton-balance                       wallet balance
+  wallet-ton-transfer <addr> <amount> [comment]
+`
+
+// RunCtl executes admin command using client and prints result to out
+func RunCtl(ctx context.Context, c *Client, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return fmt.Errorf("command is not specified\n%s", CtlUsage)
+	}
+
+	switch args[0] {
+	case "stats":
+		res, err := c.GetStats(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, s := range sortedKeys(res.Sections) {
+			st := res.Sections[s]
+			prepaidRoutes := ""
+			for _, v := range st.PrepaidPacketsRoute {
+				prepaidRoutes += " " + formatNumInt(v)
+			}
+
+			_, _ = fmt.Fprintf(out, "%s routed: %s sent: %s received: %s dropped_in: %s prepaid_routes:%s prepaid_out: %s prepaid_in: %s\n",
+				s, formatNum(st.Routed), formatNum(st.Sent), formatNum(st.Received), formatNum(st.DroppedIn),
+				prepaidRoutes, formatNumInt(st.PrepaidPacketsOut), formatNumInt(st.PrepaidPacketsIn))
+		}
+	case "speed":
+		prev, err := c.GetStats(ctx)
+		if err != nil {
+			return err
+		}
+
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-time.After(time.Second):
+			}
+
+			res, err := c.GetStats(ctx)
+			if err != nil {
+				return err
+			}
+
+			for _, s := range sortedKeys(res.Sections) {
+				st := res.Sections[s]
+				if p := prev.Sections[s]; p != nil {
+					_, _ = fmt.Fprintf(out, "%s routed: %s/s sent: %s/s received: %s/s\n",
+						s, formatNum(st.Routed-p.Routed), formatNum(st.Sent-p.Sent), formatNum(st.Received-p.Received))
+				}
+			}
+			prev = res
+		}
+	case "peers":
+		res, err := c.GetPeers(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(out, res.Peers)
+	case "sections":
+		res, err := c.GetSections(ctx)
+		if err != nil {
+			return err
+		}
+		return printJSON(out, res.Sections)
+	case "close-section":
+		if len(args) < 2 {
+			return fmt.Errorf("section key is not specified")
+		}
+
+		if err := c.CloseSection(ctx, args[1]); err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintln(out, "section closed")
+	case "balance", "capacity":
+		res, err := c.GetChannelsBalance(ctx)
+		if err != nil {
+			return err
+		}
+
+		if args[0] == "balance" {
+			_, _ = fmt.Fprintf(out, "Summarized balance: %s TON\n", res.Balance)
+		} else {
+			_, _ = fmt.Fprintf(out, "Capacity left: %s TON\n", res.Capacity)
+		}
+	case "wallet-ton-balance":
+		res, err := c.GetWalletBalance(ctx)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(out, "wallet %s balance: %s TON\n", res.Address, res.Balance)
+	case "wallet-ton-transfer":
+		if len(args) < 3 {
+			return fmt.Errorf("address and amount should be specified")
+		}
+
+		req := WalletTransferRequest{
+			Address: args[1],
+			Amount:  args[2],
+		}
+		if len(args) > 3 {
+			req.Comment = args[3]
+		}
+
+		res, err := c.WalletTransfer(ctx, req)
+		if err != nil {
+			return err
+		}
+		_, _ = fmt.Fprintf(out, "transfer transaction committed: %s\n", res.Hash)
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], CtlUsage)
+	}
+
+	return nil
+}
+
+func printJSON(out io.Writer, v any) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "\t")
+	return enc.Encode(v)
+}
+
+func sortedKeys[T any](m map[string]T) []string {
+	list := make([]string, 0, len(m))
+	for k := range m {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func formatNum(packets uint64) string {
+	sizes := []string{"", " K", " M", " B"}
+
+	sizeIndex := 0
+	sizeFloat := float64(packets)
+
+	for sizeFloat >= 1000 && sizeIndex < len(sizes)-1 {
+		sizeFloat /= 1000
+		sizeIndex++
+	}
+
+	return fmt.Sprintf("%.2f%s", sizeFloat, sizes[sizeIndex])
+}
+
+func formatNumInt(packets int64) string {
+	sizes := []string{"", " K", " M", " B"}
+
+	sizeIndex := 0
+	sizeFloat := float64(packets)
+
+	for sizeFloat >= 1000 && sizeIndex < len(sizes)-1 {
+		sizeFloat /= 1000
+		sizeIndex++
+	}
+
+	return fmt.Sprintf("%.2f%s", sizeFloat, sizes[sizeIndex])
+}
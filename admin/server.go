@@ -0,0 +1,310 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"github.com/ton-blockchain/adnl-tunnel/tunnel"
+	"github.com/xssnick/ton-payment-network/tonpayments"
+	"github.com/xssnick/ton-payment-network/tonpayments/db"
+	"github.com/xssnick/tonutils-go/address"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-go/ton"
+	"github.com/xssnick/tonutils-go/ton/wallet"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Node is a set of components which are controlled by admin api,
+// payments related fields can be nil if payments are disabled.
+type Node struct {
+	Gateway  *tunnel.Gateway
+	Payments *tonpayments.Service
+	Wallet   *wallet.Wallet
+	API      ton.APIClientWrapped
+}
+
+type Server struct {
+	node  *Node
+	token string
+	srv   *http.Server
+	log   zerolog.Logger
+}
+
+func NewServer(node *Node, token string, logger zerolog.Logger) *Server {
+	s := &Server{
+		node:  node,
+		token: token,
+		log:   logger,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/stats", s.get(s.handleStats))
+	mux.HandleFunc("/v1/peers", s.get(s.handlePeers))
+	mux.HandleFunc("/v1/sections", s.get(s.handleSections))
+	mux.HandleFunc("/v1/sections/close", s.post(s.handleCloseSection))
+	mux.HandleFunc("/v1/channels/balance", s.get(s.handleChannelsBalance))
+	mux.HandleFunc("/v1/wallet/balance", s.get(s.handleWalletBalance))
+	mux.HandleFunc("/v1/wallet/transfer", s.post(s.handleWalletTransfer))
+
+	s.srv = &http.Server{
+		Handler:      s.auth(mux),
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 90 * time.Second,
+	}
+	return s
+}
+
+// Listen parses admin address, it can be unix socket in form 'unix:/path/to.sock', or tcp 'host:port'
+func Listen(addr string) (net.Listener, error) {
+	network, address := splitAddr(addr)
+	if network == "unix" {
+		// remove socket left after previous run
+		if err := os.Remove(address); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to remove old socket: %w", err)
+		}
+
+		l, err := net.Listen(network, address)
+		if err != nil {
+			return nil, err
+		}
+
+		if err = os.Chmod(address, 0600); err != nil {
+			_ = l.Close()
+			return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+		}
+		return l, nil
+	}
+	return net.Listen(network, address)
+}
+
+func splitAddr(addr string) (string, string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", strings.TrimPrefix(strings.TrimPrefix(addr, "unix:"), "//")
+	}
+	return "tcp", addr
+}
+
+func (s *Server) Serve(l net.Listener) error {
+	if tcp, ok := l.Addr().(*net.TCPAddr); ok && !tcp.IP.IsLoopback() {
+		s.log.Warn().Str("addr", tcp.String()).Msg("admin api is listening on non loopback address")
+	}
+
+	if err := s.srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func (s *Server) Stop(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+func (s *Server) auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if s.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) != 1 {
+			writeError(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) get(h func(r *http.Request) (any, error)) http.HandlerFunc {
+	return s.handle(http.MethodGet, h)
+}
+
+func (s *Server) post(h func(r *http.Request) (any, error)) http.HandlerFunc {
+	return s.handle(http.MethodPost, h)
+}
+
+func (s *Server) handle(method string, h func(r *http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s is not allowed", r.Method))
+			return
+		}
+
+		res, err := h(r)
+		if err != nil {
+			code := http.StatusInternalServerError
+			var he *httpError
+			if errors.As(err, &he) {
+				code = he.code
+			}
+
+			s.log.Debug().Err(err).Str("path", r.URL.Path).Msg("admin request failed")
+			writeError(w, code, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err = json.NewEncoder(w).Encode(res); err != nil {
+			s.log.Debug().Err(err).Str("path", r.URL.Path).Msg("failed to write admin response")
+		}
+	}
+}
+
+type httpError struct {
+	code int
+	err  error
+}
+
+func (e *httpError) Error() string {
+	return e.err.Error()
+}
+
+func badRequest(err error) error {
+	return &httpError{code: http.StatusBadRequest, err: err}
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(ErrorResponse{Error: err.Error()})
+}
+
+func (s *Server) handleStats(_ *http.Request) (any, error) {
+	res := StatsResponse{Sections: map[string]*tunnel.SectionStats{}}
+	for key, st := range s.node.Gateway.GetPacketsStats() {
+		res.Sections[hex.EncodeToString([]byte(key))] = st
+	}
+	return res, nil
+}
+
+func (s *Server) handlePeers(_ *http.Request) (any, error) {
+	return PeersResponse{Peers: s.node.Gateway.GetActivePeers()}, nil
+}
+
+func (s *Server) handleSections(_ *http.Request) (any, error) {
+	return SectionsResponse{Sections: s.node.Gateway.GetInboundSections()}, nil
+}
+
+func (s *Server) handleCloseSection(r *http.Request) (any, error) {
+	var req CloseSectionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest(fmt.Errorf("invalid request: %w", err))
+	}
+
+	key, err := parseKey(req.Key)
+	if err != nil {
+		return nil, badRequest(err)
+	}
+
+	if err = s.node.Gateway.CloseSection(key); err != nil {
+		if errors.Is(err, tunnel.ErrSectionNotFound) {
+			return nil, &httpError{code: http.StatusNotFound, err: err}
+		}
+		return nil, err
+	}
+	return OkResponse{Ok: true}, nil
+}
+
+func (s *Server) handleChannelsBalance(r *http.Request) (any, error) {
+	if s.node.Payments == nil {
+		return nil, badRequest(fmt.Errorf("payments are not enabled"))
+	}
+
+	list, err := s.node.Payments.ListChannels(r.Context(), nil, db.ChannelStateActive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list channels: %w", err)
+	}
+
+	balance, capacity := big.NewInt(0), big.NewInt(0)
+	for _, channel := range list {
+		v, _, err := channel.CalcBalance(false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to calc channel balance: %w", err)
+		}
+		balance.Add(balance, v)
+
+		v, _, err = channel.CalcBalance(true)
+		if err != nil {
+			return nil, fmt.Errorf("failed to calc channel capacity: %w", err)
+		}
+		capacity.Add(capacity, v)
+	}
+
+	return ChannelsBalanceResponse{
+		Channels: len(list),
+		Balance:  tlb.FromNanoTON(balance).String(),
+		Capacity: tlb.FromNanoTON(capacity).String(),
+	}, nil
+}
+
+func (s *Server) handleWalletBalance(r *http.Request) (any, error) {
+	if s.node.Wallet == nil {
+		return nil, badRequest(fmt.Errorf("payments are not enabled"))
+	}
+
+	blk, err := s.node.API.CurrentMasterchainInfo(r.Context())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get current masterchain info: %w", err)
+	}
+
+	balance, err := s.node.Wallet.GetBalance(r.Context(), blk)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance: %w", err)
+	}
+
+	return WalletBalanceResponse{
+		Address: s.node.Wallet.WalletAddress().String(),
+		Balance: balance.String(),
+	}, nil
+}
+
+func (s *Server) handleWalletTransfer(r *http.Request) (any, error) {
+	if s.node.Wallet == nil {
+		return nil, badRequest(fmt.Errorf("payments are not enabled"))
+	}
+
+	var req WalletTransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest(fmt.Errorf("invalid request: %w", err))
+	}
+
+	addr, err := address.ParseAddr(req.Address)
+	if err != nil {
+		return nil, badRequest(fmt.Errorf("incorrect format of address: %w", err))
+	}
+
+	amt, err := tlb.FromTON(req.Amount)
+	if err != nil {
+		return nil, badRequest(fmt.Errorf("incorrect format of amount: %w", err))
+	}
+
+	s.log.Info().
+		Str("to_address", addr.String()).
+		Str("amount", amt.String()).
+		Msg("transferring by admin request...")
+
+	tx, _, err := s.node.Wallet.TransferWaitTransaction(r.Context(), addr, amt, req.Comment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to transfer: %w", err)
+	}
+	s.log.Info().Str("hash", base64.URLEncoding.EncodeToString(tx.Hash)).Msg("transfer transaction committed")
+
+	return WalletTransferResponse{Hash: base64.URLEncoding.EncodeToString(tx.Hash)}, nil
+}
+
+func parseKey(key string) ([]byte, error) {
+	if b, err := hex.DecodeString(key); err == nil && len(b) == 32 {
+		return b, nil
+	}
+
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("invalid key, should be 32 bytes in hex or base64")
+	}
+	return b, nil
+}
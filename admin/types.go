@@ -0,0 +1,50 @@
+package admin
+
+import "github.com/ton-blockchain/adnl-tunnel/tunnel"
+
+type ErrorResponse struct {
+	Error string
+}
+
+type OkResponse struct {
+	Ok bool
+}
+
+type StatsResponse struct {
+	// Sections is keyed by section public key in hex
+	Sections map[string]*tunnel.SectionStats
+}
+
+type PeersResponse struct {
+	Peers []tunnel.PeerStats
+}
+
+type SectionsResponse struct {
+	Sections []tunnel.InboundSectionStats
+}
+
+type CloseSectionRequest struct {
+	// Key of section in hex or base64
+	Key string
+}
+
+type ChannelsBalanceResponse struct {
+	Channels int
+	Balance  string
+	Capacity string
+}
+
+type WalletBalanceResponse struct {
+	Address string
+	Balance string
+}
+
+type WalletTransferRequest struct {
+	Address string
+	Amount  string
+	Comment string
+}
+
+type WalletTransferResponse struct {
+	Hash string
+}
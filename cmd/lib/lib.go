@@ -41,10 +41,10 @@ import (
 	"github.com/rs/zerolog/log"
 	"github.com/ton-blockchain/adnl-tunnel/config"
 	"github.com/ton-blockchain/adnl-tunnel/tunnel"
-	"github.com/xssnick/tonutils-go/adnl"
 	"github.com/xssnick/tonutils-go/liteclient"
 	"net"
 	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -143,18 +143,25 @@ func PrepareTunnel(logger C.Logger, onRecv C.RecvCallback, onReinit C.ReinitCall
 		log.Fatal().Err(err).Msg("Failed to parse tunnel config")
 	}
 
-	if cfg.NodesPoolConfigPath == "" {
-		log.Fatal().Msg("nodes pool config path is empty")
+	if cfg.EntryGuardsFile == "" {
+		cfg.EntryGuardsFile = filepath.Join(filepath.Dir(path), "tunnel-guards.json")
 	}
-
-	data, err = os.ReadFile(cfg.NodesPoolConfigPath)
-	if err != nil {
-		log.Fatal().Err(err).Str("path", cfg.NodesPoolConfigPath).Msg("Failed to load tunnel shared config (nodes pool)")
+	if cfg.Payments.BudgetsFile == "" {
+		cfg.Payments.BudgetsFile = filepath.Join(filepath.Dir(path), "tunnel-budgets.json")
 	}
 
-	var sharedCfg config.SharedConfig
-	if err = json.Unmarshal(data, &sharedCfg); err != nil {
-		log.Fatal().Err(err).Msg("Failed to parse tunnel shared config")
+	// when nodes pool is not specified, it is discovered from dht
+	var sharedCfg *config.SharedConfig
+	if cfg.NodesPoolConfigPath != "" {
+		data, err = os.ReadFile(cfg.NodesPoolConfigPath)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", cfg.NodesPoolConfigPath).Msg("Failed to load tunnel shared config (nodes pool)")
+		}
+
+		sharedCfg = &config.SharedConfig{}
+		if err = json.Unmarshal(data, sharedCfg); err != nil {
+			log.Fatal().Err(err).Msg("Failed to parse tunnel shared config")
+		}
 	}
 
 	var netCfg liteclient.GlobalConfig
@@ -164,10 +171,29 @@ func PrepareTunnel(logger C.Logger, onRecv C.RecvCallback, onReinit C.ReinitCall
 	}
 
 	events := make(chan any, 1)
-	go tunnel.RunTunnel(context.Background(), &cfg, &sharedCfg, &netCfg, log.Logger, events)
+	go tunnel.RunTunnel(context.Background(), &cfg, sharedCfg, &netCfg, log.Logger, events)
 
 	indexMatch = []unsafe.Pointer{nil}
 
+	var lastAddr *net.UDPAddr
+	var lastAddrMx sync.Mutex
+	// reinit reports external address only when it differs from the last reported one,
+	// both reroute and out address change handler can report the same address
+	reinit := func(addr *net.UDPAddr) {
+		lastAddrMx.Lock()
+		defer lastAddrMx.Unlock()
+
+		if lastAddr != nil && lastAddr.IP.Equal(addr.IP) && lastAddr.Port == addr.Port {
+			return
+		}
+		lastAddr = addr
+
+		var buf [16]byte
+		writeSockAddr(buf[:], addr)
+
+		C.on_reinit((C.RecvCallback)(onReinit), nextOnReinit, unsafe.Pointer(&buf[0]))
+	}
+
 	initUpd := make(chan tunnel.UpdatedEvent, 1)
 	once := sync.Once{}
 	go func() {
@@ -179,18 +205,25 @@ func PrepareTunnel(logger C.Logger, onRecv C.RecvCallback, onReinit C.ReinitCall
 			case tunnel.UpdatedEvent:
 				log.Info().Msg("tunnel updated")
 
-				e.Tunnel.SetOutAddressChangedHandler(func(addr *net.UDPAddr) {
-					var buf [16]byte
-					writeSockAddr(buf[:], addr)
+				first := false
+				once.Do(func() {
+					// initial address is returned to caller, it is not reported
+					lastAddrMx.Lock()
+					lastAddr = &net.UDPAddr{IP: e.ExtIP, Port: int(e.ExtPort)}
+					lastAddrMx.Unlock()
 
-					C.on_reinit((C.RecvCallback)(onReinit), nextOnReinit, unsafe.Pointer(&buf[0]))
-				})
+					// tunnel is switchable, so handler is set once and follows reroutes
+					e.Tunnel.SetOutAddressChangedHandler(reinit)
+					atomic.StorePointer(&indexMatch[0], unsafe.Pointer(e.Tunnel))
 
-				once.Do(func() {
+					first = true
 					initUpd <- e
 				})
 
-				atomic.StorePointer(&indexMatch[0], unsafe.Pointer(e.Tunnel))
+				if !first {
+					// rerouted, external address of the new route can be different
+					reinit(&net.UDPAddr{IP: e.ExtIP, Port: int(e.ExtPort)})
+				}
 			case tunnel.ConfigurationErrorEvent:
 				log.Err(e.Err).Msg("tunnel configuration error, will retry...")
 			case error:
@@ -202,12 +235,13 @@ func PrepareTunnel(logger C.Logger, onRecv C.RecvCallback, onReinit C.ReinitCall
 
 	go func() {
 		off, num := 0, 0
-		buf := make([]byte, (16+2+adnl.MaxMTU)*100)
+		// datagrams bigger than mtu are reassembled from fragments by tunnel
+		buf := make([]byte, (16+2+tunnel.DatagramMaxSize)*100)
 		sinceLastBatch := time.Now()
 		ctx, _ := context.WithTimeout(context.Background(), 20*time.Millisecond)
 
 		for {
-			tun := (*tunnel.RegularOutTunnel)(atomic.LoadPointer(&indexMatch[0]))
+			tun := (*tunnel.AtomicSwitchableRegularTunnel)(atomic.LoadPointer(&indexMatch[0]))
 			n, addr, err := tun.ReadFromWithTimeout(ctx, buf[off+18:])
 			if err != nil {
 				if !errors.Is(err, context.DeadlineExceeded) {
@@ -220,8 +254,8 @@ func PrepareTunnel(logger C.Logger, onRecv C.RecvCallback, onReinit C.ReinitCall
 				ctx, _ = context.WithTimeout(context.Background(), 20*time.Millisecond)
 			}
 
-			if n > adnl.MaxMTU {
-				log.Trace().Msg("skip message bigger than max mtu")
+			if n > tunnel.DatagramMaxSize {
+				log.Trace().Msg("skip message bigger than max datagram size")
 				continue
 			}
 
@@ -258,7 +292,7 @@ func WriteTunnel(tunIdx C.size_t, data *C.uint8_t, num C.size_t) C.int {
 
 	// log.Debug().Int("num", int(num)).Msg("batch write to tunnel")
 
-	tun := (*tunnel.RegularOutTunnel)(atomic.LoadPointer(&indexMatch[int(tunIdx)-1]))
+	tun := (*tunnel.AtomicSwitchableRegularTunnel)(atomic.LoadPointer(&indexMatch[int(tunIdx)-1]))
 
 	// convert to go slice but without copy, we don't cate about actual len so set it big
 	buf := unsafe.Slice((*byte)(unsafe.Pointer(data)), 1<<31)
@@ -13,6 +13,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/ton-blockchain/adnl-tunnel/admin"
 	"github.com/ton-blockchain/adnl-tunnel/config"
 	"github.com/ton-blockchain/adnl-tunnel/metrics"
 	"github.com/ton-blockchain/adnl-tunnel/tunnel"
@@ -24,12 +25,10 @@ import (
 	"github.com/xssnick/ton-payment-network/tonpayments/transport"
 	adnlTransport "github.com/xssnick/ton-payment-network/tonpayments/transport/adnl"
 	pWallet "github.com/xssnick/ton-payment-network/tonpayments/wallet"
-	tonaddr "github.com/xssnick/tonutils-go/address"
 	"github.com/xssnick/tonutils-go/adnl"
 	"github.com/xssnick/tonutils-go/adnl/address"
 	"github.com/xssnick/tonutils-go/adnl/dht"
 	"github.com/xssnick/tonutils-go/liteclient"
-	"github.com/xssnick/tonutils-go/tlb"
 	"github.com/xssnick/tonutils-go/ton"
 	"github.com/xssnick/tonutils-go/ton/wallet"
 	"io"
@@ -37,8 +36,11 @@ import (
 	"net"
 	"net/http"
 	"net/netip"
+	"os"
+	"os/signal"
 	"runtime"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "net/http/pprof"
@@ -61,6 +63,10 @@ var LogDisableFile = flag.Bool("log-disable-file", false, "Disable logging to fi
 var GitCommit = "dev"
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "ctl" {
+		runCtl(os.Args[2:])
+		return
+	}
 	flag.Parse()
 
 	// logs rotation
@@ -229,10 +235,17 @@ func main() {
 		}
 		log.Info().Str("payment-pub-key", base64.StdEncoding.EncodeToString(chId)).Msg("prioritized channel for payments is active")
 
+		ledger, err := tunnel.OpenPaymentLedger(cfg.Payments.GetLedgerDBPath())
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to open payments ledger")
+			return
+		}
+
 		pmt = tunnel.PaymentConfig{
 			Service:                pm,
 			MinPricePerPacketRoute: cfg.Payments.MinPricePerPacketRoute,
 			MinPricePerPacketInOut: cfg.Payments.MinPricePerPacketInOut,
+			Ledger:                 ledger,
 		}
 		wlt = w
 		apiClient = apiC
@@ -242,7 +255,31 @@ func main() {
 	if *Verbosity >= 3 {
 		lvl = zerolog.DebugLevel
 	}
-	tGate := tunnel.NewGateway(gate, dhtClient, tunKey, log.With().Str("component", "gateway").Logger().Level(lvl), pmt)
+
+	exitCfg := cfg.ExitPolicy
+	if cfg.ExternalIP != "" {
+		// packets to ourselves could reach services which are not exposed to tunnel users
+		exitCfg.Deny = append(append([]string{}, exitCfg.Deny...), cfg.ExternalIP)
+	}
+
+	exitPolicy, err := tunnel.NewExitPolicy(&exitCfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid exit policy")
+		return
+	}
+
+	log.Info().Bool("routing", cfg.Role.CanRoute()).Bool("out", cfg.Role.CanOut()).Msg("node role configured")
+
+	tGate := tunnel.NewGateway(gate, dhtClient, tunKey, log.With().Str("component", "gateway").Logger().Level(lvl), tunnel.GatewayOptions{
+		Payments:         pmt,
+		DisableRouting:   !cfg.Role.CanRoute(),
+		DisableOut:       !cfg.Role.CanOut(),
+		ExitPolicy:       exitPolicy,
+		Version:          GitCommit,
+		AdvertisePayment: cfg.RouteSection().Payment,
+		SectionPoWBits:   cfg.SectionPoWBits,
+		RouteJitter:      time.Duration(cfg.RouteJitterMs) * time.Millisecond,
+	})
 	go func() {
 		if err = tGate.Start(); err != nil {
 			log.Fatal().Err(err).Msg("tunnel gateway failed")
@@ -250,186 +287,80 @@ func main() {
 		}
 	}()
 
-	speedPrinterCtx, cancelSp := context.WithCancel(context.Background())
-	cancelSp()
-
 	log.Info().Msg("Tunnel started, listening on " + cfg.TunnelListenAddr + " ADNL id is: " + base64.StdEncoding.EncodeToString(tunKey.Public().(ed25519.PublicKey)))
-	for {
-		log.Info().Msg("Input a command:")
-		var val string
-		if _, err = fmt.Scanln(&val); err != nil {
-			log.Error().Err(err).Msg("input failure")
-			time.Sleep(100 * time.Millisecond)
-			continue
-		}
-
-		switch val {
-		case "speed":
-			select {
-			case <-speedPrinterCtx.Done():
-				speedPrinterCtx, cancelSp = context.WithCancel(context.Background())
-
-				go func() {
-					prev := tGate.GetPacketsStats()
-					for {
-						select {
-						case <-speedPrinterCtx.Done():
-							return
-						case <-time.After(time.Second * 1):
-							stats := tGate.GetPacketsStats()
-							for s, st := range stats {
-								if p := prev[s]; p != nil {
-									log.Info().Hex("section", []byte(s)).
-										Str("routed", formatNum(st.Routed-p.Routed)+"/s").
-										Str("sent", formatNum(st.Sent-p.Sent)+"/s").
-										Str("received", formatNum(st.Received-p.Received)+"/s").
-										Msg("per second")
-								}
-							}
-							prev = stats
-						}
-					}
-				}()
-
-			default:
-				cancelSp()
-			}
-		case "stats":
-			stats := tGate.GetPacketsStats()
-			for s, st := range stats {
-				log.Info().Hex("section", []byte(s)).
-					Str("routed", formatNum(st.Routed)).
-					Str("sent", formatNum(st.Sent)).
-					Str("received", formatNum(st.Received)).
-					Ints64("prepaid_routes", st.PrepaidPacketsRoute).
-					Str("prepaid_out", formatNumInt(st.PrepaidPacketsOut)).
-					Str("prepaid_in", formatNumInt(st.PrepaidPacketsIn)).
-					Msg("stats summarized")
-			}
-		case "balance", "capacity":
-			if pmt.Service == nil {
-				log.Error().Msg("payments are not enabled")
-				continue
-			}
-
-			list, err := pmt.Service.ListChannels(context.Background(), nil, db.ChannelStateActive)
-			if err != nil {
-				log.Error().Err(err).Msg("Failed to list channels")
-				continue
-			}
-
-			amount := big.NewInt(0)
-			for _, channel := range list {
-				v, _, err := channel.CalcBalance(val == "capacity")
-				if err != nil {
-					log.Error().Err(err).Msg("Failed to calc channel balance")
-					continue
-				}
-				amount = amount.Add(amount, v)
-			}
-
-			if val == "balance" {
-				log.Info().Msg("Summarized balance: " + tlb.FromNanoTON(amount).String() + " TON")
-			} else {
-				log.Info().Msg("Capacity left: " + tlb.FromNanoTON(amount).String() + " TON")
-			}
-			continue
-		case "wallet-ton-balance":
-			if wlt == nil {
-				log.Error().Msg("payments are not enabled")
-				continue
-			}
-
-			blk, err := apiClient.CurrentMasterchainInfo(context.Background())
-			if err != nil {
-				log.Error().Err(err).Msg("failed to get current masterchain info")
-				continue
-			}
-
-			balance, err := wlt.GetBalance(context.Background(), blk)
-			if err != nil {
-				log.Error().Err(err).Msg("failed to get balance")
-				continue
-			}
-
-			log.Info().Msgf("wallet balance: %s TON", balance.String())
-		case "wallet-ton-transfer":
-			if wlt == nil {
-				log.Error().Msg("payments are not enabled")
-				continue
-			}
-
-			log.Info().Msg("enter address to transfer to:")
 
-			var addrStr string
-			_, _ = fmt.Scanln(&addrStr)
-
-			addr, err := tonaddr.ParseAddr(addrStr)
-			if err != nil {
-				log.Error().Err(err).Msg("incorrect format of address")
-				continue
-			}
+	var adminSrv *admin.Server
+	if cfg.Admin.ListenAddr != "" {
+		l, err := admin.Listen(cfg.Admin.ListenAddr)
+		if err != nil {
+			log.Fatal().Err(err).Msg("failed to listen admin api")
+			return
+		}
 
-			log.Info().Msg("input amount:")
-			var strAmt string
-			_, _ = fmt.Scanln(&strAmt)
+		adminSrv = admin.NewServer(&admin.Node{
+			Gateway:  tGate,
+			Payments: pmt.Service,
+			Wallet:   wlt,
+			API:      apiClient,
+		}, cfg.Admin.Token, log.With().Str("component", "admin").Logger())
 
-			amt, err := tlb.FromTON(strAmt)
-			if err != nil {
-				log.Error().Err(err).Msg("incorrect format of amount")
-				continue
+		go func() {
+			log.Info().Str("addr", cfg.Admin.ListenAddr).Msg("starting admin api")
+			if err := adminSrv.Serve(l); err != nil {
+				log.Fatal().Err(err).Msg("admin api failed")
 			}
+		}()
+	} else {
+		log.Info().Msg("admin api is disabled, set Admin.ListenAddr in config to enable it")
+	}
 
-			log.Info().Msg("input comment:")
-			var comment string
-			_, _ = fmt.Scanln(&comment)
-
-			log.Info().
-				Str("to_address", addr.String()).
-				Str("amount", amt.String()).
-				Msg("transferring...")
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
 
-			time.Sleep(3 * time.Second) // give user some time to cancel
+	log.Info().Msg("stopping tunnel node...")
 
-			pmt.Service.GetPrivateKey()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
 
-			tx, _, err := wlt.TransferWaitTransaction(context.Background(), addr, amt, comment)
-			if err != nil {
-				log.Error().Err(err).Msg("failed to transfer")
-				continue
-			}
-			log.Info().Str("hash", base64.URLEncoding.EncodeToString(tx.Hash)).Msg("transfer transaction committed")
-		}
+	if adminSrv != nil {
+		_ = adminSrv.Stop(ctx)
+	}
 
+	if err = tGate.Stop(ctx); err != nil {
+		log.Error().Err(err).Msg("failed to stop tunnel gateway gracefully")
+		return
 	}
+	log.Info().Msg("tunnel node stopped")
 }
 
-func formatNum(packets uint64) string {
-	sizes := []string{"", " K", " M", " B"}
-
-	sizeIndex := 0
-	sizeFloat := float64(packets)
-
-	for sizeFloat >= 1000 && sizeIndex < len(sizes)-1 {
-		sizeFloat /= 1000
-		sizeIndex++
+func runCtl(args []string) {
+	fs := flag.NewFlagSet("ctl", flag.ExitOnError)
+	configPath := fs.String("config", "config.json", "Config path")
+	fs.Usage = func() {
+		_, _ = fmt.Fprint(fs.Output(), admin.CtlUsage)
 	}
+	_ = fs.Parse(args)
 
-	return fmt.Sprintf("%.2f%s", sizeFloat, sizes[sizeIndex])
-}
+	cfg, err := config.LoadConfig(*configPath)
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "failed to load config:", err)
+		os.Exit(1)
+	}
 
-func formatNumInt(packets int64) string {
-	sizes := []string{"", " K", " M", " B"}
+	if cfg.Admin.ListenAddr == "" {
+		_, _ = fmt.Fprintln(os.Stderr, "admin api is disabled in config")
+		os.Exit(1)
+	}
 
-	sizeIndex := 0
-	sizeFloat := float64(packets)
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer cancel()
 
-	for sizeFloat >= 1000 && sizeIndex < len(sizes)-1 {
-		sizeFloat /= 1000
-		sizeIndex++
+	if err = admin.RunCtl(ctx, admin.NewClient(cfg.Admin.ListenAddr, cfg.Admin.Token), fs.Args(), os.Stdout); err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		cancel()
+		os.Exit(1)
 	}
-
-	return fmt.Sprintf("%.2f%s", sizeFloat, sizes[sizeIndex])
 }
 
 func preparePayments(ctx context.Context, gCfg *liteclient.GlobalConfig, dhtClient *dht.Client, cfg *config.Config) (*tonpayments.Service, *wallet.Wallet, ton.APIClientWrapped) {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -16,6 +17,33 @@ import (
 	"time"
 )
 
+// NodeRole defines which kind of traffic node accepts, empty value means both
+type NodeRole string
+
+const (
+	NodeRoleBoth  NodeRole = "both"
+	NodeRoleRelay NodeRole = "relay"
+	NodeRoleExit  NodeRole = "exit"
+)
+
+func (r NodeRole) Validate() error {
+	switch r {
+	case "", NodeRoleBoth, NodeRoleRelay, NodeRoleExit:
+		return nil
+	}
+	return fmt.Errorf("unknown node role %q", string(r))
+}
+
+// CanRoute reports whether node relays traffic between other sections
+func (r NodeRole) CanRoute() bool {
+	return r != NodeRoleExit
+}
+
+// CanOut reports whether node can be used as out gateway
+func (r NodeRole) CanOut() bool {
+	return r != NodeRoleRelay
+}
+
 type PaymentsConfig struct {
 	ADNLServerKey     []byte
 	PaymentsNodeKey   []byte
@@ -24,18 +52,51 @@ type PaymentsConfig struct {
 	SecureProofPolicy bool
 	ChannelsConfig    configPayments.ChannelsConfig
 
+	// LedgerDBPath is a storage of accepted tunnel payments and prepaid balances,
+	// when empty, it is placed next to DBPath
+	LedgerDBPath string `json:",omitempty"`
+
 	MinPricePerPacketRoute uint64
 	MinPricePerPacketInOut uint64
 }
 
+type AdminConfig struct {
+	// ListenAddr of admin api, unix socket in form 'unix:/path/to.sock' or tcp 'host:port',
+	// when empty, admin api is disabled, configs without Admin section get it on localhost when loaded
+	ListenAddr string
+	Token      string
+}
+
+// ExitPolicyConfig restricts destinations which clients can send packets to through our out gateway,
+// private and reserved ranges are denied unless AllowPrivate is set or subnet is in Allow list
+type ExitPolicyConfig struct {
+	AllowPrivate bool
+	// Allow and Deny are IPs or subnets in CIDR notation, Deny has priority
+	Allow []string
+	Deny  []string
+	// AllowPorts and DenyPorts are ports or ranges like "1000-2000", when AllowPorts is empty, all ports are allowed
+	AllowPorts []string
+	DenyPorts  []string
+}
+
 type Config struct {
 	TunnelServerKey  []byte
 	TunnelListenAddr string
+	// Role of the node: "relay" - only relays traffic, "exit" - only works as out gateway, "both" or empty - everything
+	Role             NodeRole `json:",omitempty"`
 	TunnelThreads    uint
 	NetworkConfigUrl string
 	ExternalIP       string
 	PaymentsEnabled  bool
 	Payments         PaymentsConfig
+	Admin            AdminConfig
+	ExitPolicy       ExitPolicyConfig
+	// SectionPoWBits is a min proof of work difficulty for new sections, it is raised automatically under load
+	SectionPoWBits uint32 `json:",omitempty"`
+	// RouteJitterMs is a max random delay added to routed packets, to make timing correlation harder, max is 50
+	RouteJitterMs uint32 `json:",omitempty"`
+	// Operator is a name of who runs the node, it is included into shared config, so clients not use nodes of one operator in a route
+	Operator string `json:",omitempty"`
 }
 
 type PaymentChain struct {
@@ -61,6 +122,58 @@ type PaymentsClientConfig struct {
 	DBPath            string
 	SecureProofPolicy bool
 	ChannelsConfig    configPayments.ChannelsConfig
+
+	// Budgets limits prices of nodes and spending, per currency
+	Budgets []BudgetConfig `json:",omitempty"`
+	// BudgetsFile is where spending of the last day is saved, so hourly and daily budgets are kept after restart,
+	// when empty it is kept in memory
+	BudgetsFile string `json:",omitempty"`
+}
+
+// BudgetConfig limits prices and spending in one currency, amounts are in nano units, 0 = unlimited
+type BudgetConfig struct {
+	// JettonMaster and ExtraCurrencyID select currency, both empty for TON
+	JettonMaster    string `json:",omitempty"`
+	ExtraCurrencyID uint32 `json:",omitempty"`
+
+	// nodes with higher price are not used in routes
+	MaxPricePerPacketRouteNano uint64
+	MaxPricePerPacketOutNano   uint64
+
+	MaxSpendPerHourNano uint64
+	MaxSpendPerDayNano  uint64
+	// MaxSpendPerTunnelNano limits spending of one route, when it is reached, tunnel is rerouted
+	MaxSpendPerTunnelNano uint64
+}
+
+// OutFilterConfig is an admission policy for incoming packets on out gateway
+type OutFilterConfig struct {
+	// ConnectedOnly accepts packets only from addresses we sent something to in last ConnectedTTLSec
+	ConnectedOnly   bool
+	ConnectedTTLSec uint32
+
+	// PerSourcePPS limits packets per second from each source, 0 = unlimited
+	PerSourcePPS   uint32
+	PerSourceBurst uint32
+
+	// Bans is a list of IPs or subnets in CIDR notation to drop packets from
+	Bans []string
+}
+
+// RouteDiversityConfig is constraints for nodes of one route, nodes with unknown metadata are not considered as matching
+type RouteDiversityConfig struct {
+	// GeoIPDatabasePath is a path to ip2asn tsv database (range start, range end, asn, country, description),
+	// it is used to find country and asn of nodes by ip
+	GeoIPDatabasePath string `json:",omitempty"`
+
+	DistinctOperators bool
+	DistinctASN       bool
+	DistinctCountries bool
+	// DistinctSubnetBits is a prefix length of ipv4 subnet which nodes should not share, for example 16, 0 = not checked
+	DistinctSubnetBits uint
+
+	// OutCountries is a list of allowed out gateway countries, empty = any
+	OutCountries []string `json:",omitempty"`
 }
 
 type ClientConfig struct {
@@ -68,14 +181,69 @@ type ClientConfig struct {
 	TunnelThreads       uint
 	TunnelSectionsNum   uint
 	NodesPoolConfigPath string
+	// DiscoverNodes adds nodes published in DHT to the pool, static pool entries override discovered ones.
+	// When no static pool is specified, discovery is always used.
+	DiscoverNodes bool `json:",omitempty"`
 
 	PaymentsEnabled bool
 	Payments        PaymentsClientConfig
+
+	OutFilter *OutFilterConfig `json:",omitempty"`
+	Padding   *PaddingConfig   `json:",omitempty"`
+
+	CoverTraffic *CoverTrafficConfig `json:",omitempty"`
+
+	Diversity *RouteDiversityConfig `json:",omitempty"`
+
+	// RouteCandidates is how many routes are configured concurrently, the first initialized is used, 0 = 1
+	RouteCandidates uint `json:",omitempty"`
+	// RouteCandidateTimeoutSec is how long to wait for candidates initialization, 0 = 60
+	RouteCandidateTimeoutSec uint `json:",omitempty"`
+
+	// EntryGuardsNum is how many nodes can be the first hop of routes, 0 = 3
+	EntryGuardsNum uint `json:",omitempty"`
+	// EntryGuardsFile is where guards are saved, to use them after restart, when empty they are kept in memory
+	EntryGuardsFile    string `json:",omitempty"`
+	DisableEntryGuards bool   `json:",omitempty"`
+
+	// ProbePool enables pings of random pool nodes for health checks, they see client ip,
+	// when disabled, only the first hops of the route are probed
+	ProbePool bool `json:",omitempty"`
+
+	// SessionFile enables resumption of tunnel after restart, when set, keys of sections are saved there,
+	// so the same out address is kept if nodes still hold the sections. File contains secret keys.
+	SessionFile string `json:",omitempty"`
+}
+
+// PaddingConfig hides payload sizes from relays, in both directions
+type PaddingConfig struct {
+	// Mode is one of "off", "random" or "buckets"
+	Mode string
+	// MaxRandom is max number of bytes appended in random mode
+	MaxRandom uint32 `json:",omitempty"`
+	// Buckets are payload sizes to pad to in buckets mode, default ones are used when empty
+	Buckets []uint32 `json:",omitempty"`
+}
+
+// CoverTrafficConfig makes client send dummy packets, which are discarded by out gateway
+type CoverTrafficConfig struct {
+	// Mode is one of "off", "constant" or "poisson"
+	Mode       string
+	RatePerSec float64
+	// MaxPackets is a budget of cover packets, they consume prepaid packets on paid routes, 0 = unlimited
+	MaxPackets uint64 `json:",omitempty"`
 }
 
 type TunnelRouteSection struct {
 	Key     []byte
 	Payment *TunnelSectionPayment
+	Role    NodeRole `json:",omitempty"`
+
+	// optional metadata for route diversity, country and asn are taken from geoip database by ip, when not set
+	Operator string `json:",omitempty"`
+	IP       string `json:",omitempty"`
+	Country  string `json:",omitempty"`
+	ASN      uint32 `json:",omitempty"`
 }
 
 // SharedConfig is used as nodes pool to build a route
@@ -205,8 +373,8 @@ func LoadConfig(path string) (*Config, error) {
 			return nil, err
 		}
 
-		whKey := make([]byte, 32)
-		if _, err = rand.Read(whKey); err != nil {
+		adm, err := defaultAdminConfig()
+		if err != nil {
 			return nil, err
 		}
 
@@ -221,6 +389,7 @@ func LoadConfig(path string) (*Config, error) {
 				PaymentsNodeKey:   paymentsPrv.Seed(),
 				WalletPrivateKey:  priv.Seed(),
 				DBPath:            "./payments-db/",
+				LedgerDBPath:      "./tunnel-ledger-db/",
 				SecureProofPolicy: false,
 				ChannelsConfig: configPayments.ChannelsConfig{
 					SupportedCoins: configPayments.CoinTypes{
@@ -270,6 +439,7 @@ func LoadConfig(path string) (*Config, error) {
 					MinSafeVirtualChannelTimeoutSec: 300,
 				},
 			},
+			Admin: adm,
 		}
 
 		ip, seed := checkCanSeed()
@@ -291,12 +461,45 @@ func LoadConfig(path string) (*Config, error) {
 		if err = json.Unmarshal(data, &cfg); err != nil {
 			return nil, err
 		}
+
+		if err = cfg.Role.Validate(); err != nil {
+			return nil, err
+		}
+
+		var fields map[string]json.RawMessage
+		if err = json.Unmarshal(data, &fields); err != nil {
+			return nil, err
+		}
+
+		if _, ok := fields["Admin"]; !ok {
+			// config of older version, admin api replaced stdin commands, so enable it on localhost
+			if cfg.Admin, err = defaultAdminConfig(); err != nil {
+				return nil, err
+			}
+
+			if err = SaveConfig(&cfg, path); err != nil {
+				return nil, fmt.Errorf("failed to save migrated config: %w", err)
+			}
+			log.Info().Str("addr", cfg.Admin.ListenAddr).Msg("admin api section added to config")
+		}
 		return &cfg, nil
 	}
 
 	return nil, err
 }
 
+func defaultAdminConfig() (AdminConfig, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return AdminConfig{}, err
+	}
+
+	return AdminConfig{
+		ListenAddr: "127.0.0.1:17331",
+		Token:      hex.EncodeToString(token),
+	}, nil
+}
+
 func GenerateClientConfig() (*ClientConfig, error) {
 	_, priv, err := ed25519.GenerateKey(nil)
 	if err != nil {
@@ -327,6 +530,7 @@ func GenerateClientConfig() (*ClientConfig, error) {
 		TunnelServerKey:     tunnelPrv.Seed(),
 		TunnelThreads:       uint(runtime.NumCPU()),
 		TunnelSectionsNum:   1,
+		RouteCandidates:     1,
 		NodesPoolConfigPath: "",
 		PaymentsEnabled:     false,
 		Payments: PaymentsClientConfig{
@@ -387,10 +591,11 @@ func GenerateClientConfig() (*ClientConfig, error) {
 	return cfg, nil
 }
 
-func GenerateSharedConfig(src *Config, path string) (*SharedConfig, error) {
+// RouteSection returns pool entry describing this node, with its key, prices and role
+func (c *Config) RouteSection() TunnelRouteSection {
 	var pmt *TunnelSectionPayment
-	if src.PaymentsEnabled && (src.Payments.MinPricePerPacketInOut > 0 || src.Payments.MinPricePerPacketRoute > 0) {
-		ppk := ed25519.NewKeyFromSeed(src.Payments.PaymentsNodeKey)
+	if c.PaymentsEnabled && (c.Payments.MinPricePerPacketInOut > 0 || c.Payments.MinPricePerPacketRoute > 0) {
+		ppk := ed25519.NewKeyFromSeed(c.Payments.PaymentsNodeKey)
 		pmt = &TunnelSectionPayment{
 			Chain: []PaymentChain{
 				{
@@ -402,23 +607,36 @@ func GenerateSharedConfig(src *Config, path string) (*SharedConfig, error) {
 			},
 			JettonMaster:            nil,
 			ExtraCurrencyID:         0,
-			PricePerPacketRouteNano: src.Payments.MinPricePerPacketRoute,
-			PricePerPacketOutNano:   src.Payments.MinPricePerPacketInOut,
+			PricePerPacketRouteNano: c.Payments.MinPricePerPacketRoute,
+			PricePerPacketOutNano:   c.Payments.MinPricePerPacketInOut,
 		}
 	}
 
+	return TunnelRouteSection{
+		Key:      ed25519.NewKeyFromSeed(c.TunnelServerKey).Public().(ed25519.PublicKey),
+		Payment:  pmt,
+		Role:     c.Role,
+		Operator: c.Operator,
+		IP:       c.ExternalIP,
+	}
+}
+
+func GenerateSharedConfig(src *Config, path string) (*SharedConfig, error) {
 	cfg := &SharedConfig{
-		NodesPool: []TunnelRouteSection{
-			{
-				Key:     ed25519.NewKeyFromSeed(src.TunnelServerKey).Public().(ed25519.PublicKey),
-				Payment: pmt,
-			},
-		},
+		NodesPool: []TunnelRouteSection{src.RouteSection()},
 	}
 
 	return cfg, SaveConfig(cfg, path)
 }
 
+// GetLedgerDBPath returns path of tunnel payments ledger
+func (c *PaymentsConfig) GetLedgerDBPath() string {
+	if c.LedgerDBPath != "" {
+		return c.LedgerDBPath
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(c.DBPath)), "tunnel-ledger-db")
+}
+
 func SaveConfig(cfg any, path string) error {
 	dir := filepath.Dir(path)
 	_, err := os.Stat(dir)
@@ -7,8 +7,10 @@ require (
 	github.com/natefinch/lumberjack v2.0.0+incompatible
 	github.com/prometheus/client_golang v1.22.0
 	github.com/rs/zerolog v1.34.0
+	github.com/syndtr/goleveldb v1.0.0
 	github.com/xssnick/ton-payment-network v0.3.0
 	github.com/xssnick/tonutils-go v1.14.0
+	golang.org/x/crypto v0.40.0
 )
 
 require (
@@ -23,9 +25,7 @@ require (
 	github.com/prometheus/common v0.62.0 // indirect
 	github.com/prometheus/procfs v0.15.1 // indirect
 	github.com/sigurn/crc16 v0.0.0-20240131213347-83fcde1e29d1 // indirect
-	github.com/syndtr/goleveldb v1.0.0 // indirect
 	github.com/xssnick/raptorq v1.0.0 // indirect
-	golang.org/x/crypto v0.40.0 // indirect
 	golang.org/x/sys v0.34.0 // indirect
 	google.golang.org/protobuf v1.36.5 // indirect
 )
@@ -48,6 +48,67 @@ var (
 		},
 		[]string{"type"},
 	)
+
+	OutDroppedPackets = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "out_dropped_packets_counter",
+			Namespace: "tunnel",
+			Help:      "The number of incoming packets dropped by out gateways, separated by reason.",
+		},
+		[]string{"reason"},
+	)
+
+	ExitPolicyRejected = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name:      "exit_policy_rejected_counter",
+			Namespace: "tunnel",
+			Help:      "The number of outgoing packets rejected by exit policy.",
+		},
+	)
+
+	SectionsRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "sections_rejected_counter",
+			Namespace: "tunnel",
+			Help:      "The number of rejected section creation attempts, separated by reason.",
+		},
+		[]string{"reason"},
+	)
+
+	FragmentedDropped = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name:      "fragmented_dropped_counter",
+			Namespace: "tunnel",
+			Help:      "The number of fragmented outgoing packets dropped by out gateways before reassembly, separated by reason.",
+		},
+		[]string{"reason"},
+	)
+
+	SectionPoWDifficulty = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name:      "section_pow_difficulty",
+			Namespace: "tunnel",
+			Help:      "Current proof of work difficulty required to create section.",
+		},
+	)
+
+	PeerRTT = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "peer_rtt_seconds",
+			Namespace: "tunnel",
+			Help:      "Round trip time of pings to the most used peers, separated by kind (smoothed/variance/min/jitter).",
+		},
+		[]string{"peer", "kind"},
+	)
+
+	PeerPongLoss = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name:      "peer_pong_loss_ratio",
+			Namespace: "tunnel",
+			Help:      "Smoothed part of pings to the most used peers which were not answered.",
+		},
+		[]string{"peer"},
+	)
 )
 
 var Registered = false
@@ -63,4 +124,11 @@ func RegisterMetrics() {
 	prometheus.MustRegister(ActiveInboundSections)
 	prometheus.MustRegister(ActiveOutGateways)
 	prometheus.MustRegister(ActiveRoutes)
+	prometheus.MustRegister(OutDroppedPackets)
+	prometheus.MustRegister(ExitPolicyRejected)
+	prometheus.MustRegister(SectionsRejected)
+	prometheus.MustRegister(SectionPoWDifficulty)
+	prometheus.MustRegister(FragmentedDropped)
+	prometheus.MustRegister(PeerRTT)
+	prometheus.MustRegister(PeerPongLoss)
 }
@@ -0,0 +1,283 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/kevinms/leakybucket-go"
+	"github.com/ton-blockchain/adnl-tunnel/metrics"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"github.com/xssnick/tonutils-go/tl"
+	"math/bits"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	tl.Register(SectionChallenge{}, "adnlTunnel.sectionChallenge nodeKey:int256 sectionPubKey:int256 difficulty:int = adnlTunnel.SectionChallenge")
+}
+
+const (
+	// SectionCreationPerPeerPS is how many new sections single peer can create per second,
+	// it is high enough for relay, which is a single peer for all clients behind it
+	SectionCreationPerPeerPS    = 50
+	SectionCreationPerPeerBurst = 200
+
+	// SectionCreationPerKeyPS is how many creation attempts of the same section are processed per second
+	SectionCreationPerKeyPS    = 1
+	SectionCreationPerKeyBurst = 5
+
+	// SectionDifficultyRefreshEvery is how often client rereads node info of nodes which not accept its sections,
+	// to know their current difficulty
+	SectionDifficultyRefreshEvery = 10 * time.Second
+
+	// SectionCreationHighLoadPS is a rate of section creation attempts after which difficulty is raised
+	SectionCreationHighLoadPS = 200
+	SectionLoadCheckEverySec  = 10
+
+	// SectionPoWLoadMinBits is a difficulty set when load is detected, and there was no difficulty before
+	SectionPoWLoadMinBits = 8
+	// SectionPoWMaxBits is a max difficulty, client refuses to compute more than this
+	SectionPoWMaxBits = 22
+)
+
+const (
+	SectionRejectReasonRateLimit = "rate_limit"
+	SectionRejectReasonPoW       = "pow"
+)
+
+// SectionChallenge is sent back to directly connected peer, when it tries to create section with key which has not enough proof of work.
+// Proof of work is a section key itself, sha256(nodeKey + sectionKey) should have Difficulty leading zero bits,
+// so check is stateless and cheaper than shared key calculation. Clients behind relays know difficulty from signed node info.
+type SectionChallenge struct {
+	NodeKey       []byte `tl:"int256"`
+	SectionPubKey []byte `tl:"int256"`
+	Difficulty    uint32 `tl:"int"`
+}
+
+// SectionPoWBits returns number of leading zero bits of section key proof of work for the node
+func SectionPoWBits(nodeKey, sectionKey ed25519.PublicKey) uint32 {
+	h := sha256.New()
+	h.Write(nodeKey)
+	h.Write(sectionKey)
+	sum := h.Sum(nil)
+
+	var n uint32
+	for i := 0; i < len(sum); i += 8 {
+		v := binary.BigEndian.Uint64(sum[i:])
+		n += uint32(bits.LeadingZeros64(v))
+		if v != 0 {
+			break
+		}
+	}
+	return n
+}
+
+// GenerateEncryptionKeysPoW generates section keys satisfying node difficulty
+func GenerateEncryptionKeysPoW(ctx context.Context, targetPub ed25519.PublicKey, difficulty uint32) (*EncryptionKeys, error) {
+	if difficulty > SectionPoWMaxBits {
+		return nil, fmt.Errorf("difficulty %d is too high, max is %d", difficulty, SectionPoWMaxBits)
+	}
+
+	for i := 0; ; i++ {
+		if i%1024 == 0 && ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		pub, priv, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			return nil, fmt.Errorf("generate key failed: %v", err)
+		}
+
+		if SectionPoWBits(targetPub, pub) >= difficulty {
+			return NewEncryptionKeys(priv, targetPub)
+		}
+	}
+}
+
+// admitSection checks limits before new section allocation, returns error when section should not be created
+func (g *Gateway) admitSection(peer *Peer, sectionKey []byte) error {
+	if g.peerSectionRate.Add(string(peer.id), 1) <= 0 || g.sectionRate.Add(string(sectionKey), 1) <= 0 {
+		metrics.SectionsRejected.WithLabelValues(SectionRejectReasonRateLimit).Inc()
+		return fmt.Errorf("section creation rate limit reached")
+	}
+	atomic.AddUint64(&g.sectionAttempts, 1)
+
+	difficulty := atomic.LoadUint32(&g.sectionPoW)
+	if difficulty == 0 || SectionPoWBits(g.key.Public().(ed25519.PublicKey), sectionKey) >= difficulty {
+		return nil
+	}
+	metrics.SectionsRejected.WithLabelValues(SectionRejectReasonPoW).Inc()
+
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&peer.lastChallengeAt)
+	if now-last >= 1 && atomic.CompareAndSwapInt64(&peer.lastChallengeAt, last, now) {
+		// copied, because message buffer can be reused after handler
+		sectionKey = append([]byte{}, sectionKey...)
+
+		go func() {
+			ctx, cancel := context.WithTimeout(g.closerCtx, 5*time.Second)
+			defer cancel()
+
+			if err := peer.SendCustomMessage(ctx, SectionChallenge{
+				NodeKey:       g.key.Public().(ed25519.PublicKey),
+				SectionPubKey: sectionKey,
+				Difficulty:    difficulty,
+			}); err != nil {
+				g.log.Debug().Err(err).Msg("failed to send section challenge")
+			}
+		}()
+	}
+	return fmt.Errorf("not enough proof of work for section, required %d", difficulty)
+}
+
+// processSectionChallenge remembers difficulty of directly connected node
+func (g *Gateway) processSectionChallenge(peer *Peer, m SectionChallenge) error {
+	id, err := tl.Hash(keys.PublicKeyED25519{Key: m.NodeKey})
+	if err != nil {
+		return fmt.Errorf("failed to calc node id: %w", err)
+	}
+
+	if !bytes.Equal(id, peer.id) {
+		return fmt.Errorf("challenge node key is not belongs to peer")
+	}
+
+	g.setSectionDifficulty(m.NodeKey, m.Difficulty)
+	g.log.Debug().Str("node", base64.StdEncoding.EncodeToString(m.NodeKey)).
+		Uint32("difficulty", m.Difficulty).Msg("section challenge received")
+
+	return nil
+}
+
+func (g *Gateway) setSectionDifficulty(nodeKey []byte, difficulty uint32) {
+	g.nodesParamsMx.Lock()
+	defer g.nodesParamsMx.Unlock()
+
+	p := g.nodesParams[string(nodeKey)]
+	p.difficulty = difficulty
+	g.nodesParams[string(nodeKey)] = p
+}
+
+// sectionDifficulty returns known difficulty for sections of the node
+func (g *Gateway) sectionDifficulty(nodeKey ed25519.PublicKey) uint32 {
+	if bytes.Equal(nodeKey, g.key.Public().(ed25519.PublicKey)) {
+		return atomic.LoadUint32(&g.sectionPoW)
+	}
+
+	g.nodesParamsMx.Lock()
+	defer g.nodesParamsMx.Unlock()
+
+	return g.nodesParams[string(nodeKey)].difficulty
+}
+
+// adjustSectionDifficulty raises difficulty when too many sections are created, and lowers it back to configured when load is gone
+func (g *Gateway) adjustSectionDifficulty(attemptsPerSec uint64) uint32 {
+	cur := atomic.LoadUint32(&g.sectionPoW)
+	next := cur
+
+	switch {
+	case attemptsPerSec > SectionCreationHighLoadPS:
+		if next < SectionPoWLoadMinBits {
+			next = SectionPoWLoadMinBits
+		} else if next < SectionPoWMaxBits {
+			next++
+		}
+	case attemptsPerSec < SectionCreationHighLoadPS/2 && next > g.sectionPoWBase:
+		next--
+		if next < SectionPoWLoadMinBits {
+			next = g.sectionPoWBase
+		}
+	}
+
+	if next != cur {
+		atomic.StoreUint32(&g.sectionPoW, next)
+		metrics.SectionPoWDifficulty.Set(float64(next))
+		g.log.Info().Uint64("attempts_per_sec", attemptsPerSec).Uint32("difficulty", next).Msg("section proof of work difficulty changed")
+	}
+	return next
+}
+
+func (g *Gateway) admissionLoop() {
+	ticker := time.NewTicker(SectionLoadCheckEverySec * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-g.closerCtx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		g.adjustSectionDifficulty(atomic.SwapUint64(&g.sectionAttempts, 0) / SectionLoadCheckEverySec)
+		g.sectionRate.Prune()
+		g.peerSectionRate.Prune()
+	}
+}
+
+func newSectionRateCollector() *leakybucket.Collector {
+	return leakybucket.NewCollector(SectionCreationPerKeyPS, SectionCreationPerKeyBurst, true)
+}
+
+func newPeerSectionRateCollector() *leakybucket.Collector {
+	return leakybucket.NewCollector(SectionCreationPerPeerPS, SectionCreationPerPeerBurst, true)
+}
+
+// ensureSectionsPoW regenerates section keys which are not satisfying known difficulty of nodes,
+// it is done only before tunnel is configured, to not break existing sections
+func (t *RegularOutTunnel) ensureSectionsPoW(ctx context.Context) error {
+	t.mx.RLock()
+	nodes := append([]*SectionInfo{}, t.chainTo...)
+	nodes = append(nodes, t.chainFrom...)
+	t.mx.RUnlock()
+
+	for i, node := range nodes {
+		if t.sectionExists(node.Keys) {
+			continue
+		}
+
+		difficulty := t.gateway.sectionDifficulty(node.Keys.ReceiverPubKey)
+		if difficulty == 0 || SectionPoWBits(node.Keys.ReceiverPubKey, node.Keys.SectionPubKey) >= difficulty {
+			continue
+		}
+
+		tm := time.Now()
+		k, err := GenerateEncryptionKeysPoW(ctx, node.Keys.ReceiverPubKey, difficulty)
+		if err != nil {
+			return fmt.Errorf("generate keys for section %d failed: %w", i, err)
+		}
+		t.log.Debug().Int("section", i).Uint32("difficulty", difficulty).Dur("took", time.Since(tm)).Msg("section key regenerated with proof of work")
+
+		t.mx.Lock()
+		k.Mode = node.Keys.Mode
+		node.Keys = k
+		t.mx.Unlock()
+	}
+	return nil
+}
+
+// refreshSectionsDifficulty rereads node info of nodes which sections are not reused,
+// challenge is sent only to directly connected peer, so difficulty of farther nodes is known only from their info
+func (t *RegularOutTunnel) refreshSectionsDifficulty(ctx context.Context) {
+	if t.gateway.dht == nil {
+		return
+	}
+
+	t.mx.RLock()
+	nodes := append([]*SectionInfo{}, t.chainTo...)
+	nodes = append(nodes, t.chainFrom[:len(t.chainFrom)-1]...)
+	t.mx.RUnlock()
+
+	for _, node := range nodes {
+		if t.sectionExists(node.Keys) {
+			continue
+		}
+
+		if _, err := t.gateway.FindNodeInfo(ctx, node.Keys.ReceiverPubKey); err != nil {
+			t.log.Debug().Err(err).Str("node", base64.StdEncoding.EncodeToString(node.Keys.ReceiverPubKey)).Msg("failed to refresh node difficulty")
+		}
+	}
+}
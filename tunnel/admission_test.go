@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"github.com/rs/zerolog"
+	"testing"
+)
+
+func TestGenerateEncryptionKeysPoW(t *testing.T) {
+	nodeKey, _, _ := ed25519.GenerateKey(nil)
+
+	k, err := GenerateEncryptionKeysPoW(context.Background(), nodeKey, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if SectionPoWBits(nodeKey, k.SectionPubKey) < 8 {
+		t.Fatal("generated key is not satisfying difficulty")
+	}
+
+	if _, err = GenerateEncryptionKeysPoW(context.Background(), nodeKey, SectionPoWMaxBits+1); err == nil {
+		t.Fatal("too high difficulty should be rejected")
+	}
+}
+
+func TestAdjustSectionDifficulty(t *testing.T) {
+	g := &Gateway{sectionPoWBase: 0, log: zerolog.Nop()}
+
+	if d := g.adjustSectionDifficulty(SectionCreationHighLoadPS / 4); d != 0 {
+		t.Fatalf("difficulty should stay 0 without load, got %d", d)
+	}
+
+	if d := g.adjustSectionDifficulty(SectionCreationHighLoadPS + 1); d != SectionPoWLoadMinBits {
+		t.Fatalf("difficulty should be raised to %d, got %d", SectionPoWLoadMinBits, d)
+	}
+
+	if d := g.adjustSectionDifficulty(SectionCreationHighLoadPS + 1); d != SectionPoWLoadMinBits+1 {
+		t.Fatalf("difficulty should grow under load, got %d", d)
+	}
+
+	for i := 0; i < 100; i++ {
+		g.adjustSectionDifficulty(SectionCreationHighLoadPS * 10)
+	}
+	if d := g.adjustSectionDifficulty(SectionCreationHighLoadPS + 1); d != SectionPoWMaxBits {
+		t.Fatalf("difficulty should be capped at %d, got %d", SectionPoWMaxBits, d)
+	}
+
+	for i := 0; i < 100; i++ {
+		g.adjustSectionDifficulty(0)
+	}
+	if d := g.adjustSectionDifficulty(0); d != 0 {
+		t.Fatalf("difficulty should return to configured, got %d", d)
+	}
+}
+
+func TestAdmitSectionRateLimit(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	g := &Gateway{
+		key:             key,
+		sectionRate:     newSectionRateCollector(),
+		peerSectionRate: newPeerSectionRateCollector(),
+		log:             zerolog.Nop(),
+	}
+
+	peer := &Peer{id: []byte("peer")}
+	sectionKey := make([]byte, 32)
+	for i := 0; i < SectionCreationPerKeyBurst; i++ {
+		if err := g.admitSection(peer, sectionKey); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := g.admitSection(peer, sectionKey); err == nil {
+		t.Fatal("attempts of the same section key should be limited")
+	}
+
+	// fresh keys are not helping to bypass peer limit
+	var rejected bool
+	for i := 0; i < SectionCreationPerPeerBurst; i++ {
+		k, _, _ := ed25519.GenerateKey(nil)
+		if g.admitSection(peer, k) != nil {
+			rejected = true
+			break
+		}
+	}
+	if !rejected {
+		t.Fatal("sections of the same peer should be limited")
+	}
+
+	k, _, _ := ed25519.GenerateKey(nil)
+	if err := g.admitSection(&Peer{id: []byte("another")}, k); err != nil {
+		t.Fatal("another peer should not be limited", err)
+	}
+}
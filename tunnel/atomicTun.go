@@ -1,14 +1,27 @@
 package tunnel
 
 import (
+	"context"
 	"net"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
 )
 
+// SwitchDrainTime is how long late packets of replaced tunnel are accepted, before it is destroyed
+var SwitchDrainTime = 5 * time.Second
+
 type AtomicSwitchableRegularTunnel struct {
 	tun unsafe.Pointer
+
+	// switched is closed on each switch, to wake up readers of previous tunnel
+	switched chan struct{}
+
+	onOutAddressChanged func(addr *net.UDPAddr)
+	onSendRejected      func(addr *net.UDPAddr, reason string)
+
+	mx sync.Mutex
 }
 
 func (a *AtomicSwitchableRegularTunnel) resolve() *RegularOutTunnel {
@@ -16,15 +29,117 @@ func (a *AtomicSwitchableRegularTunnel) resolve() *RegularOutTunnel {
 }
 
 func (a *AtomicSwitchableRegularTunnel) SwitchTo(tun *RegularOutTunnel) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	if a.onOutAddressChanged != nil {
+		tun.SetOutAddressChangedHandler(a.onOutAddressChanged)
+	}
+	if a.onSendRejected != nil {
+		tun.SetSendRejectedHandler(a.onSendRejected)
+	}
 	atomic.StorePointer(&a.tun, unsafe.Pointer(tun))
+
+	if a.switched != nil {
+		close(a.switched)
+	}
+	a.switched = make(chan struct{})
+}
+
+// Replace switches traffic to the new tunnel without a gap, late packets of the previous tunnel
+// are passed to the new one during SwitchDrainTime, and then previous tunnel is destroyed
+func (a *AtomicSwitchableRegularTunnel) Replace(ctx context.Context, tun *RegularOutTunnel) {
+	prev := a.resolve()
+	a.SwitchTo(tun)
+
+	if prev == nil || prev == tun {
+		return
+	}
+
+	go func() {
+		timer := time.NewTimer(SwitchDrainTime)
+		defer timer.Stop()
+
+	drain:
+		for {
+			select {
+			case <-ctx.Done():
+				break drain
+			case <-timer.C:
+				break drain
+			case packet := <-prev.read:
+				select {
+				case tun.read <- packet:
+				default:
+					atomic.AddUint64(&tun.packetsDropped, 1)
+				}
+			}
+		}
+
+		stopCtx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		if err := prev.Stop(stopCtx); err != nil {
+			prev.log.Warn().Err(err).Msg("failed to stop replaced tunnel")
+		}
+	}()
 }
 
 func (a *AtomicSwitchableRegularTunnel) Current() *RegularOutTunnel {
 	return a.resolve()
 }
 
+// current returns tunnel and channel which is closed when it is replaced
+func (a *AtomicSwitchableRegularTunnel) current() (*RegularOutTunnel, <-chan struct{}) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+
+	if a.switched == nil {
+		a.switched = make(chan struct{})
+	}
+	return a.resolve(), a.switched
+}
+
+func (a *AtomicSwitchableRegularTunnel) SetOutAddressChangedHandler(f func(addr *net.UDPAddr)) {
+	a.mx.Lock()
+	a.onOutAddressChanged = f
+	a.mx.Unlock()
+
+	if tun := a.resolve(); tun != nil {
+		tun.SetOutAddressChangedHandler(f)
+	}
+}
+
+func (a *AtomicSwitchableRegularTunnel) SetSendRejectedHandler(f func(addr *net.UDPAddr, reason string)) {
+	a.mx.Lock()
+	a.onSendRejected = f
+	a.mx.Unlock()
+
+	if tun := a.resolve(); tun != nil {
+		tun.SetSendRejectedHandler(f)
+	}
+}
+
 func (a *AtomicSwitchableRegularTunnel) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	return a.resolve().ReadFrom(p)
+	return a.ReadFromWithTimeout(context.Background(), p)
+}
+
+// ReadFromWithTimeout reads from the current tunnel, and follows it when it is switched
+func (a *AtomicSwitchableRegularTunnel) ReadFromWithTimeout(ctx context.Context, p []byte) (n int, addr net.Addr, err error) {
+	for {
+		tun, switched := a.current()
+
+		select {
+		case packet := <-tun.read:
+			return copy(p, packet.Payload), &net.UDPAddr{
+				IP:   packet.IP,
+				Port: int(packet.Port),
+			}, nil
+		case <-switched:
+		case <-ctx.Done():
+			return -1, nil, ctx.Err()
+		}
+	}
 }
 
 func (a *AtomicSwitchableRegularTunnel) WriteTo(p []byte, addr net.Addr) (n int, err error) {
@@ -0,0 +1,68 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/rs/zerolog"
+	"testing"
+	"time"
+)
+
+func TestAtomicSwitchableReplace(t *testing.T) {
+	newTun := func() *RegularOutTunnel {
+		ctx, cancel := context.WithCancel(context.Background())
+		return &RegularOutTunnel{
+			peer:        &Peer{references: 2},
+			read:        make(chan DeliverUDPPayload, 10),
+			tunnelState: StateTypeConfiguring,
+			closerCtx:   ctx,
+			close:       cancel,
+			log:         zerolog.Nop(),
+		}
+	}
+
+	old, next := newTun(), newTun()
+
+	sw := &AtomicSwitchableRegularTunnel{}
+	sw.Replace(context.Background(), old)
+
+	// reader is waiting on the old tunnel when switch happens
+	res := make(chan int, 1)
+	go func() {
+		n, _, _ := sw.ReadFromWithTimeout(context.Background(), make([]byte, 10))
+		res <- n
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	prevDrain := SwitchDrainTime
+	SwitchDrainTime = 100 * time.Millisecond
+	defer func() {
+		SwitchDrainTime = prevDrain
+	}()
+
+	sw.Replace(context.Background(), next)
+	if sw.Current() != next {
+		t.Fatal("tunnel should be switched")
+	}
+
+	// late packet of the old tunnel
+	old.read <- DeliverUDPPayload{Seqno: 1, Payload: []byte{1, 2, 3}}
+
+	select {
+	case n := <-res:
+		if n != 3 {
+			t.Fatalf("unexpected read size %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("late packet of the old tunnel should be delivered")
+	}
+
+	select {
+	case <-old.closerCtx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("old tunnel should be stopped after drain")
+	}
+
+	if next.closerCtx.Err() != nil {
+		t.Fatal("new tunnel should stay active")
+	}
+}
@@ -0,0 +1,204 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"github.com/xssnick/tonutils-go/tl"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+func init() {
+	tl.Register(SendOutBatchPayload{}, "adnlTunnel.sendOutBatchPayload packets:(vector adnlTunnel.sendOutPayload) = adnlTunnel.SendOutBatchPayload")
+	tl.Register(DeliverUDPBatchPayload{}, "adnlTunnel.deliverUDPBatchPayload packets:(vector adnlTunnel.deliverUDPPayload) = adnlTunnel.DeliverUDPBatchPayload")
+
+	instructionOpcodes[tl.Register(OutBatchInstruction{}, "adnlTunnel.outBatchInstruction maxPackets:int flushDelayUs:int = adnlTunnel.Instruction")] = reflect.TypeOf(OutBatchInstruction{})
+}
+
+// BatchMaxPackets and BatchMaxBytes limit single tunnel message, batch is never fragmented
+const BatchMaxPackets = 16
+const BatchMaxBytes = PayloadMTU - 16
+
+// batchItemOverhead is max size of packet fields except payload, in serialized batch
+const batchItemOverhead = 48
+
+// BatchFlushDelay is how long packet can wait for others to be sent together,
+// first packet after idle period is sent immediately, so low rate traffic has no extra latency
+var BatchFlushDelay = 2 * time.Millisecond
+
+// SendOutBatchPayload is several datagrams to send by out gateway, in one tunnel message
+type SendOutBatchPayload struct {
+	Packets []SendOutPayload `tl:"vector struct"`
+}
+
+// DeliverUDPBatchPayload is several datagrams received by out gateway, in one tunnel message
+type DeliverUDPBatchPayload struct {
+	Packets []DeliverUDPPayload `tl:"vector struct"`
+}
+
+// OutBatchInstruction enables batching of incoming datagrams by out gateway,
+// client sends it only when it supports batch payloads
+type OutBatchInstruction struct {
+	MaxPackets   uint32 `tl:"int"`
+	FlushDelayUs uint32 `tl:"int"`
+}
+
+func (ins OutBatchInstruction) Execute(ctx context.Context, s *Section, msg *EncryptedMessage, restInstructions []byte) error {
+	if !s.gw.allowOut {
+		return fmt.Errorf("instruction is not executable since out is not allowed")
+	}
+
+	s.mx.RLock()
+	out := s.out
+	s.mx.RUnlock()
+
+	if out == nil {
+		return fmt.Errorf("out is not binded")
+	}
+
+	if cur := out.getBatcher(); cur != nil && cur.maxPackets == int(ins.MaxPackets) && cur.delay == time.Duration(ins.FlushDelayUs)*time.Microsecond {
+		return nil
+	}
+
+	var b *batcher
+	if ins.MaxPackets > 1 {
+		maxPackets := int(ins.MaxPackets)
+		if maxPackets > BatchMaxPackets {
+			maxPackets = BatchMaxPackets
+		}
+
+		delay := time.Duration(ins.FlushDelayUs) * time.Microsecond
+		if delay > 10*BatchFlushDelay {
+			delay = 10 * BatchFlushDelay
+		}
+
+		b = newBatcher(maxPackets, delay, out.flushBack)
+	}
+
+	if old := (*batcher)(atomic.SwapPointer(&out.batch, unsafe.Pointer(b))); old != nil {
+		old.flush()
+	}
+
+	out.log.Debug().Uint32("max_packets", ins.MaxPackets).Uint32("delay_us", ins.FlushDelayUs).Msg("out batching updated")
+	return nil
+}
+
+func (o *Out) getBatcher() *batcher {
+	return (*batcher)(atomic.LoadPointer(&o.batch))
+}
+
+func (o *Out) flushBack(items []tl.Serializable) {
+	var pl tl.Serializable = items[0]
+	if len(items) > 1 {
+		batch := DeliverUDPBatchPayload{Packets: make([]DeliverUDPPayload, 0, len(items))}
+		for _, item := range items {
+			batch.Packets = append(batch.Packets, item.(DeliverUDPPayload))
+		}
+		pl = batch
+	}
+
+	if err := o.sendBack(pl, true); err != nil {
+		o.log.Trace().Err(err).Msg("send back failed")
+	}
+}
+
+// batcher collects payloads and flushes them when batch is full or after short delay
+type batcher struct {
+	maxPackets int
+	delay      time.Duration
+	send       func(items []tl.Serializable)
+
+	items       []tl.Serializable
+	size        int
+	lastFlushAt time.Time
+	timer       *time.Timer
+	mx          sync.Mutex
+}
+
+func newBatcher(maxPackets int, delay time.Duration, send func(items []tl.Serializable)) *batcher {
+	return &batcher{
+		maxPackets: maxPackets,
+		delay:      delay,
+		send:       send,
+	}
+}
+
+func (b *batcher) add(item tl.Serializable, size int) {
+	b.mx.Lock()
+
+	if len(b.items) > 0 && b.size+size > BatchMaxBytes {
+		b.flushLocked()
+	}
+
+	b.items = append(b.items, item)
+	b.size += size
+
+	switch {
+	case len(b.items) >= b.maxPackets || b.size >= BatchMaxBytes:
+		b.flushLocked()
+	case len(b.items) == 1 && time.Since(b.lastFlushAt) >= b.delay:
+		// idle, no reason to wait
+		b.flushLocked()
+	case b.timer == nil:
+		b.timer = time.AfterFunc(b.delay, b.flush)
+	}
+
+	b.mx.Unlock()
+}
+
+func (b *batcher) flush() {
+	b.mx.Lock()
+	b.flushLocked()
+	b.mx.Unlock()
+}
+
+// stop drops collected payloads, it is used when destination is closed
+func (b *batcher) stop() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.items = nil
+	b.size = 0
+}
+
+func (b *batcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	b.lastFlushAt = time.Now()
+
+	if len(b.items) == 0 {
+		return
+	}
+
+	items := b.items
+	b.items = nil
+	b.size = 0
+
+	// sending under lock keeps order of packets
+	b.send(items)
+}
+
+// flushOut sends collected datagrams to out gateway
+func (t *RegularOutTunnel) flushOut(items []tl.Serializable) {
+	var pl tl.Serializable = items[0]
+	if len(items) > 1 {
+		batch := SendOutBatchPayload{Packets: make([]SendOutPayload, 0, len(items))}
+		for _, item := range items {
+			batch.Packets = append(batch.Packets, item.(SendOutPayload))
+		}
+		pl = batch
+	}
+
+	if err := t.sendPayload(pl); err != nil {
+		t.log.Debug().Err(err).Int("packets", len(items)).Msg("send batch failed")
+	}
+}
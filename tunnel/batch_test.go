@@ -0,0 +1,143 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"github.com/rs/zerolog"
+	"github.com/xssnick/tonutils-go/tl"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatcher(t *testing.T) {
+	var mx sync.Mutex
+	var flushed [][]tl.Serializable
+
+	b := newBatcher(4, 20*time.Millisecond, func(items []tl.Serializable) {
+		mx.Lock()
+		flushed = append(flushed, items)
+		mx.Unlock()
+	})
+	batches := func() [][]tl.Serializable {
+		mx.Lock()
+		defer mx.Unlock()
+		return append([][]tl.Serializable{}, flushed...)
+	}
+
+	b.add(SendOutPayload{Seqno: 1}, 100)
+	if got := batches(); len(got) != 1 || len(got[0]) != 1 {
+		t.Fatal("first packet after idle should be sent immediately")
+	}
+
+	for i := 2; i <= 5; i++ {
+		b.add(SendOutPayload{Seqno: uint64(i)}, 100)
+	}
+	if got := batches(); len(got) != 2 || len(got[1]) != 4 {
+		t.Fatal("full batch should be flushed")
+	}
+
+	b.add(SendOutPayload{Seqno: 6}, 100)
+	b.add(SendOutPayload{Seqno: 7}, 100)
+	if len(batches()) != 2 {
+		t.Fatal("not full batch should wait for timer")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	got := batches()
+	if len(got) != 3 || len(got[2]) != 2 || got[2][1].(SendOutPayload).Seqno != 7 {
+		t.Fatal("batch should be flushed by timer in order")
+	}
+
+	b.add(SendOutPayload{Seqno: 8}, 100)
+	b.add(SendOutPayload{Seqno: 9}, BatchMaxBytes)
+	if got = batches(); len(got) != 5 || got[3][0].(SendOutPayload).Seqno != 8 || got[4][0].(SendOutPayload).Seqno != 9 {
+		t.Fatal("batch should be flushed before bytes limit exceeds, and big packet should be sent alone")
+	}
+	b.stop()
+}
+
+func TestProcessBatchPayload(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	keys, err := GenerateEncryptionKeys(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tun := &RegularOutTunnel{
+		payloadKeys: keys,
+		read:        make(chan DeliverUDPPayload, 10),
+		tunnelState: StateTypeOptimized,
+		log:         zerolog.Nop(),
+	}
+
+	batch := DeliverUDPBatchPayload{}
+	for i := 1; i <= 3; i++ {
+		batch.Packets = append(batch.Packets, DeliverUDPPayload{
+			Seqno:   uint64(i),
+			IP:      net.IPv4(1, 2, 3, 4).To4(),
+			Port:    1000,
+			Payload: []byte{byte(i)},
+		})
+	}
+
+	data, err := tl.Serialize(batch, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// out gate encrypts with the same shared key
+	data, err = encryptStream(keys.Mode, keys.CipherKeyCRC, keys.CipherKey, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tun.Process(data, StateMeta{State: StateTypeOptimized}); err != nil {
+		t.Fatal(err)
+	}
+
+	if tun.packetsRecv != 3 || tun.messagesRecv != 1 || tun.seqnoRecv != 3 {
+		t.Fatalf("packets should be counted separately, got %d packets %d messages", tun.packetsRecv, tun.messagesRecv)
+	}
+
+	for i := 1; i <= 3; i++ {
+		if p := <-tun.read; p.Seqno != uint64(i) || p.Payload[0] != byte(i) {
+			t.Fatal("packets should be delivered in order")
+		}
+	}
+}
+
+func TestBatchPrepaidConsumption(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	keys, err := GenerateEncryptionKeys(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tun := &RegularOutTunnel{
+		usePayments:        true,
+		packetsToPrepay:    1000,
+		packetsMinPaidOut:  1000,
+		messagesMinPaidOut: 1000,
+		tunnelState:        StateTypeOptimized,
+		payloadKeys:        keys,
+		peer:               &Peer{},
+		chainTo:            []*SectionInfo{{Keys: keys}},
+		sendControlSignal:  make(chan struct{}, 1),
+		log:                zerolog.Nop(),
+	}
+	tun.batch = newBatcher(BatchMaxPackets, time.Hour, tun.flushOut)
+
+	addr := &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000}
+	for i := 0; i < 5; i++ {
+		if _, err = tun.WriteTo([]byte{1, 2, 3}, addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tun.batch.flush()
+
+	// the first packet is sent alone after idle, others in one batch
+	if tun.packetsConsumedOut != 5 || tun.messagesConsumedOut != 2 {
+		t.Fatalf("relays should be charged per message, got %d packets %d messages", tun.packetsConsumedOut, tun.messagesConsumedOut)
+	}
+}
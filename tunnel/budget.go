@@ -0,0 +1,329 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/xssnick/tonutils-go/address"
+	"math/big"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type spendRecord struct {
+	at     time.Time
+	amount *big.Int
+}
+
+type spendBudget struct {
+	cfg config.BudgetConfig
+
+	perHour   *big.Int
+	perDay    *big.Int
+	perTunnel *big.Int
+
+	// spends of the last day
+	spends []spendRecord
+}
+
+// SpendBudgets limits client spending on paid routes per currency, hourly and daily limits are shared by all tunnels
+type SpendBudgets struct {
+	budgets map[string]*spendBudget
+
+	path string
+	mx   sync.Mutex
+}
+
+// savedSpend is a spend record in budgets file
+type savedSpend struct {
+	At     int64
+	Amount *big.Int
+}
+
+// spendPlan is spending of one control message, it is checked against budgets before payments are added
+type spendPlan struct {
+	budgets *SpendBudgets
+	tunnel  map[string]*big.Int
+	pending map[string]*big.Int
+}
+
+func currencyKey(jetton string, ec uint32) string {
+	if jetton != "" {
+		if addr, err := address.ParseAddr(jetton); err == nil {
+			jetton = addr.Bounce(true).String()
+		}
+	}
+	return fmt.Sprintf("%s:%d", jetton, ec)
+}
+
+func payerCurrencyKey(p *Payer) string {
+	var jetton string
+	if p.JettonMaster != nil {
+		jetton = p.JettonMaster.String()
+	}
+	return currencyKey(jetton, p.ExtraCurrencyID)
+}
+
+func nanoLimit(v uint64) *big.Int {
+	if v == 0 {
+		return nil
+	}
+	return new(big.Int).SetUint64(v)
+}
+
+func NewSpendBudgets(cfgs []config.BudgetConfig) (*SpendBudgets, error) {
+	b := &SpendBudgets{
+		budgets: map[string]*spendBudget{},
+	}
+
+	for _, cfg := range cfgs {
+		if cfg.JettonMaster != "" {
+			if _, err := address.ParseAddr(cfg.JettonMaster); err != nil {
+				return nil, fmt.Errorf("invalid budget jetton master address: %w", err)
+			}
+		}
+
+		key := currencyKey(cfg.JettonMaster, cfg.ExtraCurrencyID)
+		if b.budgets[key] != nil {
+			return nil, fmt.Errorf("duplicate budget for currency %s", key)
+		}
+
+		b.budgets[key] = &spendBudget{
+			cfg:       cfg,
+			perHour:   nanoLimit(cfg.MaxSpendPerHourNano),
+			perDay:    nanoLimit(cfg.MaxSpendPerDayNano),
+			perTunnel: nanoLimit(cfg.MaxSpendPerTunnelNano),
+		}
+	}
+	return b, nil
+}
+
+// LoadSpendBudgets creates budgets and restores spending of the last day from file,
+// when path is empty, spending is kept only in memory
+func LoadSpendBudgets(cfgs []config.BudgetConfig, path string) (*SpendBudgets, error) {
+	b, err := NewSpendBudgets(cfgs)
+	if err != nil {
+		return nil, err
+	}
+
+	b.path = path
+	if path == "" {
+		return b, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return b, nil
+		}
+		return nil, fmt.Errorf("failed to read budgets file: %w", err)
+	}
+
+	var saved map[string][]savedSpend
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return nil, fmt.Errorf("failed to parse budgets file: %w", err)
+	}
+
+	dayAgo := time.Now().Add(-24 * time.Hour)
+	for key, list := range saved {
+		bud := b.budgets[key]
+		if bud == nil {
+			// budget was removed from config
+			continue
+		}
+
+		for _, r := range list {
+			if r.Amount == nil || time.Unix(r.At, 0).Before(dayAgo) {
+				continue
+			}
+			bud.spends = append(bud.spends, spendRecord{at: time.Unix(r.At, 0), amount: r.Amount})
+		}
+	}
+	return b, nil
+}
+
+// save must be called under lock
+func (b *SpendBudgets) save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	saved := map[string][]savedSpend{}
+	for key, bud := range b.budgets {
+		for _, r := range bud.spends {
+			saved[key] = append(saved[key], savedSpend{At: r.at.Unix(), Amount: r.amount})
+		}
+	}
+
+	data, err := json.MarshalIndent(saved, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to serialize budgets: %w", err)
+	}
+
+	tmp := b.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write budgets file: %w", err)
+	}
+
+	if err = os.Rename(tmp, b.path); err != nil {
+		return fmt.Errorf("failed to replace budgets file: %w", err)
+	}
+	return nil
+}
+
+// PriceAllowed returns false when node price is above max price of its currency
+func (b *SpendBudgets) PriceAllowed(p *config.TunnelSectionPayment, isOut bool) bool {
+	if b == nil || p == nil {
+		return true
+	}
+
+	var jetton string
+	if p.JettonMaster != nil {
+		jetton = *p.JettonMaster
+	}
+
+	bud := b.budgets[currencyKey(jetton, p.ExtraCurrencyID)]
+	if bud == nil {
+		return true
+	}
+
+	if isOut {
+		return bud.cfg.MaxPricePerPacketOutNano == 0 || p.PricePerPacketOutNano <= bud.cfg.MaxPricePerPacketOutNano
+	}
+	return bud.cfg.MaxPricePerPacketRouteNano == 0 || p.PricePerPacketRouteNano <= bud.cfg.MaxPricePerPacketRouteNano
+}
+
+// spentSince must be called under lock
+func (s *spendBudget) spentSince(t time.Time) *big.Int {
+	sum := new(big.Int)
+	for _, r := range s.spends {
+		if r.at.After(t) {
+			sum.Add(sum, r.amount)
+		}
+	}
+	return sum
+}
+
+// record must be called under lock
+func (s *spendBudget) record(amount *big.Int) {
+	now := time.Now()
+
+	i := 0
+	for i < len(s.spends) && s.spends[i].at.Before(now.Add(-24*time.Hour)) {
+		i++
+	}
+	s.spends = append(s.spends[i:], spendRecord{at: now, amount: new(big.Int).Set(amount)})
+}
+
+// WaitTime returns how long to wait until hourly and daily budgets which are fully spent have some room again
+func (b *SpendBudgets) WaitTime() time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, bud := range b.budgets {
+		for _, lim := range []struct {
+			max    *big.Int
+			window time.Duration
+		}{{bud.perHour, time.Hour}, {bud.perDay, 24 * time.Hour}} {
+			if lim.max == nil || bud.spentSince(now.Add(-lim.window)).Cmp(lim.max) < 0 {
+				continue
+			}
+
+			// room appears when the oldest spend leaves the window
+			for _, r := range bud.spends {
+				if r.at.After(now.Add(-lim.window)) {
+					if w := r.at.Add(lim.window).Sub(now); w > wait {
+						wait = w
+					}
+					break
+				}
+			}
+		}
+	}
+	return wait
+}
+
+func (b *SpendBudgets) plan(tunnel map[string]*big.Int) *spendPlan {
+	return &spendPlan{
+		budgets: b,
+		tunnel:  tunnel,
+		pending: map[string]*big.Int{},
+	}
+}
+
+// allow checks that amount can be spent in addition to already planned, and plans it
+func (p *spendPlan) allow(payer *Payer, amount *big.Int) bool {
+	if p.budgets == nil {
+		return true
+	}
+
+	key := payerCurrencyKey(payer)
+	bud := p.budgets.budgets[key]
+	if bud == nil {
+		return true
+	}
+
+	total := new(big.Int).Add(amount, zeroIfNil(p.pending[key]))
+	if bud.perTunnel != nil && new(big.Int).Add(total, zeroIfNil(p.tunnel[key])).Cmp(bud.perTunnel) > 0 {
+		return false
+	}
+
+	p.budgets.mx.Lock()
+	now := time.Now()
+	overHour := bud.perHour != nil && new(big.Int).Add(total, bud.spentSince(now.Add(-time.Hour))).Cmp(bud.perHour) > 0
+	overDay := bud.perDay != nil && new(big.Int).Add(total, bud.spentSince(now.Add(-24*time.Hour))).Cmp(bud.perDay) > 0
+	p.budgets.mx.Unlock()
+
+	if overHour || overDay {
+		return false
+	}
+
+	p.pending[key] = total
+	return true
+}
+
+// spend records payment to budgets and to tunnel spent, it is called when payment is added to the control message
+func (t *RegularOutTunnel) spend(payer *Payer, amount *big.Int) {
+	key := payerCurrencyKey(payer)
+	if t.spent == nil {
+		t.spent = map[string]*big.Int{}
+	}
+	t.spent[key] = new(big.Int).Add(zeroIfNil(t.spent[key]), amount)
+
+	b := t.gateway.payments.Budgets
+	if b == nil {
+		return
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	if bud := b.budgets[key]; bud != nil {
+		bud.record(amount)
+
+		if err := b.save(); err != nil {
+			t.log.Warn().Err(err).Msg("failed to save spend budgets")
+		}
+	}
+}
+
+// BudgetReached returns true when tunnel stopped to prepay hops because of spend budget, it should be rerouted
+func (t *RegularOutTunnel) BudgetReached() bool {
+	return atomic.LoadInt32(&t.budgetReached) != 0
+}
+
+func zeroIfNil(v *big.Int) *big.Int {
+	if v == nil {
+		return new(big.Int)
+	}
+	return v
+}
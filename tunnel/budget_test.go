@@ -0,0 +1,124 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSpendBudgets(t *testing.T) {
+	jetton := "EQCxE6mUtQJKFnGfaROTKOt1lZbDiiX1kCixRv7Nw2Id_sDs"
+	b, err := NewSpendBudgets([]config.BudgetConfig{
+		{MaxPricePerPacketOutNano: 10, MaxSpendPerHourNano: 1000, MaxSpendPerTunnelNano: 700},
+		{JettonMaster: jetton, MaxSpendPerDayNano: 100},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.PriceAllowed(&config.TunnelSectionPayment{PricePerPacketOutNano: 11}, true) ||
+		!b.PriceAllowed(&config.TunnelSectionPayment{PricePerPacketOutNano: 11, PricePerPacketRouteNano: 11}, false) ||
+		!b.PriceAllowed(&config.TunnelSectionPayment{PricePerPacketOutNano: 11, JettonMaster: &jetton}, true) {
+		t.Fatal("unexpected price check result")
+	}
+
+	ton := &Payer{}
+	tun := &RegularOutTunnel{gateway: &Gateway{payments: PaymentConfig{Budgets: b}}}
+
+	plan := b.plan(tun.spent)
+	if !plan.allow(ton, big.NewInt(400)) || plan.allow(ton, big.NewInt(400)) {
+		t.Fatal("tunnel budget should include planned amounts")
+	}
+	tun.spend(ton, big.NewInt(400))
+
+	// other tunnel is limited only by hour budget
+	other := &RegularOutTunnel{gateway: tun.gateway}
+	if !b.plan(other.spent).allow(ton, big.NewInt(600)) {
+		t.Fatal("hour budget should allow")
+	}
+	other.spend(ton, big.NewInt(600))
+
+	if b.plan(tun.spent).allow(ton, big.NewInt(1)) {
+		t.Fatal("hour budget should be reached")
+	}
+
+	if wait := b.WaitTime(); wait < 59*time.Minute || wait > time.Hour {
+		t.Fatal("unexpected wait time", wait)
+	}
+
+	// spends of other currencies are not counted
+	if !b.plan(tun.spent).allow(&Payer{ExtraCurrencyID: 5}, big.NewInt(5000)) {
+		t.Fatal("currency without budget should not be limited")
+	}
+}
+
+func TestSpendBudgetsPersistent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "budgets.json")
+	cfgs := []config.BudgetConfig{{MaxSpendPerDayNano: 1000, MaxSpendPerTunnelNano: 700}}
+
+	b, err := LoadSpendBudgets(cfgs, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ton := &Payer{}
+	tun := &RegularOutTunnel{gateway: &Gateway{payments: PaymentConfig{Budgets: b}}}
+	tun.spend(ton, big.NewInt(600))
+
+	// daily spending is kept after restart
+	if b, err = LoadSpendBudgets(cfgs, path); err != nil {
+		t.Fatal(err)
+	}
+	if b.plan(nil).allow(ton, big.NewInt(500)) || !b.plan(nil).allow(ton, big.NewInt(400)) {
+		t.Fatal("restored spending should be counted")
+	}
+
+	// rerouted tunnel continues tunnel budget
+	next := &RegularOutTunnel{}
+	next.inheritOut(tun)
+	if b.plan(next.spent).allow(ton, big.NewInt(200)) {
+		t.Fatal("tunnel budget should not be reset by reroute")
+	}
+}
+
+func TestPickRoutePriceLimit(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _ := newTestGateway(t, ctx)
+	budgets, err := NewSpendBudgets([]config.BudgetConfig{{MaxPricePerPacketRouteNano: 5, MaxPricePerPacketOutNano: 20}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.payments.Budgets = budgets
+
+	nodes := testPool(5)
+	for i := range nodes {
+		nodes[i].Payment = &config.TunnelSectionPayment{PricePerPacketRouteNano: 1, PricePerPacketOutNano: 100}
+	}
+	nodes[0].Payment.PricePerPacketOutNano = 10
+	nodes[1].Payment.PricePerPacketRouteNano = 50
+	outKey, expensiveKey := nodes[0].Key, nodes[1].Key
+
+	cfg := &config.ClientConfig{TunnelSectionsNum: 2, PaymentsEnabled: true}
+	attempts := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		c, err, _ := pickRoute(cfg, g, nodes, nil, nil, attempts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(c.chainTo[1].Keys.ReceiverPubKey) != string(outKey) {
+			t.Fatal("out gateway with allowed price should be used")
+		}
+		if string(c.chainTo[0].Keys.ReceiverPubKey) == string(expensiveKey) || string(c.chainFrom[0].Keys.ReceiverPubKey) == string(expensiveKey) {
+			t.Fatal("relay with too high price should not be used")
+		}
+		if c.price != 12 {
+			t.Fatal("unexpected route price", c.price)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package tunnel
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"golang.org/x/crypto/chacha20poly1305"
+	"hash/crc64"
+)
+
+// CipherMode is an encryption scheme of tunnel layer, it is negotiated per section:
+// client picks it based on capabilities of the node, node detects it on first message and sticks to it.
+type CipherMode uint32
+
+const (
+	// CipherModeCTR is AES-CTR with crc64 of data as integrity check, supported by all nodes
+	CipherModeCTR CipherMode = iota
+	// CipherModeAEAD is XChaCha20-Poly1305 with random nonce
+	CipherModeAEAD
+)
+
+// aeadVersion is a first byte of AEAD encrypted data, to switch scheme in the future
+const aeadVersion = 1
+
+const aeadOverhead = 1 + chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+func (m CipherMode) String() string {
+	switch m {
+	case CipherModeCTR:
+		return "ctr"
+	case CipherModeAEAD:
+		return "aead"
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(m))
+}
+
+func encryptStream(mode CipherMode, cipherKeyCrc uint64, cipherKey, data []byte) ([]byte, error) {
+	switch mode {
+	case CipherModeCTR:
+		return encryptCTR(cipherKeyCrc, cipherKey, data)
+	case CipherModeAEAD:
+		return encryptAEAD(cipherKey, data)
+	}
+	return nil, fmt.Errorf("unsupported cipher mode %s", mode)
+}
+
+func decryptStream(mode CipherMode, cipherKeyCrc uint64, cipherKey, data []byte) ([]byte, error) {
+	switch mode {
+	case CipherModeCTR:
+		return decryptCTR(cipherKeyCrc, cipherKey, data)
+	case CipherModeAEAD:
+		return decryptAEAD(cipherKey, data)
+	}
+	return nil, fmt.Errorf("unsupported cipher mode %s", mode)
+}
+
+// decryptStreamAny detects scheme of data, it is used when mode is not yet negotiated.
+// AEAD is tried first, because its check is reliable, data is not modified when it fails.
+func decryptStreamAny(cipherKeyCrc uint64, cipherKey, data []byte) ([]byte, CipherMode, error) {
+	if len(data) > aeadOverhead && data[0] == aeadVersion {
+		// not in place, because data is zeroed when authentication fails
+		if pl, err := openAEAD(nil, cipherKey, data); err == nil {
+			return pl, CipherModeAEAD, nil
+		}
+	}
+
+	pl, err := decryptCTR(cipherKeyCrc, cipherKey, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	return pl, CipherModeCTR, nil
+}
+
+func encryptCTR(cipherKeyCrc uint64, cipherKey, data []byte) ([]byte, error) {
+	enc := make([]byte, 16+len(data))
+
+	// we are using encrypted crc as part of iv to not let data bruteforce by 3rd party,
+	// and reduce message size in the same time
+	binary.LittleEndian.PutUint64(enc, crc64.Checksum(data, crcTable)^cipherKeyCrc)
+	if _, err := rand.Read(enc[8:16]); err != nil {
+		return nil, err
+	}
+
+	pl := enc[16:]
+	copy(pl, data)
+
+	// we build cipher based on shared key of tunnel+node and checksum of decrypted packet
+	// checksum is needed here to randomize cipher to make it not repeatable if underlying data is similar
+	// checksum always changes because of underlying packet "random" field of InstructionsContainer changes
+	crypt, err := keys.NewCipherCtr(cipherKey, enc[:16])
+	if err != nil {
+		return nil, fmt.Errorf("new cipher calc failed: %v", err)
+	}
+	crypt.XORKeyStream(pl, pl)
+
+	return enc, nil
+}
+
+func decryptCTR(cipherKeyCrc uint64, cipherKey, data []byte) ([]byte, error) {
+	if len(data) <= 16 {
+		return nil, fmt.Errorf("corrupted data, len %d", len(data))
+	}
+	pl := data[16:]
+
+	crypt, err := keys.NewCipherCtr(cipherKey, data[:16])
+	if err != nil {
+		return nil, fmt.Errorf("new cipher calc failed: %v", err)
+	}
+	crypt.XORKeyStream(pl, pl)
+
+	crc := crc64.Checksum(pl, crcTable) ^ cipherKeyCrc
+	if binary.LittleEndian.Uint64(data[:8]) != crc {
+		return nil, fmt.Errorf("corrupted data, checksum not match")
+	}
+
+	return pl, nil
+}
+
+// aeadKey derives separate key from shared key, to not use the same key with different ciphers
+func aeadKey(cipherKey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("adnl-tunnel-aead"))
+	h.Write(cipherKey)
+	return h.Sum(nil)
+}
+
+func encryptAEAD(cipherKey, data []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(aeadKey(cipherKey))
+	if err != nil {
+		return nil, fmt.Errorf("new cipher calc failed: %v", err)
+	}
+
+	enc := make([]byte, 1+chacha20poly1305.NonceSizeX, len(data)+aeadOverhead)
+	enc[0] = aeadVersion
+	if _, err = rand.Read(enc[1:]); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(enc, enc[1:], data, nil), nil
+}
+
+func decryptAEAD(cipherKey, data []byte) ([]byte, error) {
+	if len(data) <= aeadOverhead {
+		return nil, fmt.Errorf("corrupted data, len %d", len(data))
+	}
+	return openAEAD(data[aeadOverhead-chacha20poly1305.Overhead:][:0], cipherKey, data)
+}
+
+func openAEAD(dst, cipherKey, data []byte) ([]byte, error) {
+	if len(data) <= aeadOverhead {
+		return nil, fmt.Errorf("corrupted data, len %d", len(data))
+	}
+
+	if data[0] != aeadVersion {
+		return nil, fmt.Errorf("unsupported aead version %d", data[0])
+	}
+
+	aead, err := chacha20poly1305.NewX(aeadKey(cipherKey))
+	if err != nil {
+		return nil, fmt.Errorf("new cipher calc failed: %v", err)
+	}
+
+	nonce := data[1 : 1+chacha20poly1305.NonceSizeX]
+	pl, err := aead.Open(dst, nonce, data[1+chacha20poly1305.NonceSizeX:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("corrupted data, authentication failed")
+	}
+	return pl, nil
+}
@@ -0,0 +1,133 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"github.com/rs/zerolog"
+	"hash/crc64"
+	"strings"
+	"testing"
+)
+
+func testCipherKey() ([]byte, uint64) {
+	key := make([]byte, 32)
+	_, _ = rand.Read(key)
+	return key, crc64.Checksum(key, crcTable)
+}
+
+func TestCipherModes(t *testing.T) {
+	key, crc := testCipherKey()
+	data := []byte("some tunnel packet data")
+
+	for _, mode := range []CipherMode{CipherModeCTR, CipherModeAEAD} {
+		t.Run(mode.String(), func(t *testing.T) {
+			enc, err := encryptStream(mode, crc, key, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			dec, detected, err := decryptStreamAny(crc, key, append([]byte{}, enc...))
+			if err != nil {
+				t.Fatalf("decryptStreamAny() error = %v", err)
+			}
+			if detected != mode {
+				t.Fatalf("detected mode %s, want %s", detected, mode)
+			}
+			if !bytes.Equal(dec, data) {
+				t.Fatal("data not match")
+			}
+
+			dec, err = decryptStream(mode, crc, key, append([]byte{}, enc...))
+			if err != nil || !bytes.Equal(dec, data) {
+				t.Fatalf("decryptStream() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestCipherAEADTamper(t *testing.T) {
+	key, crc := testCipherKey()
+
+	enc, err := encryptStream(CipherModeAEAD, crc, key, []byte("transfer 1 ton"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := aeadOverhead - 16; i < len(enc); i++ {
+		tampered := append([]byte{}, enc...)
+		tampered[i] ^= 1
+
+		if _, err = decryptStream(CipherModeAEAD, crc, key, tampered); err == nil {
+			t.Fatalf("flipped bit at %d was not detected", i)
+		}
+	}
+}
+
+func TestSectionCipherNoDowngrade(t *testing.T) {
+	key, crc := testCipherKey()
+	s := &Section{cipherKey: key, cipherKeyCrc: crc, log: zerolog.Nop()}
+
+	enc, _ := encryptStream(CipherModeAEAD, crc, key, []byte("first"))
+	if _, err := s.decrypt(enc); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.getCipherMode() != CipherModeAEAD {
+		t.Fatalf("negotiated mode %s, want aead", s.getCipherMode())
+	}
+
+	enc, _ = encryptStream(CipherModeCTR, crc, key, []byte("second"))
+	if _, err := s.decrypt(enc); err == nil {
+		t.Fatal("ctr should not be accepted after aead negotiated")
+	}
+}
+
+func TestTunnelRecvCipherPinned(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _ := newTestGateway(t, ctx)
+	g.tunnels[7] = &RegularOutTunnel{chainFrom: []*SectionInfo{{Keys: &EncryptionKeys{Mode: CipherModeAEAD}}}}
+
+	s := &Section{gw: g, cipherMode: uint32(CipherModeCTR), log: zerolog.Nop()}
+	err := DeliverInitiatorInstruction{From: 7}.Execute(ctx, s, &EncryptedMessage{}, nil)
+	if err == nil || !strings.Contains(err.Error(), "negotiated") {
+		t.Fatal("payload of our section with not negotiated cipher should be rejected, got:", err)
+	}
+
+	s.cipherMode = uint32(CipherModeAEAD)
+	err = DeliverInitiatorInstruction{From: 7}.Execute(ctx, s, &EncryptedMessage{}, nil)
+	if err != nil && strings.Contains(err.Error(), "negotiated") {
+		t.Fatal("negotiated cipher should be accepted")
+	}
+}
+
+func benchmarkCipher(b *testing.B, mode CipherMode) {
+	key, crc := testCipherKey()
+	data := make([]byte, 1200)
+	_, _ = rand.Read(data)
+
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		enc, err := encryptStream(mode, crc, key, data)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		if _, err = decryptStream(mode, crc, key, enc); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCipherCTR(b *testing.B) {
+	benchmarkCipher(b, CipherModeCTR)
+}
+
+func BenchmarkCipherAEAD(b *testing.B) {
+	benchmarkCipher(b, CipherModeAEAD)
+}
@@ -0,0 +1,291 @@
+package tunnel
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/xssnick/tonutils-go/tl"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	tl.Register(CoverPayload{}, "adnlTunnel.coverPayload data:bytes = adnlTunnel.CoverPayload")
+}
+
+// CoverMode defines how dummy packets are distributed in time
+type CoverMode uint32
+
+const (
+	CoverModeOff CoverMode = iota
+	// CoverModeConstant sends dummy packets with constant interval
+	CoverModeConstant
+	// CoverModePoisson sends dummy packets with exponentially distributed intervals
+	CoverModePoisson
+)
+
+const CoverMaxRatePerSec = 1000
+
+// CoverMaxSize is a max size of dummy data, padding policy is applied to cover packets too
+const CoverMaxSize = PayloadMTU / 2
+
+// RouteJitterMax limits random delay which relay adds to routed payloads
+const RouteJitterMax = 50 * time.Millisecond
+
+// JitterQueueMax limits number of delayed payloads, when it is full, payloads are routed without delay
+const JitterQueueMax = 64 * 1024
+
+// CoverPayload is a dummy packet, out gateway discards it without sending
+type CoverPayload struct {
+	Data []byte `tl:"bytes"`
+}
+
+// CoverTrafficPolicy makes tunnel send dummy packets to out gateway, to hide timing of real ones from relays.
+// Cover packets consume prepaid packets of paid routes, MaxPackets limits their total number, 0 = unlimited.
+type CoverTrafficPolicy struct {
+	Mode       CoverMode
+	RatePerSec float64
+	MaxPackets uint64
+}
+
+func (m CoverMode) String() string {
+	switch m {
+	case CoverModeOff:
+		return "off"
+	case CoverModeConstant:
+		return "constant"
+	case CoverModePoisson:
+		return "poisson"
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(m))
+}
+
+func (p *CoverTrafficPolicy) validate() error {
+	switch p.Mode {
+	case CoverModeOff:
+		return nil
+	case CoverModeConstant, CoverModePoisson:
+	default:
+		return fmt.Errorf("unknown cover mode %d", p.Mode)
+	}
+
+	if p.RatePerSec <= 0 || p.RatePerSec > CoverMaxRatePerSec {
+		return fmt.Errorf("cover rate should be in range (0, %d]", CoverMaxRatePerSec)
+	}
+	return nil
+}
+
+func (p *CoverTrafficPolicy) nextInterval() time.Duration {
+	interval := float64(time.Second) / p.RatePerSec
+	if p.Mode == CoverModePoisson {
+		interval *= rand.ExpFloat64()
+	}
+	return time.Duration(interval)
+}
+
+// SetCoverTraffic starts sending dummy packets according to policy, nil or off policy stops it
+func (t *RegularOutTunnel) SetCoverTraffic(p *CoverTrafficPolicy) error {
+	if p != nil {
+		if err := p.validate(); err != nil {
+			return err
+		}
+
+		if p.Mode == CoverModeOff {
+			p = nil
+		}
+	}
+
+	if p != nil && t.rendezvous != nil {
+		return fmt.Errorf("cover traffic is not supported for hidden services")
+	}
+
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	if t.coverStop != nil {
+		t.coverStop()
+		t.coverStop = nil
+	}
+
+	if p != nil {
+		ctx, cancel := context.WithCancel(t.closerCtx)
+		t.coverStop = cancel
+
+		pol := *p
+		go t.coverLoop(ctx, &pol)
+	}
+	return nil
+}
+
+func (t *RegularOutTunnel) coverLoop(ctx context.Context, p *CoverTrafficPolicy) {
+	t.log.Debug().Str("mode", p.Mode.String()).Float64("rate", p.RatePerSec).Uint64("budget", p.MaxPackets).Msg("cover traffic started")
+
+	timer := time.NewTimer(p.nextInterval())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+		timer.Reset(p.nextInterval())
+
+		if atomic.LoadUint32(&t.tunnelState) < StateTypeOptimized || atomic.LoadInt32(&t.wantDestroy) != 0 {
+			continue
+		}
+
+		if p.MaxPackets > 0 && atomic.LoadUint64(&t.coverSent) >= p.MaxPackets {
+			t.log.Info().Uint64("sent", p.MaxPackets).Msg("cover traffic budget is exhausted, stopping it")
+			return
+		}
+
+		if err := t.sendCover(); err != nil {
+			t.log.Debug().Err(err).Msg("send cover packet failed")
+		}
+	}
+}
+
+func (t *RegularOutTunnel) sendCover() error {
+	if t.usePayments {
+		// cover is paid as regular packet, but it is not allowed to go into debt
+		paid := atomic.LoadInt64(&t.packetsMinPaidOut)
+		if paid <= atomic.LoadInt64(&t.packetsConsumedOut) {
+			return fmt.Errorf("not enough packets prepaid")
+		}
+		atomic.AddInt64(&t.packetsConsumedOut, 1)
+	}
+
+	data := make([]byte, rand.Intn(CoverMaxSize+1))
+	if err := t.sendPayload(CoverPayload{Data: data}); err != nil {
+		return err
+	}
+	atomic.AddUint64(&t.coverSent, 1)
+
+	return nil
+}
+
+// routeJitter returns random delay for routed payload, it hides timing relation of incoming and outgoing packets
+func (g *Gateway) routeJitter() time.Duration {
+	if g.routeJitterMax <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(g.routeJitterMax) + 1))
+}
+
+type delayedSend struct {
+	at   time.Time
+	send func()
+}
+
+type delayedHeap []*delayedSend
+
+func (h delayedHeap) Len() int           { return len(h) }
+func (h delayedHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+func (h delayedHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *delayedHeap) Push(x any)        { *h = append(*h, x.(*delayedSend)) }
+func (h *delayedHeap) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// jitterQueue sends delayed payloads from single loop with one timer, instead of timer per payload
+type jitterQueue struct {
+	items delayedHeap
+	wake  chan struct{}
+	mx    sync.Mutex
+}
+
+func newJitterQueue() *jitterQueue {
+	return &jitterQueue{
+		wake: make(chan struct{}, 1),
+	}
+}
+
+func (q *jitterQueue) add(d time.Duration, send func()) {
+	q.mx.Lock()
+	if len(q.items) >= JitterQueueMax {
+		q.mx.Unlock()
+		send()
+		return
+	}
+
+	item := &delayedSend{at: time.Now().Add(d), send: send}
+	heap.Push(&q.items, item)
+	first := q.items[0] == item
+	q.mx.Unlock()
+
+	if first {
+		// loop should rearm timer to the earlier time
+		select {
+		case q.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// due removes payloads which should be sent now, and returns time to wait for the next one
+func (q *jitterQueue) due(now time.Time) ([]func(), time.Duration) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	var res []func()
+	for len(q.items) > 0 && !q.items[0].at.After(now) {
+		res = append(res, heap.Pop(&q.items).(*delayedSend).send)
+	}
+
+	wait := time.Second
+	if len(q.items) > 0 {
+		wait = q.items[0].at.Sub(now)
+	}
+	return res, wait
+}
+
+func (q *jitterQueue) loop(ctx context.Context) {
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+
+	for {
+		list, wait := q.due(time.Now())
+		for _, send := range list {
+			send()
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-q.wake:
+		}
+	}
+}
+
+func coverFromConfig(cfg *config.CoverTrafficConfig) (*CoverTrafficPolicy, error) {
+	p := &CoverTrafficPolicy{
+		RatePerSec: cfg.RatePerSec,
+		MaxPackets: cfg.MaxPackets,
+	}
+
+	switch cfg.Mode {
+	case "", "off":
+		p.Mode = CoverModeOff
+	case "constant":
+		p.Mode = CoverModeConstant
+	case "poisson":
+		p.Mode = CoverModePoisson
+	default:
+		return nil, fmt.Errorf("unknown cover mode %q", cfg.Mode)
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
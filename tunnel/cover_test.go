@@ -0,0 +1,112 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/xssnick/tonutils-go/tl"
+	"math/big"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCoverTrafficPolicy(t *testing.T) {
+	p, err := coverFromConfig(&config.CoverTrafficConfig{Mode: "constant", RatePerSec: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if d := p.nextInterval(); d != 100*time.Millisecond {
+		t.Fatalf("unexpected constant interval %s", d)
+	}
+
+	p.Mode = CoverModePoisson
+	var sum time.Duration
+	for i := 0; i < 10000; i++ {
+		sum += p.nextInterval()
+	}
+	if avg := sum / 10000; avg < 90*time.Millisecond || avg > 110*time.Millisecond {
+		t.Fatalf("unexpected poisson average interval %s", avg)
+	}
+
+	if _, err = coverFromConfig(&config.CoverTrafficConfig{Mode: "poisson"}); err == nil {
+		t.Fatal("zero rate should be rejected")
+	}
+	if _, err = coverFromConfig(&config.CoverTrafficConfig{Mode: "burst", RatePerSec: 1}); err == nil {
+		t.Fatal("unknown mode should be rejected")
+	}
+}
+
+func TestOutDiscardsCover(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	keys, err := GenerateEncryptionKeys(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	o := &Out{
+		PayloadCipherKey:    keys.CipherKey,
+		PayloadCipherKeyCRC: keys.CipherKeyCRC,
+		PricePerPacket:      big.NewInt(1),
+		PrepaidPacketsOut:   10,
+	}
+
+	data, err := tl.Serialize(CoverPayload{Data: make([]byte, 100)}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if data, err = keys.EncryptPayload(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = o.Send(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if o.PacketsSentOut != 0 || o.PrepaidPacketsOut != 9 || o.MessagesIn != 1 {
+		t.Fatal("cover packet should be discarded without sending, and charged as packet")
+	}
+}
+
+func TestRouteJitter(t *testing.T) {
+	g := &Gateway{}
+	if g.routeJitter() != 0 {
+		t.Fatal("jitter should be disabled by default")
+	}
+
+	g.routeJitterMax = 5 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		if d := g.routeJitter(); d < 0 || d > g.routeJitterMax {
+			t.Fatalf("jitter %s is out of bounds", d)
+		}
+	}
+}
+
+func TestJitterQueueOrder(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q := newJitterQueue()
+	go q.loop(ctx)
+
+	var mx sync.Mutex
+	var sent []int
+	var wg sync.WaitGroup
+	for i, d := range []time.Duration{30, 10, 20} {
+		wg.Add(1)
+		i := i
+		q.add(d*time.Millisecond, func() {
+			mx.Lock()
+			sent = append(sent, i)
+			mx.Unlock()
+			wg.Done()
+		})
+	}
+	wg.Wait()
+
+	if sent[0] != 1 || sent[1] != 2 || sent[2] != 0 {
+		t.Fatal("payloads should be sent in order of their delays, got", sent)
+	}
+}
@@ -1,6 +1,7 @@
 package tunnel
 
 import (
+	"bytes"
 	"context"
 	"crypto/ed25519"
 	"errors"
@@ -10,17 +11,91 @@ import (
 	"github.com/xssnick/tonutils-go/adnl/overlay"
 	"github.com/xssnick/tonutils-go/tl"
 	"sort"
+	"sync"
 	"time"
 )
 
 func init() {
 	tl.Register(OverlayKey{}, "adnlTunnel.overlayKey paymentNode:int256 = adnlTunnel.OverlayKey")
+	tl.Register(OverlayShardKey{}, "adnlTunnel.overlayShardKey paymentNode:int256 shard:int = adnlTunnel.OverlayKey")
+}
+
+// DiscoveryShards is a number of overlay keys nodes are distributed between,
+// each dht overlay list holds only OverlayMaxNodes nodes
+const DiscoveryShards = 32
+const OverlayMaxNodes = 5
+
+// NodeLookupWorkers limits concurrent dht lookups of nodes info
+const NodeLookupWorkers = 16
+
+var nodeInfoDHTName = []byte("adnlTunnel.nodeInfo")
+
+// lookupEach calls lookup for indexes from 0 to num by NodeLookupWorkers workers, and waits for all of them
+func lookupEach(num int, lookup func(i int)) {
+	var wg sync.WaitGroup
+	queue := make(chan int)
+	for w := 0; w < NodeLookupWorkers && w < num; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range queue {
+				lookup(i)
+			}
+		}()
+	}
+
+	for i := 0; i < num; i++ {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
 }
 
 type OverlayKey struct {
 	PaymentNode []byte `tl:"int256"`
 }
 
+type OverlayShardKey struct {
+	PaymentNode []byte `tl:"int256"`
+	Shard       uint32 `tl:"int"`
+}
+
+// FindNodeInfo resolves metadata published by node with the given key
+func (g *Gateway) FindNodeInfo(ctx context.Context, key ed25519.PublicKey) (*NodeInfo, error) {
+	id, err := tl.Hash(keys.PublicKeyED25519{Key: key})
+	if err != nil {
+		return nil, fmt.Errorf("failed to calc node id: %w", err)
+	}
+
+	val, _, err := g.dht.FindValue(ctx, &dht.Key{
+		ID:    id,
+		Name:  nodeInfoDHTName,
+		Index: 0,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find node info: %w", err)
+	}
+
+	var info NodeInfo
+	if _, err = tl.Parse(&info, val.Data, true); err != nil {
+		return nil, fmt.Errorf("failed to parse node info: %w", err)
+	}
+
+	if !bytes.Equal(info.Key, key) {
+		return nil, fmt.Errorf("node info belongs to another key")
+	}
+
+	if err = info.Verify(); err != nil {
+		return nil, fmt.Errorf("failed to verify node info: %w", err)
+	}
+
+	g.setSectionDifficulty(info.Key, info.SectionDifficulty)
+	g.setNodeCapabilities(info.Key, info.Capabilities)
+	g.verifyKnownNode(info.Key)
+	return &info, nil
+}
+
 func (g *Gateway) updateDHT(ctx context.Context, ttlSeconds int64) error {
 	addr := g.gate.GetAddressList()
 	stored, _, err := g.dht.StoreAddress(ctx, addr, time.Duration(ttlSeconds)*time.Second, g.key, 0)
@@ -28,21 +103,50 @@ func (g *Gateway) updateDHT(ctx context.Context, ttlSeconds int64) error {
 		return fmt.Errorf("failed to store address: %w", err)
 	}
 
-	pn := g.paymentNode
-	if len(pn) == 0 {
-		pn = make([]byte, 32)
+	ni := g.nodeInfo()
+	if err = ni.Sign(g.key); err != nil {
+		return fmt.Errorf("failed to sign node info: %w", err)
 	}
 
-	overlayKey, err := tl.Hash(OverlayKey{
-		PaymentNode: pn,
-	})
+	info, err := tl.Serialize(ni, true)
+	if err != nil {
+		return fmt.Errorf("failed to serialize node info: %w", err)
+	}
+
+	infoStored, _, err := g.dht.Store(ctx, keys.PublicKeyED25519{Key: g.key.Public().(ed25519.PublicKey)},
+		nodeInfoDHTName, 0, info, dht.UpdateRuleSignature{}, time.Duration(ttlSeconds)*time.Second, g.key, 0)
+	if err != nil && infoStored == 0 {
+		return fmt.Errorf("failed to store node info: %w", err)
+	}
+
+	ourKey := g.key.Public().(ed25519.PublicKey)
+
+	// legacy key is kept for clients which are not aware of shards
+	overlayKeys, err := g.overlayKeys(-1, int(discoveryShard(ourKey)))
 	if err != nil {
-		return fmt.Errorf("failed to serialize key for dht overlay: %w", err)
+		return err
 	}
 
+	ovStored := 0
+	for _, overlayKey := range overlayKeys {
+		n, found, err := g.storeInOverlay(ctx, overlayKey, ttlSeconds)
+		if err != nil {
+			return err
+		}
+		ovStored += n
+		g.addKnownNodes(found, true)
+	}
+
+	g.log.Debug().Int("addr_nodes", stored).Int("info_nodes", infoStored).Int("overlay_nodes", ovStored).Msg("dht records updated")
+
+	return nil
+}
+
+// storeInOverlay adds our node to the overlay nodes list, and returns other nodes found in it
+func (g *Gateway) storeInOverlay(ctx context.Context, overlayKey []byte, ttlSeconds int64) (int, []ed25519.PublicKey, error) {
 	nodesList, _, err := g.dht.FindOverlayNodes(ctx, overlayKey)
 	if err != nil && !errors.Is(err, dht.ErrDHTValueIsNotFound) {
-		return fmt.Errorf("failed to find overlay nodes: %w", err)
+		return 0, nil, fmt.Errorf("failed to find overlay nodes: %w", err)
 	}
 
 	if nodesList == nil {
@@ -51,9 +155,10 @@ func (g *Gateway) updateDHT(ctx context.Context, ttlSeconds int64) error {
 
 	node, err := overlay.NewNode(overlayKey, g.key)
 	if err != nil {
-		return fmt.Errorf("failed creating overlay node: %w", err)
+		return 0, nil, fmt.Errorf("failed creating overlay node: %w", err)
 	}
 
+	var found []ed25519.PublicKey
 	refreshed := false
 	var newList []overlay.Node
 	// refresh if already exists
@@ -62,79 +167,123 @@ func (g *Gateway) updateDHT(ctx context.Context, ttlSeconds int64) error {
 		if ok && id.Key.Equal(node.ID.(keys.PublicKeyED25519).Key) {
 			newList = append(newList, *node)
 			refreshed = true
-			break
+			continue
 		}
 
 		// cleanup outdated ???
 		if uint32(nodesList.List[i].Version) > uint32(time.Now().Unix()-ttlSeconds) {
 			newList = append(newList, nodesList.List[i])
+			if ok {
+				found = append(found, id.Key)
+			}
 		}
 	}
 	nodesList.List = newList
 
 	if !refreshed {
-		// create if no records
-		if len(nodesList.List) == 0 {
-			nodesList = &overlay.NodesList{
-				List: []overlay.Node{*node},
-			}
-			refreshed = true
+		if len(nodesList.List) >= OverlayMaxNodes {
+			sort.Slice(nodesList.List, func(i, j int) bool {
+				return nodesList.List[i].Version < nodesList.List[j].Version
+			})
+
+			// replace oldest
+			nodesList.List[0] = *node
 		} else {
-			if len(nodesList.List) >= 5 {
-				sort.Slice(nodesList.List, func(i, j int) bool {
-					return nodesList.List[i].Version < nodesList.List[j].Version
-				})
-
-				// replace oldest
-				nodesList.List[0] = *node
-				refreshed = true
-			} else {
-				// add our node if < 5 in list
-				nodesList.List = append(nodesList.List, *node)
-				refreshed = true
-			}
+			nodesList.List = append(nodesList.List, *node)
 		}
 	}
 
 	ovStored, _, err := g.dht.StoreOverlayNodes(ctx, overlayKey, nodesList, time.Duration(ttlSeconds)*time.Second, 0)
 	if err != nil {
-		return fmt.Errorf("failed to store overlay nodes: %w", err)
+		return 0, nil, fmt.Errorf("failed to store overlay nodes: %w", err)
 	}
-
-	g.log.Debug().Int("addr_nodes", stored).Int("overlay_nodes", ovStored).Msg("dht records updated")
-
-	return nil
+	return ovStored, found, nil
 }
 
-func (g *Gateway) DiscoverNodes(ctx context.Context) ([]ed25519.PublicKey, error) {
+// overlayKeys calculates dht overlay keys of the given shards, -1 is a legacy not sharded key
+func (g *Gateway) overlayKeys(shards ...int) ([][]byte, error) {
 	pn := g.paymentNode
 	if len(pn) == 0 {
 		pn = make([]byte, 32)
 	}
 
-	overlayKey, err := tl.Hash(OverlayKey{
-		PaymentNode: pn,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to serialize key for dht overlay: %w", err)
+	var res [][]byte
+	for _, shard := range shards {
+		var key tl.Serializable = OverlayKey{PaymentNode: pn}
+		if shard >= 0 {
+			key = OverlayShardKey{PaymentNode: pn, Shard: uint32(shard)}
+		}
+
+		overlayKey, err := tl.Hash(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize key for dht overlay: %w", err)
+		}
+		res = append(res, overlayKey)
 	}
+	return res, nil
+}
 
-	nodesList, _, err := g.dht.FindOverlayNodes(ctx, overlayKey)
-	if err != nil && !errors.Is(err, dht.ErrDHTValueIsNotFound) {
-		return nil, fmt.Errorf("failed to find overlay nodes: %w", err)
+// discoveryShard returns overlay shard where node with the given key publishes itself
+func discoveryShard(key ed25519.PublicKey) uint32 {
+	return uint32(key[0]) % DiscoveryShards
+}
+
+// DiscoverNodes finds nodes in all overlay shards, and then asks some of them
+// for nodes they know, to find nodes which are not fit into dht lists.
+func (g *Gateway) DiscoverNodes(ctx context.Context) ([]ed25519.PublicKey, error) {
+	shards := []int{-1}
+	for i := 0; i < DiscoveryShards; i++ {
+		shards = append(shards, i)
 	}
 
-	if nodesList == nil {
-		return nil, nil
+	overlayKeys, err := g.overlayKeys(shards...)
+	if err != nil {
+		return nil, err
 	}
 
-	var keysList []ed25519.PublicKey
-	for _, node := range nodesList.List {
-		id, ok := node.ID.(keys.PublicKeyED25519)
-		if ok {
-			keysList = append(keysList, id.Key)
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	var lastErr error
+	var found []ed25519.PublicKey
+	for _, overlayKey := range overlayKeys {
+		wg.Add(1)
+		go func(overlayKey []byte) {
+			defer wg.Done()
+
+			nodesList, _, err := g.dht.FindOverlayNodes(ctx, overlayKey)
+			if err != nil && !errors.Is(err, dht.ErrDHTValueIsNotFound) {
+				mx.Lock()
+				lastErr = err
+				mx.Unlock()
+				return
+			}
+
+			if nodesList == nil {
+				return
+			}
+
+			mx.Lock()
+			for _, node := range nodesList.List {
+				if id, ok := node.ID.(keys.PublicKeyED25519); ok {
+					found = append(found, id.Key)
+				}
+			}
+			mx.Unlock()
+		}(overlayKey)
+	}
+	wg.Wait()
+
+	g.addKnownNodes(found, true)
+
+	known := g.getKnownNodes(0)
+	if len(known) == 0 {
+		if lastErr != nil {
+			return nil, fmt.Errorf("failed to find overlay nodes: %w", lastErr)
 		}
+		return nil, nil
 	}
 
-	return keysList, nil
+	g.gossipRound(ctx, GossipPeersPerRound)
+
+	return g.getKnownNodes(0), nil
 }
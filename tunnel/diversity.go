@@ -0,0 +1,227 @@
+package tunnel
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"github.com/xssnick/tonutils-go/tl"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type geoRange struct {
+	from, to uint32
+	asn      uint32
+	country  string
+}
+
+// GeoIPDatabase maps ipv4 addresses to asn and country
+type GeoIPDatabase struct {
+	ranges []geoRange
+}
+
+// LoadGeoIPDatabase reads ip2asn tsv file, each line is: range start, range end, asn, country, description
+func LoadGeoIPDatabase(path string) (*GeoIPDatabase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open geoip database: %w", err)
+	}
+	defer f.Close()
+
+	db := &GeoIPDatabase{}
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		parts := strings.Split(sc.Text(), "\t")
+		if len(parts) < 4 {
+			continue
+		}
+
+		from, to := net.ParseIP(parts[0]).To4(), net.ParseIP(parts[1]).To4()
+		if from == nil || to == nil {
+			// ipv6 ranges are skipped
+			continue
+		}
+
+		asn, err := strconv.ParseUint(parts[2], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid asn on line %d: %w", line, err)
+		}
+
+		country := strings.ToUpper(parts[3])
+		if country == "NONE" {
+			country = ""
+		}
+
+		db.ranges = append(db.ranges, geoRange{
+			from:    binary.BigEndian.Uint32(from),
+			to:      binary.BigEndian.Uint32(to),
+			asn:     uint32(asn),
+			country: country,
+		})
+	}
+	if err = sc.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read geoip database: %w", err)
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return db.ranges[i].from < db.ranges[j].from
+	})
+	return db, nil
+}
+
+// Lookup returns asn and country of ip, asn 0 in database means not routed
+func (db *GeoIPDatabase) Lookup(ip net.IP) (asn uint32, country string, ok bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0, "", false
+	}
+	v := binary.BigEndian.Uint32(ip4)
+
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return db.ranges[i].from > v
+	}) - 1
+	if i < 0 || db.ranges[i].to < v {
+		return 0, "", false
+	}
+	r := db.ranges[i]
+	return r.asn, r.country, true
+}
+
+// fillNodesGeo sets country and asn of nodes with known ip, values from shared config are not overridden
+func (db *GeoIPDatabase) fillNodesGeo(nodes []config.TunnelRouteSection) {
+	for i := range nodes {
+		ip := net.ParseIP(nodes[i].IP)
+		if ip == nil {
+			continue
+		}
+
+		asn, country, ok := db.Lookup(ip)
+		if !ok {
+			continue
+		}
+
+		if nodes[i].ASN == 0 {
+			nodes[i].ASN = asn
+		}
+		if nodes[i].Country == "" {
+			nodes[i].Country = country
+		}
+	}
+}
+
+// resolveNodesIP fills ip of pool nodes, which are not specified in shared config, from their dht addresses
+func resolveNodesIP(ctx context.Context, tGate *Gateway, nodes []config.TunnelRouteSection) {
+	// pool can be big, so lookups are limited
+	lookupEach(len(nodes), func(i int) {
+		node := &nodes[i]
+		if node.IP != "" {
+			return
+		}
+
+		id, err := tl.Hash(keys.PublicKeyED25519{Key: node.Key})
+		if err != nil {
+			return
+		}
+
+		ctxFind, cancel := context.WithTimeout(ctx, 7*time.Second)
+		addresses, _, err := tGate.dht.FindAddresses(ctxFind, id)
+		cancel()
+		if err != nil || len(addresses.Addresses) == 0 {
+			tGate.log.Debug().Err(err).Str("key", base64.StdEncoding.EncodeToString(node.Key)).Msg("failed to resolve node address")
+			return
+		}
+		node.IP = addresses.Addresses[0].IP.String()
+	})
+}
+
+// diversityOutAllowed checks out gateway country, when allowed countries are set, node with unknown country is not allowed
+func diversityOutAllowed(cfg *config.RouteDiversityConfig, node *config.TunnelRouteSection) bool {
+	if cfg == nil || len(cfg.OutCountries) == 0 {
+		return true
+	}
+
+	for _, c := range cfg.OutCountries {
+		if node.Country != "" && strings.EqualFold(c, node.Country) {
+			return true
+		}
+	}
+	return false
+}
+
+// routeNodes returns pool entries of route nodes, out gateway is the first, the same node can be used in both chains
+func routeNodes(pool []config.TunnelRouteSection, chainTo, chainFrom []*SectionInfo) []config.TunnelRouteSection {
+	var res []config.TunnelRouteSection
+	for i := len(chainTo) - 1; i >= 0; i-- {
+		for j := range pool {
+			if bytes.Equal(pool[j].Key, chainTo[i].Keys.ReceiverPubKey) {
+				res = append(res, pool[j])
+				break
+			}
+		}
+	}
+	for _, si := range chainFrom {
+		for j := range pool {
+			if bytes.Equal(pool[j].Key, si.Keys.ReceiverPubKey) {
+				res = append(res, pool[j])
+				break
+			}
+		}
+	}
+	return res
+}
+
+// checkRouteDiversity verifies that distinct nodes of route do not share operator, asn, country or subnet,
+// first node is out gateway.
+func checkRouteDiversity(cfg *config.RouteDiversityConfig, nodes []config.TunnelRouteSection) error {
+	if cfg == nil {
+		return nil
+	}
+
+	if len(nodes) > 0 && !diversityOutAllowed(cfg, &nodes[0]) {
+		return fmt.Errorf("out gateway country %q is not allowed", nodes[0].Country)
+	}
+
+	subnet := func(node *config.TunnelRouteSection) net.IP {
+		if cfg.DistinctSubnetBits == 0 || cfg.DistinctSubnetBits > 32 {
+			return nil
+		}
+
+		ip := net.ParseIP(node.IP).To4()
+		if ip == nil {
+			return nil
+		}
+		return ip.Mask(net.CIDRMask(int(cfg.DistinctSubnetBits), 32))
+	}
+
+	for i := range nodes {
+		for j := i + 1; j < len(nodes); j++ {
+			a, b := &nodes[i], &nodes[j]
+			if bytes.Equal(a.Key, b.Key) {
+				continue
+			}
+
+			if cfg.DistinctOperators && a.Operator != "" && strings.EqualFold(a.Operator, b.Operator) {
+				return fmt.Errorf("nodes share operator %q", a.Operator)
+			}
+			if cfg.DistinctASN && a.ASN != 0 && a.ASN == b.ASN {
+				return fmt.Errorf("nodes share asn %d", a.ASN)
+			}
+			if cfg.DistinctCountries && a.Country != "" && strings.EqualFold(a.Country, b.Country) {
+				return fmt.Errorf("nodes share country %s", a.Country)
+			}
+			if sa, sb := subnet(a), subnet(b); sa != nil && sa.Equal(sb) {
+				return fmt.Errorf("nodes share subnet %s/%d", sa.String(), cfg.DistinctSubnetBits)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package tunnel
+
+import (
+	"context"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestGeoIPDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip2asn-v4.tsv")
+	data := "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+		"5.0.0.0\t5.0.255.255\t24940\tDE\tHETZNER-AS\n" +
+		"10.0.0.0\t10.255.255.255\t0\tNone\tNot routed\n"
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := LoadGeoIPDatabase(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if asn, country, ok := db.Lookup(net.ParseIP("5.0.10.1")); !ok || asn != 24940 || country != "DE" {
+		t.Fatal("unexpected lookup result", asn, country, ok)
+	}
+	if _, _, ok := db.Lookup(net.ParseIP("2.0.0.1")); ok {
+		t.Fatal("ip out of ranges should not be found")
+	}
+
+	nodes := []config.TunnelRouteSection{{IP: "1.0.0.1"}, {IP: "5.0.0.1", Country: "FI"}, {IP: "10.0.0.1"}}
+	db.fillNodesGeo(nodes)
+	if nodes[0].ASN != 13335 || nodes[0].Country != "US" || nodes[1].Country != "FI" || nodes[1].ASN != 24940 || nodes[2].Country != "" || nodes[2].ASN != 0 {
+		t.Fatal("unexpected nodes metadata", nodes)
+	}
+}
+
+func TestCheckRouteDiversity(t *testing.T) {
+	nodes := testPool(3)
+	nodes[0].IP, nodes[0].Country, nodes[0].Operator = "1.1.0.1", "NL", "a"
+	nodes[1].IP, nodes[1].Country, nodes[1].Operator = "1.2.0.1", "DE", "b"
+	nodes[2].IP, nodes[2].Country, nodes[2].Operator = "2.1.0.1", "FI", "c"
+
+	cfg := &config.RouteDiversityConfig{
+		DistinctOperators:  true,
+		DistinctCountries:  true,
+		DistinctSubnetBits: 16,
+		OutCountries:       []string{"nl"},
+	}
+
+	// same node in both chains is allowed
+	route := []config.TunnelRouteSection{nodes[0], nodes[1], nodes[2], nodes[1]}
+	if err := checkRouteDiversity(cfg, route); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := checkRouteDiversity(cfg, []config.TunnelRouteSection{nodes[1], nodes[0]}); err == nil {
+		t.Fatal("out gateway country should be checked")
+	}
+
+	cfg.DistinctSubnetBits = 8
+	if err := checkRouteDiversity(cfg, route); err == nil {
+		t.Fatal("shared subnet should be rejected")
+	}
+	cfg.DistinctSubnetBits = 0
+
+	route[2].Operator = "A"
+	if err := checkRouteDiversity(cfg, route); err == nil {
+		t.Fatal("shared operator should be rejected")
+	}
+}
+
+func TestPickRouteDiversity(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _ := newTestGateway(t, ctx)
+	nodes := testPool(4)
+	for i := range nodes {
+		nodes[i].Operator = "same"
+	}
+	nodes[3].Operator = "other"
+	nodes[3].Country = "NL"
+	outKey := nodes[3].Key
+
+	cfg := &config.ClientConfig{TunnelSectionsNum: 2, Diversity: &config.RouteDiversityConfig{
+		DistinctOperators: true,
+		OutCountries:      []string{"NL"},
+	}}
+
+	attempts := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		c, err, _ := pickRoute(cfg, g, nodes, nil, nil, attempts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(c.chainTo[1].Keys.ReceiverPubKey) != string(outKey) {
+			t.Fatal("out gateway should be in allowed country")
+		}
+	}
+
+	cfg.TunnelSectionsNum = 3
+	if _, err, _ := pickRoute(cfg, g, nodes, nil, nil, map[string]bool{}); err != ErrNoMoreRoutes {
+		t.Fatal("route with relays of one operator should not be picked, got", err)
+	}
+}
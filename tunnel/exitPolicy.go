@@ -0,0 +1,234 @@
+package tunnel
+
+import (
+	"fmt"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/ton-blockchain/adnl-tunnel/metrics"
+	"github.com/xssnick/tonutils-go/tl"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+func init() {
+	tl.Register(SendOutErrorPayload{}, "adnlTunnel.sendOutErrorPayload seqno:long ip:bytes port:int reason:string = adnlTunnel.SendOutErrorPayload")
+}
+
+const exitPolicyReportEverySec = 1
+
+// SendOutErrorPayload is sent back to client when out gateway refused to send its packet
+type SendOutErrorPayload struct {
+	Seqno uint64 `tl:"long"`
+
+	IP     []byte `tl:"bytes"`
+	Port   uint32 `tl:"int"`
+	Reason string `tl:"string"`
+}
+
+// reservedPrefixes are private, local or special purpose ranges, not routable in public internet
+var reservedPrefixes = mustParsePrefixes(
+	"0.0.0.0/8",       // this network
+	"10.0.0.0/8",      // private
+	"100.64.0.0/10",   // carrier grade nat
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link local
+	"172.16.0.0/12",   // private
+	"192.0.0.0/24",    // ietf protocol assignments
+	"192.0.2.0/24",    // documentation
+	"192.88.99.0/24",  // 6to4 relay anycast
+	"192.168.0.0/16",  // private
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved and broadcast
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"64:ff9b::/96",    // nat64, embeds ipv4 address
+	"64:ff9b:1::/48",  // local use nat64
+	"100::/64",        // discard only
+	"2001::/32",       // teredo, embeds ipv4 address
+	"2001:db8::/32",   // documentation
+	"2002::/16",       // 6to4, embeds ipv4 address
+	"fc00::/7",        // unique local
+	"fe80::/10",       // link local
+	"ff00::/8",        // multicast
+)
+
+type portRange struct {
+	from, to uint16
+}
+
+// ExitPolicy decides which destinations out gateway is allowed to send packets to
+type ExitPolicy struct {
+	allow        []netip.Prefix
+	deny         []netip.Prefix
+	allowPorts   []portRange
+	denyPorts    []portRange
+	allowPrivate bool
+}
+
+// DefaultExitPolicy denies private and reserved ranges, everything else is allowed
+func DefaultExitPolicy() *ExitPolicy {
+	return &ExitPolicy{}
+}
+
+func NewExitPolicy(cfg *config.ExitPolicyConfig) (*ExitPolicy, error) {
+	p := &ExitPolicy{
+		allowPrivate: cfg.AllowPrivate,
+	}
+
+	var err error
+	if p.allow, err = parsePrefixes(cfg.Allow); err != nil {
+		return nil, fmt.Errorf("invalid allow list: %w", err)
+	}
+	if p.deny, err = parsePrefixes(cfg.Deny); err != nil {
+		return nil, fmt.Errorf("invalid deny list: %w", err)
+	}
+	if p.allowPorts, err = parsePortRanges(cfg.AllowPorts); err != nil {
+		return nil, fmt.Errorf("invalid allow ports: %w", err)
+	}
+	if p.denyPorts, err = parsePortRanges(cfg.DenyPorts); err != nil {
+		return nil, fmt.Errorf("invalid deny ports: %w", err)
+	}
+	return p, nil
+}
+
+// Check returns reason of rejection, or empty string when destination is allowed.
+// Explicitly allowed subnets bypass private ranges restriction, but not deny list.
+func (p *ExitPolicy) Check(addr netip.AddrPort) string {
+	ip := addr.Addr().Unmap()
+
+	for _, r := range p.denyPorts {
+		if r.contains(addr.Port()) {
+			return "port is denied"
+		}
+	}
+
+	if len(p.allowPorts) > 0 {
+		allowed := false
+		for _, r := range p.allowPorts {
+			if r.contains(addr.Port()) {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return "port is not allowed"
+		}
+	}
+
+	for _, prefix := range p.deny {
+		if prefix.Contains(ip) {
+			return "destination is denied"
+		}
+	}
+
+	for _, prefix := range p.allow {
+		if prefix.Contains(ip) {
+			return ""
+		}
+	}
+
+	if !p.allowPrivate {
+		for _, prefix := range reservedPrefixes {
+			if prefix.Contains(ip) {
+				return "destination is private or reserved"
+			}
+		}
+	}
+	return ""
+}
+
+func (r portRange) contains(port uint16) bool {
+	return port >= r.from && port <= r.to
+}
+
+func parsePortRanges(list []string) ([]portRange, error) {
+	var res []portRange
+	for _, s := range list {
+		from, to, found := strings.Cut(s, "-")
+		if !found {
+			to = from
+		}
+
+		f, err := strconv.ParseUint(strings.TrimSpace(from), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port range %q: %w", s, err)
+		}
+
+		t, err := strconv.ParseUint(strings.TrimSpace(to), 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port range %q: %w", s, err)
+		}
+
+		if f > t {
+			return nil, fmt.Errorf("invalid port range %q", s)
+		}
+		res = append(res, portRange{from: uint16(f), to: uint16(t)})
+	}
+	return res, nil
+}
+
+func parsePrefixes(list []string) ([]netip.Prefix, error) {
+	var res []netip.Prefix
+	for _, s := range list {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			ip, ipErr := netip.ParseAddr(s)
+			if ipErr != nil {
+				return nil, fmt.Errorf("invalid subnet %q: %w", s, err)
+			}
+			p = netip.PrefixFrom(ip, ip.BitLen())
+		}
+		res = append(res, p.Masked())
+	}
+	return res, nil
+}
+
+func mustParsePrefixes(list ...string) []netip.Prefix {
+	res, err := parsePrefixes(list)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
+// SetExitPolicy replaces policy of out gateways, it is applied to all active outs
+func (g *Gateway) SetExitPolicy(p *ExitPolicy) {
+	if p == nil {
+		p = DefaultExitPolicy()
+	}
+	atomic.StorePointer(&g.exitPolicy, unsafe.Pointer(p))
+}
+
+func (g *Gateway) getExitPolicy() *ExitPolicy {
+	return (*ExitPolicy)(atomic.LoadPointer(&g.exitPolicy))
+}
+
+// rejectSend counts rejection and reports it to client, not more often than once a second,
+// to not let client spend our inbound traffic on reports
+func (o *Out) rejectSend(addr netip.AddrPort, reason string) {
+	metrics.ExitPolicyRejected.Inc()
+
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&o.lastRejectReportAt)
+	if now-last < exitPolicyReportEverySec || !atomic.CompareAndSwapInt64(&o.lastRejectReportAt, last, now) {
+		return
+	}
+
+	go func() {
+		if err := o.sendBack(SendOutErrorPayload{
+			Seqno:  atomic.LoadUint64(&o.PacketsSentIn),
+			IP:     addr.Addr().AsSlice(),
+			Port:   uint32(addr.Port()),
+			Reason: reason,
+		}, true); err != nil {
+			o.log.Debug().Err(err).Msg("send back reject report failed")
+		}
+	}()
+}
@@ -0,0 +1,54 @@
+package tunnel
+
+import (
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"net/netip"
+	"testing"
+)
+
+func TestExitPolicyCheck(t *testing.T) {
+	p, err := NewExitPolicy(&config.ExitPolicyConfig{
+		Allow:     []string{"10.1.0.0/16"},
+		Deny:      []string{"8.8.8.8", "10.1.1.0/24"},
+		DenyPorts: []string{"25", "6000-6100"},
+	})
+	if err != nil {
+		t.Fatalf("NewExitPolicy() error = %v", err)
+	}
+
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"1.1.1.1:53", true},
+		{"[2606:4700::1111]:53", true},
+		{"127.0.0.1:17331", false},
+		{"192.168.1.1:53", false},
+		{"172.20.0.1:53", false},
+		{"169.254.169.254:80", false},
+		{"[::1]:53", false},
+		{"[fe80::1]:53", false},
+		{"[::ffff:127.0.0.1]:53", false},
+		{"[64:ff9b::7f00:1]:53", false},
+		{"[2002:c0a8:101::1]:53", false},
+		{"[2001:0:4136:e378::1]:53", false},
+		{"8.8.8.8:53", false},
+		{"8.8.4.4:53", true},
+		{"10.1.2.3:53", true},
+		{"10.1.1.3:53", false},
+		{"10.2.0.1:53", false},
+		{"1.1.1.1:25", false},
+		{"1.1.1.1:6050", false},
+	}
+
+	for _, tt := range tests {
+		reason := p.Check(netip.MustParseAddrPort(tt.addr))
+		if (reason == "") != tt.allowed {
+			t.Errorf("Check(%s) = %q, expected allowed %v", tt.addr, reason, tt.allowed)
+		}
+	}
+
+	if _, err = NewExitPolicy(&config.ExitPolicyConfig{DenyPorts: []string{"200-100"}}); err == nil {
+		t.Fatal("expected error for invalid port range")
+	}
+}
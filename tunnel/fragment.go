@@ -0,0 +1,200 @@
+package tunnel
+
+import (
+	"fmt"
+	"github.com/xssnick/tonutils-go/adnl"
+	"github.com/xssnick/tonutils-go/tl"
+	"sync"
+	"time"
+)
+
+func init() {
+	tl.Register(FragmentPayload{}, "adnlTunnel.fragmentPayload id:long index:int count:int data:bytes = adnlTunnel.FragmentPayload")
+}
+
+// PayloadMTU is a max size of serialized payload carried by single tunnel message,
+// the rest of adnl base mtu is left for tunnel message and cipher headers.
+// Bigger payloads are fragmented, so relays are not splitting and reassembling them on each hop.
+const PayloadMTU = adnl.BasePayloadMTU - 96
+
+const (
+	// FragmentMaxCount limits size of fragmented payload
+	FragmentMaxCount = 8
+	// FragmentMaxPending is how many incomplete payloads receiver keeps
+	FragmentMaxPending = 256
+
+	fragmentOverhead = 32
+	fragmentDataSize = PayloadMTU - fragmentOverhead
+)
+
+// DatagramMaxSize is a max size of datagram which can be sent through tunnel in fragments
+const DatagramMaxSize = FragmentMaxCount*fragmentDataSize - batchItemOverhead
+
+// FragmentTimeout is how long receiver waits for all fragments of payload
+var FragmentTimeout = 5 * time.Second
+
+const (
+	FragmentDropReasonTimeout  = "timeout"
+	FragmentDropReasonOverflow = "overflow"
+	// FragmentDropReasonMismatch is when fragments with the same id have different count, sender restarted and reused id
+	FragmentDropReasonMismatch = "mismatch"
+)
+
+// FragmentPayload is a numbered piece of serialized payload which is bigger than PayloadMTU.
+// Loss of any fragment drops the whole payload.
+type FragmentPayload struct {
+	ID    uint64 `tl:"long"`
+	Index uint32 `tl:"int"`
+	Count uint32 `tl:"int"`
+	Data  []byte `tl:"bytes"`
+}
+
+// splitPayload returns nil when payload fits into single message
+func splitPayload(id uint64, data []byte) ([]FragmentPayload, error) {
+	if len(data) <= PayloadMTU {
+		return nil, nil
+	}
+
+	count := (len(data) + fragmentDataSize - 1) / fragmentDataSize
+	if count > FragmentMaxCount {
+		return nil, fmt.Errorf("payload is too big: %d bytes", len(data))
+	}
+
+	fragments := make([]FragmentPayload, 0, count)
+	for i := 0; i < count; i++ {
+		part := data[i*fragmentDataSize:]
+		if len(part) > fragmentDataSize {
+			part = part[:fragmentDataSize]
+		}
+
+		fragments = append(fragments, FragmentPayload{
+			ID:    id,
+			Index: uint32(i),
+			Count: uint32(count),
+			Data:  part,
+		})
+	}
+	return fragments, nil
+}
+
+type fragmentedPayload struct {
+	parts     [][]byte
+	left      int
+	createdAt time.Time
+}
+
+// fragmentBuffer reassembles fragmented payloads of single sender
+type fragmentBuffer struct {
+	pending     map[uint64]*fragmentedPayload
+	lastCleanAt time.Time
+
+	// onDrop is called when incomplete payload is dropped
+	onDrop func(reason string)
+
+	mx sync.Mutex
+}
+
+func newFragmentBuffer(onDrop func(reason string)) *fragmentBuffer {
+	return &fragmentBuffer{
+		pending: map[uint64]*fragmentedPayload{},
+		onDrop:  onDrop,
+	}
+}
+
+// add returns reassembled payload when all its fragments are received, and nil otherwise
+func (b *fragmentBuffer) add(f FragmentPayload) ([]byte, error) {
+	if f.Count < 2 || f.Count > FragmentMaxCount || f.Index >= f.Count {
+		return nil, fmt.Errorf("invalid fragment %d of %d", f.Index, f.Count)
+	}
+
+	if len(f.Data) == 0 || len(f.Data) > fragmentDataSize {
+		return nil, fmt.Errorf("invalid fragment size %d", len(f.Data))
+	}
+
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	now := time.Now()
+	if now.Sub(b.lastCleanAt) >= time.Second {
+		b.cleanup(now)
+	}
+
+	p := b.pending[f.ID]
+	if p != nil && len(p.parts) != int(f.Count) {
+		// sender restarted and reused id
+		delete(b.pending, f.ID)
+		b.drop(FragmentDropReasonMismatch)
+		p = nil
+	}
+
+	if p == nil {
+		if len(b.pending) >= FragmentMaxPending {
+			b.cleanup(now)
+			if len(b.pending) >= FragmentMaxPending {
+				b.drop(FragmentDropReasonOverflow)
+				return nil, nil
+			}
+		}
+
+		p = &fragmentedPayload{
+			parts:     make([][]byte, f.Count),
+			left:      int(f.Count),
+			createdAt: now,
+		}
+		b.pending[f.ID] = p
+	}
+
+	if p.parts[f.Index] != nil {
+		// duplicate
+		return nil, nil
+	}
+	// copied, because message buffer can be reused until payload is completed
+	p.parts[f.Index] = append([]byte{}, f.Data...)
+	p.left--
+
+	if p.left > 0 {
+		return nil, nil
+	}
+	delete(b.pending, f.ID)
+
+	var size int
+	for _, part := range p.parts {
+		size += len(part)
+	}
+
+	data := make([]byte, 0, size)
+	for _, part := range p.parts {
+		data = append(data, part...)
+	}
+	return data, nil
+}
+
+// cleanup drops payloads which were not completed in time, it means some fragment was lost
+func (b *fragmentBuffer) cleanup(now time.Time) {
+	b.lastCleanAt = now
+	for id, p := range b.pending {
+		if now.Sub(p.createdAt) >= FragmentTimeout {
+			delete(b.pending, id)
+			b.drop(FragmentDropReasonTimeout)
+		}
+	}
+}
+
+func (b *fragmentBuffer) drop(reason string) {
+	if b.onDrop != nil {
+		b.onDrop(reason)
+	}
+}
+
+// parseReassembled parses payload collected from fragments, it should not be fragmented itself
+func parseReassembled(data []byte) (tl.Serializable, error) {
+	var pl tl.Serializable
+	if _, err := tl.Parse(&pl, data, true); err != nil {
+		return nil, fmt.Errorf("parse reassembled payload failed: %w", err)
+	}
+
+	if _, ok := pl.(FragmentPayload); ok {
+		return nil, fmt.Errorf("nested fragments are not allowed")
+	}
+	return pl, nil
+}
@@ -0,0 +1,180 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"github.com/rs/zerolog"
+	"github.com/xssnick/tonutils-go/adnl"
+	"github.com/xssnick/tonutils-go/tl"
+	"net"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestFragmentReassemble(t *testing.T) {
+	data := make([]byte, 3*PayloadMTU)
+	_, _ = rand.Read(data)
+
+	fragments, err := splitPayload(7, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fragments) != 4 {
+		t.Fatalf("unexpected fragments count %d", len(fragments))
+	}
+
+	if small, _ := splitPayload(8, data[:PayloadMTU]); small != nil {
+		t.Fatal("payload which fits into mtu should not be fragmented")
+	}
+
+	if _, err = splitPayload(9, make([]byte, (FragmentMaxCount+1)*PayloadMTU)); err == nil {
+		t.Fatal("too big payload should not be fragmented")
+	}
+
+	var drops []string
+	b := newFragmentBuffer(func(reason string) {
+		drops = append(drops, reason)
+	})
+
+	// out of order with duplicate
+	for _, i := range []int{2, 0, 2, 3} {
+		full, err := b.add(fragments[i])
+		if err != nil || full != nil {
+			t.Fatal("payload should not be completed yet", err)
+		}
+	}
+
+	full, err := b.add(fragments[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(full, data) {
+		t.Fatal("reassembled payload is not equal to original")
+	}
+
+	if _, err = b.add(FragmentPayload{ID: 1, Index: 2, Count: 2, Data: []byte{1}}); err == nil {
+		t.Fatal("fragment index out of count should be rejected")
+	}
+
+	// lost fragment
+	if full, _ = b.add(fragments[0]); full != nil {
+		t.Fatal("payload should not be completed")
+	}
+
+	b.mx.Lock()
+	b.cleanup(time.Now().Add(FragmentTimeout))
+	b.mx.Unlock()
+
+	if len(drops) != 1 || drops[0] != FragmentDropReasonTimeout || len(b.pending) != 0 {
+		t.Fatal("incomplete payload should be dropped after timeout")
+	}
+
+	// sender reused id for payload with other fragments count
+	_, _ = b.add(FragmentPayload{ID: 5, Index: 0, Count: 2, Data: []byte{1}})
+	_, _ = b.add(FragmentPayload{ID: 5, Index: 0, Count: 3, Data: []byte{1}})
+	if len(drops) != 2 || drops[1] != FragmentDropReasonMismatch {
+		t.Fatal("payload with mismatched count should be dropped with its own reason", drops)
+	}
+}
+
+func TestFragmentsPrepaidConsumption(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	keys, err := GenerateEncryptionKeys(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tun := &RegularOutTunnel{
+		usePayments:        true,
+		packetsToPrepay:    1000,
+		packetsMinPaidOut:  1000,
+		messagesMinPaidOut: 1000,
+		tunnelState:        StateTypeOptimized,
+		payloadKeys:        keys,
+		peer:               &Peer{},
+		chainTo:            []*SectionInfo{{Keys: keys}},
+		sendControlSignal:  make(chan struct{}, 1),
+		log:                zerolog.Nop(),
+	}
+	conn := &countingConn{}
+	tun.peer.conn = unsafe.Pointer(&connAtomic{conn: conn})
+
+	if _, err = tun.WriteTo(make([]byte, DatagramMaxSize), &net.UDPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	if conn.sent != FragmentMaxCount || tun.packetsConsumedOut != 1 || tun.messagesConsumedOut != FragmentMaxCount {
+		t.Fatalf("each fragment should be charged, sent %d, consumed %d packets %d messages", conn.sent, tun.packetsConsumedOut, tun.messagesConsumedOut)
+	}
+}
+
+// countingConn counts sent messages, other methods of peer are not used
+type countingConn struct {
+	adnl.Peer
+	sent int
+}
+
+func (c *countingConn) SendCustomMessage(ctx context.Context, req tl.Serializable) error {
+	c.sent++
+	return nil
+}
+
+func TestProcessFragmentedPayload(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(nil)
+	keys, err := GenerateEncryptionKeys(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tun := &RegularOutTunnel{
+		payloadKeys: keys,
+		read:        make(chan DeliverUDPPayload, 10),
+		tunnelState: StateTypeOptimized,
+		fragments:   newFragmentBuffer(nil),
+		log:         zerolog.Nop(),
+	}
+
+	pl := DeliverUDPPayload{
+		Seqno:   1,
+		IP:      net.IPv4(1, 2, 3, 4).To4(),
+		Port:    1000,
+		Payload: make([]byte, 2000),
+	}
+	_, _ = rand.Read(pl.Payload)
+
+	data, err := tl.Serialize(pl, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fragments, err := splitPayload(1, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range fragments {
+		data, err = tl.Serialize(f, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err = encryptStream(keys.Mode, keys.CipherKeyCRC, keys.CipherKey, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = tun.Process(data, StateMeta{State: StateTypeOptimized}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if tun.packetsRecv != 1 || tun.messagesRecv != uint64(len(fragments)) {
+		t.Fatalf("unexpected counters, %d packets %d messages", tun.packetsRecv, tun.messagesRecv)
+	}
+
+	if p := <-tun.read; !bytes.Equal(p.Payload, pl.Payload) {
+		t.Fatal("reassembled packet is not equal to original")
+	}
+}
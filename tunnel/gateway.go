@@ -3,13 +3,13 @@ package tunnel
 import (
 	"context"
 	"crypto/ed25519"
-	"crypto/rand"
 	"encoding/base64"
-	"encoding/binary"
+	"errors"
 	"fmt"
 	"github.com/kevinms/leakybucket-go"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
+	"github.com/ton-blockchain/adnl-tunnel/config"
 	"github.com/ton-blockchain/adnl-tunnel/metrics"
 	"github.com/xssnick/ton-payment-network/pkg/payments"
 	"github.com/xssnick/ton-payment-network/tonpayments"
@@ -28,6 +28,11 @@ import (
 
 var crcTable = crc64.MakeTable(crc64.ECMA)
 
+var ErrSectionNotFound = errors.New("section not found")
+
+// SectionMaxInactiveSec is how long node keeps section without packets
+const SectionMaxInactiveSec = 120
+
 func init() {
 	tl.Register(Ping{}, "adnlTunnel.ping seqno:long = adnlTunnel.Ping")
 	tl.Register(Pong{}, "adnlTunnel.pong seqno:long = adnlTunnel.Pong")
@@ -53,14 +58,18 @@ type RouteTarget struct {
 }
 
 type Route struct {
-	ID            uint32
-	Target        unsafe.Pointer // *RouteTarget
-	PacketsRouted uint64
-	Section       *Section
+	ID             uint32
+	Target         unsafe.Pointer // *RouteTarget
+	PacketsRouted  uint64
+	PacketsDropped uint64
+	Section        *Section
 
 	PaymentReceived bool
 	PrepaidPackets  int64
 	rate            *leakybucket.LeakyBucket
+
+	// restricted route is a control route of exit-only node, always rate limited
+	restricted bool
 }
 
 type Out struct {
@@ -74,18 +83,41 @@ type Out struct {
 	InboundADNL         []byte
 	PayloadCipherKey    []byte
 	PayloadCipherKeyCRC uint64
+	cipherMode          CipherMode
 	InboundSectionKey   []byte
-	Instructions        []byte
 
-	PacketsSentOut uint64
-	PacketsSentIn  uint64
+	prevPayloadKey    []byte
+	prevPayloadKeyCRC uint64
+	prevKeyUntil      int64
+	keyUnused         int32
+
+	Instructions []byte
+
+	PacketsSentOut   uint64
+	PacketsSentIn    uint64
+	PacketsDroppedIn uint64
+
+	// messages are counted separately from packets, because single message can carry batch of packets
+	MessagesIn   uint64
+	MessagesBack uint64
 
 	PrepaidPacketsIn  int64
 	PrepaidPacketsOut int64
 
 	PricePerPacket *big.Int
 
-	backSeqno uint32
+	filter    unsafe.Pointer // *outFilter
+	batch     unsafe.Pointer // *batcher
+	padding   unsafe.Pointer // *PaddingPolicy
+	fragments *fragmentBuffer
+	contacted sync.Map // netip.AddrPort -> *int64
+	// contactedNum is a number of contacted addresses, it is limited by OutFilterMaxSources
+	contactedNum int64
+
+	lastRejectReportAt int64
+
+	backSeqno     uint32
+	fragmentSeqno uint64
 
 	mx  sync.RWMutex
 	log zerolog.Logger
@@ -121,20 +153,32 @@ type Section struct {
 	key          []byte
 	cipherKey    []byte
 	cipherKeyCrc uint64
+	cipherMode   uint32 // CipherMode
+	negotiated   uint32
 	routes       map[uint32]*Route
-	out          *Out
+
+	prevCipherKey    []byte
+	prevCipherKeyCrc uint64
+	prevKeyUntil     int64
+	keyUnused        int32
+
+	out     *Out
+	intro   *serviceIntro
+	session *rendezvousSession
 
 	cachedActions    []CachedAction
 	cachedActionsVer uint64
 
 	payments map[string]*PaymentChannel
+	restored *LedgerSectionRecord
 
 	seqno       SeqnoWindow
 	seqnoCached SeqnoWindow
 
-	lastOnceLogAt int64
-	log           zerolog.Logger
-	mx            sync.RWMutex
+	lastOnceLogAt     int64
+	lastStatsReportAt int64
+	log               zerolog.Logger
+	mx                sync.RWMutex
 }
 
 type Gateway struct {
@@ -151,6 +195,8 @@ type Gateway struct {
 
 	closerCtx context.Context
 	close     func()
+	// keepAliveWg is waited on stop, so ledger is not closed while it is being saved
+	keepAliveWg sync.WaitGroup
 
 	tunnels map[uint32]Tunnel
 
@@ -158,7 +204,33 @@ type Gateway struct {
 	statsSent     uint64
 	statsRouted   uint64
 
-	payments PaymentConfig
+	payments   PaymentConfig
+	exitPolicy unsafe.Pointer // *ExitPolicy
+
+	version          string
+	advertisePayment *config.TunnelSectionPayment
+
+	knownNodes map[string]*knownNode
+	knownMx    sync.Mutex
+
+	services     map[string]*serviceIntro
+	sessions     map[uint64]*rendezvousSession
+	rendezvousMx sync.RWMutex
+
+	sectionRate     *leakybucket.Collector
+	peerSectionRate *leakybucket.Collector
+	sectionAttempts uint64
+	sectionPoW      uint32
+	sectionPoWBase  uint32
+
+	nodesParams   map[string]nodeParams
+	nodesParamsMx sync.Mutex
+
+	routeJitterMax time.Duration
+	jitter         *jitterQueue
+
+	health   map[string]*nodeHealth
+	healthMx sync.Mutex
 
 	bufPool sync.Pool
 
@@ -191,16 +263,58 @@ type PaymentConfig struct {
 	Service                *tonpayments.Service
 	MinPricePerPacketRoute uint64
 	MinPricePerPacketInOut uint64
+
+	// Ledger is optional, when set, accepted payments and prepaid balances survive node restart
+	Ledger *PaymentLedger
+
+	// Budgets limits spending of client tunnels, nil = unlimited
+	Budgets *SpendBudgets
 }
 
-func NewGateway(gate *adnl.Gateway, dht *dht.Client, key ed25519.PrivateKey, logger zerolog.Logger, pay PaymentConfig) *Gateway {
+type GatewayOptions struct {
+	Payments PaymentConfig
+
+	// DisableRouting makes node exit-only, it will route only control messages of its out clients
+	DisableRouting bool
+	// DisableOut makes node relay-only, it will not bind out ports
+	DisableOut bool
+
+	// ExitPolicy restricts destinations of out packets, DefaultExitPolicy is used when nil
+	ExitPolicy *ExitPolicy
+
+	// Version of node software, published in node info
+	Version string
+	// AdvertisePayment is prices and payment chain published in node info, nil for free node
+	AdvertisePayment *config.TunnelSectionPayment
+
+	// SectionPoWBits is a min proof of work difficulty for new sections, 0 = required only under load
+	SectionPoWBits uint32
+
+	// RouteJitter is a max random delay added to routed payloads, 0 = disabled, limited by RouteJitterMax
+	RouteJitter time.Duration
+}
+
+func NewGateway(gate *adnl.Gateway, dht *dht.Client, key ed25519.PrivateKey, logger zerolog.Logger, opts GatewayOptions) *Gateway {
+	exitPolicy := opts.ExitPolicy
+	if exitPolicy == nil {
+		exitPolicy = DefaultExitPolicy()
+	}
+
+	if opts.SectionPoWBits > SectionPoWMaxBits {
+		opts.SectionPoWBits = SectionPoWMaxBits
+	}
+
+	if opts.RouteJitter > RouteJitterMax {
+		opts.RouteJitter = RouteJitterMax
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	g := &Gateway{
 		gate:             gate,
 		key:              key,
 		dht:              dht,
-		allowRouting:     true,
-		allowOut:         true,
+		allowRouting:     !opts.DisableRouting,
+		allowOut:         !opts.DisableOut,
 		paymentNode:      nil,
 		activePeers:      map[string]*Peer{},
 		signalCheckPeers: make(chan struct{}, 1),
@@ -208,8 +322,21 @@ func NewGateway(gate *adnl.Gateway, dht *dht.Client, key ed25519.PrivateKey, log
 		close:            cancel,
 		tunnels:          map[uint32]Tunnel{},
 		log:              logger,
-		payments:         pay,
+		payments:         opts.Payments,
 		inboundSections:  map[string]*Section{},
+		exitPolicy:       unsafe.Pointer(exitPolicy),
+		version:          opts.Version,
+		advertisePayment: opts.AdvertisePayment,
+		knownNodes:       map[string]*knownNode{},
+		services:         map[string]*serviceIntro{},
+		sessions:         map[uint64]*rendezvousSession{},
+		sectionRate:      newSectionRateCollector(),
+		peerSectionRate:  newPeerSectionRateCollector(),
+		sectionPoW:       opts.SectionPoWBits,
+		sectionPoWBase:   opts.SectionPoWBits,
+		nodesParams:      map[string]nodeParams{},
+		routeJitterMax:   opts.RouteJitter,
+		health:           map[string]*nodeHealth{},
 		bufPool: sync.Pool{
 			New: func() interface{} {
 				return make([]byte, 2048)
@@ -217,6 +344,11 @@ func NewGateway(gate *adnl.Gateway, dht *dht.Client, key ed25519.PrivateKey, log
 		},
 	}
 
+	if g.routeJitterMax > 0 {
+		g.jitter = newJitterQueue()
+		go g.jitter.loop(ctx)
+	}
+
 	if metrics.Registered {
 		go g.speedMetricsUpdater()
 	}
@@ -224,15 +356,63 @@ func NewGateway(gate *adnl.Gateway, dht *dht.Client, key ed25519.PrivateKey, log
 }
 
 type SectionStats struct {
-	Routed   uint64
-	Sent     uint64
-	Received uint64
+	Routed    uint64
+	Sent      uint64
+	Received  uint64
+	DroppedIn uint64
 
 	PrepaidPacketsRoute []int64
 	PrepaidPacketsIn    int64
 	PrepaidPacketsOut   int64
 }
 
+type PeerStats struct {
+	ID               []byte
+	Addr             string
+	Connected        bool
+	References       int64
+	LastPacketFromAt int64
+	LastPacketToAt   int64
+
+	// round trip time of keepalive pings, 0 when not measured yet
+	SRTTMs     float64
+	RTTVarMs   float64
+	MinRTTMs   float64
+	JitterMs   float64
+	PongLoss   float64
+	LastPongAt int64
+}
+
+type RouteStats struct {
+	ID               uint32
+	TargetADNL       []byte
+	TargetSectionKey []byte
+	PricePerPacket   uint64
+	PacketsRouted    uint64
+	PaymentReceived  bool
+	PrepaidPackets   int64
+}
+
+type OutStats struct {
+	Port              uint16
+	InboundADNL       []byte
+	PricePerPacket    uint64
+	PacketsSentOut    uint64
+	PacketsSentIn     uint64
+	PacketsDroppedIn  uint64
+	PrepaidPacketsIn  int64
+	PrepaidPacketsOut int64
+	ConnectedOnly     bool
+}
+
+type InboundSectionStats struct {
+	Key             []byte
+	LastPacketAt    int64
+	Routes          []RouteStats
+	Out             *OutStats
+	PaymentChannels int
+}
+
 func (g *Gateway) requestCheckPeers() {
 	select {
 	case g.signalCheckPeers <- struct{}{}:
@@ -261,10 +441,25 @@ func (g *Gateway) speedMetricsUpdater() {
 			routedPrev = routed
 			inPrev = in
 			outPrev = out
+
+			g.updatePeerMetrics()
 		}
 	}
 }
 
+func (g *Gateway) saveLedger() {
+	var list []*Section
+	g.mx.RLock()
+	for _, section := range g.inboundSections {
+		list = append(list, section)
+	}
+	g.mx.RUnlock()
+
+	for _, section := range list {
+		section.saveLedger()
+	}
+}
+
 func (g *Gateway) GetPacketsStats() map[string]*SectionStats {
 	tmp := map[string]*Section{}
 	res := map[string]*SectionStats{}
@@ -290,6 +485,7 @@ func (g *Gateway) GetPacketsStats() map[string]*SectionStats {
 		if section.out != nil {
 			stats.Sent = atomic.LoadUint64(&section.out.PacketsSentOut)
 			stats.Received = atomic.LoadUint64(&section.out.PacketsSentIn)
+			stats.DroppedIn = atomic.LoadUint64(&section.out.PacketsDroppedIn)
 			stats.PrepaidPacketsIn = atomic.LoadInt64(&section.out.PrepaidPacketsIn)
 			stats.PrepaidPacketsOut = atomic.LoadInt64(&section.out.PrepaidPacketsOut)
 		}
@@ -299,9 +495,120 @@ func (g *Gateway) GetPacketsStats() map[string]*SectionStats {
 	return res
 }
 
+func (g *Gateway) GetActivePeers() []PeerStats {
+	g.mx.RLock()
+	defer g.mx.RUnlock()
+
+	res := make([]PeerStats, 0, len(g.activePeers))
+	for _, peer := range g.activePeers {
+		rtt := peer.RTTStats()
+		res = append(res, PeerStats{
+			ID:               peer.id,
+			Addr:             peer.getAddr(),
+			Connected:        peer.getConn() != nil,
+			References:       atomic.LoadInt64(&peer.references),
+			LastPacketFromAt: atomic.LoadInt64(&peer.LastPacketFromAt),
+			LastPacketToAt:   atomic.LoadInt64(&peer.LastPacketToAt),
+			SRTTMs:           durationMs(rtt.SRTT),
+			RTTVarMs:         durationMs(rtt.RTTVar),
+			MinRTTMs:         durationMs(rtt.MinRTT),
+			JitterMs:         durationMs(rtt.Jitter),
+			PongLoss:         rtt.PongLoss,
+			LastPongAt:       rtt.LastPongAt,
+		})
+	}
+	return res
+}
+
+func (g *Gateway) GetInboundSections() []InboundSectionStats {
+	var list []*Section
+	g.mx.RLock()
+	for _, section := range g.inboundSections {
+		list = append(list, section)
+	}
+	g.mx.RUnlock()
+
+	res := make([]InboundSectionStats, 0, len(list))
+	for _, section := range list {
+		st := InboundSectionStats{
+			Key:          section.key,
+			LastPacketAt: atomic.LoadInt64(&section.lastPacketAt),
+		}
+
+		section.mx.RLock()
+		for _, route := range section.routes {
+			rs := RouteStats{
+				ID:              route.ID,
+				PacketsRouted:   atomic.LoadUint64(&route.PacketsRouted),
+				PaymentReceived: route.PaymentReceived,
+				PrepaidPackets:  atomic.LoadInt64(&route.PrepaidPackets),
+			}
+
+			if target := (*RouteTarget)(atomic.LoadPointer(&route.Target)); target != nil {
+				rs.TargetADNL = target.ADNL
+				rs.TargetSectionKey = target.SectionKey
+				rs.PricePerPacket = target.PricePerPacket
+			}
+			st.Routes = append(st.Routes, rs)
+		}
+
+		if out := section.out; out != nil {
+			outSt := &OutStats{
+				InboundADNL:       out.InboundADNL,
+				PacketsSentOut:    atomic.LoadUint64(&out.PacketsSentOut),
+				PacketsSentIn:     atomic.LoadUint64(&out.PacketsSentIn),
+				PacketsDroppedIn:  atomic.LoadUint64(&out.PacketsDroppedIn),
+				PrepaidPacketsIn:  atomic.LoadInt64(&out.PrepaidPacketsIn),
+				PrepaidPacketsOut: atomic.LoadInt64(&out.PrepaidPacketsOut),
+			}
+			if addr, ok := out.conn.LocalAddr().(*net.UDPAddr); ok {
+				outSt.Port = uint16(addr.Port)
+			}
+			if f := out.getFilter(); f != nil {
+				outSt.ConnectedOnly = f.cfg.ConnectedOnly
+			}
+			if out.PricePerPacket != nil {
+				outSt.PricePerPacket = out.PricePerPacket.Uint64()
+			}
+			st.Out = outSt
+		}
+		st.PaymentChannels = len(section.payments)
+		section.mx.RUnlock()
+
+		res = append(res, st)
+	}
+	return res
+}
+
+// CloseSection closes inbound section with its routes, out and payment channels
+func (g *Gateway) CloseSection(key []byte) error {
+	g.mx.Lock()
+	section := g.inboundSections[string(key)]
+	delete(g.inboundSections, string(key))
+	g.mx.Unlock()
+
+	if section == nil {
+		return ErrSectionNotFound
+	}
+
+	section.mx.Lock()
+	defer section.mx.Unlock()
+	section.close()
+
+	return nil
+}
+
 func (g *Gateway) Stop(ctx context.Context) error {
 	var err error
 	g.close()
+	g.keepAliveWg.Wait()
+
+	if g.payments.Ledger != nil {
+		g.saveLedger()
+		if lErr := g.payments.Ledger.Close(); lErr != nil {
+			g.log.Warn().Err(lErr).Msg("failed to close payments ledger")
+		}
+	}
 	if g.payments.Service != nil {
 		if err = g.payments.Service.CommitAllOurVirtualChannelsAndWait(ctx); err != nil {
 			err = fmt.Errorf("commit virtual channels error: %w", err)
@@ -351,6 +658,10 @@ func (g *Gateway) Start() error {
 
 					g.log.Debug().Msg("dht updated")
 
+					ctx, cancel = context.WithTimeout(g.closerCtx, 60*time.Second)
+					g.gossipRound(ctx, GossipPeersPerRound)
+					cancel()
+
 				} else {
 					g.log.Debug().Msg("skipping dht because no external address known")
 				}
@@ -360,18 +671,25 @@ func (g *Gateway) Start() error {
 		}
 	}()
 
-	go g.keepAlivePeersAndSections()
+	g.keepAliveWg.Add(1)
+	go func() {
+		defer g.keepAliveWg.Done()
+		g.keepAlivePeersAndSections()
+	}()
+	go g.admissionLoop()
 	<-g.closerCtx.Done()
 	return nil
 }
 
 func (g *Gateway) keepAlivePeersAndSections() {
-	const SectionMaxInactiveSec = 120
 	const PeerMaxInactiveSec = 10
 
+	const LedgerSaveEverySec = 10
+
 	ticker := time.NewTicker(1 * time.Second)
 	defer ticker.Stop()
 
+	var ledgerSavedAt int64
 	for {
 		select {
 		case <-g.closerCtx.Done():
@@ -380,6 +698,7 @@ func (g *Gateway) keepAlivePeersAndSections() {
 			tm := time.Now().Unix()
 			var sectionsToClose []*Section
 			var paymentsToClose []*PaymentChannel
+			var expiredChannels [][]byte
 
 			g.mx.RLock()
 			for _, peer := range g.activePeers {
@@ -413,10 +732,7 @@ func (g *Gateway) keepAlivePeersAndSections() {
 				if tm-peer.LastPingSentAt > 3 {
 					peer.LastPingSentAt = tm
 					g.log.Debug().Int64("refs", atomic.LoadInt64(&peer.references)).Str("id", base64.StdEncoding.EncodeToString(peer.id)).Msg("pinging peer")
-					err := peer.SendCustomMessage(context.Background(), Ping{
-						Seqno: atomic.AddUint64(&peer.pingSeqno, 1),
-					})
-					if err != nil {
+					if err := peer.sendPing(); err != nil {
 						continue
 					}
 				}
@@ -437,6 +753,7 @@ func (g *Gateway) keepAlivePeersAndSections() {
 								continue
 							}
 							delete(section.payments, k)
+							expiredChannels = append(expiredChannels, channel.Key)
 						}
 					}
 				}
@@ -455,6 +772,19 @@ func (g *Gateway) keepAlivePeersAndSections() {
 			for _, channel := range paymentsToClose {
 				_ = g.closePaymentChannel(channel)
 			}
+
+			if g.payments.Ledger != nil {
+				for _, key := range expiredChannels {
+					if err := g.payments.Ledger.DeleteChannel(key); err != nil {
+						g.log.Warn().Err(err).Msg("failed to delete expired channel from ledger")
+					}
+				}
+
+				if tm-ledgerSavedAt >= LedgerSaveEverySec {
+					ledgerSavedAt = tm
+					g.saveLedger()
+				}
+			}
 		}
 	}
 }
@@ -471,7 +801,18 @@ func (g *Gateway) messageHandler(peer *Peer) func(msg *adnl.MessageCustom) error
 			g.log.Trace().Str("peer", base64.StdEncoding.EncodeToString(peer.id)).Str("addr", peer.getAddr()).Msg("ping received")
 		case Pong:
 			atomic.StoreUint64(&peer.pongSeqno, m.Seqno)
+			peer.pongReceived(m.Seqno)
 			g.log.Trace().Str("peer", base64.StdEncoding.EncodeToString(peer.id)).Str("addr", peer.getAddr()).Msg("pong received")
+		case GetKnownNodes:
+			if err := g.answerKnownNodes(peer, m.Limit); err != nil {
+				return fmt.Errorf("send known nodes failed: %w", err)
+			}
+		case KnownNodes:
+			g.processKnownNodes(peer, m)
+		case SectionChallenge:
+			if err := g.processSectionChallenge(peer, m); err != nil {
+				return fmt.Errorf("process section challenge failed: %w", err)
+			}
 		case EncryptedMessageCached:
 			g.mx.RLock()
 			sec := g.inboundSections[string(m.SectionPubKey)]
@@ -502,13 +843,23 @@ func (g *Gateway) messageHandler(peer *Peer) func(msg *adnl.MessageCustom) error
 			sec := g.inboundSections[string(m.SectionPubKey)]
 			g.mx.RUnlock()
 
-			// TODO: random tunnel creation ddos protection
 			if sec == nil {
+				if err := g.admitSection(peer, m.SectionPubKey); err != nil {
+					return fmt.Errorf("section is not admitted: %w", err)
+				}
+
 				shKey, err := keys.SharedKey(g.key, m.SectionPubKey)
 				if err != nil {
 					return fmt.Errorf("shared key calc failed: %v", err)
 				}
 
+				var restored *LedgerSectionRecord
+				if g.payments.Ledger != nil {
+					if restored, err = g.payments.Ledger.GetSection(m.SectionPubKey); err != nil {
+						g.log.Warn().Err(err).Msg("failed to load section balances from ledger")
+					}
+				}
+
 				sec = &Section{
 					key:          m.SectionPubKey,
 					gw:           g,
@@ -516,13 +867,18 @@ func (g *Gateway) messageHandler(peer *Peer) func(msg *adnl.MessageCustom) error
 					cipherKeyCrc: crc64.Checksum(shKey, crcTable),
 					routes:       map[uint32]*Route{},
 					payments:     map[string]*PaymentChannel{},
+					restored:     restored,
 					lastPacketAt: time.Now().Unix(),
 					log: g.log.With().
 						Str("from_addr", peer.getConn().RemoteAddr()).
 						Str("from_adnl", base64.StdEncoding.EncodeToString(peer.id)).
 						Str("tunnel", base64.StdEncoding.EncodeToString(m.SectionPubKey)).Logger(),
 				}
-				sec.log.Info().Msg("inbound section created")
+				if restored != nil {
+					sec.log.Info().Msg("inbound section created, balances restored from ledger")
+				} else {
+					sec.log.Info().Msg("inbound section created")
+				}
 
 				g.mx.Lock()
 				g.inboundSections[string(m.SectionPubKey)] = sec
@@ -574,71 +930,64 @@ func (s *Section) logOnce() *zerolog.Event {
 	return e
 }
 
-func (s *Section) decryptMessage(m *EncryptedMessage) (*InstructionsContainer, []byte, error) {
-	data, err := decryptStream(s.cipherKeyCrc, s.cipherKey, m.Instructions)
-	if err != nil {
-		return nil, nil, fmt.Errorf("shared key calc failed: %v", err)
-	}
+// decrypt detects cipher mode on the first message, after that only this mode is accepted, to not allow downgrade
+func (s *Section) decrypt(data []byte) ([]byte, error) {
+	s.mx.RLock()
+	key, crc := s.cipherKey, s.cipherKeyCrc
+	prevKey, prevCrc := s.prevCipherKey, s.prevCipherKeyCrc
+	s.mx.RUnlock()
 
-	if len(data) < 12 {
-		return nil, nil, fmt.Errorf("corrupted instructions, len %d", len(data))
+	if until := atomic.LoadInt64(&s.prevKeyUntil); until != 0 && until < time.Now().Unix() {
+		prevKey = nil
 	}
 
-	var container = &InstructionsContainer{}
-	restInstructions, err := tl.Parse(container, data, true)
-	if err != nil {
-		return nil, nil, fmt.Errorf("parse instructions failed: %v", err)
-	}
-
-	return container, restInstructions, nil
-}
+	if atomic.LoadUint32(&s.negotiated) != 0 {
+		pl, usedPrev, err := decryptWithAlt(s.getCipherMode(), crc, key, prevCrc, prevKey, data)
+		if err != nil {
+			return nil, err
+		}
 
-func encryptStream(cipherKeyCrc uint64, cipherKey, data []byte) ([]byte, error) {
-	enc := make([]byte, 16+len(data))
+		if !usedPrev {
+			s.keyUsed()
+		}
+		return pl, nil
+	}
 
-	// we are using encrypted crc as part of iv to not let data bruteforce by 3rd party,
-	// and reduce message size in the same time
-	binary.LittleEndian.PutUint64(enc, crc64.Checksum(data, crcTable)^cipherKeyCrc)
-	if _, err := rand.Read(enc[8:16]); err != nil {
+	pl, mode, err := decryptStreamAny(crc, key, data)
+	if err != nil {
 		return nil, err
 	}
 
-	pl := enc[16:]
-	copy(pl, data)
-
-	// binary.LittleEndian.PutUint64(iv, checksum)
-	// binary.LittleEndian.PutUint64(iv[8:], crc64.Checksum(cipherKey, crcTable))
-
-	// we build cipher based on shared key of tunnel+node and checksum of decrypted packet
-	// checksum is needed here to randomize cipher to make it not repeatable if underlying data is similar
-	// checksum always changes because of underlying packet "random" field of InstructionsContainer changes
-	crypt, err := keys.NewCipherCtr(cipherKey, enc[:16])
-	if err != nil {
-		return nil, fmt.Errorf("new cipher calc failed: %v", err)
+	if atomic.CompareAndSwapUint32(&s.negotiated, 0, 1) {
+		atomic.StoreUint32(&s.cipherMode, uint32(mode))
+		s.log.Debug().Str("mode", mode.String()).Msg("section cipher negotiated")
+	} else if mode != s.getCipherMode() {
+		return nil, fmt.Errorf("cipher mode %s is not negotiated", mode)
 	}
-	crypt.XORKeyStream(pl, pl)
+	return pl, nil
+}
 
-	return enc, nil
+func (s *Section) getCipherMode() CipherMode {
+	return CipherMode(atomic.LoadUint32(&s.cipherMode))
 }
 
-func decryptStream(cipherKeyCrc uint64, cipherKey, data []byte) ([]byte, error) {
-	if len(data) <= 16 {
-		return nil, fmt.Errorf("corrupted data, len %d", len(data))
+func (s *Section) decryptMessage(m *EncryptedMessage) (*InstructionsContainer, []byte, error) {
+	data, err := s.decrypt(m.Instructions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decrypt instructions failed: %v", err)
 	}
-	pl := data[16:]
 
-	crypt, err := keys.NewCipherCtr(cipherKey, data[:16])
-	if err != nil {
-		return nil, fmt.Errorf("new cipher calc failed: %v", err)
+	if len(data) < 12 {
+		return nil, nil, fmt.Errorf("corrupted instructions, len %d", len(data))
 	}
-	crypt.XORKeyStream(pl, pl)
 
-	crc := crc64.Checksum(pl, crcTable) ^ cipherKeyCrc
-	if binary.LittleEndian.Uint64(data[:8]) != crc {
-		return nil, fmt.Errorf("corrupted data, checksum not match")
+	var container = &InstructionsContainer{}
+	restInstructions, err := tl.Parse(container, data, true)
+	if err != nil {
+		return nil, nil, fmt.Errorf("parse instructions failed: %v", err)
 	}
 
-	return pl, nil
+	return container, restInstructions, nil
 }
 
 func (g *Gateway) closePaymentChannel(ch *PaymentChannel) error {
@@ -670,6 +1019,12 @@ func (s *Section) closeIfNotLocked() bool {
 	}
 	defer s.mx.Unlock()
 
+	s.close()
+	return true
+}
+
+// close must be called under section lock
+func (s *Section) close() {
 	for _, ch := range s.payments {
 		_ = s.gw.closePaymentChannel(ch)
 	}
@@ -682,9 +1037,17 @@ func (s *Section) closeIfNotLocked() bool {
 		s.log.Debug().Msg("closing out port")
 		s.out.Close()
 	}
+
+	if s.intro != nil || s.session != nil {
+		s.closeRendezvous()
+	}
+
+	if l := s.gw.payments.Ledger; l != nil {
+		if err := l.DeleteSection(s.key); err != nil {
+			s.log.Warn().Err(err).Msg("failed to delete section from ledger")
+		}
+	}
 	s.log.Debug().Msg("section closed")
 
 	metrics.ActiveInboundSections.Dec()
-
-	return true
 }
@@ -0,0 +1,231 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"github.com/xssnick/tonutils-go/tl"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	tl.Register(GetKnownNodes{}, "adnlTunnel.getKnownNodes limit:int = adnlTunnel.GetKnownNodes")
+	tl.Register(KnownNodes{}, "adnlTunnel.knownNodes nodes:(vector int256) = adnlTunnel.KnownNodes")
+}
+
+const (
+	GossipMaxNodes      = 64
+	GossipPeersPerRound = 3
+
+	KnownNodesMax      = 2048
+	KnownNodeTTLSec    = 3600
+	GossipAnswerPerSec = 1
+)
+
+// GetKnownNodes asks peer for nodes it knows, answer is sent back as KnownNodes message
+type GetKnownNodes struct {
+	Limit uint32 `tl:"int"`
+}
+
+type KnownNodes struct {
+	Nodes [][]byte `tl:"vector int256"`
+}
+
+type knownNode struct {
+	// seenAt is when node was added, it is not extended when node is received again, so dead nodes expire
+	seenAt int64
+	// verifiedAt is when node was found in dht, or answered to us itself
+	verifiedAt int64
+}
+
+func (n *knownNode) expired(old int64) bool {
+	return n.seenAt < old && n.verifiedAt < old
+}
+
+// addKnownNodes remembers nodes found in dht or received from other nodes,
+// they are not trusted, node info is verified before using node.
+// Nodes are verified when they are from dht, when table is full, the oldest not verified node is replaced.
+func (g *Gateway) addKnownNodes(list []ed25519.PublicKey, verified bool) {
+	ourKey := g.key.Public().(ed25519.PublicKey)
+	now := time.Now().Unix()
+
+	g.knownMx.Lock()
+	defer g.knownMx.Unlock()
+
+	for _, key := range list {
+		if len(key) != ed25519.PublicKeySize || bytes.Equal(key, ourKey) {
+			continue
+		}
+
+		if n := g.knownNodes[string(key)]; n != nil {
+			if verified {
+				n.verifiedAt = now
+			}
+			continue
+		}
+
+		if len(g.knownNodes) >= KnownNodesMax && !g.evictUnverifiedKnownNode() {
+			continue
+		}
+
+		n := &knownNode{seenAt: now}
+		if verified {
+			n.verifiedAt = now
+		}
+		g.knownNodes[string(key)] = n
+	}
+}
+
+// verifyKnownNode marks node as alive, if we know it
+func (g *Gateway) verifyKnownNode(key ed25519.PublicKey) {
+	g.knownMx.Lock()
+	defer g.knownMx.Unlock()
+
+	if n := g.knownNodes[string(key)]; n != nil {
+		n.verifiedAt = time.Now().Unix()
+	}
+}
+
+// evictUnverifiedKnownNode removes the oldest node which was never verified, returns false when there is no such
+func (g *Gateway) evictUnverifiedKnownNode() bool {
+	var oldestKey string
+	var oldest *knownNode
+	for k, n := range g.knownNodes {
+		if n.verifiedAt == 0 && (oldest == nil || n.seenAt < oldest.seenAt) {
+			oldestKey, oldest = k, n
+		}
+	}
+
+	if oldest == nil {
+		return false
+	}
+	delete(g.knownNodes, oldestKey)
+	return true
+}
+
+// getKnownNodes returns up to limit random known nodes, 0 means all
+func (g *Gateway) getKnownNodes(limit int) []ed25519.PublicKey {
+	old := time.Now().Unix() - KnownNodeTTLSec
+
+	g.knownMx.Lock()
+	res := make([]ed25519.PublicKey, 0, len(g.knownNodes))
+	for k, n := range g.knownNodes {
+		if n.expired(old) {
+			delete(g.knownNodes, k)
+			continue
+		}
+		res = append(res, ed25519.PublicKey(k))
+	}
+	g.knownMx.Unlock()
+
+	if limit > 0 && len(res) > limit {
+		rand.Shuffle(len(res), func(i, j int) {
+			res[i], res[j] = res[j], res[i]
+		})
+		res = res[:limit]
+	}
+	return res
+}
+
+// gossipRound asks random known nodes for the nodes they know
+func (g *Gateway) gossipRound(ctx context.Context, peers int) {
+	var wg sync.WaitGroup
+	for _, key := range g.getKnownNodes(peers) {
+		wg.Add(1)
+		go func(key ed25519.PublicKey) {
+			defer wg.Done()
+
+			ctxGossip, cancel := context.WithTimeout(ctx, 15*time.Second)
+			defer cancel()
+
+			if err := g.gossipWith(ctxGossip, key); err != nil {
+				g.log.Debug().Err(err).Str("peer", base64.StdEncoding.EncodeToString(key)).Msg("gossip with node failed")
+			}
+		}(key)
+	}
+	wg.Wait()
+}
+
+func (g *Gateway) gossipWith(ctx context.Context, key ed25519.PublicKey) error {
+	id, err := tl.Hash(keys.PublicKeyED25519{Key: key})
+	if err != nil {
+		return fmt.Errorf("failed to calc node id: %w", err)
+	}
+
+	peer := g.addPeer(id, nil)
+	peer.AddReference()
+	defer peer.Dereference()
+
+	if err := peer.waitConnected(ctx); err != nil {
+		return err
+	}
+
+	atomic.StoreInt32(&peer.gossipRequested, 1)
+	if err := peer.SendCustomMessage(ctx, GetKnownNodes{
+		Limit: GossipMaxNodes,
+	}); err != nil {
+		return err
+	}
+
+	// answer is processed by message handler, we just keep peer alive for it
+	select {
+	case <-ctx.Done():
+	case <-time.After(3 * time.Second):
+	}
+
+	if atomic.CompareAndSwapInt32(&peer.gossipRequested, 1, 0) {
+		return fmt.Errorf("no answer")
+	}
+	// node answered, so it is alive
+	g.verifyKnownNode(key)
+	return nil
+}
+
+func (g *Gateway) answerKnownNodes(peer *Peer, limit uint32) error {
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&peer.lastGossipAnswerAt)
+	if now-last < GossipAnswerPerSec || !atomic.CompareAndSwapInt64(&peer.lastGossipAnswerAt, last, now) {
+		return nil
+	}
+
+	if limit == 0 || limit > GossipMaxNodes {
+		limit = GossipMaxNodes
+	}
+
+	var res KnownNodes
+	for _, key := range g.getKnownNodes(int(limit)) {
+		res.Nodes = append(res.Nodes, key)
+	}
+
+	// we are also a node, if we publish ourselves
+	if len(g.gate.GetAddressList().Addresses) > 0 && len(res.Nodes) < int(limit) {
+		res.Nodes = append(res.Nodes, g.key.Public().(ed25519.PublicKey))
+	}
+
+	return peer.SendCustomMessage(context.Background(), res)
+}
+
+func (g *Gateway) processKnownNodes(peer *Peer, m KnownNodes) {
+	// accept only requested answers, to not let anyone fill our list
+	if !atomic.CompareAndSwapInt32(&peer.gossipRequested, 1, 0) {
+		return
+	}
+
+	if len(m.Nodes) > GossipMaxNodes {
+		m.Nodes = m.Nodes[:GossipMaxNodes]
+	}
+
+	list := make([]ed25519.PublicKey, 0, len(m.Nodes))
+	for _, key := range m.Nodes {
+		list = append(list, key)
+	}
+
+	g.addKnownNodes(list, false)
+	g.log.Debug().Str("peer", base64.StdEncoding.EncodeToString(peer.id)).Int("nodes", len(m.Nodes)).Msg("known nodes received")
+}
@@ -0,0 +1,110 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"github.com/rs/zerolog"
+	"testing"
+	"time"
+)
+
+func TestKnownNodes(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	g := &Gateway{
+		key:        key,
+		knownNodes: map[string]*knownNode{},
+		log:        zerolog.Nop(),
+	}
+
+	var list []ed25519.PublicKey
+	for i := 0; i < 10; i++ {
+		pub, _, _ := ed25519.GenerateKey(nil)
+		list = append(list, pub)
+	}
+	// our own key and garbage should be ignored
+	list = append(list, key.Public().(ed25519.PublicKey), ed25519.PublicKey{1, 2, 3})
+
+	g.addKnownNodes(list, false)
+	if n := len(g.getKnownNodes(0)); n != 10 {
+		t.Fatalf("expected 10 known nodes, got %d", n)
+	}
+
+	if n := len(g.getKnownNodes(3)); n != 3 {
+		t.Fatalf("expected 3 random nodes, got %d", n)
+	}
+
+	// received again, but it is not extending life of node
+	g.knownNodes[string(list[0])].seenAt = time.Now().Unix() - KnownNodeTTLSec - 1
+	g.addKnownNodes(list[:1], false)
+	if n := len(g.getKnownNodes(0)); n != 9 {
+		t.Fatalf("expected expired node to be removed, got %d nodes", n)
+	}
+
+	// verified node is kept
+	g.knownNodes[string(list[1])].seenAt = time.Now().Unix() - KnownNodeTTLSec - 1
+	g.verifyKnownNode(list[1])
+	if n := len(g.getKnownNodes(0)); n != 9 {
+		t.Fatalf("expected verified node to be kept, got %d nodes", n)
+	}
+}
+
+func TestKnownNodesFull(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	g := &Gateway{
+		key:        key,
+		knownNodes: map[string]*knownNode{},
+		log:        zerolog.Nop(),
+	}
+
+	var list []ed25519.PublicKey
+	for i := 0; i < KnownNodesMax; i++ {
+		pub, _, _ := ed25519.GenerateKey(nil)
+		list = append(list, pub)
+	}
+	g.addKnownNodes(list[:KnownNodesMax/2], true)
+	g.addKnownNodes(list[KnownNodesMax/2:], false)
+	g.knownNodes[string(list[KnownNodesMax/2+1])].seenAt--
+
+	pub, _, _ := ed25519.GenerateKey(nil)
+	g.addKnownNodes([]ed25519.PublicKey{pub}, false)
+	if len(g.knownNodes) != KnownNodesMax || g.knownNodes[string(pub)] == nil {
+		t.Fatal("new node should replace unverified one")
+	}
+	if g.knownNodes[string(list[KnownNodesMax/2+1])] != nil {
+		t.Fatal("the oldest unverified node should be replaced")
+	}
+
+	// only verified are left
+	g.knownNodes = map[string]*knownNode{}
+	g.addKnownNodes(list, true)
+	g.addKnownNodes([]ed25519.PublicKey{pub}, false)
+	if g.knownNodes[string(pub)] != nil {
+		t.Fatal("verified nodes should not be replaced")
+	}
+}
+
+func TestKnownNodesUnsolicited(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+	g := &Gateway{
+		key:        key,
+		knownNodes: map[string]*knownNode{},
+		log:        zerolog.Nop(),
+	}
+
+	peerKey, _, _ := ed25519.GenerateKey(nil)
+	node, _, _ := ed25519.GenerateKey(nil)
+	p := &Peer{id: peerKey, gw: g}
+
+	g.processKnownNodes(p, KnownNodes{Nodes: [][]byte{node}})
+	if n := len(g.getKnownNodes(0)); n != 0 {
+		t.Fatalf("unsolicited answer should be ignored, got %d nodes", n)
+	}
+
+	p.gossipRequested = 1
+	g.processKnownNodes(p, KnownNodes{Nodes: [][]byte{node}})
+	if n := len(g.getKnownNodes(0)); n != 1 {
+		t.Fatalf("expected node to be known, got %d nodes", n)
+	}
+	if g.knownNodes[string(node)].verifiedAt != 0 {
+		t.Fatal("node from gossip should not be verified")
+	}
+}
@@ -0,0 +1,213 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// DefaultEntryGuardsNum is how many entry guards client keeps, when it is not set in config
+const DefaultEntryGuardsNum = 3
+
+// EntryGuardLifetime is how long guard is used, after that it is replaced with a new random one
+var EntryGuardLifetime = 60 * 24 * time.Hour
+
+// EntryGuardMaxFailureTime is how long guard can fail continuously before it is replaced
+var EntryGuardMaxFailureTime = 24 * time.Hour
+
+// EntryGuard is a node which can be the first hop of client routes, only guards know client ip
+type EntryGuard struct {
+	Key       []byte
+	AddedAt   int64
+	ExpiresAt int64
+	// FailingSince is a time of the first failed route through guard after the last successful one, 0 = ok
+	FailingSince int64 `json:",omitempty"`
+	// MissingSince is a time when guard disappeared from pool or stopped to fit, 0 = present
+	MissingSince int64 `json:",omitempty"`
+}
+
+// EntryGuards is a small persistent set of first hops, so not every relay of the pool learns client ip over time
+type EntryGuards struct {
+	Guards []EntryGuard
+
+	path string
+	mx   sync.Mutex
+}
+
+// LoadEntryGuards reads guards from file, when path is empty, guards are kept only in memory
+func LoadEntryGuards(path string) (*EntryGuards, error) {
+	g := &EntryGuards{path: path}
+	if path == "" {
+		return g, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return g, nil
+		}
+		return nil, fmt.Errorf("failed to read guards file: %w", err)
+	}
+
+	if err = json.Unmarshal(data, g); err != nil {
+		return nil, fmt.Errorf("failed to parse guards file: %w", err)
+	}
+	return g, nil
+}
+
+// save must be called under lock
+func (g *EntryGuards) save() error {
+	if g.path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(g, "", "\t")
+	if err != nil {
+		return fmt.Errorf("failed to serialize guards: %w", err)
+	}
+
+	tmp := g.path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write guards file: %w", err)
+	}
+
+	if err = os.Rename(tmp, g.path); err != nil {
+		return fmt.Errorf("failed to replace guards file: %w", err)
+	}
+	return nil
+}
+
+// Select removes expired, long failing and long missing guards, adds new random ones from pool nodes which fit,
+// to have num guards, and returns keys of guards which can be used now.
+// Set is never bigger than num, so failures of guards do not expose client to more relays.
+func (g *EntryGuards) Select(pool []config.TunnelRouteSection, fit func(node *config.TunnelRouteSection) bool, num int) ([][]byte, error) {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	now := time.Now()
+	changed := false
+
+	inPool := func(key []byte) *config.TunnelRouteSection {
+		for i := range pool {
+			if bytes.Equal(pool[i].Key, key) && fit(&pool[i]) {
+				return &pool[i]
+			}
+		}
+		return nil
+	}
+
+	var res [][]byte
+	var guards []EntryGuard
+	var dropped [][]byte
+	for _, guard := range g.Guards {
+		present := inPool(guard.Key) != nil
+		if present && guard.MissingSince != 0 {
+			guard.MissingSince = 0
+			changed = true
+		} else if !present && guard.MissingSince == 0 {
+			// not in pool now, but may appear later, it is replaced only when missing for a long time
+			guard.MissingSince = now.Unix()
+			changed = true
+		}
+
+		if guard.ExpiresAt < now.Unix() || len(guards) >= num ||
+			(guard.FailingSince != 0 && guard.FailingSince < now.Add(-EntryGuardMaxFailureTime).Unix()) ||
+			(guard.MissingSince != 0 && guard.MissingSince < now.Add(-EntryGuardMaxFailureTime).Unix()) {
+			dropped = append(dropped, guard.Key)
+			changed = true
+			continue
+		}
+
+		guards = append(guards, guard)
+		if present {
+			res = append(res, guard.Key)
+		}
+	}
+	g.Guards = guards
+
+	for len(g.Guards) < num {
+		var candidates []*config.TunnelRouteSection
+		for i := range pool {
+			if !fit(&pool[i]) || g.has(pool[i].Key) || isGuard(dropped, pool[i].Key) {
+				continue
+			}
+			candidates = append(candidates, &pool[i])
+		}
+
+		if len(candidates) == 0 {
+			break
+		}
+
+		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(candidates))))
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate random number: %w", err)
+		}
+		node := candidates[idx.Int64()]
+
+		g.Guards = append(g.Guards, EntryGuard{
+			Key:       node.Key,
+			AddedAt:   now.Unix(),
+			ExpiresAt: now.Add(EntryGuardLifetime).Unix(),
+		})
+		res = append(res, node.Key)
+		changed = true
+	}
+
+	if changed {
+		if err := g.save(); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// has must be called under lock
+func (g *EntryGuards) has(key []byte) bool {
+	for _, guard := range g.Guards {
+		if bytes.Equal(guard.Key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// Report marks result of route through guard, guard is replaced only when it is failing for a long time
+func (g *EntryGuards) Report(key []byte, ok bool) error {
+	g.mx.Lock()
+	defer g.mx.Unlock()
+
+	for i := range g.Guards {
+		if !bytes.Equal(g.Guards[i].Key, key) {
+			continue
+		}
+
+		if ok == (g.Guards[i].FailingSince == 0) {
+			// state is not changed
+			return nil
+		}
+
+		if ok {
+			g.Guards[i].FailingSince = 0
+		} else {
+			g.Guards[i].FailingSince = time.Now().Unix()
+		}
+		return g.save()
+	}
+	return nil
+}
+
+func isGuard(guards [][]byte, key []byte) bool {
+	for _, k := range guards {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testPool(num int) []config.TunnelRouteSection {
+	var nodes []config.TunnelRouteSection
+	for i := 0; i < num; i++ {
+		pub, _, _ := ed25519.GenerateKey(nil)
+		nodes = append(nodes, config.TunnelRouteSection{Key: pub})
+	}
+	return nodes
+}
+
+func TestEntryGuardsSelect(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "guards.json")
+	nodes := testPool(10)
+	fit := func(node *config.TunnelRouteSection) bool { return true }
+
+	g, err := LoadEntryGuards(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := g.Select(nodes, fit, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 {
+		t.Fatal("3 guards should be selected")
+	}
+
+	// guards are persistent
+	g, err = LoadEntryGuards(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys2, err := g.Select(nodes, fit, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range keys {
+		if !bytes.Equal(keys[i], keys2[i]) {
+			t.Fatal("guards should be kept after reload")
+		}
+	}
+
+	// short failure does not rotate guard
+	if err = g.Report(keys[0], false); err != nil {
+		t.Fatal(err)
+	}
+	if keys2, _ = g.Select(nodes, fit, 3); !isGuard(keys2, keys[0]) {
+		t.Fatal("recently failed guard should be kept")
+	}
+
+	// long failure and expiration rotate guards
+	g.Guards[0].FailingSince = time.Now().Add(-EntryGuardMaxFailureTime - time.Minute).Unix()
+	g.Guards[1].ExpiresAt = time.Now().Add(-time.Minute).Unix()
+	if keys2, _ = g.Select(nodes, fit, 3); isGuard(keys2, keys[0]) || isGuard(keys2, keys[1]) || !isGuard(keys2, keys[2]) {
+		t.Fatal("only failing and expired guards should be replaced")
+	}
+	if len(keys2) != 3 {
+		t.Fatal("guards should be refilled")
+	}
+
+	// when all guards are failing, set is not extended
+	for _, k := range keys2 {
+		_ = g.Report(k, false)
+	}
+	if keys2, _ = g.Select(nodes, fit, 3); len(keys2) != 3 || len(g.Guards) != 3 {
+		t.Fatal("guards set should be capped")
+	}
+
+	// guard missing in pool is kept for a while, and then replaced
+	var pool []config.TunnelRouteSection
+	for i := range nodes {
+		if !bytes.Equal(nodes[i].Key, keys2[0]) {
+			pool = append(pool, nodes[i])
+		}
+	}
+	if keys3, _ := g.Select(pool, fit, 3); len(keys3) != 2 || len(g.Guards) != 3 {
+		t.Fatal("missing guard should be kept, but not used")
+	}
+	g.Guards[0].MissingSince = time.Now().Add(-EntryGuardMaxFailureTime - time.Minute).Unix()
+	if keys3, _ := g.Select(pool, fit, 3); len(keys3) != 3 || isGuard(keys3, keys2[0]) {
+		t.Fatal("long missing guard should be replaced")
+	}
+}
+
+func TestPickRouteEntryGuard(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _ := newTestGateway(t, ctx)
+	nodes := testPool(6)
+	guards := [][]byte{nodes[1].Key}
+
+	cfg := &config.ClientConfig{TunnelSectionsNum: 3}
+	attempts := map[string]bool{}
+	for i := 0; i < 5; i++ {
+		c, err, _ := pickRoute(cfg, g, nodes, nil, guards, attempts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !isGuard(guards, c.chainTo[0].Keys.ReceiverPubKey) || !isGuard(guards, c.chainFrom[len(c.chainFrom)-2].Keys.ReceiverPubKey) {
+			t.Fatal("first hop should be entry guard")
+		}
+		if isGuard(guards, c.chainTo[len(c.chainTo)-1].Keys.ReceiverPubKey) {
+			t.Fatal("entry guard should not be out gate when others can")
+		}
+	}
+
+	cfg = &config.ClientConfig{TunnelSectionsNum: 1}
+	c, err, _ := pickRoute(cfg, g, nodes, nil, guards, map[string]bool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isGuard(guards, c.chainTo[0].Keys.ReceiverPubKey) {
+		t.Fatal("single section out gate should be entry guard")
+	}
+}
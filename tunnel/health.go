@@ -0,0 +1,205 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"github.com/xssnick/tonutils-go/tl"
+	"math"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// HealthDeadAfter is how long node should not answer, to be skipped in routes
+var HealthDeadAfter = 30 * time.Second
+
+// HealthProbeSample is how many random pool nodes are probed besides the first hops of the current route,
+// when pool probing is enabled, so big pool is not pinged as a whole on every keepalive
+var HealthProbeSample = 32
+
+// healthDefaultRTT is used to weight nodes which were not measured yet
+const healthDefaultRTT = 150 * time.Millisecond
+
+// NodeHealth is a result of probing of pool node
+type NodeHealth struct {
+	Key ed25519.PublicKey
+	// Resolved is true when node address is found in dht and connection is registered
+	Resolved bool
+	// RTT is a smoothed round trip time of pings, 0 when not measured yet
+	RTT time.Duration
+	// Loss is a smoothed part of lost pings, from 0 to 1
+	Loss       float64
+	LastSeenAt int64
+	// Dead is true when node not answers for HealthDeadAfter
+	Dead bool
+}
+
+type nodeHealth struct {
+	key          ed25519.PublicKey
+	peer         *Peer
+	probingSince time.Time
+}
+
+func (h *nodeHealth) stats(now time.Time) NodeHealth {
+	rtt := h.peer.RTTStats()
+
+	since := h.probingSince
+	if seen := time.Unix(rtt.LastPongAt, 0); seen.After(since) {
+		since = seen
+	}
+
+	return NodeHealth{
+		Key:        h.key,
+		Resolved:   h.peer.getConn() != nil,
+		RTT:        rtt.SRTT,
+		Loss:       rtt.PongLoss,
+		LastSeenAt: rtt.LastPongAt,
+		Dead:       now.Sub(since) > HealthDeadAfter,
+	}
+}
+
+// ProbeNodes sets pool nodes to be probed, their peers are kept connected and pinged by gateway,
+// health is used in route selection. Nodes which are not in the list anymore are not probed.
+func (g *Gateway) ProbeNodes(nodes []ed25519.PublicKey) {
+	g.healthMx.Lock()
+	defer g.healthMx.Unlock()
+
+	keep := map[string]bool{}
+	for _, key := range nodes {
+		keep[string(key)] = true
+		if g.health[string(key)] != nil {
+			continue
+		}
+
+		id, err := tl.Hash(keys.PublicKeyED25519{Key: key})
+		if err != nil {
+			continue
+		}
+
+		peer := g.addPeer(id, nil)
+		// referenced peer is kept, rediscovered and pinged by gateway
+		peer.AddReference()
+
+		g.health[string(key)] = &nodeHealth{
+			key:          key,
+			peer:         peer,
+			probingSince: time.Now(),
+		}
+	}
+
+	for key, h := range g.health {
+		if !keep[key] {
+			delete(g.health, key)
+			h.peer.Dereference()
+		}
+	}
+}
+
+// NodesHealth returns health of probed pool nodes, gateway is passed to embedding application with GatewayStartedEvent
+func (g *Gateway) NodesHealth() []NodeHealth {
+	g.healthMx.Lock()
+	defer g.healthMx.Unlock()
+
+	now := time.Now()
+	res := make([]NodeHealth, 0, len(g.health))
+	for _, h := range g.health {
+		res = append(res, h.stats(now))
+	}
+
+	sort.Slice(res, func(i, j int) bool {
+		return string(res[i].Key) < string(res[j].Key)
+	})
+	return res
+}
+
+// probeKeys returns the first hops of the route, which are connected directly anyway, and random sample of other pool nodes.
+// Other nodes of the route are never in the sample, they should not see our ip.
+func probeKeys(nodes []config.TunnelRouteSection, direct, route []ed25519.PublicKey, sample int) []ed25519.PublicKey {
+	res := append([]ed25519.PublicKey{}, direct...)
+	skip := map[string]bool{}
+	for _, key := range direct {
+		skip[string(key)] = true
+	}
+	for _, key := range route {
+		skip[string(key)] = true
+	}
+
+	for _, i := range rand.Perm(len(nodes)) {
+		if len(res)-len(direct) >= sample {
+			break
+		}
+
+		if !skip[string(nodes[i].Key)] {
+			res = append(res, nodes[i].Key)
+		}
+	}
+	return res
+}
+
+// directNodeKeys returns keys of nodes which we are connected to directly, the first hops in both directions
+func (t *RegularOutTunnel) directNodeKeys() []ed25519.PublicKey {
+	res := []ed25519.PublicKey{t.chainTo[0].Keys.ReceiverPubKey}
+	if len(t.chainFrom) > 1 {
+		if key := t.chainFrom[len(t.chainFrom)-2].Keys.ReceiverPubKey; !bytes.Equal(key, res[0]) {
+			res = append(res, key)
+		}
+	}
+	return res
+}
+
+// routeNodeKeys returns keys of all nodes of tunnel, except us
+func (t *RegularOutTunnel) routeNodeKeys() []ed25519.PublicKey {
+	var res []ed25519.PublicKey
+	for _, node := range t.chainTo {
+		res = append(res, node.Keys.ReceiverPubKey)
+	}
+	for _, node := range t.chainFrom[:len(t.chainFrom)-1] {
+		res = append(res, node.Keys.ReceiverPubKey)
+	}
+	return res
+}
+
+// aliveNodes filters out nodes which are known to be dead, all nodes are returned when not enough are alive
+func (g *Gateway) aliveNodes(nodes []config.TunnelRouteSection, min uint) []config.TunnelRouteSection {
+	g.healthMx.Lock()
+	defer g.healthMx.Unlock()
+
+	now := time.Now()
+	var res []config.TunnelRouteSection
+	for i := range nodes {
+		if h := g.health[string(nodes[i].Key)]; h != nil && h.stats(now).Dead {
+			continue
+		}
+		res = append(res, nodes[i])
+	}
+
+	if uint(len(res)) < min {
+		return nodes
+	}
+	return res
+}
+
+// latencyShuffle randomly orders nodes, nodes with lower rtt are more likely to be first
+func (g *Gateway) latencyShuffle(rnd *rand.Rand, nodes []config.TunnelRouteSection) {
+	scores := map[string]float64{}
+
+	g.healthMx.Lock()
+	for i := range nodes {
+		rtt := healthDefaultRTT
+		if h := g.health[string(nodes[i].Key)]; h != nil {
+			if st := h.peer.RTTStats(); st.SRTT > 0 {
+				rtt = st.SRTT
+			}
+		}
+
+		// weighted random order, weight is 1/rtt: key = u^(1/weight), larger is first
+		scores[string(nodes[i].Key)] = math.Log(1-rnd.Float64()) * float64(rtt.Milliseconds()+1)
+	}
+	g.healthMx.Unlock()
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return scores[string(nodes[i].Key)] > scores[string(nodes[j].Key)]
+	})
+}
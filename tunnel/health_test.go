@@ -0,0 +1,102 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestNodesHealth(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, peer := newTestGateway(t, ctx)
+
+	var nodes []config.TunnelRouteSection
+	var keys []ed25519.PublicKey
+	for i := 0; i < 3; i++ {
+		pub, _, _ := ed25519.GenerateKey(nil)
+		peer(pub)
+		keys = append(keys, pub)
+		nodes = append(nodes, config.TunnelRouteSection{Key: pub})
+	}
+	g.ProbeNodes(keys)
+
+	fast, dead, slow := g.health[string(keys[0])], g.health[string(keys[1])], g.health[string(keys[2])]
+
+	fast.peer.rtt.pings = map[uint64]time.Time{10: time.Now().Add(-20 * time.Millisecond)}
+	fast.peer.pongReceived(10)
+	if st := fast.stats(time.Now()); st.RTT < 20*time.Millisecond || st.LastSeenAt == 0 {
+		t.Fatal("pong should be recorded", st.RTT)
+	}
+
+	slow.peer.rtt.srtt = time.Second
+	dead.probingSince = time.Now().Add(-HealthDeadAfter - time.Second)
+
+	for _, h := range g.NodesHealth() {
+		if h.Dead != (string(h.Key) == string(keys[1])) {
+			t.Fatal("unexpected dead state")
+		}
+	}
+
+	if alive := g.aliveNodes(nodes, 2); len(alive) != 2 {
+		t.Fatal("dead node should be skipped")
+	}
+	if alive := g.aliveNodes(nodes, 3); len(alive) != 3 {
+		t.Fatal("all nodes should be used when not enough alive")
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	var fastFirst int
+	for i := 0; i < 1000; i++ {
+		list := []config.TunnelRouteSection{nodes[2], nodes[0]}
+		g.latencyShuffle(rnd, list)
+		if string(list[0].Key) == string(keys[0]) {
+			fastFirst++
+		}
+	}
+	if fastFirst < 900 {
+		t.Fatal("node with lower rtt should be preferred", fastFirst)
+	}
+
+	g.ProbeNodes(keys[:1])
+	if len(g.NodesHealth()) != 1 {
+		t.Fatal("removed nodes should not be probed")
+	}
+}
+
+func TestProbeKeys(t *testing.T) {
+	nodes := testPool(100)
+	direct := []ed25519.PublicKey{nodes[3].Key}
+	route := []ed25519.PublicKey{nodes[3].Key, nodes[4].Key, nodes[50].Key}
+
+	keys := probeKeys(nodes, direct, route, 10)
+	if len(keys) != 11 {
+		t.Fatal("first hop and sample should be probed, got", len(keys))
+	}
+
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if seen[string(k)] {
+			t.Fatal("node should be probed once")
+		}
+		seen[string(k)] = true
+	}
+	if !seen[string(direct[0])] {
+		t.Fatal("first hop should be always probed")
+	}
+	if seen[string(route[1])] || seen[string(route[2])] {
+		t.Fatal("other route nodes should not be probed")
+	}
+
+	if keys = probeKeys(nodes[:6], direct, route, 10); len(keys) != 5 {
+		t.Fatal("small pool should be probed as a whole, except route, got", len(keys))
+	}
+
+	if keys = probeKeys(nodes, direct, route, 0); len(keys) != 1 {
+		t.Fatal("only first hop should be probed when pool probing is disabled, got", len(keys))
+	}
+}
@@ -49,9 +49,7 @@ func init() {
 	instructionOpcodes[tl.Register(BuildRouteInstruction{}, "adnlTunnel.buildRouteInstruction targetADNL:int256 targetSectionPubKey:int256 routeId:int = adnlTunnel.Instruction")] = reflect.TypeOf(BuildRouteInstruction{})
 	instructionOpcodes[tl.Register(PaymentInstruction{}, "adnlTunnel.paymentInstruction paymentChannelState:bytes = adnlTunnel.Instruction")] = reflect.TypeOf(PaymentInstruction{})
 	instructionOpcodes[tl.Register(BindOutInstruction{}, "adnlTunnel.bindOutInstruction inboundNodeADNL:int256 inboundSectionPubKey:int256 inboundInstructions:bytes receiverPubKey:int256 = adnlTunnel.Instruction")] = reflect.TypeOf(BindOutInstruction{})
-	instructionOpcodes[tl.Register(ReportStatsInstruction{}, "adnlTunnel.reportStatsInstruction inboundNodeADNL:int256 inboundSectionPubKey:int256 inboundInstructions:bytes receiverPubKey:int256 = adnlTunnel.Instruction")] = reflect.TypeOf(ReportStatsInstruction{})
 	instructionOpcodes[tl.Register(SendOutInstruction{}, "adnlTunnel.sendOutInstruction = adnlTunnel.Instruction")] = reflect.TypeOf(SendOutInstruction{})
-	instructionOpcodes[tl.Register(DeliverInstruction{}, "adnlTunnel.deliverInstruction = adnlTunnel.Instruction")] = reflect.TypeOf(DeliverInstruction{})
 	instructionOpcodes[tl.Register(DeliverInitiatorInstruction{}, "adnlTunnel.deliverInitiatorInstruction from:int metadata:bytes = adnlTunnel.Instruction")] = reflect.TypeOf(DeliverInitiatorInstruction{})
 }
 
@@ -231,6 +229,10 @@ func (ins CacheInstruction) Execute(ctx context.Context, s *Section, msg *Encryp
 			})
 		case *SendOutInstruction:
 			list = append(list, &SendOutCachedAction{})
+		case *DeliverInstruction:
+			list = append(list, &DeliverCachedAction{})
+		case *ServiceReplyInstruction:
+			list = append(list, &ServiceReplyCachedAction{})
 		case *RouteInstruction:
 			s.mx.RLock()
 			route := s.routes[v.RouteID]
@@ -272,6 +274,18 @@ type BuildRouteInstruction struct {
 	PricePerPacket      uint64 `tl:"long"`
 }
 
+// isOutInbound checks that target is inbound route of the out bound to section, must be called under section lock
+func (s *Section) isOutInbound(adnlID, sectionKey []byte) bool {
+	if s.out == nil {
+		return false
+	}
+
+	s.out.mx.RLock()
+	defer s.out.mx.RUnlock()
+
+	return bytes.Equal(s.out.InboundADNL, adnlID) && bytes.Equal(s.out.InboundSectionKey, sectionKey)
+}
+
 const FreePacketsMaxPS = 10
 const FreePacketsMaxPSBurst = FreePacketsMaxPS * 2
 const MaxActiveRoutesPerSection = 3
@@ -280,7 +294,9 @@ func (ins BuildRouteInstruction) Execute(ctx context.Context, s *Section, msg *E
 	s.mx.Lock()
 	defer s.mx.Unlock()
 
-	if !s.gw.allowRouting {
+	// exit-only node routes only control messages back to the client of its out
+	restricted := !s.gw.allowRouting
+	if restricted && (!s.gw.allowOut || ins.RouteID != ^binary.LittleEndian.Uint32(ins.TargetSectionPubKey) || !s.isOutInbound(ins.TargetADNL, ins.TargetSectionPubKey)) {
 		return fmt.Errorf("instruction is not executable since routing is not allowed")
 	}
 
@@ -302,12 +318,24 @@ func (ins BuildRouteInstruction) Execute(ctx context.Context, s *Section, msg *E
 		}
 
 		route = &Route{
-			ID:      ins.RouteID,
-			Target:  unsafe.Pointer(target),
-			Section: s,
+			ID:         ins.RouteID,
+			Target:     unsafe.Pointer(target),
+			Section:    s,
+			restricted: restricted,
 			// we need some free capacity to configure route, and not create payment channels for not working tunnels
 			rate: leakybucket.NewLeakyBucket(FreePacketsMaxPS, FreePacketsMaxPSBurst),
 		}
+
+		if s.restored != nil {
+			if balance, ok := s.restored.Routes[ins.RouteID]; ok {
+				route.PaymentReceived = balance.PaymentReceived
+				route.PrepaidPackets = balance.PrepaidPackets
+				delete(s.restored.Routes, ins.RouteID)
+
+				s.log.Info().Uint32("id", ins.RouteID).Int64("balance", balance.PrepaidPackets).Msg("route balance restored from ledger")
+			}
+		}
+
 		target.Peer.AddReference()
 		s.routes[ins.RouteID] = route
 
@@ -371,6 +399,11 @@ func (r *Route) Close() {
 func (r *Route) Route(ctx context.Context, payload []byte, cached bool, instructions []byte, seqno uint32) error {
 	target := (*RouteTarget)(atomic.LoadPointer(&r.Target))
 
+	if r.restricted && r.rate.Add(1) <= 0 {
+		atomic.AddUint64(&r.PacketsDropped, 1)
+		return fmt.Errorf("packets exceeds rate limit for restricted route %d", r.ID)
+	}
+
 	var paid bool
 	if target.PricePerPacket > 0 {
 		if r.PaymentReceived {
@@ -382,17 +415,34 @@ func (r *Route) Route(ctx context.Context, payload []byte, cached bool, instruct
 		}
 
 		if !paid && r.rate.Add(1) <= 0 {
+			atomic.AddUint64(&r.PacketsDropped, 1)
 			return fmt.Errorf("free packets exceeds rate limit for route %d", r.ID)
 		}
 	}
 
-	var msg any
+	var msg tl.Serializable
 	if cached {
 		msg = EncryptedMessageCached{
 			SectionPubKey: target.SectionKey,
 			Seqno:         seqno,
 			Payload:       payload,
 		}
+
+		if d := r.Section.gw.routeJitter(); d > 0 {
+			// payload is copied, because buffer of incoming message is not owned by us after return
+			msg = EncryptedMessageCached{
+				SectionPubKey: target.SectionKey,
+				Seqno:         seqno,
+				Payload:       append([]byte{}, payload...),
+			}
+
+			r.Section.gw.jitter.add(d, func() {
+				if err := r.send(r.Section.gw.closerCtx, target, msg, paid); err != nil {
+					r.Section.log.Trace().Err(err).Msg("delayed route failed")
+				}
+			})
+			return nil
+		}
 	} else {
 		msg = EncryptedMessage{
 			SectionPubKey: target.SectionKey,
@@ -401,11 +451,16 @@ func (r *Route) Route(ctx context.Context, payload []byte, cached bool, instruct
 		}
 	}
 
+	return r.send(ctx, target, msg, paid)
+}
+
+func (r *Route) send(ctx context.Context, target *RouteTarget, msg tl.Serializable, paid bool) error {
 	if err := target.Peer.SendCustomMessage(ctx, msg); err != nil {
 		if paid {
 			// refund packet
 			atomic.AddInt64(&r.PrepaidPackets, 1)
 		}
+		atomic.AddUint64(&r.PacketsDropped, 1)
 		return fmt.Errorf("route message failed: %w", err)
 	}
 	atomic.AddUint64(&r.PacketsRouted, 1)
@@ -415,7 +470,7 @@ func (r *Route) Route(ctx context.Context, payload []byte, cached bool, instruct
 }
 
 func (a *RouteCachedAction) Execute(ctx context.Context, s *Section, msg *EncryptedMessageCached) error {
-	if !s.gw.allowRouting {
+	if !s.gw.allowRouting && !a.Route.restricted {
 		return fmt.Errorf("instruction is not executable since routing is not allowed")
 	}
 
@@ -428,10 +483,6 @@ type RouteInstruction struct {
 }
 
 func (ins RouteInstruction) Execute(ctx context.Context, s *Section, msg *EncryptedMessage, restInstructions []byte) error {
-	if !s.gw.allowRouting {
-		return fmt.Errorf("instruction is not executable since routing is not allowed")
-	}
-
 	s.mx.RLock()
 	route := s.routes[ins.RouteID]
 	s.mx.RUnlock()
@@ -440,6 +491,10 @@ func (ins RouteInstruction) Execute(ctx context.Context, s *Section, msg *Encryp
 		return fmt.Errorf("route %d not exists", ins.RouteID)
 	}
 
+	if !s.gw.allowRouting && !route.restricted {
+		return fmt.Errorf("instruction is not executable since routing is not allowed")
+	}
+
 	return route.Route(ctx, msg.Payload, false, restInstructions, 0)
 }
 
@@ -454,7 +509,11 @@ type PaymentInstruction struct {
 const MinChannelTimeoutSec = 300
 
 func (ins PaymentInstruction) Execute(ctx context.Context, s *Section, _ *EncryptedMessage, _ []byte) error {
-	if !s.gw.allowRouting {
+	if ins.Purpose>>32 == PaymentPurposeOut {
+		if !s.gw.allowOut {
+			return fmt.Errorf("instruction is not executable since out is not allowed")
+		}
+	} else if !s.gw.allowRouting {
 		return fmt.Errorf("instruction is not executable since routing is not allowed")
 	}
 
@@ -462,8 +521,6 @@ func (ins PaymentInstruction) Execute(ctx context.Context, s *Section, _ *Encryp
 		return fmt.Errorf("payments are not enabled")
 	}
 
-	// TODO: recover payments after restart
-
 	var st payments.VirtualChannelState
 	if err := tlb.LoadFromCell(&st, ins.PaymentChannelState.BeginParse()); err != nil {
 		return fmt.Errorf("incorrect state cell: %w", err)
@@ -501,7 +558,29 @@ func (ins PaymentInstruction) Execute(ctx context.Context, s *Section, _ *Encryp
 			}
 		}
 
-		// TODO: recover paid packets num after restart
+		// state accepted before restart is already counted in restored balances
+		restored := false
+		if l := s.gw.payments.Ledger; l != nil {
+			rec, err := l.GetChannel(ins.Key)
+			if err != nil {
+				return fmt.Errorf("get channel %x from ledger failed: %w", ins.Key, err)
+			}
+
+			if rec != nil {
+				if !bytes.Equal(rec.SectionKey, s.key) {
+					return fmt.Errorf("payment channel is already used by another section")
+				}
+
+				if rec.Purpose != ins.Purpose {
+					return fmt.Errorf("purpose change is not allowed")
+				}
+
+				if last, err = rec.LoadState(); err != nil {
+					return fmt.Errorf("load channel %x state from ledger failed: %w", ins.Key, err)
+				}
+				restored = true
+			}
+		}
 
 		if vc.Incoming == nil {
 			return fmt.Errorf("payment channel direction is incorrect")
@@ -516,11 +595,12 @@ func (ins PaymentInstruction) Execute(ctx context.Context, s *Section, _ *Encryp
 			return fmt.Errorf("incorrect capacity: %w", err)
 		}
 
-		justLoadedAndCountable = time.Until(vc.Incoming.SafeDeadline) >= MinChannelTimeoutSec*time.Second
+		safe := time.Until(vc.Incoming.SafeDeadline) >= MinChannelTimeoutSec*time.Second
+		justLoadedAndCountable = safe && !restored
 
 		v = &PaymentChannel{
 			Key:         ins.Key,
-			Active:      vc.Status == db.VirtualChannelStateActive && justLoadedAndCountable,
+			Active:      vc.Status == db.VirtualChannelStateActive && safe,
 			Deadline:    vc.Incoming.SafeDeadline.Unix(),
 			Capacity:    capacity.Nano(),
 			Purpose:     ins.Purpose,
@@ -651,6 +731,18 @@ func (ins PaymentInstruction) Execute(ctx context.Context, s *Section, _ *Encryp
 	mutation()
 	v.LatestState = &st
 
+	var ledgerErr error
+	if l := s.gw.payments.Ledger; l != nil {
+		if ledgerErr = l.PutPayment(ins.Key, &LedgerChannelRecord{
+			SectionKey: s.key,
+			Purpose:    v.Purpose,
+			State:      ins.PaymentChannelState.ToBOC(),
+			Deadline:   v.Deadline,
+		}, s.key, s.snapshotLedger()); ledgerErr != nil {
+			s.log.Error().Err(ledgerErr).Str("key", base64.StdEncoding.EncodeToString(ins.Key)).Msg("payment is accepted, but not saved to ledger, it will be lost after restart")
+		}
+	}
+
 	if ins.Final {
 		go func() { // it locks inside, so we close async
 			for i := 1; i <= 5; i++ {
@@ -664,6 +756,9 @@ func (ins PaymentInstruction) Execute(ctx context.Context, s *Section, _ *Encryp
 		}()
 	}
 
+	if ledgerErr != nil {
+		return fmt.Errorf("save payment to ledger failed: %w", ledgerErr)
+	}
 	return nil
 }
 
@@ -733,6 +828,7 @@ func (ins BindOutInstruction) Execute(ctx context.Context, s *Section, _ *Encryp
 			InboundADNL:         ins.InboundNodeADNL,
 			PayloadCipherKey:    sharedPayloadKey,
 			PayloadCipherKeyCRC: crc64.Checksum(sharedPayloadKey, crcTable),
+			cipherMode:          s.getCipherMode(),
 			InboundSectionKey:   ins.InboundSectionPubKey,
 			Instructions:        ins.InboundInstructions,
 			PacketsSentOut:      0,
@@ -740,6 +836,19 @@ func (ins BindOutInstruction) Execute(ctx context.Context, s *Section, _ *Encryp
 			PricePerPacket:      new(big.Int).SetUint64(ins.PricePerPacket),
 			log:                 s.log.With().Str("component", "out").Logger(),
 		}
+		s.out.fragments = newFragmentBuffer(func(reason string) {
+			metrics.FragmentedDropped.WithLabelValues(reason).Inc()
+		})
+
+		if s.restored != nil && s.restored.HasOut {
+			s.out.PrepaidPacketsIn = s.restored.PrepaidPacketsIn
+			s.out.PrepaidPacketsOut = s.restored.PrepaidPacketsOut
+			s.restored.HasOut = false
+
+			s.log.Info().Int64("in_balance", s.out.PrepaidPacketsIn).
+				Int64("out_balance", s.out.PrepaidPacketsOut).
+				Msg("out balance restored from ledger")
+		}
 
 		metrics.ActiveOutGateways.WithLabelValues(strconv.FormatBool(ins.PricePerPacket > 0)).Inc()
 
@@ -763,6 +872,20 @@ func (ins BindOutInstruction) Execute(ctx context.Context, s *Section, _ *Encryp
 			s.out.PricePerPacket.Cmp(new(big.Int).SetUint64(ins.PricePerPacket)) != 0
 
 		if changed {
+			if !bytes.Equal(s.out.InboundSectionKey, ins.InboundSectionPubKey) {
+				// inbound chain was rebuilt, system route to the previous one is not needed anymore
+				oldID := ^binary.LittleEndian.Uint32(s.out.InboundSectionKey)
+				if r := s.routes[oldID]; r != nil && oldID != ^binary.LittleEndian.Uint32(ins.InboundSectionPubKey) &&
+					bytes.Equal((*RouteTarget)(atomic.LoadPointer(&r.Target)).SectionKey, s.out.InboundSectionKey) {
+					r.Close()
+					delete(s.routes, oldID)
+				}
+
+				// counters are compared with stats of the new chain, so they start over
+				atomic.StoreUint64(&s.out.MessagesIn, 0)
+				atomic.StoreUint64(&s.out.MessagesBack, 0)
+			}
+
 			if inADNLChanged {
 				s.out.inboundPeer.Dereference()
 				s.out.inboundPeer = s.gw.addPeer(ins.InboundNodeADNL, nil)
@@ -800,25 +923,6 @@ func (ins BindOutInstruction) Execute(ctx context.Context, s *Section, _ *Encryp
 	return nil
 }
 
-// ReportStatsInstruction is used to get network statistics from some node,
-// for example to calc packet loss or align payment amount
-type ReportStatsInstruction struct {
-	InboundNodeADNL             []byte `tl:"int256"`
-	InboundSectionPubKey        []byte `tl:"int256"`
-	InboundInstructions         []byte `tl:"bytes"`
-	InboundInstructionsChecksum uint64 `tl:"long"`
-	ReceiverPubKey              []byte `tl:"int256"`
-}
-
-func (ins ReportStatsInstruction) Execute(ctx context.Context, s *Section, msg *EncryptedMessage, restInstructions []byte) error {
-	if !s.gw.allowRouting {
-		return fmt.Errorf("instruction is not executable since routing is not allowed")
-	}
-
-	println(reflect.TypeOf(ins).String())
-	return nil
-}
-
 type SendOutCachedAction struct{}
 
 func (_ *SendOutCachedAction) Execute(ctx context.Context, s *Section, msg *EncryptedMessageCached) error {
@@ -838,15 +942,6 @@ func (ins SendOutInstruction) Execute(ctx context.Context, s *Section, msg *Encr
 	return s.out.Send(msg.Payload)
 }
 
-// DeliverInstruction used to identify that node is the destination
-// and payload should be processed on this server, to decrypt shared key of private receiver + public tunnel should be used
-type DeliverInstruction struct{}
-
-func (ins DeliverInstruction) Execute(ctx context.Context, s *Section, msg *EncryptedMessage, restInstructions []byte) error {
-	println(reflect.TypeOf(ins).String())
-	return nil
-}
-
 type DeliverInitiatorCachedAction struct {
 	Metadata any
 
@@ -864,7 +959,7 @@ func (d *DeliverInitiatorCachedAction) Execute(ctx context.Context, s *Section,
 // and payload should be processed on this server, to decrypt shared key of public sender + private tunnel should be used
 type DeliverInitiatorInstruction struct {
 	From     uint32 `tl:"int"`
-	Metadata any    `tl:"struct boxed [adnlTunnel.stateMeta,adnlTunnel.paymentMeta,adnlTunnel.pingMeta]"`
+	Metadata any    `tl:"struct boxed [adnlTunnel.stateMeta,adnlTunnel.paymentMeta,adnlTunnel.pingMeta,adnlTunnel.statsMeta]"`
 }
 
 func (ins DeliverInitiatorInstruction) Execute(ctx context.Context, s *Section, msg *EncryptedMessage, _ []byte) error {
@@ -876,6 +971,13 @@ func (ins DeliverInitiatorInstruction) Execute(ctx context.Context, s *Section,
 		return fmt.Errorf("no tunnel registered for from: %d", ins.From)
 	}
 
+	if rt, ok := t.(*RegularOutTunnel); ok {
+		// our section is built by ourselves, so its cipher is known and is not detected from what is received
+		if mode := rt.recvCipherMode(); s.getCipherMode() != mode {
+			return fmt.Errorf("cipher mode %s is used instead of negotiated %s", s.getCipherMode(), mode)
+		}
+	}
+
 	if err := t.Process(msg.Payload, ins.Metadata); err != nil {
 		return fmt.Errorf("process recv message failed: %w", err)
 	}
@@ -914,6 +1016,9 @@ type SendOutPayload struct {
 
 func (o *Out) Close() {
 	o.closerClose()
+	if b := o.getBatcher(); b != nil {
+		b.stop()
+	}
 	o.conn.Close()
 	o.inboundPeer.Dereference()
 
@@ -932,16 +1037,56 @@ func (o *Out) Send(payload []byte) error {
 	o.mx.RLock()
 	defer o.mx.RUnlock()
 
-	data, err := decryptStream(o.PayloadCipherKeyCRC, o.PayloadCipherKey, payload)
+	atomic.AddUint64(&o.MessagesIn, 1)
+
+	data, err := o.decrypt(payload)
 	if err != nil {
 		return fmt.Errorf("decrypt payload failed: %w", err)
 	}
 
-	var pl SendOutPayload
+	var pl tl.Serializable
 	if _, err = tl.Parse(&pl, data, true); err != nil {
 		return fmt.Errorf("parse payload failed: %w", err)
 	}
 
+	if f, ok := pl.(FragmentPayload); ok {
+		full, err := o.fragments.add(f)
+		if err != nil || full == nil {
+			return err
+		}
+
+		if pl, err = parseReassembled(full); err != nil {
+			return err
+		}
+	}
+
+	switch p := pl.(type) {
+	case CoverPayload:
+		// dummy packet of client, to hide timing of real ones, it is paid as packet, client counts it the same way
+		if o.PricePerPacket.Sign() > 0 {
+			atomic.AddInt64(&o.PrepaidPacketsOut, -1)
+		}
+		return nil
+	case SendOutPayload:
+		return o.sendOut(p)
+	case SendOutBatchPayload:
+		if len(p.Packets) > BatchMaxPackets {
+			return fmt.Errorf("too many packets in batch: %d", len(p.Packets))
+		}
+
+		// each packet is checked and paid separately, failed one not affects others
+		var firstErr error
+		for _, packet := range p.Packets {
+			if err = o.sendOut(packet); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+	return fmt.Errorf("unexpected payload type %T", pl)
+}
+
+func (o *Out) sendOut(pl SendOutPayload) error {
 	if len(pl.Payload) == 0 {
 		return nil
 	}
@@ -950,7 +1095,12 @@ func (o *Out) Send(payload []byte) error {
 	if !ok {
 		return fmt.Errorf("invalid IP address")
 	}
-	addr := net.UDPAddrFromAddrPort(netip.AddrPortFrom(ip, uint16(pl.Port)))
+	dst := netip.AddrPortFrom(ip.Unmap(), uint16(pl.Port))
+	if reason := o.gw.getExitPolicy().Check(dst); reason != "" {
+		o.rejectSend(dst, reason)
+		return fmt.Errorf("destination %s rejected by exit policy: %s", dst.String(), reason)
+	}
+	addr := net.UDPAddrFromAddrPort(dst)
 
 	if o.PricePerPacket.Sign() > 0 {
 		if atomic.LoadInt64(&o.PrepaidPacketsIn) < -int64((o.PacketsSentIn/100)*LossAcceptablePercent+LossAcceptableStartup) {
@@ -960,11 +1110,13 @@ func (o *Out) Send(payload []byte) error {
 		if prepaid := atomic.LoadInt64(&o.PrepaidPacketsOut); prepaid <= 0 {
 			return fmt.Errorf("prepaid packets exceeds limit")
 		}
-		// we not so care about concurrency here, and it is okay to allow couple packets overdraft
-		atomic.AddInt64(&o.PrepaidPacketsOut, -1)
+		// we not so care about concurrency here, and it is okay to allow couple packets overdraft,
+		// padding is paid by seqno, client counts it the same way
+		atomic.AddInt64(&o.PrepaidPacketsOut, -1-paddingPackets(pl.Seqno-1, pl.Seqno, o.getPadding().surcharge()))
 	}
 
-	if _, err = o.conn.WriteTo(pl.Payload, addr); err != nil {
+	o.markContacted(dst)
+	if _, err := o.conn.WriteTo(pl.Payload, addr); err != nil {
 		return fmt.Errorf("write out failed: %w", err)
 	}
 	atomic.AddUint64(&o.PacketsSentOut, 1)
@@ -979,6 +1131,8 @@ const LossAcceptableStartup = 20000
 func (o *Out) Listen(threads int) {
 	pks := make(chan inPacket, 256*1024)
 
+	go o.filterCleaner()
+
 	for i := 0; i < threads; i++ {
 		go func() {
 			var p inPacket
@@ -994,6 +1148,8 @@ func (o *Out) Listen(threads int) {
 					maxCredit := (atomic.LoadUint64(&o.PacketsSentIn)/100)*LossAcceptablePercent + LossAcceptableStartup
 					if prepaid := atomic.LoadInt64(&o.PrepaidPacketsIn); prepaid <= -int64(maxCredit) {
 						o.log.Trace().Int64("credit", prepaid).Uint64("sent", atomic.LoadUint64(&o.PacketsSentIn)).Msg("incoming packet was dropped because not paid")
+						o.gw.bufPool.Put(p.buf)
+						o.dropIn(OutDropReasonNotPaid)
 						continue
 					}
 					// we not so care about concurrency here, and it is okay to allow couple packets overdraft
@@ -1001,9 +1157,29 @@ func (o *Out) Listen(threads int) {
 				}
 				atomic.AddUint64(&o.gw.statsReceived, 1)
 
+				seqno := atomic.AddUint64(&o.PacketsSentIn, 1)
+				if o.PricePerPacket.Sign() > 0 {
+					// padding is paid by seqno, client counts it the same way, even when packets are lost
+					if n := paddingPackets(seqno-1, seqno, o.getPadding().surcharge()); n > 0 {
+						atomic.AddInt64(&o.PrepaidPacketsIn, -n)
+					}
+				}
+
 				src := p.from.(*net.UDPAddr)
+				if b := o.getBatcher(); b != nil {
+					// payload is copied, because buffer is returned to pool before batch is flushed
+					b.add(DeliverUDPPayload{
+						Seqno:   seqno,
+						IP:      src.IP,
+						Port:    uint32(src.Port),
+						Payload: append([]byte{}, p.buf[:p.n]...),
+					}, p.n+batchItemOverhead)
+					o.gw.bufPool.Put(p.buf)
+					continue
+				}
+
 				err := o.sendBack(DeliverUDPPayload{
-					Seqno:   atomic.AddUint64(&o.PacketsSentIn, 1),
+					Seqno:   seqno,
 					IP:      src.IP,
 					Port:    uint32(src.Port),
 					Payload: p.buf[:p.n],
@@ -1032,7 +1208,6 @@ func (o *Out) Listen(threads int) {
 
 			continue
 		}
-		// TODO: filter "from", add bans
 
 		//TODO: verify packets as much as possible
 
@@ -1042,6 +1217,15 @@ func (o *Out) Listen(threads int) {
 			continue
 		}
 
+		if f := o.getFilter(); f != nil {
+			ap := from.(*net.UDPAddr).AddrPort()
+			if reason := f.check(o, netip.AddrPortFrom(ap.Addr().Unmap(), ap.Port()), time.Now().Unix()); reason != "" {
+				o.gw.bufPool.Put(buf)
+				o.dropIn(reason)
+				continue
+			}
+		}
+
 		select {
 		case pks <- inPacket{
 			from: from,
@@ -1055,24 +1239,54 @@ func (o *Out) Listen(threads int) {
 	}
 }
 
+// sendBack sends payload to client through inbound route, payload bigger than PayloadMTU is sent in fragments
 func (o *Out) sendBack(obj tl.Serializable, isPayload bool) error {
 	pl, err := tl.Serialize(obj, true)
 	if err != nil {
 		return fmt.Errorf("serialize payload failed: %w", err)
 	}
 
+	if !isPayload {
+		return o.sendBackData(pl, false)
+	}
+
+	fragments, err := splitPayload(atomic.AddUint64(&o.fragmentSeqno, 1), pl)
+	if err != nil {
+		return fmt.Errorf("fragment payload failed: %w", err)
+	}
+
+	if fragments == nil {
+		return o.sendBackData(pl, true)
+	}
+
+	for _, f := range fragments {
+		if pl, err = tl.Serialize(f, true); err != nil {
+			return fmt.Errorf("serialize fragment failed: %w", err)
+		}
+
+		if err = o.sendBackData(pl, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (o *Out) sendBackData(pl []byte, isPayload bool) error {
+	if isPayload {
+		pl, _ = o.getPadding().pad(pl)
+	}
+
 	o.mx.RLock()
 	defer o.mx.RUnlock()
 
-	pl, err = encryptStream(o.PayloadCipherKeyCRC, o.PayloadCipherKey, pl)
+	pl, err := encryptStream(o.cipherMode, o.PayloadCipherKeyCRC, o.PayloadCipherKey, pl)
 	if err != nil {
 		return fmt.Errorf("encrypt payload failed: %w", err)
 	}
 
-	//TODO: add random padding to payload
-
 	var msg tl.Serializable
 	if isPayload {
+		atomic.AddUint64(&o.MessagesBack, 1)
 		msg = EncryptedMessageCached{
 			SectionPubKey: o.InboundSectionKey,
 			Seqno:         atomic.AddUint32(&o.backSeqno, 1),
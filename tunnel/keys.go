@@ -6,7 +6,9 @@ import (
 	"github.com/xssnick/tonutils-go/adnl/keys"
 	"github.com/xssnick/tonutils-go/tl"
 	"hash/crc64"
+	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type EncryptionKeys struct {
@@ -15,6 +17,16 @@ type EncryptionKeys struct {
 	Seqno          uint32
 	SectionPubKey  ed25519.PublicKey
 	ReceiverPubKey ed25519.PublicKey
+
+	// Mode is a cipher used for section, node detects it from the first message
+	Mode CipherMode
+
+	// alt key is also accepted on decrypt during rekey, it is upcoming key before rotation and previous after
+	altKey    []byte
+	altKeyCRC uint64
+	altUntil  int64
+
+	mx sync.RWMutex
 }
 
 func NewEncryptionKeys(sectionPrivate ed25519.PrivateKey, targetPub ed25519.PublicKey) (*EncryptionKeys, error) {
@@ -40,7 +52,9 @@ func GenerateEncryptionKeys(targetPub ed25519.PublicKey) (*EncryptionKeys, error
 }
 
 func (k *EncryptionKeys) EncryptPayload(payload []byte) ([]byte, error) {
-	data, err := encryptStream(k.CipherKeyCRC, k.CipherKey, payload)
+	k.mx.RLock()
+	data, err := encryptStream(k.Mode, k.CipherKeyCRC, k.CipherKey, payload)
+	k.mx.RUnlock()
 	if err != nil {
 		return nil, fmt.Errorf("encryption failed: %v", err)
 	}
@@ -63,18 +77,67 @@ func (k *EncryptionKeys) EncryptInstructionsMessage(msg *EncryptedMessage, instr
 		return fmt.Errorf("serialize instructions failed: %v", err)
 	}
 
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+
 	msg.SectionPubKey = k.SectionPubKey
 	msg.Instructions = append(instructionsData, msg.Instructions...)
 
-	if msg.Instructions, err = encryptStream(k.CipherKeyCRC, k.CipherKey, msg.Instructions); err != nil {
+	if msg.Instructions, err = encryptStream(k.Mode, k.CipherKeyCRC, k.CipherKey, msg.Instructions); err != nil {
 		return fmt.Errorf("encryption failed: %v", err)
 	}
 
 	return nil
 }
 
+func (k *EncryptionKeys) decrypt(data []byte) ([]byte, error) {
+	k.mx.RLock()
+	altKey := k.altKey
+	if k.altUntil != 0 && k.altUntil < time.Now().Unix() {
+		altKey = nil
+	}
+	pl, _, err := decryptWithAlt(k.Mode, k.CipherKeyCRC, k.CipherKey, k.altKeyCRC, altKey, data)
+	k.mx.RUnlock()
+
+	return pl, err
+}
+
+// expectNext makes upcoming key of rekey accepted on decrypt, because node switches to it before us
+func (k *EncryptionKeys) expectNext(next *EncryptionKeys) {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+
+	k.altKey = next.CipherKey
+	k.altKeyCRC = next.CipherKeyCRC
+	k.altUntil = 0
+}
+
+// rotate switches to key of next, previous key is accepted on decrypt during overlap window.
+// Section keeps its public key as an id, payload key is changed together with its public key.
+func (k *EncryptionKeys) rotate(next *EncryptionKeys, withPubKey bool) {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+
+	k.altKey = k.CipherKey
+	k.altKeyCRC = k.CipherKeyCRC
+	k.altUntil = time.Now().Unix() + RekeyOverlapSec
+
+	k.CipherKey = next.CipherKey
+	k.CipherKeyCRC = next.CipherKeyCRC
+	if withPubKey {
+		k.SectionPubKey = next.SectionPubKey
+	}
+}
+
+func (k *EncryptionKeys) pubKey() ed25519.PublicKey {
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+
+	return k.SectionPubKey
+}
+
 func (k *EncryptionKeys) decryptRecvPayload(payload []byte) (tl.Serializable, error) {
-	data, err := decryptStream(k.CipherKeyCRC, k.CipherKey, payload)
+	data, err := k.decrypt(payload)
 	if err != nil {
 		return nil, fmt.Errorf("decrypt payload failed: %w", err)
 	}
@@ -0,0 +1,256 @@
+package tunnel
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"github.com/xssnick/ton-payment-network/pkg/payments"
+	"github.com/xssnick/tonutils-go/tlb"
+	"github.com/xssnick/tonutils-go/tvm/cell"
+	"sync/atomic"
+	"time"
+)
+
+// LedgerSectionMaxAgeSec is how long section balances are kept after the last update,
+// clients reconfigure tunnel with the same keys after node restart, so it should cover restart downtime.
+const LedgerSectionMaxAgeSec = 3600
+
+var (
+	ledgerChannelPrefix = []byte("ch:")
+	ledgerSectionPrefix = []byte("sec:")
+)
+
+// PaymentLedger is a durable storage of accepted inbound payments,
+// it is used to restore prepaid balances of sections after node restart.
+type PaymentLedger struct {
+	db *leveldb.DB
+}
+
+type LedgerChannelRecord struct {
+	SectionKey []byte
+	Purpose    uint64
+	State      []byte // boc of latest accepted payments.VirtualChannelState
+	Deadline   int64
+}
+
+type LedgerRouteBalance struct {
+	PaymentReceived bool
+	PrepaidPackets  int64
+}
+
+type LedgerSectionRecord struct {
+	Routes            map[uint32]LedgerRouteBalance
+	HasOut            bool
+	PrepaidPacketsIn  int64
+	PrepaidPacketsOut int64
+	UpdatedAt         int64
+}
+
+func OpenPaymentLedger(path string) (*PaymentLedger, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open leveldb: %w", err)
+	}
+
+	l := &PaymentLedger{db: db}
+	if err = l.Cleanup(time.Now()); err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to cleanup ledger: %w", err)
+	}
+	return l, nil
+}
+
+func (l *PaymentLedger) Close() error {
+	return l.db.Close()
+}
+
+func (l *PaymentLedger) GetChannel(key []byte) (*LedgerChannelRecord, error) {
+	var rec LedgerChannelRecord
+	if err := l.get(append(append([]byte{}, ledgerChannelPrefix...), key...), &rec); err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &rec, nil
+}
+
+func (l *PaymentLedger) PutChannel(key []byte, rec *LedgerChannelRecord) error {
+	return l.put(append(append([]byte{}, ledgerChannelPrefix...), key...), rec)
+}
+
+func (l *PaymentLedger) DeleteChannel(key []byte) error {
+	return l.db.Delete(append(append([]byte{}, ledgerChannelPrefix...), key...), nil)
+}
+
+func (l *PaymentLedger) GetSection(key []byte) (*LedgerSectionRecord, error) {
+	var rec LedgerSectionRecord
+	if err := l.get(append(append([]byte{}, ledgerSectionPrefix...), key...), &rec); err != nil {
+		if errors.Is(err, leveldb.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if rec.UpdatedAt < time.Now().Unix()-LedgerSectionMaxAgeSec {
+		// too old, client already rebuilt the tunnel
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+func (l *PaymentLedger) PutSection(key []byte, rec *LedgerSectionRecord) error {
+	return l.put(append(append([]byte{}, ledgerSectionPrefix...), key...), rec)
+}
+
+// PutPayment saves accepted payment of channel together with section balances it is credited to,
+// in one write, so after crash they are not restored separately
+func (l *PaymentLedger) PutPayment(channelKey []byte, ch *LedgerChannelRecord, sectionKey []byte, sec *LedgerSectionRecord) error {
+	chData, err := json.Marshal(ch)
+	if err != nil {
+		return fmt.Errorf("failed to serialize channel record: %w", err)
+	}
+
+	secData, err := json.Marshal(sec)
+	if err != nil {
+		return fmt.Errorf("failed to serialize section record: %w", err)
+	}
+
+	batch := new(leveldb.Batch)
+	batch.Put(append(append([]byte{}, ledgerChannelPrefix...), channelKey...), chData)
+	batch.Put(append(append([]byte{}, ledgerSectionPrefix...), sectionKey...), secData)
+	return l.db.Write(batch, nil)
+}
+
+func (l *PaymentLedger) DeleteSection(key []byte) error {
+	return l.db.Delete(append(append([]byte{}, ledgerSectionPrefix...), key...), nil)
+}
+
+// Cleanup removes records of expired channels and outdated sections
+func (l *PaymentLedger) Cleanup(now time.Time) error {
+	batch := new(leveldb.Batch)
+
+	iter := l.db.NewIterator(util.BytesPrefix(ledgerChannelPrefix), nil)
+	for iter.Next() {
+		var rec LedgerChannelRecord
+		if err := json.Unmarshal(iter.Value(), &rec); err != nil || rec.Deadline < now.Unix() {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("iterate channels failed: %w", err)
+	}
+
+	iter = l.db.NewIterator(util.BytesPrefix(ledgerSectionPrefix), nil)
+	for iter.Next() {
+		var rec LedgerSectionRecord
+		if err := json.Unmarshal(iter.Value(), &rec); err != nil || rec.UpdatedAt < now.Unix()-LedgerSectionMaxAgeSec {
+			batch.Delete(append([]byte{}, iter.Key()...))
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		return fmt.Errorf("iterate sections failed: %w", err)
+	}
+
+	if batch.Len() == 0 {
+		return nil
+	}
+	return l.db.Write(batch, nil)
+}
+
+func (l *PaymentLedger) get(key []byte, v any) error {
+	data, err := l.db.Get(key, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse record: %w", err)
+	}
+	return nil
+}
+
+func (l *PaymentLedger) put(key []byte, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to serialize record: %w", err)
+	}
+	return l.db.Put(key, data, nil)
+}
+
+func (r *LedgerChannelRecord) LoadState() (*payments.VirtualChannelState, error) {
+	cl, err := cell.FromBOC(r.State)
+	if err != nil {
+		return nil, fmt.Errorf("incorrect state boc: %w", err)
+	}
+
+	var st payments.VirtualChannelState
+	if err = tlb.LoadFromCell(&st, cl.BeginParse()); err != nil {
+		return nil, fmt.Errorf("incorrect state cell: %w", err)
+	}
+	return &st, nil
+}
+
+// snapshotLedger collects current section balances to persist them
+func (s *Section) snapshotLedger() *LedgerSectionRecord {
+	rec := &LedgerSectionRecord{
+		Routes:    map[uint32]LedgerRouteBalance{},
+		UpdatedAt: time.Now().Unix(),
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	for id, route := range s.routes {
+		rec.Routes[id] = LedgerRouteBalance{
+			PaymentReceived: route.PaymentReceived,
+			PrepaidPackets:  atomic.LoadInt64(&route.PrepaidPackets),
+		}
+	}
+
+	if s.out != nil {
+		rec.HasOut = true
+		rec.PrepaidPacketsIn = atomic.LoadInt64(&s.out.PrepaidPacketsIn)
+		rec.PrepaidPacketsOut = atomic.LoadInt64(&s.out.PrepaidPacketsOut)
+	}
+
+	if s.restored != nil {
+		// keep balances which are not yet picked up by rebuilt routes and out
+		for id, balance := range s.restored.Routes {
+			if _, ok := rec.Routes[id]; !ok {
+				rec.Routes[id] = balance
+			}
+		}
+
+		if !rec.HasOut && s.restored.HasOut {
+			rec.HasOut = true
+			rec.PrepaidPacketsIn = s.restored.PrepaidPacketsIn
+			rec.PrepaidPacketsOut = s.restored.PrepaidPacketsOut
+		}
+	}
+	return rec
+}
+
+// saveLedger persists section balances, if ledger is enabled and section has any payments
+func (s *Section) saveLedger() {
+	l := s.gw.payments.Ledger
+	if l == nil {
+		return
+	}
+
+	s.mx.RLock()
+	hasPayments := len(s.payments) > 0 || s.restored != nil
+	s.mx.RUnlock()
+
+	if !hasPayments {
+		return
+	}
+
+	if err := l.PutSection(s.key, s.snapshotLedger()); err != nil {
+		s.log.Warn().Err(err).Msg("failed to save section balances to ledger")
+	}
+}
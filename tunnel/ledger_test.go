@@ -0,0 +1,103 @@
+package tunnel
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPaymentLedger(t *testing.T) {
+	l, err := OpenPaymentLedger(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenPaymentLedger() error = %v", err)
+	}
+	defer l.Close()
+
+	chKey := bytes.Repeat([]byte{1}, 32)
+	secKey := bytes.Repeat([]byte{2}, 32)
+
+	if rec, err := l.GetChannel(chKey); err != nil || rec != nil {
+		t.Fatalf("expected no channel record, got %v, err %v", rec, err)
+	}
+
+	if err = l.PutChannel(chKey, &LedgerChannelRecord{
+		SectionKey: secKey,
+		Purpose:    PaymentPurposeOut << 32,
+		State:      []byte{0xAA},
+		Deadline:   time.Now().Add(time.Hour).Unix(),
+	}); err != nil {
+		t.Fatalf("PutChannel() error = %v", err)
+	}
+
+	rec, err := l.GetChannel(chKey)
+	if err != nil || rec == nil {
+		t.Fatalf("expected channel record, err %v", err)
+	}
+	if !bytes.Equal(rec.SectionKey, secKey) || rec.Purpose != PaymentPurposeOut<<32 {
+		t.Fatalf("unexpected channel record %+v", rec)
+	}
+
+	if err = l.PutSection(secKey, &LedgerSectionRecord{
+		Routes: map[uint32]LedgerRouteBalance{
+			7: {PaymentReceived: true, PrepaidPackets: 1000},
+		},
+		HasOut:            true,
+		PrepaidPacketsIn:  500,
+		PrepaidPacketsOut: 400,
+		UpdatedAt:         time.Now().Unix(),
+	}); err != nil {
+		t.Fatalf("PutSection() error = %v", err)
+	}
+
+	sec, err := l.GetSection(secKey)
+	if err != nil || sec == nil {
+		t.Fatalf("expected section record, err %v", err)
+	}
+	if sec.Routes[7].PrepaidPackets != 1000 || !sec.Routes[7].PaymentReceived || sec.PrepaidPacketsIn != 500 || sec.PrepaidPacketsOut != 400 {
+		t.Fatalf("unexpected section record %+v", sec)
+	}
+
+	// expired records should be removed
+	if err = l.Cleanup(time.Now().Add(2 * time.Hour)); err != nil {
+		t.Fatalf("Cleanup() error = %v", err)
+	}
+
+	if rec, err = l.GetChannel(chKey); err != nil || rec != nil {
+		t.Fatalf("expected channel record to be removed, got %v, err %v", rec, err)
+	}
+
+	if sec, err = l.GetSection(secKey); err != nil || sec != nil {
+		t.Fatalf("expected section record to be removed, got %v, err %v", sec, err)
+	}
+}
+
+func TestPaymentLedgerPutPayment(t *testing.T) {
+	l, err := OpenPaymentLedger(t.TempDir())
+	if err != nil {
+		t.Fatalf("OpenPaymentLedger() error = %v", err)
+	}
+	defer l.Close()
+
+	chKey := bytes.Repeat([]byte{1}, 32)
+	secKey := bytes.Repeat([]byte{2}, 32)
+
+	if err = l.PutPayment(chKey, &LedgerChannelRecord{
+		SectionKey: secKey,
+		Purpose:    PaymentPurposeOut << 32,
+		State:      []byte{0xAA},
+		Deadline:   time.Now().Add(time.Hour).Unix(),
+	}, secKey, &LedgerSectionRecord{
+		HasOut:            true,
+		PrepaidPacketsOut: 400,
+		UpdatedAt:         time.Now().Unix(),
+	}); err != nil {
+		t.Fatalf("PutPayment() error = %v", err)
+	}
+
+	if rec, err := l.GetChannel(chKey); err != nil || rec == nil || !bytes.Equal(rec.SectionKey, secKey) {
+		t.Fatalf("expected channel record, got %v, err %v", rec, err)
+	}
+	if sec, err := l.GetSection(secKey); err != nil || sec == nil || sec.PrepaidPacketsOut != 400 {
+		t.Fatalf("expected section record, got %v, err %v", sec, err)
+	}
+}
@@ -0,0 +1,253 @@
+package tunnel
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"fmt"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/xssnick/tonutils-go/tl"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	tl.Register(NodePaymentChainPart{}, "adnlTunnel.nodePaymentChainPart nodeKey:int256 maxCapacity:string percentFee:string minFee:string = adnlTunnel.NodePaymentChainPart")
+	tl.Register(NodePayment{}, "adnlTunnel.nodePayment jettonMaster:string extraCurrencyId:int priceRoute:long priceOut:long chain:(vector adnlTunnel.nodePaymentChainPart) = adnlTunnel.NodePayment")
+	tl.Register(NodeInfo{}, "adnlTunnel.nodeInfo key:int256 roles:int capabilities:int version:string sectionDifficulty:int payments:(vector adnlTunnel.nodePayment) createdAt:long signature:bytes = adnlTunnel.NodeInfo")
+}
+
+const (
+	NodeRoleFlagRelay uint32 = 1 << iota
+	NodeRoleFlagOut
+)
+
+const (
+	// NodeCapabilityAEAD means node supports CipherModeAEAD for sections
+	NodeCapabilityAEAD uint32 = 1 << iota
+	// NodeCapabilityBatch means node understands batch payloads, and can batch datagrams of out gateway
+	NodeCapabilityBatch
+	// NodeCapabilityPadding means out gateway can pad payloads sent back to the client
+	NodeCapabilityPadding
+)
+
+// NodeInfoMaxClockSkewSec is how far in future node info can be created, to tolerate not synced clocks
+const NodeInfoMaxClockSkewSec = 300
+
+type NodePaymentChainPart struct {
+	NodeKey     []byte `tl:"int256"`
+	MaxCapacity string `tl:"string"`
+	PercentFee  string `tl:"string"`
+	MinFee      string `tl:"string"`
+}
+
+// NodePayment describes accepted currency, prices and payment chain to reach the node
+type NodePayment struct {
+	// JettonMaster is empty for TON and extra currencies
+	JettonMaster    string                 `tl:"string"`
+	ExtraCurrencyID uint32                 `tl:"int"`
+	PriceRoute      uint64                 `tl:"long"`
+	PriceOut        uint64                 `tl:"long"`
+	Chain           []NodePaymentChainPart `tl:"vector struct"`
+}
+
+// NodeInfo is a metadata published to dht by each node, signed with its key
+type NodeInfo struct {
+	Key          []byte `tl:"int256"`
+	Roles        uint32 `tl:"int"`
+	Capabilities uint32 `tl:"int"`
+	Version      string `tl:"string"`
+	// SectionDifficulty is proof of work required for new sections at the moment of publication
+	SectionDifficulty uint32        `tl:"int"`
+	Payments          []NodePayment `tl:"vector struct"`
+	CreatedAt         int64         `tl:"long"`
+	Signature         []byte        `tl:"bytes"`
+}
+
+func (n *NodeInfo) CanRoute() bool {
+	return n.Roles&NodeRoleFlagRelay != 0
+}
+
+func (n *NodeInfo) CanOut() bool {
+	return n.Roles&NodeRoleFlagOut != 0
+}
+
+func (n *NodeInfo) SupportsAEAD() bool {
+	return n.Capabilities&NodeCapabilityAEAD != 0
+}
+
+func (n *NodeInfo) SupportsBatch() bool {
+	return n.Capabilities&NodeCapabilityBatch != 0
+}
+
+func (n *NodeInfo) SupportsPadding() bool {
+	return n.Capabilities&NodeCapabilityPadding != 0
+}
+
+func (n *NodeInfo) Role() config.NodeRole {
+	switch {
+	case n.CanRoute() && n.CanOut():
+		return config.NodeRoleBoth
+	case n.CanOut():
+		return config.NodeRoleExit
+	}
+	return config.NodeRoleRelay
+}
+
+func (n *NodeInfo) Sign(key ed25519.PrivateKey) error {
+	n.Key = key.Public().(ed25519.PublicKey)
+	n.Signature = nil
+
+	data, err := tl.Serialize(n, true)
+	if err != nil {
+		return fmt.Errorf("failed to serialize node info: %w", err)
+	}
+	n.Signature = ed25519.Sign(key, data)
+	return nil
+}
+
+func (n *NodeInfo) Verify() error {
+	if len(n.Key) != ed25519.PublicKeySize {
+		return fmt.Errorf("invalid key size")
+	}
+
+	if n.CreatedAt > time.Now().Unix()+NodeInfoMaxClockSkewSec {
+		return fmt.Errorf("node info is created in future")
+	}
+
+	cp := *n
+	cp.Signature = nil
+
+	data, err := tl.Serialize(&cp, true)
+	if err != nil {
+		return fmt.Errorf("failed to serialize node info: %w", err)
+	}
+
+	if !ed25519.Verify(n.Key, data, n.Signature) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// ToRouteSection converts node info to pool entry, first payment option is used
+func (n *NodeInfo) ToRouteSection() (config.TunnelRouteSection, error) {
+	s := config.TunnelRouteSection{
+		Key:  n.Key,
+		Role: n.Role(),
+	}
+
+	if len(n.Payments) > 0 {
+		p := n.Payments[0]
+		s.Payment = &config.TunnelSectionPayment{
+			ExtraCurrencyID:         p.ExtraCurrencyID,
+			PricePerPacketRouteNano: p.PriceRoute,
+			PricePerPacketOutNano:   p.PriceOut,
+		}
+
+		if p.JettonMaster != "" {
+			jetton := p.JettonMaster
+			s.Payment.JettonMaster = &jetton
+		}
+
+		for _, part := range p.Chain {
+			fee, err := strconv.ParseFloat(part.PercentFee, 64)
+			if err != nil {
+				return config.TunnelRouteSection{}, fmt.Errorf("invalid percent fee %q of payment chain: %w", part.PercentFee, err)
+			}
+			if !(fee >= 0 && fee <= 100) {
+				return config.TunnelRouteSection{}, fmt.Errorf("percent fee %q of payment chain is out of range", part.PercentFee)
+			}
+
+			s.Payment.Chain = append(s.Payment.Chain, config.PaymentChain{
+				NodeKey:                      part.NodeKey,
+				MaxCapacityPerVirtualChannel: part.MaxCapacity,
+				PercentFeePerVirtualChannel:  fee,
+				MinFeePerVirtualChannel:      part.MinFee,
+			})
+		}
+	}
+	return s, nil
+}
+
+// nodeParams is what we know about other node from its info or challenges
+type nodeParams struct {
+	difficulty   uint32
+	capabilities uint32
+}
+
+func (g *Gateway) setNodeCapabilities(nodeKey []byte, capabilities uint32) {
+	g.nodesParamsMx.Lock()
+	defer g.nodesParamsMx.Unlock()
+
+	p := g.nodesParams[string(nodeKey)]
+	p.capabilities = capabilities
+	g.nodesParams[string(nodeKey)] = p
+}
+
+// nodeHasCapability checks known capabilities of the node, we have all of them
+func (g *Gateway) nodeHasCapability(nodeKey ed25519.PublicKey, capability uint32) bool {
+	if bytes.Equal(nodeKey, g.key.Public().(ed25519.PublicKey)) {
+		return true
+	}
+
+	g.nodesParamsMx.Lock()
+	defer g.nodesParamsMx.Unlock()
+
+	return g.nodesParams[string(nodeKey)].capabilities&capability != 0
+}
+
+// nodeCapabilitiesKnown returns true when info of the node was resolved, nodes of older versions have no capabilities
+func (g *Gateway) nodeCapabilitiesKnown(nodeKey ed25519.PublicKey) bool {
+	g.nodesParamsMx.Lock()
+	defer g.nodesParamsMx.Unlock()
+
+	return g.nodesParams[string(nodeKey)].capabilities != 0
+}
+
+// cipherModeFor returns best cipher supported by the node, nodes of older versions support only CTR
+func (g *Gateway) cipherModeFor(nodeKey ed25519.PublicKey) CipherMode {
+	if g.nodeHasCapability(nodeKey, NodeCapabilityAEAD) {
+		return CipherModeAEAD
+	}
+	return CipherModeCTR
+}
+
+func (g *Gateway) nodeInfo() NodeInfo {
+	info := NodeInfo{
+		Capabilities:      NodeCapabilityAEAD | NodeCapabilityBatch | NodeCapabilityPadding,
+		Version:           g.version,
+		SectionDifficulty: atomic.LoadUint32(&g.sectionPoW),
+		CreatedAt:         time.Now().Unix(),
+	}
+
+	if g.allowRouting {
+		info.Roles |= NodeRoleFlagRelay
+	}
+	if g.allowOut {
+		info.Roles |= NodeRoleFlagOut
+	}
+
+	if p := g.advertisePayment; p != nil {
+		np := NodePayment{
+			ExtraCurrencyID: p.ExtraCurrencyID,
+			PriceRoute:      p.PricePerPacketRouteNano,
+			PriceOut:        p.PricePerPacketOutNano,
+		}
+
+		if p.JettonMaster != nil {
+			np.JettonMaster = *p.JettonMaster
+		}
+
+		for _, part := range p.Chain {
+			np.Chain = append(np.Chain, NodePaymentChainPart{
+				NodeKey:     part.NodeKey,
+				MaxCapacity: part.MaxCapacityPerVirtualChannel,
+				PercentFee:  strconv.FormatFloat(part.PercentFeePerVirtualChannel, 'f', -1, 64),
+				MinFee:      part.MinFeePerVirtualChannel,
+			})
+		}
+		info.Payments = append(info.Payments, np)
+	}
+
+	return info
+}
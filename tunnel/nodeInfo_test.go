@@ -0,0 +1,186 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"github.com/rs/zerolog"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/xssnick/tonutils-go/tl"
+	"testing"
+)
+
+func TestNodeInfoRoles(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+
+	tests := []struct {
+		gw   *Gateway
+		role config.NodeRole
+	}{
+		{&Gateway{allowRouting: true, allowOut: true}, config.NodeRoleBoth},
+		{&Gateway{allowRouting: true}, config.NodeRoleRelay},
+		{&Gateway{allowOut: true}, config.NodeRoleExit},
+	}
+
+	for _, tt := range tests {
+		ni := tt.gw.nodeInfo()
+		if err := ni.Sign(key); err != nil {
+			t.Fatalf("Sign() error = %v", err)
+		}
+
+		data, err := tl.Serialize(ni, true)
+		if err != nil {
+			t.Fatalf("Serialize() error = %v", err)
+		}
+
+		var info NodeInfo
+		if _, err = tl.Parse(&info, data, true); err != nil {
+			t.Fatalf("Parse() error = %v", err)
+		}
+
+		if info.Role() != tt.role {
+			t.Errorf("expected role %s, got %s", tt.role, info.Role())
+		}
+
+		if info.Role().CanRoute() != tt.gw.allowRouting || info.Role().CanOut() != tt.gw.allowOut {
+			t.Errorf("role %s capabilities mismatch", info.Role())
+		}
+	}
+}
+
+func TestNodeInfoSignature(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+	payNode, _, _ := ed25519.GenerateKey(nil)
+
+	jetton := "EQCxE6mUtQJKFnGfaROTKOt1lZbDiiX1kCixRv7Nw2Id_sDs"
+	gw := &Gateway{
+		allowRouting: true,
+		allowOut:     true,
+		version:      "test",
+		advertisePayment: &config.TunnelSectionPayment{
+			Chain: []config.PaymentChain{
+				{
+					NodeKey:                      payNode,
+					PercentFeePerVirtualChannel:  0.5,
+					MinFeePerVirtualChannel:      "0.01",
+					MaxCapacityPerVirtualChannel: "3",
+				},
+			},
+			JettonMaster:            &jetton,
+			PricePerPacketRouteNano: 10,
+			PricePerPacketOutNano:   20,
+		},
+	}
+
+	ni := gw.nodeInfo()
+	if err := ni.Sign(key); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	data, err := tl.Serialize(ni, true)
+	if err != nil {
+		t.Fatalf("Serialize() error = %v", err)
+	}
+
+	var info NodeInfo
+	if _, err = tl.Parse(&info, data, true); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if err = info.Verify(); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	sec, err := info.ToRouteSection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sec.Key, pub) || sec.Role != config.NodeRoleBoth || sec.Payment == nil {
+		t.Fatalf("unexpected route section: %+v", sec)
+	}
+
+	if *sec.Payment.JettonMaster != jetton || sec.Payment.PricePerPacketRouteNano != 10 || sec.Payment.PricePerPacketOutNano != 20 {
+		t.Fatalf("unexpected payment: %+v", sec.Payment)
+	}
+
+	if len(sec.Payment.Chain) != 1 || !bytes.Equal(sec.Payment.Chain[0].NodeKey, payNode) ||
+		sec.Payment.Chain[0].PercentFeePerVirtualChannel != 0.5 || sec.Payment.Chain[0].MinFeePerVirtualChannel != "0.01" {
+		t.Fatalf("unexpected payment chain: %+v", sec.Payment.Chain)
+	}
+
+	info.Payments[0].PriceOut = 1
+	if err = info.Verify(); err == nil {
+		t.Fatal("expected verification failure of modified info")
+	}
+
+	for _, fee := range []string{"abc", "-1", "NaN", "101"} {
+		info.Payments[0].Chain[0].PercentFee = fee
+		if _, err = info.ToRouteSection(); err == nil {
+			t.Fatalf("invalid percent fee %q should be rejected", fee)
+		}
+	}
+}
+
+func TestMergeNodesPool(t *testing.T) {
+	discovered := []config.TunnelRouteSection{
+		{Key: []byte{1}, Role: config.NodeRoleBoth},
+		{Key: []byte{2}, Role: config.NodeRoleBoth},
+	}
+	static := []config.TunnelRouteSection{
+		{Key: []byte{2}, Role: config.NodeRoleRelay},
+		{Key: []byte{3}},
+	}
+
+	res := mergeNodesPool(discovered, static)
+	if len(res) != 3 {
+		t.Fatalf("expected 3 nodes, got %d", len(res))
+	}
+
+	for _, s := range res {
+		if s.Key[0] == 2 && s.Role != config.NodeRoleRelay {
+			t.Fatalf("static entry should override discovered, got role %s", s.Role)
+		}
+	}
+}
+
+func TestExitOnlyRoute(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _ := newTestGateway(t, ctx)
+	g.allowOut = true
+
+	inboundADNL, otherADNL := make([]byte, 32), make([]byte, 32)
+	inboundADNL[0], otherADNL[0] = 1, 2
+	for _, id := range [][]byte{inboundADNL, otherADNL} {
+		g.activePeers[string(id)] = &Peer{id: id, gw: g, closerCtx: ctx, closer: func() {}, discoverInProgress: 1}
+	}
+
+	inboundKey, otherKey := make([]byte, 32), make([]byte, 32)
+	inboundKey[0], otherKey[0] = 3, 4
+
+	s := &Section{key: make([]byte, 32), gw: g, routes: map[uint32]*Route{}, log: zerolog.Nop()}
+	route := func(adnlID, key []byte) error {
+		return BuildRouteInstruction{
+			TargetADNL:          adnlID,
+			TargetSectionPubKey: key,
+			RouteID:             ^binary.LittleEndian.Uint32(key),
+		}.Execute(ctx, s, nil, nil)
+	}
+
+	if err := route(inboundADNL, inboundKey); err == nil {
+		t.Fatal("route should be rejected when out is not bound")
+	}
+
+	s.out = &Out{InboundADNL: inboundADNL, InboundSectionKey: inboundKey}
+	if err := route(otherADNL, otherKey); err == nil {
+		t.Fatal("route to target which is not inbound of out should be rejected")
+	}
+	if err := route(otherADNL, inboundKey); err == nil {
+		t.Fatal("route to other node should be rejected")
+	}
+	if err := route(inboundADNL, inboundKey); err != nil {
+		t.Fatal("route back to out client should be allowed", err)
+	}
+}
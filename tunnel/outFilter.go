@@ -0,0 +1,330 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/ton-blockchain/adnl-tunnel/metrics"
+	"github.com/xssnick/tonutils-go/tl"
+	"net/netip"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+func init() {
+	tl.Register(OutFilterBan{}, "adnlTunnel.outFilterBan ip:bytes bits:int = adnlTunnel.OutFilterBan")
+
+	instructionOpcodes[tl.Register(OutFilterInstruction{}, "adnlTunnel.outFilterInstruction connectedOnly:Bool connectedTtl:int perSourcePps:int perSourceBurst:int bans:(vector adnlTunnel.outFilterBan) = adnlTunnel.Instruction")] = reflect.TypeOf(OutFilterInstruction{})
+}
+
+const (
+	OutDropReasonNotPaid      = "not_paid"
+	OutDropReasonNotConnected = "not_connected"
+	OutDropReasonRateLimit    = "rate_limit"
+	OutDropReasonBanned       = "banned"
+)
+
+const OutFilterDefaultConnectedTTLSec = 120
+const OutFilterMaxBans = 256
+
+// OutFilterMaxSources limits how many addresses are tracked as contacted, and for per source rate limit,
+// packets of new sources are dropped by rate limit when it is reached
+const OutFilterMaxSources = 64 * 1024
+
+// OutFilterBan is a subnet to drop incoming packets from, Bits = 0 means whole IP
+type OutFilterBan struct {
+	IP   []byte `tl:"bytes"`
+	Bits uint32 `tl:"int"`
+}
+
+// OutFilterInstruction configures admission policy for incoming packets of out gateway,
+// filtered packets are dropped before being forwarded, so client is not paying for them
+type OutFilterInstruction struct {
+	// ConnectedOnly accepts packets only from addresses we sent to in last ConnectedTTLSec
+	ConnectedOnly   bool   `tl:"bool"`
+	ConnectedTTLSec uint32 `tl:"int"`
+
+	// PerSourcePPS limits packets per second from each source address, 0 = unlimited
+	PerSourcePPS   uint32 `tl:"int"`
+	PerSourceBurst uint32 `tl:"int"`
+
+	Bans []OutFilterBan `tl:"vector struct"`
+}
+
+type outFilter struct {
+	cfg  OutFilterInstruction
+	ttl  int64
+	bans []netip.Prefix
+	rate *sourceLimiter
+}
+
+// sourceBucket is a token bucket of one source address
+type sourceBucket struct {
+	tokens float64
+	at     time.Time
+}
+
+// sourceLimiter limits packets per second of each source, addresses are keys as is, to not allocate per packet
+type sourceLimiter struct {
+	pps     float64
+	burst   float64
+	buckets map[netip.AddrPort]*sourceBucket
+	mx      sync.Mutex
+}
+
+func (ins OutFilterInstruction) Execute(ctx context.Context, s *Section, msg *EncryptedMessage, restInstructions []byte) error {
+	if !s.gw.allowOut {
+		return fmt.Errorf("instruction is not executable since out is not allowed")
+	}
+
+	s.mx.RLock()
+	out := s.out
+	s.mx.RUnlock()
+
+	if out == nil {
+		return fmt.Errorf("out is not binded")
+	}
+
+	if cur := out.getFilter(); cur != nil && cur.cfg.equal(&ins) {
+		return nil
+	}
+
+	f, err := newOutFilter(ins)
+	if err != nil {
+		return fmt.Errorf("invalid filter: %w", err)
+	}
+	atomic.StorePointer(&out.filter, unsafe.Pointer(f))
+
+	out.log.Debug().Bool("connected_only", ins.ConnectedOnly).
+		Uint32("pps", ins.PerSourcePPS).
+		Int("bans", len(f.bans)).
+		Msg("out filter updated")
+
+	return nil
+}
+
+func newOutFilter(cfg OutFilterInstruction) (*outFilter, error) {
+	if len(cfg.Bans) > OutFilterMaxBans {
+		return nil, fmt.Errorf("too many bans: %d, max is %d", len(cfg.Bans), OutFilterMaxBans)
+	}
+
+	f := &outFilter{
+		cfg: cfg,
+		ttl: int64(cfg.ConnectedTTLSec),
+	}
+	if f.ttl == 0 {
+		f.ttl = OutFilterDefaultConnectedTTLSec
+	}
+
+	for i, ban := range cfg.Bans {
+		ip, ok := netip.AddrFromSlice(ban.IP)
+		if !ok {
+			return nil, fmt.Errorf("invalid ip in ban %d", i)
+		}
+		ip = ip.Unmap()
+
+		bits := int(ban.Bits)
+		if bits == 0 || bits > ip.BitLen() {
+			bits = ip.BitLen()
+		}
+
+		p, err := ip.Prefix(bits)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prefix in ban %d: %w", i, err)
+		}
+		f.bans = append(f.bans, p)
+	}
+
+	if cfg.PerSourcePPS > 0 {
+		burst := int64(cfg.PerSourceBurst)
+		if burst < int64(cfg.PerSourcePPS) {
+			burst = int64(cfg.PerSourcePPS)
+		}
+		f.rate = &sourceLimiter{
+			pps:     float64(cfg.PerSourcePPS),
+			burst:   float64(burst),
+			buckets: map[netip.AddrPort]*sourceBucket{},
+		}
+	}
+
+	return f, nil
+}
+
+func (c *OutFilterInstruction) equal(ins *OutFilterInstruction) bool {
+	if c.ConnectedOnly != ins.ConnectedOnly ||
+		c.ConnectedTTLSec != ins.ConnectedTTLSec ||
+		c.PerSourcePPS != ins.PerSourcePPS ||
+		c.PerSourceBurst != ins.PerSourceBurst ||
+		len(c.Bans) != len(ins.Bans) {
+		return false
+	}
+
+	for i := range c.Bans {
+		if c.Bans[i].Bits != ins.Bans[i].Bits || !bytes.Equal(c.Bans[i].IP, ins.Bans[i].IP) {
+			return false
+		}
+	}
+	return true
+}
+
+// check returns drop reason, or empty string when packet is accepted
+func (f *outFilter) check(o *Out, from netip.AddrPort, now int64) string {
+	for _, ban := range f.bans {
+		if ban.Contains(from.Addr()) {
+			return OutDropReasonBanned
+		}
+	}
+
+	if f.cfg.ConnectedOnly {
+		at, ok := o.contacted.Load(from)
+		if !ok || atomic.LoadInt64(at.(*int64)) < now-f.ttl {
+			return OutDropReasonNotConnected
+		}
+	}
+
+	if f.rate != nil && !f.rate.allow(from, time.Now()) {
+		return OutDropReasonRateLimit
+	}
+	return ""
+}
+
+func (l *sourceLimiter) allow(from netip.AddrPort, now time.Time) bool {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	b := l.buckets[from]
+	if b == nil {
+		if len(l.buckets) >= OutFilterMaxSources {
+			return false
+		}
+		b = &sourceBucket{tokens: l.burst, at: now}
+		l.buckets[from] = b
+	}
+
+	b.tokens += now.Sub(b.at).Seconds() * l.pps
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.at = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// prune removes buckets which are refilled, their sources are idle
+func (l *sourceLimiter) prune(now time.Time) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	for from, b := range l.buckets {
+		if b.tokens+now.Sub(b.at).Seconds()*l.pps >= l.burst {
+			delete(l.buckets, from)
+		}
+	}
+}
+
+func (o *Out) getFilter() *outFilter {
+	return (*outFilter)(atomic.LoadPointer(&o.filter))
+}
+
+// markContacted remembers destination, to accept packets from it in connected only mode.
+// It is recorded even when filter is not set, so connected only mode works for flows started before it.
+func (o *Out) markContacted(dst netip.AddrPort) {
+	now := time.Now().Unix()
+	if at, ok := o.contacted.Load(dst); ok {
+		atomic.StoreInt64(at.(*int64), now)
+		return
+	}
+
+	if atomic.LoadInt64(&o.contactedNum) >= OutFilterMaxSources {
+		return
+	}
+
+	if _, loaded := o.contacted.LoadOrStore(dst, &now); !loaded {
+		atomic.AddInt64(&o.contactedNum, 1)
+	}
+}
+
+func (o *Out) dropIn(reason string) {
+	atomic.AddUint64(&o.PacketsDroppedIn, 1)
+	metrics.OutDroppedPackets.WithLabelValues(reason).Inc()
+}
+
+func (o *Out) filterCleaner() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-o.closer.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ttl := int64(OutFilterDefaultConnectedTTLSec)
+		if f := o.getFilter(); f != nil {
+			if f.rate != nil {
+				f.rate.prune(time.Now())
+			}
+			ttl = f.ttl
+		}
+
+		tm := time.Now().Unix()
+		o.contacted.Range(func(key, value any) bool {
+			if atomic.LoadInt64(value.(*int64)) < tm-ttl {
+				if _, deleted := o.contacted.LoadAndDelete(key); deleted {
+					atomic.AddInt64(&o.contactedNum, -1)
+				}
+			}
+			return true
+		})
+	}
+}
+
+// SetOutFilter sets admission policy for incoming packets on out gateway,
+// it is delivered with control messages, nil disables filtering
+func (t *RegularOutTunnel) SetOutFilter(f *OutFilterInstruction) {
+	if f == nil {
+		// empty filter accepts everything
+		f = &OutFilterInstruction{}
+	}
+
+	t.mx.Lock()
+	t.outFilter = f
+	t.mx.Unlock()
+
+	t.requestControlMessage()
+}
+
+func outFilterFromConfig(cfg *config.OutFilterConfig) (*OutFilterInstruction, error) {
+	f := &OutFilterInstruction{
+		ConnectedOnly:   cfg.ConnectedOnly,
+		ConnectedTTLSec: cfg.ConnectedTTLSec,
+		PerSourcePPS:    cfg.PerSourcePPS,
+		PerSourceBurst:  cfg.PerSourceBurst,
+	}
+
+	bans, err := parsePrefixes(cfg.Bans)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bans: %w", err)
+	}
+
+	for _, p := range bans {
+		f.Bans = append(f.Bans, OutFilterBan{
+			IP:   p.Addr().AsSlice(),
+			Bits: uint32(p.Bits()),
+		})
+	}
+
+	if _, err := newOutFilter(*f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/xssnick/tonutils-go/tl"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+	"unsafe"
+)
+
+func TestOutFilterCheck(t *testing.T) {
+	ins, err := outFilterFromConfig(&config.OutFilterConfig{
+		ConnectedOnly:  true,
+		PerSourcePPS:   2,
+		PerSourceBurst: 2,
+		Bans:           []string{"10.0.0.0/8", "1.2.3.4"},
+	})
+	if err != nil {
+		t.Fatalf("outFilterFromConfig() error = %v", err)
+	}
+
+	f, err := newOutFilter(*ins)
+	if err != nil {
+		t.Fatalf("newOutFilter() error = %v", err)
+	}
+
+	o := &Out{}
+	o.filter = unsafe.Pointer(f)
+
+	now := time.Now().Unix()
+	known := netip.MustParseAddrPort("8.8.8.8:53")
+	o.markContacted(known)
+
+	if r := f.check(o, netip.MustParseAddrPort("10.1.2.3:53"), now); r != OutDropReasonBanned {
+		t.Fatalf("expected banned subnet, got %q", r)
+	}
+	if r := f.check(o, netip.MustParseAddrPort("1.2.3.4:53"), now); r != OutDropReasonBanned {
+		t.Fatalf("expected banned ip, got %q", r)
+	}
+	if r := f.check(o, netip.MustParseAddrPort("8.8.4.4:53"), now); r != OutDropReasonNotConnected {
+		t.Fatalf("expected not connected, got %q", r)
+	}
+	if r := f.check(o, known, now+OutFilterDefaultConnectedTTLSec+1); r != OutDropReasonNotConnected {
+		t.Fatalf("expected expired connection, got %q", r)
+	}
+
+	for i := 0; i < 2; i++ {
+		if r := f.check(o, known, now); r != "" {
+			t.Fatalf("expected accepted packet %d, got %q", i, r)
+		}
+	}
+	if r := f.check(o, known, now); r != OutDropReasonRateLimit {
+		t.Fatalf("expected rate limit, got %q", r)
+	}
+}
+
+func TestOutContactedWithoutFilter(t *testing.T) {
+	o := &Out{}
+	known := netip.MustParseAddrPort("8.8.8.8:53")
+	o.markContacted(known)
+	o.markContacted(known)
+
+	if o.contactedNum != 1 {
+		t.Fatal("contacted address should be recorded once without filter")
+	}
+
+	// filter enabled later accepts flows which were started before it
+	f, err := newOutFilter(OutFilterInstruction{ConnectedOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := f.check(o, known, time.Now().Unix()); r != "" {
+		t.Fatalf("expected accepted packet, got %q", r)
+	}
+
+	o.contactedNum = OutFilterMaxSources
+	o.markContacted(netip.MustParseAddrPort("8.8.4.4:53"))
+	if _, ok := o.contacted.Load(netip.MustParseAddrPort("8.8.4.4:53")); ok {
+		t.Fatal("contacted addresses should be limited")
+	}
+}
+
+func TestOutFilterInstructionSerialize(t *testing.T) {
+	ins := OutFilterInstruction{
+		ConnectedOnly:   true,
+		ConnectedTTLSec: 60,
+		PerSourcePPS:    100,
+		Bans: []OutFilterBan{
+			{IP: net.IPv4(1, 2, 3, 4).To4(), Bits: 24},
+		},
+	}
+
+	data, err := tl.Serialize(ins, true)
+	if err != nil {
+		t.Fatalf("Serialize() error = %v", err)
+	}
+
+	var parsed OutFilterInstruction
+	if _, err = tl.Parse(&parsed, data, true); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if !parsed.equal(&ins) {
+		t.Fatalf("parsed instruction is not equal to original: %+v", parsed)
+	}
+}
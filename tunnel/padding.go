@@ -0,0 +1,253 @@
+package tunnel
+
+import (
+	"context"
+	"fmt"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/xssnick/tonutils-go/tl"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync/atomic"
+	"unsafe"
+)
+
+func init() {
+	instructionOpcodes[tl.Register(OutPaddingInstruction{}, "adnlTunnel.outPaddingInstruction mode:int maxRandom:int buckets:(vector int) = adnlTunnel.Instruction")] = reflect.TypeOf(OutPaddingInstruction{})
+}
+
+// PaddingMode defines how payload size is hidden from relays
+type PaddingMode uint32
+
+const (
+	PaddingModeOff PaddingMode = iota
+	// PaddingModeRandom appends random number of bytes, up to MaxRandom
+	PaddingModeRandom
+	// PaddingModeBuckets pads payload to the nearest bucket size, so only few sizes are visible
+	PaddingModeBuckets
+)
+
+const PaddingMaxBuckets = 8
+
+// PaddingBytesPerPacket is how many padding bytes are paid as one packet
+const PaddingBytesPerPacket = PayloadMTU
+
+// DefaultPaddingBuckets are used when buckets mode is set without sizes
+var DefaultPaddingBuckets = []uint32{128, 256, 512, PayloadMTU}
+
+// PaddingPolicy is applied to payloads after serialization and before encryption.
+// Padding is appended after serialized payload, receiver drops it when parses payload,
+// so nodes of older versions are also accepting padded payloads.
+type PaddingPolicy struct {
+	Mode      PaddingMode
+	MaxRandom uint32
+	Buckets   []uint32
+}
+
+// OutPaddingInstruction sets padding policy of out gateway for payloads sent back to the client
+type OutPaddingInstruction struct {
+	Mode      uint32   `tl:"int"`
+	MaxRandom uint32   `tl:"int"`
+	Buckets   []uint32 `tl:"vector int"`
+}
+
+func (m PaddingMode) String() string {
+	switch m {
+	case PaddingModeOff:
+		return "off"
+	case PaddingModeRandom:
+		return "random"
+	case PaddingModeBuckets:
+		return "buckets"
+	}
+	return fmt.Sprintf("unknown(%d)", uint32(m))
+}
+
+func (p *PaddingPolicy) validate() error {
+	switch p.Mode {
+	case PaddingModeOff:
+	case PaddingModeRandom:
+		if p.MaxRandom == 0 || p.MaxRandom > PayloadMTU {
+			return fmt.Errorf("max random padding should be in range 1-%d", PayloadMTU)
+		}
+	case PaddingModeBuckets:
+		if len(p.Buckets) == 0 || len(p.Buckets) > PaddingMaxBuckets {
+			return fmt.Errorf("buckets number should be in range 1-%d", PaddingMaxBuckets)
+		}
+
+		for i, b := range p.Buckets {
+			if b == 0 || b > PayloadMTU {
+				return fmt.Errorf("bucket size should be in range 1-%d", PayloadMTU)
+			}
+			if i > 0 && b <= p.Buckets[i-1] {
+				return fmt.Errorf("buckets should be sorted ascending")
+			}
+		}
+	default:
+		return fmt.Errorf("unknown padding mode %d", p.Mode)
+	}
+	return nil
+}
+
+// paddingSize returns how many bytes should be appended to payload of given size
+func (p *PaddingPolicy) paddingSize(size int) int {
+	if p == nil || size >= PayloadMTU {
+		return 0
+	}
+
+	var n int
+	switch p.Mode {
+	case PaddingModeRandom:
+		n = rand.Intn(int(p.MaxRandom) + 1)
+	case PaddingModeBuckets:
+		for _, b := range p.Buckets {
+			if int(b) >= size {
+				return int(b) - size
+			}
+		}
+	}
+
+	if size+n > PayloadMTU {
+		n = PayloadMTU - size
+	}
+	return n
+}
+
+// pad returns data with padding and its size, padding is zeroes, they are encrypted after
+func (p *PaddingPolicy) pad(data []byte) ([]byte, int) {
+	n := p.paddingSize(len(data))
+	if n == 0 {
+		return data, 0
+	}
+	return append(data, make([]byte, n)...), n
+}
+
+func (p *PaddingPolicy) instruction() OutPaddingInstruction {
+	return OutPaddingInstruction{
+		Mode:      uint32(p.Mode),
+		MaxRandom: p.MaxRandom,
+		Buckets:   p.Buckets,
+	}
+}
+
+func (ins OutPaddingInstruction) Execute(ctx context.Context, s *Section, msg *EncryptedMessage, restInstructions []byte) error {
+	if !s.gw.allowOut {
+		return fmt.Errorf("instruction is not executable since out is not allowed")
+	}
+
+	s.mx.RLock()
+	out := s.out
+	s.mx.RUnlock()
+
+	if out == nil {
+		return fmt.Errorf("out is not binded")
+	}
+
+	p := &PaddingPolicy{
+		Mode:      PaddingMode(ins.Mode),
+		MaxRandom: ins.MaxRandom,
+		Buckets:   ins.Buckets,
+	}
+	if err := p.validate(); err != nil {
+		return fmt.Errorf("invalid padding policy: %w", err)
+	}
+
+	if p.Mode == PaddingModeOff {
+		p = nil
+	}
+	atomic.StorePointer(&out.padding, unsafe.Pointer(p))
+
+	return nil
+}
+
+func (o *Out) getPadding() *PaddingPolicy {
+	return (*PaddingPolicy)(atomic.LoadPointer(&o.padding))
+}
+
+// surcharge returns padding bytes which are paid with each packet. It is derived from policy and not from actual padding,
+// so both sides count the same cost by seqno of packets, even when some messages are lost.
+// It is an expected padding: half of max random, or half of the largest gap between buckets.
+func (p *PaddingPolicy) surcharge() uint64 {
+	if p == nil {
+		return 0
+	}
+
+	switch p.Mode {
+	case PaddingModeRandom:
+		return uint64(p.MaxRandom) / 2
+	case PaddingModeBuckets:
+		var prev, gap uint32
+		for _, b := range p.Buckets {
+			if b-prev > gap {
+				gap = b - prev
+			}
+			prev = b
+		}
+		return uint64(gap) / 2
+	}
+	return 0
+}
+
+// paddingPackets returns number of packets which pay padding surcharge of packets with seqno in range (from, to]
+func paddingPackets(from, to, surcharge uint64) int64 {
+	if surcharge == 0 || to <= from {
+		return 0
+	}
+	return int64(to*surcharge/PaddingBytesPerPacket - from*surcharge/PaddingBytesPerPacket)
+}
+
+// SetPaddingPolicy sets padding for both directions, out gateway receives its policy with init message,
+// so it should be called before WaitForInit, or it will be applied to out gateway on next reinit
+func (t *RegularOutTunnel) SetPaddingPolicy(p *PaddingPolicy) error {
+	if p != nil {
+		if err := p.validate(); err != nil {
+			return err
+		}
+
+		if p.Mode == PaddingModeOff {
+			p = nil
+		}
+	}
+
+	atomic.StorePointer(&t.padding, unsafe.Pointer(p))
+	return nil
+}
+
+func (t *RegularOutTunnel) getPadding() *PaddingPolicy {
+	return (*PaddingPolicy)(atomic.LoadPointer(&t.padding))
+}
+
+// paddingSurcharge returns padding bytes paid with each packet, by policy which was sent to out gate
+func (t *RegularOutTunnel) paddingSurcharge() uint64 {
+	if !t.usePayments || !t.paddingCharged {
+		return 0
+	}
+	return (*PaddingPolicy)(atomic.LoadPointer(&t.outPadding)).surcharge()
+}
+
+func paddingFromConfig(cfg *config.PaddingConfig) (*PaddingPolicy, error) {
+	p := &PaddingPolicy{
+		MaxRandom: cfg.MaxRandom,
+		Buckets:   append([]uint32{}, cfg.Buckets...),
+	}
+
+	switch cfg.Mode {
+	case "", "off":
+		p.Mode = PaddingModeOff
+	case "random":
+		p.Mode = PaddingModeRandom
+	case "buckets":
+		p.Mode = PaddingModeBuckets
+		if len(p.Buckets) == 0 {
+			p.Buckets = append([]uint32{}, DefaultPaddingBuckets...)
+		}
+		sort.Slice(p.Buckets, func(i, j int) bool { return p.Buckets[i] < p.Buckets[j] })
+	default:
+		return nil, fmt.Errorf("unknown padding mode %q", cfg.Mode)
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
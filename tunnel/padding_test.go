@@ -0,0 +1,112 @@
+package tunnel
+
+import (
+	"bytes"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"github.com/xssnick/tonutils-go/tl"
+	"testing"
+)
+
+func TestPaddingPolicy(t *testing.T) {
+	p, err := paddingFromConfig(&config.PaddingConfig{Mode: "buckets", Buckets: []uint32{512, 128}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for size, want := range map[int]int{1: 128, 128: 128, 129: 512, 600: 600, PayloadMTU: PayloadMTU} {
+		if got := size + p.paddingSize(size); got != want {
+			t.Fatalf("size %d padded to %d, want %d", size, got, want)
+		}
+	}
+
+	r := &PaddingPolicy{Mode: PaddingModeRandom, MaxRandom: 64}
+	for i := 0; i < 100; i++ {
+		if n := r.paddingSize(PayloadMTU - 10); n > 10 {
+			t.Fatalf("padding should not exceed payload mtu, got %d", n)
+		}
+		if n := r.paddingSize(100); n > 64 {
+			t.Fatalf("random padding exceeds max, got %d", n)
+		}
+	}
+
+	if _, err = paddingFromConfig(&config.PaddingConfig{Mode: "random"}); err == nil {
+		t.Fatal("random mode without max should be rejected")
+	}
+	if _, err = paddingFromConfig(&config.PaddingConfig{Mode: "buckets", Buckets: []uint32{PayloadMTU + 1}}); err == nil {
+		t.Fatal("bucket bigger than mtu should be rejected")
+	}
+	if err = (&PaddingPolicy{Mode: PaddingModeBuckets, Buckets: []uint32{256, 128}}).validate(); err == nil {
+		t.Fatal("not sorted buckets should be rejected")
+	}
+
+	var nilPolicy *PaddingPolicy
+	if _, n := nilPolicy.pad([]byte{1, 2, 3}); n != 0 {
+		t.Fatal("nil policy should not pad")
+	}
+}
+
+func TestPaddingStripped(t *testing.T) {
+	pl := SendOutPayload{Seqno: 5, IP: []byte{1, 2, 3, 4}, Port: 80, Payload: []byte("hello")}
+	data, err := tl.Serialize(pl, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := &PaddingPolicy{Mode: PaddingModeBuckets, Buckets: DefaultPaddingBuckets}
+	padded, n := p.pad(data)
+	if len(padded) != 128 || n != 128-len(data) {
+		t.Fatalf("unexpected padded size %d", len(padded))
+	}
+
+	var parsed tl.Serializable
+	rest, err := tl.Parse(&parsed, padded, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rest) != n || !bytes.Equal(parsed.(SendOutPayload).Payload, pl.Payload) {
+		t.Fatal("padding should be left after parsed payload")
+	}
+
+	ins := p.instruction()
+	data, err = tl.Serialize(ins, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsedIns OutPaddingInstruction
+	if _, err = tl.Parse(&parsedIns, data, true); err != nil {
+		t.Fatal(err)
+	}
+	if parsedIns.Mode != uint32(PaddingModeBuckets) || len(parsedIns.Buckets) != len(DefaultPaddingBuckets) {
+		t.Fatal("instruction is not equal after parse")
+	}
+}
+
+func TestPaddingSurcharge(t *testing.T) {
+	if (*PaddingPolicy)(nil).surcharge() != 0 || (&PaddingPolicy{}).surcharge() != 0 {
+		t.Fatal("no padding should not be charged")
+	}
+
+	if s := (&PaddingPolicy{Mode: PaddingModeRandom, MaxRandom: 200}).surcharge(); s != 100 {
+		t.Fatalf("unexpected random surcharge: %d", s)
+	}
+
+	if s := (&PaddingPolicy{Mode: PaddingModeBuckets, Buckets: []uint32{128, 256, 1000}}).surcharge(); s != 372 {
+		t.Fatalf("unexpected buckets surcharge: %d", s)
+	}
+
+	// cost depends only on seqno range, so lost packets are not making sides to disagree
+	surcharge := uint64(PaddingBytesPerPacket / 4)
+	var one int64
+	for seqno := uint64(1); seqno <= 10; seqno++ {
+		one += paddingPackets(seqno-1, seqno, surcharge)
+	}
+	if one != 2 || paddingPackets(0, 10, surcharge) != one {
+		t.Fatalf("unexpected packets for padding: %d", one)
+	}
+
+	if paddingPackets(5, 5, surcharge) != 0 || paddingPackets(^uint64(0), 0, surcharge) != 0 {
+		t.Fatal("empty range should not be charged")
+	}
+}
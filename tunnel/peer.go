@@ -34,6 +34,14 @@ type Peer struct {
 
 	discoverInProgress int32
 
+	gossipRequested    int32
+	lastGossipAnswerAt int64
+
+	lastChallengeAt int64
+
+	rtt   peerRTT
+	rttMx sync.Mutex
+
 	closerCtx context.Context
 	closer    context.CancelFunc
 	mx        sync.Mutex
@@ -110,6 +118,18 @@ func (p *Peer) discover(ctx context.Context) error {
 	return nil
 }
 
+// waitConnected waits until peer is discovered and connected
+func (p *Peer) waitConnected(ctx context.Context) error {
+	for p.getConn() == nil {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	return nil
+}
+
 func (p *Peer) getConn() adnl.Peer {
 	c := (*connAtomic)(atomic.LoadPointer(&p.conn))
 	if c == nil {
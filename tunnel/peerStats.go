@@ -0,0 +1,176 @@
+package tunnel
+
+import (
+	"encoding/base64"
+	"github.com/ton-blockchain/adnl-tunnel/metrics"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// PeerPingTimeout is how long to wait for pong, after that ping is considered lost
+var PeerPingTimeout = 9 * time.Second
+
+// PeerUnresponsiveAfter is how long peer should not answer to pings, to consider it unreachable
+var PeerUnresponsiveAfter = 7 * time.Second
+
+// MetricsMaxPeers limits number of peers exported to metrics, most referenced peers are exported
+const MetricsMaxPeers = 32
+
+// peerRTT is round trip time estimation of keepalive pings, similar to tcp (rfc 6298)
+type peerRTT struct {
+	pings map[uint64]time.Time
+
+	srtt    time.Duration
+	rttVar  time.Duration
+	minRTT  time.Duration
+	lastRTT time.Duration
+	jitter  time.Duration
+	// loss is a smoothed part of lost pongs, from 0 to 1
+	loss float64
+
+	lastPongAt int64
+}
+
+// PeerRTTStats is a latency and loss to directly connected peer
+type PeerRTTStats struct {
+	SRTT     time.Duration
+	RTTVar   time.Duration
+	MinRTT   time.Duration
+	Jitter   time.Duration
+	PongLoss float64
+	// LastPongAt is 0 when peer never answered
+	LastPongAt int64
+}
+
+// sendPing sends keepalive ping and remembers its time, to measure rtt when pong is received
+func (p *Peer) sendPing() error {
+	seqno := atomic.AddUint64(&p.pingSeqno, 1)
+
+	now := time.Now()
+	p.rttMx.Lock()
+	if p.rtt.pings == nil {
+		p.rtt.pings = map[uint64]time.Time{}
+	}
+	for s, at := range p.rtt.pings {
+		if now.Sub(at) > PeerPingTimeout {
+			delete(p.rtt.pings, s)
+			p.rtt.loss = p.rtt.loss*0.9 + 0.1
+		}
+	}
+	p.rtt.pings[seqno] = now
+	p.rttMx.Unlock()
+
+	return p.SendCustomMessage(p.closerCtx, Ping{
+		Seqno: seqno,
+	})
+}
+
+func (p *Peer) pongReceived(seqno uint64) {
+	p.rttMx.Lock()
+	defer p.rttMx.Unlock()
+
+	at, ok := p.rtt.pings[seqno]
+	if !ok {
+		// late or not ours
+		return
+	}
+	delete(p.rtt.pings, seqno)
+
+	r := &p.rtt
+	rtt := time.Since(at)
+	if r.srtt == 0 {
+		r.srtt = rtt
+		r.rttVar = rtt / 2
+		r.minRTT = rtt
+	} else {
+		diff := r.srtt - rtt
+		if diff < 0 {
+			diff = -diff
+		}
+		r.rttVar = (r.rttVar*3 + diff) / 4
+		r.srtt = (r.srtt*7 + rtt) / 8
+
+		if rtt < r.minRTT {
+			r.minRTT = rtt
+		}
+
+		d := rtt - r.lastRTT
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (d - r.jitter) / 16
+	}
+	r.lastRTT = rtt
+	r.loss *= 0.9
+	r.lastPongAt = time.Now().Unix()
+}
+
+// RTTStats returns latency and loss of keepalive pings to peer
+func (p *Peer) RTTStats() PeerRTTStats {
+	p.rttMx.Lock()
+	defer p.rttMx.Unlock()
+
+	return PeerRTTStats{
+		SRTT:       p.rtt.srtt,
+		RTTVar:     p.rtt.rttVar,
+		MinRTT:     p.rtt.minRTT,
+		Jitter:     p.rtt.jitter,
+		PongLoss:   p.rtt.loss,
+		LastPongAt: p.rtt.lastPongAt,
+	}
+}
+
+// unresponsive returns true when peer answered before, but not answers to pings sent after that for a while
+func (p *Peer) unresponsive(now time.Time) bool {
+	p.rttMx.Lock()
+	defer p.rttMx.Unlock()
+
+	if p.rtt.lastPongAt == 0 {
+		return false
+	}
+
+	for _, at := range p.rtt.pings {
+		if at.Unix() >= p.rtt.lastPongAt && now.Sub(at) > PeerUnresponsiveAfter {
+			return true
+		}
+	}
+	return false
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func (g *Gateway) updatePeerMetrics() {
+	g.mx.RLock()
+	peers := make([]*Peer, 0, len(g.activePeers))
+	for _, peer := range g.activePeers {
+		peers = append(peers, peer)
+	}
+	g.mx.RUnlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return atomic.LoadInt64(&peers[i].references) > atomic.LoadInt64(&peers[j].references)
+	})
+	if len(peers) > MetricsMaxPeers {
+		peers = peers[:MetricsMaxPeers]
+	}
+
+	// reset removes peers which are gone, so number of series is bounded
+	metrics.PeerRTT.Reset()
+	metrics.PeerPongLoss.Reset()
+	for _, peer := range peers {
+		st := peer.RTTStats()
+		if st.LastPongAt == 0 {
+			continue
+		}
+
+		id := base64.StdEncoding.EncodeToString(peer.id)
+		metrics.PeerRTT.WithLabelValues(id, "smoothed").Set(st.SRTT.Seconds())
+		metrics.PeerRTT.WithLabelValues(id, "variance").Set(st.RTTVar.Seconds())
+		metrics.PeerRTT.WithLabelValues(id, "min").Set(st.MinRTT.Seconds())
+		metrics.PeerRTT.WithLabelValues(id, "jitter").Set(st.Jitter.Seconds())
+		metrics.PeerPongLoss.WithLabelValues(id).Set(st.PongLoss)
+	}
+}
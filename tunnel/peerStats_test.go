@@ -0,0 +1,72 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestPeerRTT(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, addPeer := newTestGateway(t, ctx)
+	pub, _, _ := ed25519.GenerateKey(nil)
+	addPeer(pub)
+
+	var p *Peer
+	for _, peer := range g.activePeers {
+		p = peer
+	}
+
+	// not connected peer, ping is remembered anyway, to be counted as lost
+	if err := p.sendPing(); err != ErrNotConnected {
+		t.Fatal("unexpected send result", err)
+	}
+
+	now := time.Now()
+	p.rtt.pings = map[uint64]time.Time{
+		1: now.Add(-100 * time.Millisecond),
+		2: now.Add(-40 * time.Millisecond),
+		3: now.Add(-PeerPingTimeout - time.Second),
+	}
+	p.pongReceived(1)
+	p.pongReceived(2)
+	p.pongReceived(2)
+
+	st := p.RTTStats()
+	if st.MinRTT < 40*time.Millisecond || st.MinRTT > 90*time.Millisecond {
+		t.Fatal("unexpected min rtt", st.MinRTT)
+	}
+	if st.SRTT <= st.MinRTT || st.SRTT >= 100*time.Millisecond+50*time.Millisecond || st.RTTVar == 0 || st.Jitter == 0 {
+		t.Fatal("unexpected rtt stats", st)
+	}
+	if st.LastPongAt == 0 || st.PongLoss != 0 {
+		t.Fatal("unexpected pong stats", st)
+	}
+
+	// expired ping is lost
+	_ = p.sendPing()
+	if st = p.RTTStats(); st.PongLoss == 0 {
+		t.Fatal("expired ping should be counted as lost")
+	}
+
+	if p.unresponsive(time.Now()) {
+		t.Fatal("peer answered recently")
+	}
+	if !p.unresponsive(time.Now().Add(PeerUnresponsiveAfter + time.Second)) {
+		t.Fatal("peer not answering to new pings should be unresponsive")
+	}
+
+	tun := &RegularOutTunnel{peer: p, lastFullyCheckedAt: time.Now().Add(-10 * time.Second).Unix(),
+		chainTo: []*SectionInfo{{}}, chainFrom: []*SectionInfo{{}}}
+	if !tun.looksDisconnected(time.Now().Add(PeerUnresponsiveAfter + time.Second)) {
+		t.Fatal("tunnel with unresponsive first hop should look disconnected earlier")
+	}
+
+	p.rtt.pings = nil
+	if tun.looksDisconnected(time.Now()) {
+		t.Fatal("tunnel should not look disconnected before timeout")
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+	"unsafe"
 )
 
 const (
@@ -63,6 +64,9 @@ type Payer struct {
 	LatestInstruction     *PaymentInstruction
 	LatestPacketsPaid     int64
 
+	// suspended is set when hop loses too many packets according to stats reports
+	suspended int32
+
 	feeMx sync.RWMutex
 }
 
@@ -77,7 +81,13 @@ type RegularOutTunnel struct {
 	peer              *Peer
 	usePayments       bool
 	paymentsConfirmed int32
-	wantDestroy       int32
+	// paymentsHeld is set while tunnel is a route candidate, so losing candidates are not paid
+	paymentsHeld int32
+	wantDestroy  int32
+	// outKept is set when out gate section is used by the rerouted tunnel
+	outKept int32
+	// existingSections are keys of sections taken from previous tunnel
+	existingSections []*EncryptionKeys
 
 	tunnelState       uint32
 	sendControlSignal chan struct{}
@@ -85,11 +95,33 @@ type RegularOutTunnel struct {
 	externalPort      uint16
 
 	onOutAddressChanged func(addr *net.UDPAddr)
+	onSendRejected      func(addr *net.UDPAddr, reason string)
+	outFilter           *OutFilterInstruction
+	rendezvous          *rendezvous
 
 	chainTo     []*SectionInfo
 	chainFrom   []*SectionInfo
 	payloadKeys *EncryptionKeys
 
+	// batch is nil when out gate not supports batch payloads
+	batch *batcher
+
+	fragments     *fragmentBuffer
+	fragmentSeqno uint64
+
+	padding unsafe.Pointer // *PaddingPolicy
+	// outPadding is a policy sent to out gate, padding surcharge is paid by it
+	outPadding unsafe.Pointer // *PaddingPolicy
+	// paddingCharged is true when out gate charges padding, older nodes are not
+	paddingCharged bool
+
+	coverStop context.CancelFunc
+	coverSent uint64
+
+	// spent is paid amount per currency, for tunnel spend budget
+	spent         map[string]*big.Int
+	budgetReached int32
+
 	read chan DeliverUDPPayload
 
 	seqnoSend               uint64
@@ -98,6 +130,7 @@ type RegularOutTunnel struct {
 	packetsRecvPaidConsumed uint64
 	packetsDropped          uint64
 	packetsSent             uint64
+	messagesRecv            uint64
 
 	controlSeqno             uint64
 	controlSeqnoReceived     uint64
@@ -109,9 +142,21 @@ type RegularOutTunnel struct {
 	packetsConsumedOut int64
 	packetsMinPaidIn   int64
 	packetsMinPaidOut  int64
+	// relays charge for each tunnel message, when datagrams are batched, it is less than packets
+	messagesConsumedOut int64
+	messagesMinPaidOut  int64
 
 	lastFullyCheckedAt int64
 
+	statsSeqno       uint64
+	statsPacketsSent uint64
+	hopStats         []*HopStats
+	statsMx          sync.RWMutex
+
+	rekey            *pendingRekey
+	rekeyedAt        time.Time
+	rekeyedOnPackets uint64
+
 	seqnoForward uint32
 
 	wDeadline time.Time
@@ -131,6 +176,11 @@ var ChannelCapacityForNumPayments int64 = 30
 var ChannelPacketsToPrepay int64 = 200000
 
 func (g *Gateway) CreateRegularOutTunnel(ctx context.Context, chainTo, chainFrom []*SectionInfo, log zerolog.Logger) (*RegularOutTunnel, error) {
+	return g.createRegularOutTunnel(ctx, chainTo, chainFrom, nil, nil, log)
+}
+
+// createRegularOutTunnel when prev is set, out gate section and payload key of it are reused
+func (g *Gateway) createRegularOutTunnel(ctx context.Context, chainTo, chainFrom []*SectionInfo, rv *rendezvous, prev *RegularOutTunnel, log zerolog.Logger) (*RegularOutTunnel, error) {
 	if len(chainTo) == 0 || len(chainFrom) == 0 {
 		return nil, fmt.Errorf("chains should have at least one node")
 	}
@@ -142,9 +192,31 @@ func (g *Gateway) CreateRegularOutTunnel(ctx context.Context, chainTo, chainFrom
 	// TODO: generate based on key (ipv6 form)
 	ap, _ := netip.ParseAddrPort("255.0.0.0:1")
 
-	pec, err := GenerateEncryptionKeys(chainTo[len(chainTo)-1].Keys.ReceiverPubKey)
-	if err != nil {
-		return nil, fmt.Errorf("generate payload key failed: %w", err)
+	for _, node := range append(append([]*SectionInfo{}, chainTo...), chainFrom...) {
+		if prev != nil && prev.hasKeys(node.Keys) {
+			// cipher of existing section is already negotiated
+			continue
+		}
+		node.Keys.Mode = g.cipherModeFor(node.Keys.ReceiverPubKey)
+	}
+
+	var pec *EncryptionKeys
+	if prev != nil {
+		pec = prev.payloadKeys
+	} else {
+		var err error
+		pec, err = GenerateEncryptionKeys(chainTo[len(chainTo)-1].Keys.ReceiverPubKey)
+		if err != nil {
+			return nil, fmt.Errorf("generate payload key failed: %w", err)
+		}
+		// out gate decrypts payload with the same cipher as its section
+		pec.Mode = chainTo[len(chainTo)-1].Keys.Mode
+	}
+
+	localID := binary.LittleEndian.Uint32(pec.SectionPubKey) // first 4 bytes
+	if prev != nil {
+		// payload key is shared with previous tunnel, it still receives packets until drained
+		localID = binary.LittleEndian.Uint32(chainFrom[len(chainFrom)-1].Keys.SectionPubKey)
 	}
 
 	id, err := tl.Hash(keys.PublicKeyED25519{Key: chainTo[0].Keys.ReceiverPubKey})
@@ -154,12 +226,13 @@ func (g *Gateway) CreateRegularOutTunnel(ctx context.Context, chainTo, chainFrom
 
 	closerCtx, closer := context.WithCancel(g.closerCtx)
 	rt := &RegularOutTunnel{
-		localID:            binary.LittleEndian.Uint32(pec.SectionPubKey), // first 4 bytes
+		localID:            localID,
 		gateway:            g,
 		peer:               g.addPeer(id, nil),
 		chainTo:            chainTo,
 		chainFrom:          chainFrom,
 		payloadKeys:        pec,
+		rekeyedAt:          time.Now(),
 		sendControlSignal:  make(chan struct{}, 1),
 		read:               make(chan DeliverUDPPayload, 512*1024),
 		localAddr:          net.UDPAddrFromAddrPort(ap),
@@ -169,8 +242,18 @@ func (g *Gateway) CreateRegularOutTunnel(ctx context.Context, chainTo, chainFrom
 		close:              closer,
 		packetsToPrepay:    ChannelPacketsToPrepay,
 		lastFullyCheckedAt: time.Now().Unix(),
+		rendezvous:         rv,
 	}
 	rt.peer.AddReference()
+	rt.fragments = newFragmentBuffer(func(reason string) {
+		atomic.AddUint64(&rt.packetsDropped, 1)
+		rt.log.Debug().Str("reason", reason).Msg("incomplete fragmented payload dropped")
+	})
+
+	if rv == nil && g.nodeHasCapability(chainTo[len(chainTo)-1].Keys.ReceiverPubKey, NodeCapabilityBatch) {
+		rt.batch = newBatcher(BatchMaxPackets, BatchFlushDelay, rt.flushOut)
+	}
+	rt.paddingCharged = rv == nil && g.nodeHasCapability(chainTo[len(chainTo)-1].Keys.ReceiverPubKey, NodeCapabilityPadding)
 
 	list := append([]*SectionInfo{}, chainTo...)
 	list = append(list, chainFrom...)
@@ -185,10 +268,14 @@ func (g *Gateway) CreateRegularOutTunnel(ctx context.Context, chainTo, chainFrom
 		}
 	}
 
+	if prev != nil {
+		rt.inheritOut(prev)
+	}
+
 	go rt.startControlSender()
 
 	g.mx.Lock()
-	g.tunnels[binary.LittleEndian.Uint32(rt.payloadKeys.SectionPubKey)] = rt
+	g.tunnels[rt.localID] = rt
 	g.mx.Unlock()
 
 	return rt, nil
@@ -251,12 +338,21 @@ func (t *RegularOutTunnel) SetOutAddressChangedHandler(f func(addr *net.UDPAddr)
 	t.onOutAddressChanged = f
 }
 
+// SetSendRejectedHandler sets callback for packets which out gateway refused to send, for example because of exit policy
+func (t *RegularOutTunnel) SetSendRejectedHandler(f func(addr *net.UDPAddr, reason string)) {
+	t.onSendRejected = f
+}
+
 func (t *RegularOutTunnel) startControlSender() {
 	const CheckEvery = 1 * time.Second
 
 	ticker := time.NewTicker(CheckEvery)
 
 	lastTry := time.Time{}
+	var statsRequestedAt time.Time
+	// difficulty of nodes is refreshed when sections are not accepted for a while
+	difficultyRefreshedAt := time.Now()
+	var refreshingDifficulty int32
 
 	t.requestControlMessage()
 	for {
@@ -280,6 +376,22 @@ func (t *RegularOutTunnel) startControlSender() {
 		lastTry = time.Now()
 
 		if atomic.LoadUint32(&t.tunnelState) == StateTypeConfiguring {
+			if time.Since(difficultyRefreshedAt) >= SectionDifficultyRefreshEvery && atomic.CompareAndSwapInt32(&refreshingDifficulty, 0, 1) {
+				difficultyRefreshedAt = time.Now()
+				go func() {
+					defer atomic.StoreInt32(&refreshingDifficulty, 0)
+
+					ctx, cancel := context.WithTimeout(t.closerCtx, SectionDifficultyRefreshEvery)
+					defer cancel()
+					t.refreshSectionsDifficulty(ctx)
+				}()
+			}
+
+			if err := t.ensureSectionsPoW(t.closerCtx); err != nil {
+				t.log.Error().Err(err).Msg("prepare sections proof of work failed")
+				continue
+			}
+
 			msg, err := t.prepareInitMessage(StateTypeConfiguring)
 			if err != nil {
 				t.log.Error().Err(err).Msg("prepare tunnel init failed")
@@ -298,12 +410,24 @@ func (t *RegularOutTunnel) startControlSender() {
 			log.Info().Msg("sending tunnel init message, waiting for confirmation")
 			continue
 		}
+		difficultyRefreshedAt = time.Now()
 
 		var paidRecvLoss float64
 		var attachPayments = false
 
 		if atomic.LoadUint32(&t.tunnelState) == StateTypeOptimized {
-			if time.Now().Unix()-atomic.LoadInt64(&t.lastFullyCheckedAt) > 15 {
+			if time.Since(statsRequestedAt) >= StatsRequestEverySec*time.Second {
+				statsRequestedAt = time.Now()
+				go t.sendStatsRequests()
+			}
+
+			if t.rekeyDue() {
+				if err := t.startRekey(); err != nil {
+					t.log.Error().Err(err).Msg("start rekey failed")
+				}
+			}
+
+			if t.looksDisconnected(time.Now()) {
 				t.log.Info().Msg("tunnel looks disconnected, trying to reconfigure...")
 
 				// try to reconfigure tunnel in case server restart on one of the nodes on the way
@@ -321,8 +445,10 @@ func (t *RegularOutTunnel) startControlSender() {
 				paidUsed := atomic.LoadUint64(&t.packetsRecvPaidConsumed)
 
 				// attaching payments only after checking that tunnel works
-				attachPayments = t.controlSeqnoReceived > 0
-				if attachPayments {
+				attachPayments = t.controlSeqnoReceived > 0 && atomic.LoadInt32(&t.paymentsHeld) == 0
+				// when all nodes report stats, loss is checked per hop, and only guilty hops are not paid
+				t.expireHopStats()
+				if attachPayments && !t.hasAllHopStats() {
 					const LossNumAcceptable = 5000 // + 33%
 					if paidUsed > received+received/3+LossNumAcceptable {
 						attachPayments = false
@@ -354,6 +480,24 @@ func (t *RegularOutTunnel) startControlSender() {
 	}
 }
 
+// looksDisconnected returns true when control messages are not returned for 15 seconds, or for 5 seconds,
+// when the first hop not answers to pings too. More time is given when the first hop is slow.
+func (t *RegularOutTunnel) looksDisconnected(now time.Time) bool {
+	since := now.Sub(time.Unix(atomic.LoadInt64(&t.lastFullyCheckedAt), 0))
+	if t.peer.unresponsive(now) {
+		return since > 5*time.Second
+	}
+
+	limit := 15 * time.Second
+	if st := t.peer.RTTStats(); st.SRTT > 0 {
+		// control message passes all hops and returns
+		if l := time.Duration(len(t.chainTo)+len(t.chainFrom)) * (st.SRTT + 4*st.RTTVar); l > limit {
+			limit = l
+		}
+	}
+	return since > limit
+}
+
 func (t *RegularOutTunnel) buildTunnelPaymentsChain(paymentTunnel []PaymentTunnelSection, initialCapacity *big.Int, baseTTL, hopTTL time.Duration) ([]transport.TunnelChainPart, error) {
 	n := len(paymentTunnel)
 
@@ -583,7 +727,7 @@ func (t *RegularOutTunnel) reassembleInstructions(msg *EncryptedMessage) (*Encry
 			return nil, fmt.Errorf("section %x not found", sectionKey)
 		}
 
-		data, err := decryptStream(sec.Keys.CipherKeyCRC, sec.Keys.CipherKey, restInstructions)
+		data, err := sec.Keys.decrypt(restInstructions)
 		if err != nil {
 			return nil, fmt.Errorf("decrypt stream %x failed: %v", sec.Keys.SectionPubKey, err)
 		}
@@ -669,7 +813,10 @@ func (t *RegularOutTunnel) prepareTunnelCloseMessage() (*EncryptedMessage, error
 
 		instructions = append(instructions, RouteInstruction{
 			RouteID: ^routeId, // through system tunnel
-		}, DestroyInstruction{})
+		})
+		if i != len(t.chainTo)-1 || atomic.LoadInt32(&t.outKept) == 0 {
+			instructions = append(instructions, DestroyInstruction{})
+		}
 
 		if err := nodes[i].Keys.EncryptInstructionsMessage(msg, instructions...); err != nil {
 			return nil, fmt.Errorf("encrypt failed: %w", err)
@@ -688,6 +835,7 @@ func (t *RegularOutTunnel) prepareTunnelControlMessage(withPayments, forcePaymen
 
 	var consumedOut = atomic.LoadInt64(&t.packetsConsumedOut)
 	var consumedIn = atomic.LoadInt64(&t.packetsConsumedIn)
+	var messagesConsumedOut = atomic.LoadInt64(&t.messagesConsumedOut)
 	var consumedMax = consumedOut
 	if consumedMax < consumedIn {
 		consumedMax = consumedIn
@@ -696,17 +844,18 @@ func (t *RegularOutTunnel) prepareTunnelControlMessage(withPayments, forcePaymen
 	msg := &EncryptedMessage{}
 
 	var mutations []func()
+	plan := t.gateway.payments.Budgets.plan(t.spent)
 
 	for i := len(nodes) - 1; i >= 0; i-- {
 		if i == len(nodes)-1 {
 			// deliver meta to ourself
-			if err := nodes[i].Keys.EncryptInstructionsMessage(msg, DeliverInitiatorInstruction{
+			if err := nodes[i].Keys.EncryptInstructionsMessage(msg, append(t.rekeyInstruction(i), DeliverInitiatorInstruction{
 				From: t.localID,
 				Metadata: PingMeta{
 					Seqno:        t.controlSeqno + 1,
 					WithPayments: withPayments,
 				},
-			}); err != nil {
+			})...); err != nil {
 				return nil, time.Time{}, fmt.Errorf("encrypt failed: %w", err)
 			}
 			continue
@@ -716,7 +865,7 @@ func (t *RegularOutTunnel) prepareTunnelControlMessage(withPayments, forcePaymen
 
 		routeId := binary.LittleEndian.Uint32(nodes[i+1].Keys.SectionPubKey)
 		// check if we need to pay
-		if p := nodes[i].PaymentInfo; withPayments && p != nil && p.PricePerPacket > 0 {
+		if p := nodes[i].PaymentInfo; withPayments && p != nil && p.PricePerPacket > 0 && atomic.LoadInt32(&p.suspended) == 0 {
 			skipNewPayment := false
 			if p.LatestInstruction != nil &&
 				p.LatestPaidOnSeqno > atomic.LoadUint64(&t.controlPaidSeqnoReceived) {
@@ -735,7 +884,7 @@ func (t *RegularOutTunnel) prepareTunnelControlMessage(withPayments, forcePaymen
 			}
 
 			if !skipNewPayment {
-				balance := consumedOut
+				balance := messagesConsumedOut
 				if i >= len(t.chainTo) {
 					balance = consumedIn
 				} else if i == len(t.chainTo)-1 {
@@ -744,13 +893,22 @@ func (t *RegularOutTunnel) prepareTunnelControlMessage(withPayments, forcePaymen
 				}
 				balance = p.PaidPackets - balance
 
-				if balance <= t.packetsToPrepay/2 || forcePayments {
-					prepay := t.packetsToPrepay - balance
-					if prepay < 0 {
-						prepay = 0
+				prepay := t.packetsToPrepay - balance
+				if prepay < 0 {
+					prepay = 0
+				}
+				price := new(big.Int).SetUint64(p.PricePerPacket)
+
+				needPayment := balance <= t.packetsToPrepay/2 || forcePayments
+				if needPayment && !plan.allow(p, new(big.Int).Mul(big.NewInt(prepay), price)) {
+					// hop is not prepaid anymore, tunnel should be rerouted instead of overspending
+					needPayment = false
+					if atomic.CompareAndSwapInt32(&t.budgetReached, 0, 1) {
+						t.log.Warn().Str("section_key", base64.StdEncoding.EncodeToString(nodes[i].Keys.SectionPubKey)).Msg("spend budget is reached, payments stopped")
 					}
+				}
 
-					price := new(big.Int).SetUint64(p.PricePerPacket)
+				if needPayment {
 					if p.CurrentChannel == nil || p.CurrentChannel.SafeDeadline.Before(time.Now()) {
 						regularAmount := new(big.Int).Mul(big.NewInt(t.packetsToPrepay), price)
 						// make capacity enough for ChannelCapacityForNumPayments payments,
@@ -819,6 +977,7 @@ func (t *RegularOutTunnel) prepareTunnelControlMessage(withPayments, forcePaymen
 					// and it will produce double spend otherwise.
 					// Channel may still be opened but spend will not happen.
 					mutations = append(mutations, func() {
+						t.spend(p, amount)
 						p.PaidPackets += payFor
 
 						p.LatestPacketsPaid = payFor
@@ -835,6 +994,11 @@ func (t *RegularOutTunnel) prepareTunnelControlMessage(withPayments, forcePaymen
 			}
 		}
 
+		if i == len(t.chainTo)-1 && t.outFilter != nil {
+			instructions = append(instructions, *t.outFilter)
+		}
+		instructions = append(instructions, t.rekeyInstruction(i)...)
+
 		instructions = append(instructions, RouteInstruction{
 			RouteID: ^routeId, // through system tunnel
 		})
@@ -854,7 +1018,7 @@ func (t *RegularOutTunnel) prepareTunnelControlMessage(withPayments, forcePaymen
 	}
 
 	var minDeadline time.Time
-	var minPaidIn, minPaidOut int64 = math.MaxInt64, math.MaxInt64
+	var minPaidIn, minPaidOut, minPaidMessagesOut int64 = math.MaxInt64, math.MaxInt64, math.MaxInt64
 	for i, node := range nodes {
 		if i == len(nodes)-1 {
 			// ourself
@@ -885,14 +1049,15 @@ func (t *RegularOutTunnel) prepareTunnelControlMessage(withPayments, forcePaymen
 			}
 		} else {
 			// out
-			if minPaidOut > node.PaymentInfo.PaidPackets {
-				minPaidOut = node.PaymentInfo.PaidPackets
+			if minPaidMessagesOut > node.PaymentInfo.PaidPackets {
+				minPaidMessagesOut = node.PaymentInfo.PaidPackets
 			}
 		}
 	}
 
 	atomic.StoreInt64(&t.packetsMinPaidIn, minPaidIn)
 	atomic.StoreInt64(&t.packetsMinPaidOut, minPaidOut)
+	atomic.StoreInt64(&t.messagesMinPaidOut, minPaidMessagesOut)
 
 	t.log.Debug().Uint64("seqno", t.controlSeqno).Msg("control instructions prepared")
 
@@ -942,29 +1107,66 @@ func (t *RegularOutTunnel) prepareInitMessage(state uint32) (*EncryptedMessage,
 					price = t.chainTo[i].PaymentInfo.PricePerPacket
 				}
 
-				if err = t.chainTo[i].Keys.EncryptInstructionsMessage(msg, BuildRouteInstruction{ // we build route here to route system messages, like tunnel payments
+				systemRoute := BuildRouteInstruction{ // we build route here to route system messages, like tunnel payments
 					TargetADNL:          id,
 					TargetSectionPubKey: backMsg.SectionPubKey,
 					RouteID:             ^binary.LittleEndian.Uint32(backMsg.SectionPubKey),
 					PricePerPacket:      price, // we assign price, but free rate is enough for us here, we will not pay actually
-				}, BindOutInstruction{
-					InboundNodeADNL:      id,
-					InboundSectionPubKey: backMsg.SectionPubKey,
-					InboundInstructions:  backMsg.Instructions,
-					ReceiverPubKey:       t.payloadKeys.SectionPubKey,
-					PricePerPacket:       price,
-				}, CacheInstruction{
-					Version:      uint64(time.Now().UnixNano()),
-					Instructions: []any{SendOutInstruction{}},
-				}); err != nil {
+				}
+
+				var instructions []tl.Serializable
+				if t.rendezvous != nil {
+					instructions = append(instructions, systemRoute)
+					instructions = append(instructions, t.rendezvousInstructions(t.chainTo[i].Keys.SectionPubKey, id, backMsg)...)
+				} else {
+					// out is bound before the route, exit-only node accepts only route to inbound of its out
+					instructions = append(instructions, BindOutInstruction{
+						InboundNodeADNL:      id,
+						InboundSectionPubKey: backMsg.SectionPubKey,
+						InboundInstructions:  backMsg.Instructions,
+						ReceiverPubKey:       t.payloadKeys.pubKey(),
+						PricePerPacket:       price,
+					}, systemRoute, CacheInstruction{
+						Version:      uint64(time.Now().UnixNano()),
+						Instructions: []any{SendOutInstruction{}},
+					})
+
+					if t.batch != nil {
+						instructions = append(instructions, OutBatchInstruction{
+							MaxPackets:   uint32(t.batch.maxPackets),
+							FlushDelayUs: uint32(t.batch.delay / time.Microsecond),
+						})
+					}
+
+					if t.paddingCharged {
+						// sent even when off, to reset policy of reused out
+						p := t.getPadding()
+						if p == nil {
+							p = &PaddingPolicy{}
+						}
+						instructions = append(instructions, p.instruction())
+						atomic.StorePointer(&t.outPadding, unsafe.Pointer(p))
+					}
+				}
+
+				if err = t.chainTo[i].Keys.EncryptInstructionsMessage(msg, instructions...); err != nil {
 					return nil, fmt.Errorf("encrypt bind out failed: %w", err)
 				}
 				continue
 			}
 
+			var cached any = SendOutInstruction{}
+			if rv := t.rendezvous; rv != nil {
+				if rv.serviceKey != nil {
+					cached = ServiceReplyInstruction{}
+				} else {
+					cached = DeliverInstruction{}
+				}
+			}
+
 			if err := t.chainTo[i].Keys.EncryptInstructionsMessage(msg, CacheInstruction{
 				Version:      uint64(time.Now().UnixNano()),
-				Instructions: []any{SendOutInstruction{}},
+				Instructions: []any{cached},
 			}); err != nil {
 				return nil, fmt.Errorf("encrypt send out failed: %w", err)
 			}
@@ -983,6 +1185,11 @@ func (t *RegularOutTunnel) prepareInitMessage(state uint32) (*EncryptedMessage,
 	return msg, nil
 }
 
+// recvCipherMode is a cipher of our own section, which receives messages of tunnel
+func (t *RegularOutTunnel) recvCipherMode() CipherMode {
+	return t.chainFrom[len(t.chainFrom)-1].Keys.Mode
+}
+
 func (t *RegularOutTunnel) Process(payload []byte, meta any) error {
 	switch m := meta.(type) {
 	case StateMeta:
@@ -1028,43 +1235,38 @@ func (t *RegularOutTunnel) Process(payload []byte, meta any) error {
 			atomic.StoreInt64(&t.lastFullyCheckedAt, time.Now().Unix())
 		}
 
-		switch p := data.(type) {
-		case DeliverUDPPayload:
-			if len(p.IP) != net.IPv4len && len(p.IP) != net.IPv6len {
-				return fmt.Errorf("invalid ip len %d", len(p.IP))
-			}
+		switch data.(type) {
+		case DeliverUDPPayload, DeliverUDPBatchPayload, SendOutErrorPayload, FragmentPayload:
+			// payload messages of out gate, compared with its stats
+			atomic.AddUint64(&t.messagesRecv, 1)
+		}
 
-			if p.Port > math.MaxUint16 {
-				return fmt.Errorf("invalid port %d", p.Port)
+		if f, ok := data.(FragmentPayload); ok {
+			full, err := t.fragments.add(f)
+			if err != nil || full == nil {
+				return err
 			}
 
-			atomic.AddUint64(&t.packetsRecv, 1) // fact received
-
-			var seqnoDiff uint64
-			if prev := atomic.LoadUint64(&t.seqnoRecv); prev < p.Seqno &&
-				atomic.CompareAndSwapUint64(&t.seqnoRecv, prev, p.Seqno) {
-				seqnoDiff = p.Seqno - prev
+			if data, err = parseReassembled(full); err != nil {
+				return err
 			}
+		}
 
-			if t.usePayments && seqnoDiff > 0 {
-				atomic.AddUint64(&t.packetsRecvPaidConsumed, seqnoDiff)
-
-				paid := atomic.LoadInt64(&t.packetsMinPaidIn)
-				consumed := atomic.AddInt64(&t.packetsConsumedIn, int64(seqnoDiff)) // ideally received (when no loss)
-				if paid-consumed < t.packetsToPrepay/2 {
-					t.requestControlMessage()
-				}
+		switch p := data.(type) {
+		case DeliverUDPPayload:
+			return t.processDeliverUDP(p)
+		case DeliverUDPBatchPayload:
+			if len(p.Packets) > BatchMaxPackets {
+				return fmt.Errorf("too many packets in batch: %d", len(p.Packets))
 			}
 
-			select {
-			case t.read <- p:
-				// t.log.Debug().Uint64("seqno", p.Seqno).Msg("udp delivered")
-				return nil
-			default:
-				atomic.AddUint64(&t.packetsDropped, 1)
-				t.log.Warn().Uint64("seqno", p.Seqno).Msg("full, skip")
-				return fmt.Errorf("read channel full")
+			var firstErr error
+			for _, packet := range p.Packets {
+				if err = t.processDeliverUDP(packet); err != nil && firstErr == nil {
+					firstErr = err
+				}
 			}
+			return firstErr
 		case OutBindDonePayload:
 			t.mx.Lock()
 			defer t.mx.Unlock()
@@ -1090,10 +1292,31 @@ func (t *RegularOutTunnel) Process(payload []byte, meta any) error {
 
 			t.log.Info().Str("ip", net.IP(p.IP).String()).Uint32("port", p.Port).Msg("out gateway updated")
 
+			return nil
+		case RendezvousBoundPayload:
+			t.log.Info().Msg("rendezvous bound on introduction node")
+			return nil
+		case ServiceDeliverPayload:
+			return t.processServiceDeliver(p)
+		case DeliverPayload:
+			return t.processServiceReply(p)
+		case SendOutErrorPayload:
+			addr := &net.UDPAddr{
+				IP:   p.IP,
+				Port: int(p.Port),
+			}
+
+			t.log.Debug().Str("addr", addr.String()).Str("reason", p.Reason).Msg("out gateway rejected packet")
+
+			if f := t.onSendRejected; f != nil {
+				f(addr, p.Reason)
+			}
 			return nil
 		default:
 			return fmt.Errorf("incorrect payload type: %T", p)
 		}
+	case StatsMeta:
+		return t.processStatsReport(payload, m)
 	case PingMeta:
 		for {
 			if sq := atomic.LoadUint64(&t.controlSeqnoReceived); sq < m.Seqno {
@@ -1109,6 +1332,7 @@ func (t *RegularOutTunnel) Process(payload []byte, meta any) error {
 					atomic.StoreUint64(&t.controlPaidSeqnoReceived, m.Seqno)
 				}
 				t.log.Debug().Uint64("seqno", m.Seqno).Msg("control message returned successfully")
+				t.confirmRekey(m.Seqno)
 
 				if atomic.LoadUint32(&t.tunnelState) == StateTypeConfiguring {
 					msg, err := t.prepareInitMessage(StateTypeConfiguring)
@@ -1130,47 +1354,59 @@ func (t *RegularOutTunnel) Process(payload []byte, meta any) error {
 }
 
 func (t *RegularOutTunnel) WaitForInit(ctx context.Context, events func(string)) (net.IP, uint16, error) {
+	if err := t.waitConfigured(ctx); err != nil {
+		return nil, 0, err
+	}
+
+	if err := t.waitPayments(ctx, events); err != nil {
+		return nil, 0, err
+	}
+	return t.externalAddr, t.externalPort, nil
+}
+
+// waitConfigured waits until all sections of tunnel are configured, payments are not required for it
+func (t *RegularOutTunnel) waitConfigured(ctx context.Context) error {
 	for {
 		select {
 		case <-ctx.Done():
-			return nil, 0, ctx.Err()
+			return ctx.Err()
 		case <-t.closerCtx.Done():
-			return nil, 0, t.closerCtx.Err()
+			return t.closerCtx.Err()
 		case <-time.After(5 * time.Millisecond):
-			if atomic.LoadUint32(&t.tunnelState) != StateTypeOptimized {
-				continue
+			if atomic.LoadUint32(&t.tunnelState) == StateTypeOptimized {
+				return nil
 			}
+		}
+	}
+}
 
-			if t.usePayments {
-				if events != nil {
-					events("Tunnel configured, sending payments...")
-				}
+// waitPayments releases held payments and waits until nodes confirm them
+func (t *RegularOutTunnel) waitPayments(ctx context.Context, events func(string)) error {
+	atomic.StoreInt32(&t.paymentsHeld, 0)
 
-				t.requestControlMessage()
-				log.Info().Msg("adnl tunnel initialized, waiting payment confirmation...")
-
-				for {
-					select {
-					case <-ctx.Done():
-						return nil, 0, ctx.Err()
-					case <-t.closerCtx.Done():
-						return nil, 0, t.closerCtx.Err()
-					case <-time.After(5 * time.Millisecond):
-						if atomic.LoadInt32(&t.paymentsConfirmed) == 0 {
-							continue
-						}
-					}
+	if t.usePayments {
+		if events != nil {
+			events("Tunnel configured, sending payments...")
+		}
 
-					break
-				}
-			}
+		t.requestControlMessage()
+		log.Info().Msg("adnl tunnel initialized, waiting payment confirmation...")
 
-			if events != nil {
-				events("Tunnel initialized")
+		for atomic.LoadInt32(&t.paymentsConfirmed) == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-t.closerCtx.Done():
+				return t.closerCtx.Err()
+			case <-time.After(5 * time.Millisecond):
 			}
-			return t.externalAddr, t.externalPort, nil
 		}
 	}
+
+	if events != nil {
+		events("Tunnel initialized")
+	}
+	return nil
 }
 
 func (t *RegularOutTunnel) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
@@ -1193,6 +1429,45 @@ func (t *RegularOutTunnel) ReadFromWithTimeout(ctx context.Context, p []byte) (n
 	}
 }
 
+func (t *RegularOutTunnel) processDeliverUDP(p DeliverUDPPayload) error {
+	if len(p.IP) != net.IPv4len && len(p.IP) != net.IPv6len {
+		return fmt.Errorf("invalid ip len %d", len(p.IP))
+	}
+
+	if p.Port > math.MaxUint16 {
+		return fmt.Errorf("invalid port %d", p.Port)
+	}
+
+	atomic.AddUint64(&t.packetsRecv, 1) // fact received
+
+	var seqnoDiff uint64
+	if prev := atomic.LoadUint64(&t.seqnoRecv); prev < p.Seqno &&
+		atomic.CompareAndSwapUint64(&t.seqnoRecv, prev, p.Seqno) {
+		seqnoDiff = p.Seqno - prev
+	}
+
+	if t.usePayments && seqnoDiff > 0 {
+		atomic.AddUint64(&t.packetsRecvPaidConsumed, seqnoDiff)
+
+		paid := atomic.LoadInt64(&t.packetsMinPaidIn)
+		// ideally received (when no loss), with padding paid by seqno
+		consumed := atomic.AddInt64(&t.packetsConsumedIn, int64(seqnoDiff)+paddingPackets(p.Seqno-seqnoDiff, p.Seqno, t.paddingSurcharge()))
+		if paid-consumed < t.packetsToPrepay/2 {
+			t.requestControlMessage()
+		}
+	}
+
+	select {
+	case t.read <- p:
+		// t.log.Debug().Uint64("seqno", p.Seqno).Msg("udp delivered")
+		return nil
+	default:
+		atomic.AddUint64(&t.packetsDropped, 1)
+		t.log.Warn().Uint64("seqno", p.Seqno).Msg("full, skip")
+		return fmt.Errorf("read channel full")
+	}
+}
+
 func (t *RegularOutTunnel) requestControlMessage() {
 	select {
 	case t.sendControlSignal <- struct{}{}:
@@ -1221,9 +1496,33 @@ func (t *RegularOutTunnel) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 			return -1, fmt.Errorf("not enough packets prepaid, paid: %d, consumed: %d", paid, consumed)
 		}
 
-		if paid-atomic.AddInt64(&t.packetsConsumedOut, 1) < t.packetsToPrepay/2 {
-			t.requestControlMessage()
+		paid = atomic.LoadInt64(&t.messagesMinPaidOut)
+		consumed = atomic.LoadInt64(&t.messagesConsumedOut)
+		if paid < consumed {
+			return -1, fmt.Errorf("not enough messages prepaid, paid: %d, consumed: %d", paid, consumed)
 		}
+
+		// out gate charges each datagram, relays charge each message, it is counted when message is sent
+		t.consumeOut(1, 0)
+	}
+
+	if rv := t.rendezvous; rv != nil {
+		if rv.e2e == nil {
+			return -1, fmt.Errorf("service should reply using listener")
+		}
+
+		data, err := rv.e2e.EncryptPayload(p)
+		if err != nil {
+			return -1, fmt.Errorf("encrypt end-to-end payload error: %w", err)
+		}
+
+		if err = t.sendPayload(DeliverPayload{
+			Seqno:   atomic.AddUint64(&t.seqnoSend, 1),
+			Payload: data,
+		}); err != nil {
+			return -1, err
+		}
+		return len(p), nil
 	}
 
 	updAddr, ok := addr.(*net.UDPAddr)
@@ -1238,14 +1537,85 @@ func (t *RegularOutTunnel) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		Payload: p,
 	}
 
+	// padding is paid by seqno, out gate counts it the same way
+	if n := paddingPackets(pl.Seqno-1, pl.Seqno, t.paddingSurcharge()); n > 0 {
+		t.consumeOut(n, 0)
+	}
+
+	if t.batch != nil {
+		// batch is flushed later, so we cannot reuse caller's buffer
+		pl.Payload = append([]byte{}, p...)
+		t.batch.add(pl, len(p)+batchItemOverhead)
+		return len(p), nil
+	}
+
+	if err := t.sendPayload(pl); err != nil {
+		return -1, err
+	}
+
+	return len(p), nil
+}
+
+// consumeOut counts datagrams paid to out gate and tunnel messages paid to relays of chainTo,
+// control message is requested when prepaid amount is running low
+func (t *RegularOutTunnel) consumeOut(packets, messages int64) {
+	if !t.usePayments {
+		return
+	}
+
+	low := false
+	if packets > 0 && atomic.LoadInt64(&t.packetsMinPaidOut)-atomic.AddInt64(&t.packetsConsumedOut, packets) < t.packetsToPrepay/2 {
+		low = true
+	}
+	if messages > 0 && atomic.LoadInt64(&t.messagesMinPaidOut)-atomic.AddInt64(&t.messagesConsumedOut, messages) < t.packetsToPrepay/2 {
+		low = true
+	}
+
+	if low {
+		t.requestControlMessage()
+	}
+}
+
+// sendPayload encrypts payload for out gateway and sends it using cached route,
+// payload bigger than PayloadMTU is sent in fragments
+func (t *RegularOutTunnel) sendPayload(pl tl.Serializable) error {
 	payload, err := tl.Serialize(pl, true)
 	if err != nil {
-		return -1, fmt.Errorf("SendOutPayload serialization error: %w", err)
+		return fmt.Errorf("%T serialization error: %w", pl, err)
 	}
 
-	payload, err = t.payloadKeys.EncryptPayload(payload)
+	fragments, err := splitPayload(atomic.AddUint64(&t.fragmentSeqno, 1), payload)
 	if err != nil {
-		return -1, fmt.Errorf("encrypt payload error: %w", err)
+		return fmt.Errorf("fragment %T error: %w", pl, err)
+	}
+
+	if fragments == nil {
+		return t.sendPayloadData(payload)
+	}
+
+	for _, f := range fragments {
+		payload, err = tl.Serialize(f, true)
+		if err != nil {
+			return fmt.Errorf("fragment serialization error: %w", err)
+		}
+
+		if err = t.sendPayloadData(payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sendPayloadData sends single tunnel message, relays charge for each one, so it is counted here,
+// batch and each fragment are one message
+func (t *RegularOutTunnel) sendPayloadData(payload []byte) error {
+	t.consumeOut(0, 1)
+
+	payload, _ = t.getPadding().pad(payload)
+
+	payload, err := t.payloadKeys.EncryptPayload(payload)
+	if err != nil {
+		return fmt.Errorf("encrypt payload error: %w", err)
 	}
 
 	if err = t.peer.SendCustomMessage(context.Background(), EncryptedMessageCached{
@@ -1253,11 +1623,11 @@ func (t *RegularOutTunnel) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 		Seqno:         atomic.AddUint32(&t.seqnoForward, 1),
 		Payload:       payload,
 	}); err != nil {
-		return -1, fmt.Errorf("send encrypted message error: %w", err)
+		return fmt.Errorf("send encrypted message error: %w", err)
 	}
 	atomic.AddUint64(&t.packetsSent, 1)
 
-	return len(p), nil
+	return nil
 }
 
 func (t *RegularOutTunnel) Close() error {
@@ -1267,6 +1637,10 @@ func (t *RegularOutTunnel) Close() error {
 func (t *RegularOutTunnel) Stop(ctx context.Context) error {
 	atomic.StoreInt32(&t.wantDestroy, 1)
 
+	if t.batch != nil {
+		t.batch.flush()
+	}
+
 	if _, ok := ctx.Deadline(); !ok {
 		var cancel context.CancelFunc
 		ctx, cancel = context.WithTimeout(ctx, time.Second*15)
@@ -1286,6 +1660,11 @@ func (t *RegularOutTunnel) Stop(ctx context.Context) error {
 				break
 			}
 
+			if atomic.LoadInt32(&t.outKept) != 0 {
+				// out gate routes back to the new tunnel, confirmation will not come
+				break
+			}
+
 			select {
 			case <-t.closerCtx.Done():
 			case <-ctx.Done():
@@ -0,0 +1,256 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"github.com/xssnick/tonutils-go/tl"
+	"hash/crc64"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	instructionOpcodes[tl.Register(RekeyInstruction{}, "adnlTunnel.rekeyInstruction sectionKey:int256 payloadKey:bytes = adnlTunnel.Instruction")] = reflect.TypeOf(RekeyInstruction{})
+}
+
+// RekeyOverlapSec is how long previous key is accepted after the new one is used first time,
+// to decrypt packets which are still in flight
+const RekeyOverlapSec = 30
+
+// RekeyInterval and RekeyAfterPackets define how often tunnel rotates keys of its sections
+var RekeyInterval = 6 * time.Hour
+var RekeyAfterPackets uint64 = 1 << 28
+
+// RekeyInstruction rotates cipher key of section, and payload key of out gate when PayloadKey is set.
+// New keys are derived from node key and new initiator's keys, same as initial ones.
+// Section id is not changed, previous key is accepted until initiator switches to the new one, and some time after.
+type RekeyInstruction struct {
+	SectionKey []byte `tl:"int256"`
+	PayloadKey []byte `tl:"bytes"`
+}
+
+type pendingRekey struct {
+	// sections are new keys by index in chainTo + chainFrom
+	sections []*EncryptionKeys
+	payload  *EncryptionKeys
+
+	// seqno is a first control message which carries rekey, its confirmation means all nodes switched
+	seqno uint64
+}
+
+func (ins RekeyInstruction) Execute(ctx context.Context, s *Section, msg *EncryptedMessage, restInstructions []byte) error {
+	key, err := keys.SharedKey(s.gw.key, ins.SectionKey)
+	if err != nil {
+		return fmt.Errorf("shared key calc failed: %w", err)
+	}
+	s.rotateKey(key)
+
+	if len(ins.PayloadKey) > 0 {
+		if len(ins.PayloadKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("invalid payload key size")
+		}
+
+		s.mx.RLock()
+		out := s.out
+		s.mx.RUnlock()
+
+		if out == nil {
+			return fmt.Errorf("out is not binded")
+		}
+
+		payloadKey, err := keys.SharedKey(s.gw.key, ins.PayloadKey)
+		if err != nil {
+			return fmt.Errorf("shared payload key calc failed: %w", err)
+		}
+		out.rotateKey(payloadKey)
+	}
+	return nil
+}
+
+func (s *Section) rotateKey(key []byte) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if bytes.Equal(s.cipherKey, key) {
+		return
+	}
+
+	// when current key was never used, initiator still uses previous, so we keep it
+	if atomic.LoadInt32(&s.keyUnused) == 0 {
+		s.prevCipherKey = s.cipherKey
+		s.prevCipherKeyCrc = s.cipherKeyCrc
+	}
+	s.cipherKey = key
+	s.cipherKeyCrc = crc64.Checksum(key, crcTable)
+	atomic.StoreInt64(&s.prevKeyUntil, 0)
+	atomic.StoreInt32(&s.keyUnused, 1)
+
+	s.log.Debug().Msg("section key rotated")
+}
+
+// keyUsed starts overlap window of previous key, when initiator switched to the current one
+func (s *Section) keyUsed() {
+	if atomic.CompareAndSwapInt32(&s.keyUnused, 1, 0) {
+		atomic.StoreInt64(&s.prevKeyUntil, time.Now().Unix()+RekeyOverlapSec)
+	}
+}
+
+func (o *Out) rotateKey(key []byte) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+
+	if bytes.Equal(o.PayloadCipherKey, key) {
+		return
+	}
+
+	if atomic.LoadInt32(&o.keyUnused) == 0 {
+		o.prevPayloadKey = o.PayloadCipherKey
+		o.prevPayloadKeyCRC = o.PayloadCipherKeyCRC
+	}
+	o.PayloadCipherKey = key
+	o.PayloadCipherKeyCRC = crc64.Checksum(key, crcTable)
+	atomic.StoreInt64(&o.prevKeyUntil, 0)
+	atomic.StoreInt32(&o.keyUnused, 1)
+
+	o.log.Debug().Msg("payload key rotated")
+}
+
+// decrypt should be called under read lock
+func (o *Out) decrypt(payload []byte) ([]byte, error) {
+	prevKey := o.prevPayloadKey
+	if until := atomic.LoadInt64(&o.prevKeyUntil); until != 0 && until < time.Now().Unix() {
+		prevKey = nil
+	}
+
+	data, usedPrev, err := decryptWithAlt(o.cipherMode, o.PayloadCipherKeyCRC, o.PayloadCipherKey, o.prevPayloadKeyCRC, prevKey, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if !usedPrev && atomic.CompareAndSwapInt32(&o.keyUnused, 1, 0) {
+		atomic.StoreInt64(&o.prevKeyUntil, time.Now().Unix()+RekeyOverlapSec)
+	}
+	return data, nil
+}
+
+// decryptWithAlt tries current key, and then alternative key when it is set,
+// data is copied only in this case, because failed decryption damages it
+func decryptWithAlt(mode CipherMode, crc uint64, key []byte, altCrc uint64, altKey, data []byte) ([]byte, bool, error) {
+	if altKey == nil {
+		pl, err := decryptStream(mode, crc, key, data)
+		return pl, false, err
+	}
+
+	if pl, err := decryptStream(mode, crc, key, append([]byte{}, data...)); err == nil {
+		return pl, false, nil
+	}
+
+	pl, err := decryptStream(mode, altCrc, altKey, data)
+	if err != nil {
+		return nil, false, err
+	}
+	return pl, true, nil
+}
+
+func (t *RegularOutTunnel) rekeyDue() bool {
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+
+	if t.rekey != nil {
+		return false
+	}
+
+	packets := atomic.LoadUint64(&t.packetsSent) + atomic.LoadUint64(&t.packetsRecv)
+	return time.Since(t.rekeyedAt) >= RekeyInterval || packets-t.rekeyedOnPackets >= RekeyAfterPackets
+}
+
+// startRekey generates new keys for all sections, they will be delivered with control messages
+func (t *RegularOutTunnel) startRekey() error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	nodes := append([]*SectionInfo{}, t.chainTo...)
+	nodes = append(nodes, t.chainFrom...)
+
+	rk := &pendingRekey{}
+	for i, node := range nodes {
+		k, err := GenerateEncryptionKeys(node.Keys.ReceiverPubKey)
+		if err != nil {
+			return fmt.Errorf("generate keys for section %d failed: %w", i, err)
+		}
+		k.Mode = node.Keys.Mode
+		rk.sections = append(rk.sections, k)
+	}
+
+	// rendezvous node has no out, its payload key is bound to the service route
+	if t.rendezvous == nil {
+		k, err := GenerateEncryptionKeys(t.payloadKeys.ReceiverPubKey)
+		if err != nil {
+			return fmt.Errorf("generate payload keys failed: %w", err)
+		}
+		k.Mode = t.payloadKeys.Mode
+		rk.payload = k
+	}
+
+	for i, node := range nodes {
+		node.Keys.expectNext(rk.sections[i])
+	}
+	if rk.payload != nil {
+		t.payloadKeys.expectNext(rk.payload)
+	}
+	t.rekey = rk
+
+	t.log.Debug().Msg("rekey started")
+	return nil
+}
+
+// rekeyInstruction should be called under lock, during control message preparation
+func (t *RegularOutTunnel) rekeyInstruction(i int) []tl.Serializable {
+	rk := t.rekey
+	if rk == nil {
+		return nil
+	}
+
+	if rk.seqno == 0 {
+		rk.seqno = t.controlSeqno + 1
+	}
+
+	ins := RekeyInstruction{
+		SectionKey: rk.sections[i].SectionPubKey,
+	}
+	if i == len(t.chainTo)-1 && rk.payload != nil {
+		ins.PayloadKey = rk.payload.SectionPubKey
+	}
+	return []tl.Serializable{ins}
+}
+
+// confirmRekey switches to the new keys, when control message with rekey was returned through all nodes
+func (t *RegularOutTunnel) confirmRekey(seqno uint64) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	rk := t.rekey
+	if rk == nil || rk.seqno == 0 || seqno < rk.seqno {
+		return
+	}
+
+	nodes := append([]*SectionInfo{}, t.chainTo...)
+	nodes = append(nodes, t.chainFrom...)
+
+	for i, node := range nodes {
+		node.Keys.rotate(rk.sections[i], false)
+	}
+	if rk.payload != nil {
+		t.payloadKeys.rotate(rk.payload, true)
+	}
+
+	t.rekey = nil
+	t.rekeyedAt = time.Now()
+	t.rekeyedOnPackets = atomic.LoadUint64(&t.packetsSent) + atomic.LoadUint64(&t.packetsRecv)
+
+	t.log.Info().Msg("tunnel keys rotated")
+}
@@ -0,0 +1,104 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"github.com/rs/zerolog"
+	"hash/crc64"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSectionRekey(t *testing.T) {
+	nodePub, nodeKey, _ := ed25519.GenerateKey(nil)
+
+	client, err := GenerateEncryptionKeys(nodePub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Section{
+		gw:           &Gateway{key: nodeKey},
+		cipherKey:    client.CipherKey,
+		cipherKeyCrc: client.CipherKeyCRC,
+		negotiated:   1,
+		log:          zerolog.Nop(),
+	}
+
+	encrypt := func(k *EncryptionKeys) []byte {
+		data, err := k.EncryptPayload([]byte("instructions"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	next, err := GenerateEncryptionKeys(nodePub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.expectNext(next)
+
+	if err = (RekeyInstruction{SectionKey: next.SectionPubKey}).Execute(context.Background(), s, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// repeated rekey should not drop the key client still uses
+	if err = (RekeyInstruction{SectionKey: next.SectionPubKey}).Execute(context.Background(), s, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.decrypt(encrypt(client)); err != nil {
+		t.Fatalf("old key should be accepted until the new one is used: %v", err)
+	}
+
+	// node answers with the new key before client switched
+	reply, _ := encryptStream(CipherModeCTR, s.cipherKeyCrc, s.cipherKey, []byte("report"))
+	if _, err = client.decrypt(reply); err != nil {
+		t.Fatalf("client should accept upcoming key: %v", err)
+	}
+
+	old := encrypt(client)
+	client.rotate(next, false)
+
+	if _, err = s.decrypt(encrypt(client)); err != nil {
+		t.Fatalf("new key should be accepted: %v", err)
+	}
+
+	if _, err = s.decrypt(append([]byte{}, old...)); err != nil {
+		t.Fatalf("old key should be accepted during overlap: %v", err)
+	}
+
+	atomic.StoreInt64(&s.prevKeyUntil, time.Now().Unix()-1)
+	if _, err = s.decrypt(old); err == nil {
+		t.Fatal("old key should not be accepted after overlap")
+	}
+}
+
+func TestOutRekey(t *testing.T) {
+	key0 := []byte("0123456789abcdef0123456789abcdef")
+	key1 := []byte("fedcba9876543210fedcba9876543210")
+
+	o := &Out{
+		PayloadCipherKey:    key0,
+		PayloadCipherKeyCRC: crc64.Checksum(key0, crcTable),
+		log:                 zerolog.Nop(),
+	}
+
+	old, _ := encryptStream(CipherModeCTR, crc64.Checksum(key0, crcTable), key0, []byte("payload"))
+	o.rotateKey(key1)
+
+	if _, err := o.decrypt(append([]byte{}, old...)); err != nil {
+		t.Fatalf("old key should be accepted before switch: %v", err)
+	}
+
+	fresh, _ := encryptStream(CipherModeCTR, crc64.Checksum(key1, crcTable), key1, []byte("payload"))
+	if _, err := o.decrypt(fresh); err != nil {
+		t.Fatalf("new key should be accepted: %v", err)
+	}
+
+	if atomic.LoadInt64(&o.prevKeyUntil) == 0 {
+		t.Fatal("overlap window should be started after new key is used")
+	}
+}
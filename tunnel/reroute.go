@@ -0,0 +1,94 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/rs/zerolog"
+	"math/big"
+	"sync/atomic"
+	"unsafe"
+)
+
+// inheritSeqnoGap is added to seqnos taken from the previous tunnel, to skip seqnos
+// which it may still send before traffic is switched, or which were not saved
+const inheritSeqnoGap = 1 << 20
+
+// RerouteRegularOutTunnel creates tunnel through new relays, which keeps out gate section of prev,
+// so external address and port are not changed. Last node of chainTo should be the out gate of prev.
+// Out gate rebinds its inbound route when new tunnel is initialized, after that prev should be replaced with
+// the new one, and stopped; its out gate section will not be destroyed.
+func (g *Gateway) RerouteRegularOutTunnel(ctx context.Context, prev *RegularOutTunnel, chainTo, chainFrom []*SectionInfo, log zerolog.Logger) (*RegularOutTunnel, error) {
+	if prev.rendezvous != nil {
+		return nil, fmt.Errorf("rendezvous tunnel cannot be rerouted")
+	}
+
+	if len(chainTo) == 0 {
+		return nil, fmt.Errorf("chains should have at least one node")
+	}
+
+	out := prev.chainTo[len(prev.chainTo)-1]
+	last := chainTo[len(chainTo)-1]
+	if !bytes.Equal(last.Keys.ReceiverPubKey, out.Keys.ReceiverPubKey) {
+		return nil, fmt.Errorf("last 'chain to' should be the out gate of the previous tunnel")
+	}
+
+	// same keys address same section on out gate
+	chainTo[len(chainTo)-1] = &SectionInfo{
+		Keys:        out.Keys,
+		PaymentInfo: last.PaymentInfo,
+	}
+
+	return g.createRegularOutTunnel(ctx, chainTo, chainFrom, nil, prev, log)
+}
+
+// inheritOut takes state of out gate from previous tunnel, must be called before tunnel is started
+func (t *RegularOutTunnel) inheritOut(prev *RegularOutTunnel) {
+	// out gate checks seqnos of cached messages, and fragment ids, they should continue
+	t.seqnoForward = atomic.LoadUint32(&prev.seqnoForward) + inheritSeqnoGap
+	t.fragmentSeqno = atomic.LoadUint64(&prev.fragmentSeqno) + inheritSeqnoGap
+
+	prev.mx.RLock()
+	t.outFilter = prev.outFilter
+	// out gate is the same, so tunnel spend budget is continued, it is not reset by rerouting
+	if prev.spent != nil {
+		t.spent = map[string]*big.Int{}
+		for key, amount := range prev.spent {
+			t.spent[key] = new(big.Int).Set(amount)
+		}
+	}
+	prev.mx.RUnlock()
+
+	atomic.StorePointer(&t.padding, unsafe.Pointer(prev.getPadding()))
+
+	for _, node := range append(append([]*SectionInfo{}, t.chainTo...), t.chainFrom...) {
+		if prev.hasKeys(node.Keys) {
+			t.existingSections = append(t.existingSections, node.Keys)
+		}
+	}
+}
+
+func (t *RegularOutTunnel) hasKeys(k *EncryptionKeys) bool {
+	for _, node := range append(append([]*SectionInfo{}, t.chainTo...), t.chainFrom...) {
+		if node.Keys == k {
+			return true
+		}
+	}
+	return false
+}
+
+// sectionExists returns true when section with these keys was created on node by previous tunnel,
+// its keys and cipher should not be changed
+func (t *RegularOutTunnel) sectionExists(k *EncryptionKeys) bool {
+	for _, e := range t.existingSections {
+		if e == k {
+			return true
+		}
+	}
+	return false
+}
+
+// keepOut marks that out gate section was passed to the rerouted tunnel, so it will not be destroyed on stop
+func (t *RegularOutTunnel) keepOut() {
+	atomic.StoreInt32(&t.outKept, 1)
+}
@@ -0,0 +1,121 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"github.com/rs/zerolog"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"github.com/xssnick/tonutils-go/tl"
+	"testing"
+)
+
+// newTestGateway creates gateway for client tunnels, peers added with returned func are not discovered in dht
+func newTestGateway(t *testing.T, ctx context.Context) (*Gateway, func(pub ed25519.PublicKey)) {
+	_, key, _ := ed25519.GenerateKey(nil)
+
+	g := &Gateway{
+		key:         key,
+		closerCtx:   ctx,
+		activePeers: map[string]*Peer{},
+		tunnels:     map[uint32]Tunnel{},
+		nodesParams: map[string]nodeParams{},
+		health:      map[string]*nodeHealth{},
+		log:         zerolog.Nop(),
+	}
+
+	return g, func(pub ed25519.PublicKey) {
+		id, err := tl.Hash(keys.PublicKeyED25519{Key: pub})
+		if err != nil {
+			t.Fatal(err)
+		}
+		g.activePeers[string(id)] = &Peer{id: id, gw: g, closerCtx: ctx, closer: func() {}, discoverInProgress: 1}
+	}
+}
+
+func testSection(t *testing.T, pub ed25519.PublicKey) *SectionInfo {
+	k, err := GenerateEncryptionKeys(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SectionInfo{Keys: k}
+}
+
+func TestRerouteKeepsOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, peer := newTestGateway(t, ctx)
+	section := func(pub ed25519.PublicKey) *SectionInfo {
+		return testSection(t, pub)
+	}
+
+	relayPub, _, _ := ed25519.GenerateKey(nil)
+	peer(relayPub)
+	outPub, _, _ := ed25519.GenerateKey(nil)
+	us := g.key.Public().(ed25519.PublicKey)
+
+	prev, err := g.CreateRegularOutTunnel(ctx, []*SectionInfo{section(relayPub), section(outPub)},
+		[]*SectionInfo{section(relayPub), section(us)}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	prev.seqnoForward = 100
+
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	if _, err = g.RerouteRegularOutTunnel(ctx, prev, []*SectionInfo{section(relayPub), section(otherPub)},
+		[]*SectionInfo{section(relayPub), section(us)}, zerolog.Nop()); err == nil {
+		t.Fatal("reroute with other out gate should fail")
+	}
+
+	newRelayPub, _, _ := ed25519.GenerateKey(nil)
+	peer(newRelayPub)
+	next, err := g.RerouteRegularOutTunnel(ctx, prev, []*SectionInfo{section(newRelayPub), section(outPub)},
+		[]*SectionInfo{section(newRelayPub), section(us)}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if next.chainTo[1].Keys != prev.chainTo[1].Keys || next.payloadKeys != prev.payloadKeys {
+		t.Fatal("out gate section and payload keys should be kept")
+	}
+
+	if next.localID == prev.localID || g.tunnels[next.localID] != next || g.tunnels[prev.localID] != prev {
+		t.Fatal("both tunnels should be registered with different ids")
+	}
+
+	if next.seqnoForward <= prev.seqnoForward {
+		t.Fatal("forward seqno should continue after the previous tunnel")
+	}
+
+	// previous tunnel should not destroy kept out gate
+	prev.keepOut()
+	msg, err := prev.prepareTunnelCloseMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, sec := range prev.chainTo {
+		s := &Section{
+			cipherKey:    sec.Keys.CipherKey,
+			cipherKeyCrc: sec.Keys.CipherKeyCRC,
+			log:          zerolog.Nop(),
+		}
+
+		container, rest, err := s.decryptMessage(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var destroy bool
+		for _, ins := range container.List {
+			if _, ok := ins.(*DestroyInstruction); ok {
+				destroy = true
+			}
+		}
+
+		if isOut := i == len(prev.chainTo)-1; destroy == isOut {
+			t.Fatalf("unexpected destroy instruction presence %v for hop %d", destroy, i)
+		}
+		msg = &EncryptedMessage{Instructions: rest}
+	}
+}
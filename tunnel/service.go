@@ -0,0 +1,682 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/kevinms/leakybucket-go"
+	"github.com/rs/zerolog"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"github.com/xssnick/tonutils-go/tl"
+	"hash/crc64"
+	"net"
+	"net/netip"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	tl.Register(RendezvousBoundPayload{}, "adnlTunnel.rendezvousBoundPayload seqno:long = adnlTunnel.RendezvousBoundPayload")
+	tl.Register(ServiceDeliverPayload{}, "adnlTunnel.serviceDeliverPayload seqno:long session:long clientKey:int256 payload:bytes = adnlTunnel.ServiceDeliverPayload")
+	tl.Register(ServiceReplyPayload{}, "adnlTunnel.serviceReplyPayload session:long payload:bytes = adnlTunnel.ServiceReplyPayload")
+
+	instructionOpcodes[tl.Register(BindServiceInstruction{}, "adnlTunnel.bindServiceInstruction serviceKey:int256 signature:bytes inboundNodeADNL:int256 inboundSectionPubKey:int256 inboundInstructions:bytes receiverPubKey:int256 = adnlTunnel.Instruction")] = reflect.TypeOf(BindServiceInstruction{})
+	instructionOpcodes[tl.Register(ServiceReplyInstruction{}, "adnlTunnel.serviceReplyInstruction = adnlTunnel.Instruction")] = reflect.TypeOf(ServiceReplyInstruction{})
+	instructionOpcodes[tl.Register(BindRendezvousInstruction{}, "adnlTunnel.bindRendezvousInstruction serviceKey:int256 clientKey:int256 inboundNodeADNL:int256 inboundSectionPubKey:int256 inboundInstructions:bytes receiverPubKey:int256 = adnlTunnel.Instruction")] = reflect.TypeOf(BindRendezvousInstruction{})
+	instructionOpcodes[tl.Register(DeliverInstruction{}, "adnlTunnel.deliverInstruction = adnlTunnel.Instruction")] = reflect.TypeOf(DeliverInstruction{})
+}
+
+// BindServiceInstruction registers introduction point of hidden service on this node,
+// packets of clients bound to the service are spliced into inbound route of the service tunnel.
+// Signature is made by service key over section key, to prove ownership of the service.
+type BindServiceInstruction struct {
+	ServiceKey           []byte `tl:"int256"`
+	Signature            []byte `tl:"bytes"`
+	InboundNodeADNL      []byte `tl:"int256"`
+	InboundSectionPubKey []byte `tl:"int256"`
+	InboundInstructions  []byte `tl:"bytes"`
+	ReceiverPubKey       []byte `tl:"int256"`
+}
+
+// ServiceReplyInstruction used by service to send packet back to its client, like SendOutInstruction
+type ServiceReplyInstruction struct{}
+
+// BindRendezvousInstruction binds client section to registered service, with route back to the client.
+// ClientKey is used by service to calculate end-to-end encryption key.
+type BindRendezvousInstruction struct {
+	ServiceKey           []byte `tl:"int256"`
+	ClientKey            []byte `tl:"int256"`
+	InboundNodeADNL      []byte `tl:"int256"`
+	InboundSectionPubKey []byte `tl:"int256"`
+	InboundInstructions  []byte `tl:"bytes"`
+	ReceiverPubKey       []byte `tl:"int256"`
+}
+
+// DeliverInstruction used to identify that node is the destination
+// and payload should be processed on this server, to decrypt shared key of private receiver + public tunnel should be used.
+// Payload is delivered to the service which client section is bound to with BindRendezvousInstruction.
+type DeliverInstruction struct{}
+
+type RendezvousBoundPayload struct {
+	Seqno uint64 `tl:"long"`
+}
+
+// ServiceDeliverPayload is client packet spliced into service tunnel,
+// payload is end-to-end encrypted with shared key of service and client key
+type ServiceDeliverPayload struct {
+	Seqno     uint64 `tl:"long"`
+	Session   uint64 `tl:"long"`
+	ClientKey []byte `tl:"int256"`
+	Payload   []byte `tl:"bytes"`
+}
+
+type ServiceReplyPayload struct {
+	Session uint64 `tl:"long"`
+	Payload []byte `tl:"bytes"`
+}
+
+// ServiceMessage is a packet received by hidden service from its client
+type ServiceMessage struct {
+	Session   uint64
+	ClientKey ed25519.PublicKey
+	Payload   []byte
+}
+
+// returnRoute is a prepared route back to tunnel owner, like inbound route of Out
+type returnRoute struct {
+	peer         *Peer
+	sectionKey   []byte
+	instructions []byte
+	cipherKey    []byte
+	cipherKeyCrc uint64
+	cipherMode   CipherMode
+
+	seqno     uint64
+	backSeqno uint32
+}
+
+type serviceIntro struct {
+	key     ed25519.PublicKey
+	section *Section
+	back    *returnRoute
+}
+
+// RendezvousPacketsMaxPS limits packets of each client bound to a service on introduction node
+const RendezvousPacketsMaxPS = 100
+const RendezvousPacketsMaxPSBurst = RendezvousPacketsMaxPS * 2
+
+type rendezvousSession struct {
+	id        uint64
+	service   ed25519.PublicKey
+	clientKey []byte
+	back      *returnRoute
+	rate      *leakybucket.LeakyBucket
+}
+
+func (g *Gateway) newReturnRoute(mode CipherMode, inboundADNL, inboundSection, instructions, receiver []byte) (*returnRoute, error) {
+	key, err := keys.SharedKey(g.key, receiver)
+	if err != nil {
+		return nil, fmt.Errorf("calculate shared payload key failed: %w", err)
+	}
+
+	peer := g.addPeer(inboundADNL, nil)
+	peer.AddReference()
+
+	return &returnRoute{
+		peer:         peer,
+		sectionKey:   inboundSection,
+		instructions: instructions,
+		cipherKey:    key,
+		cipherKeyCrc: crc64.Checksum(key, crcTable),
+		cipherMode:   mode,
+	}, nil
+}
+
+func (r *returnRoute) send(ctx context.Context, obj tl.Serializable, isPayload bool) error {
+	pl, err := tl.Serialize(obj, true)
+	if err != nil {
+		return fmt.Errorf("serialize payload failed: %w", err)
+	}
+
+	pl, err = encryptStream(r.cipherMode, r.cipherKeyCrc, r.cipherKey, pl)
+	if err != nil {
+		return fmt.Errorf("encrypt payload failed: %w", err)
+	}
+
+	var msg tl.Serializable
+	if isPayload {
+		msg = EncryptedMessageCached{
+			SectionPubKey: r.sectionKey,
+			Seqno:         atomic.AddUint32(&r.backSeqno, 1),
+			Payload:       pl,
+		}
+	} else {
+		msg = EncryptedMessage{
+			SectionPubKey: r.sectionKey,
+			Instructions:  r.instructions,
+			Payload:       pl,
+		}
+	}
+
+	if err = r.peer.SendCustomMessage(ctx, msg); err != nil {
+		return fmt.Errorf("send message to inbound tunnel failed: %w", err)
+	}
+	return nil
+}
+
+func (r *returnRoute) decrypt(payload []byte, dst tl.Serializable) error {
+	data, err := decryptStream(r.cipherMode, r.cipherKeyCrc, r.cipherKey, payload)
+	if err != nil {
+		return fmt.Errorf("decrypt payload failed: %w", err)
+	}
+
+	if _, err = tl.Parse(dst, data, true); err != nil {
+		return fmt.Errorf("parse payload failed: %w", err)
+	}
+	return nil
+}
+
+func (ins BindServiceInstruction) Execute(ctx context.Context, s *Section, _ *EncryptedMessage, _ []byte) error {
+	if !s.gw.allowRouting {
+		return fmt.Errorf("instruction is not executable since routing is not allowed")
+	}
+
+	if len(ins.ServiceKey) != ed25519.PublicKeySize || !ed25519.Verify(ins.ServiceKey, s.key, ins.Signature) {
+		return fmt.Errorf("invalid service signature")
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.intro != nil && bytes.Equal(s.intro.key, ins.ServiceKey) &&
+		bytes.Equal(s.intro.back.sectionKey, ins.InboundSectionPubKey) &&
+		bytes.Equal(s.intro.back.instructions, ins.InboundInstructions) {
+		// already bound, just confirm
+		return s.intro.back.send(ctx, RendezvousBoundPayload{Seqno: atomic.AddUint64(&s.intro.back.seqno, 1)}, false)
+	}
+
+	back, err := s.gw.newReturnRoute(s.getCipherMode(), ins.InboundNodeADNL, ins.InboundSectionPubKey, ins.InboundInstructions, ins.ReceiverPubKey)
+	if err != nil {
+		return err
+	}
+
+	intro := &serviceIntro{
+		key:     ins.ServiceKey,
+		section: s,
+		back:    back,
+	}
+
+	s.gw.rendezvousMx.Lock()
+	if s.intro != nil {
+		if cur := s.gw.services[string(s.intro.key)]; cur == s.intro {
+			delete(s.gw.services, string(s.intro.key))
+		}
+		s.intro.back.peer.Dereference()
+	}
+	s.gw.services[string(ins.ServiceKey)] = intro
+	s.gw.rendezvousMx.Unlock()
+	s.intro = intro
+
+	s.log.Info().Str("service", base64.StdEncoding.EncodeToString(ins.ServiceKey)).Msg("service introduction point registered")
+
+	if err = back.send(ctx, RendezvousBoundPayload{Seqno: atomic.AddUint64(&back.seqno, 1)}, false); err != nil {
+		s.log.Debug().Err(err).Msg("send back failed")
+	}
+	return nil
+}
+
+func (ins ServiceReplyInstruction) Execute(ctx context.Context, s *Section, msg *EncryptedMessage, _ []byte) error {
+	return s.serviceReply(ctx, msg.Payload)
+}
+
+type ServiceReplyCachedAction struct{}
+
+func (a *ServiceReplyCachedAction) Execute(ctx context.Context, s *Section, msg *EncryptedMessageCached) error {
+	return s.serviceReply(ctx, msg.Payload)
+}
+
+func (s *Section) serviceReply(ctx context.Context, payload []byte) error {
+	s.mx.RLock()
+	intro := s.intro
+	s.mx.RUnlock()
+
+	if intro == nil {
+		return fmt.Errorf("service is not bound")
+	}
+
+	var pl ServiceReplyPayload
+	if err := intro.back.decrypt(payload, &pl); err != nil {
+		return err
+	}
+
+	s.gw.rendezvousMx.RLock()
+	sess := s.gw.sessions[pl.Session]
+	s.gw.rendezvousMx.RUnlock()
+
+	if sess == nil || !bytes.Equal(sess.service, intro.key) {
+		return fmt.Errorf("session %d is not exists", pl.Session)
+	}
+
+	return sess.back.send(ctx, DeliverPayload{
+		Seqno:   atomic.AddUint64(&sess.back.seqno, 1),
+		Payload: pl.Payload,
+	}, true)
+}
+
+func (ins BindRendezvousInstruction) Execute(ctx context.Context, s *Section, _ *EncryptedMessage, _ []byte) error {
+	if !s.gw.allowRouting {
+		return fmt.Errorf("instruction is not executable since routing is not allowed")
+	}
+
+	s.gw.rendezvousMx.RLock()
+	intro := s.gw.services[string(ins.ServiceKey)]
+	s.gw.rendezvousMx.RUnlock()
+
+	if intro == nil {
+		return fmt.Errorf("service is not registered on this node")
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if sess := s.session; sess != nil && bytes.Equal(sess.service, ins.ServiceKey) &&
+		bytes.Equal(sess.clientKey, ins.ClientKey) &&
+		bytes.Equal(sess.back.sectionKey, ins.InboundSectionPubKey) &&
+		bytes.Equal(sess.back.instructions, ins.InboundInstructions) {
+		return sess.back.send(ctx, RendezvousBoundPayload{Seqno: atomic.AddUint64(&sess.back.seqno, 1)}, false)
+	}
+
+	// session id is random, so it tells nothing about client section to the service
+	id, err := randomSessionID()
+	if err != nil {
+		return err
+	}
+
+	back, err := s.gw.newReturnRoute(s.getCipherMode(), ins.InboundNodeADNL, ins.InboundSectionPubKey, ins.InboundInstructions, ins.ReceiverPubKey)
+	if err != nil {
+		return err
+	}
+
+	sess := &rendezvousSession{
+		id:        id,
+		service:   ins.ServiceKey,
+		clientKey: ins.ClientKey,
+		back:      back,
+		// rendezvous traffic is never paid, so it is always limited
+		rate: leakybucket.NewLeakyBucket(RendezvousPacketsMaxPS, RendezvousPacketsMaxPSBurst),
+	}
+
+	s.gw.rendezvousMx.Lock()
+	if s.gw.sessions[sess.id] != nil {
+		s.gw.rendezvousMx.Unlock()
+		back.peer.Dereference()
+		return fmt.Errorf("session id collision")
+	}
+	if s.session != nil {
+		if cur := s.gw.sessions[s.session.id]; cur == s.session {
+			delete(s.gw.sessions, s.session.id)
+		}
+		s.session.back.peer.Dereference()
+	}
+	s.gw.sessions[sess.id] = sess
+	s.gw.rendezvousMx.Unlock()
+	s.session = sess
+
+	s.log.Debug().Str("service", base64.StdEncoding.EncodeToString(ins.ServiceKey)).Msg("rendezvous session bound")
+
+	if err = back.send(ctx, RendezvousBoundPayload{Seqno: atomic.AddUint64(&back.seqno, 1)}, false); err != nil {
+		s.log.Debug().Err(err).Msg("send back failed")
+	}
+	return nil
+}
+
+func (ins DeliverInstruction) Execute(ctx context.Context, s *Section, msg *EncryptedMessage, restInstructions []byte) error {
+	return s.deliverToService(ctx, msg.Payload)
+}
+
+type DeliverCachedAction struct{}
+
+func (a *DeliverCachedAction) Execute(ctx context.Context, s *Section, msg *EncryptedMessageCached) error {
+	return s.deliverToService(ctx, msg.Payload)
+}
+
+func (s *Section) deliverToService(ctx context.Context, payload []byte) error {
+	s.mx.RLock()
+	sess := s.session
+	s.mx.RUnlock()
+
+	if sess == nil {
+		return fmt.Errorf("rendezvous is not bound")
+	}
+
+	if sess.rate.Add(1) <= 0 {
+		return fmt.Errorf("rendezvous packets exceeds rate limit")
+	}
+
+	var pl DeliverPayload
+	if err := sess.back.decrypt(payload, &pl); err != nil {
+		return err
+	}
+
+	s.gw.rendezvousMx.RLock()
+	intro := s.gw.services[string(sess.service)]
+	s.gw.rendezvousMx.RUnlock()
+
+	if intro == nil {
+		return fmt.Errorf("service is not registered on this node")
+	}
+
+	return intro.back.send(ctx, ServiceDeliverPayload{
+		Seqno:     atomic.AddUint64(&intro.back.seqno, 1),
+		Session:   sess.id,
+		ClientKey: sess.clientKey,
+		Payload:   pl.Payload,
+	}, true)
+}
+
+func randomSessionID() (uint64, error) {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, fmt.Errorf("generate session id failed: %w", err)
+	}
+	return binary.LittleEndian.Uint64(b[:]), nil
+}
+
+// closeRendezvous must be called under section lock
+func (s *Section) closeRendezvous() {
+	s.gw.rendezvousMx.Lock()
+	defer s.gw.rendezvousMx.Unlock()
+
+	if s.intro != nil {
+		if cur := s.gw.services[string(s.intro.key)]; cur == s.intro {
+			delete(s.gw.services, string(s.intro.key))
+		}
+		s.intro.back.peer.Dereference()
+		s.intro = nil
+	}
+
+	if s.session != nil {
+		if cur := s.gw.sessions[s.session.id]; cur == s.session {
+			delete(s.gw.sessions, s.session.id)
+		}
+		s.session.back.peer.Dereference()
+		s.session = nil
+	}
+}
+
+const (
+	// ServiceMaxSessions limits client sessions which keys are kept by service, the least recently used is evicted
+	ServiceMaxSessions = 16 * 1024
+	// ServiceNewSessionsPS limits shared key calculations for new sessions of service
+	ServiceNewSessionsPS    = 100
+	ServiceNewSessionsBurst = ServiceNewSessionsPS * 2
+)
+
+// ServiceSessionIdleTimeout is how long key of client session is kept without packets
+var ServiceSessionIdleTimeout = 10 * time.Minute
+
+// rendezvous configures tunnel to be a hidden service or its client, instead of using out gateway
+type rendezvous struct {
+	// service mode
+	serviceKey      ed25519.PrivateKey
+	accept          chan ServiceMessage
+	sessions        map[uint64]*serviceSessionKey
+	sessionsCleanAt time.Time
+	newSessions     *leakybucket.LeakyBucket
+	sessionsMx      sync.Mutex
+
+	// client mode
+	servicePub ed25519.PublicKey
+	e2e        *EncryptionKeys
+}
+
+type serviceSessionKey struct {
+	clientKey  []byte
+	key        []byte
+	crc        uint64
+	lastUsedAt time.Time
+}
+
+func newServiceRendezvous(serviceKey ed25519.PrivateKey) *rendezvous {
+	return &rendezvous{
+		serviceKey:  serviceKey,
+		accept:      make(chan ServiceMessage, 16*1024),
+		sessions:    map[uint64]*serviceSessionKey{},
+		newSessions: leakybucket.NewLeakyBucket(ServiceNewSessionsPS, ServiceNewSessionsBurst),
+	}
+}
+
+// getSession returns key of known session, nil when session is unknown or belongs to another client
+func (rv *rendezvous) getSession(id uint64, clientKey []byte) *serviceSessionKey {
+	rv.sessionsMx.Lock()
+	defer rv.sessionsMx.Unlock()
+
+	sk := rv.sessions[id]
+	if sk == nil || (clientKey != nil && !bytes.Equal(sk.clientKey, clientKey)) {
+		return nil
+	}
+	sk.lastUsedAt = time.Now()
+	return sk
+}
+
+// storeSession keeps key of session which packet was decrypted, idle sessions are removed,
+// and the least recently used one is evicted when there are too many
+func (rv *rendezvous) storeSession(id uint64, sk *serviceSessionKey) {
+	rv.sessionsMx.Lock()
+	defer rv.sessionsMx.Unlock()
+
+	now := time.Now()
+	sk.lastUsedAt = now
+
+	if now.Sub(rv.sessionsCleanAt) >= time.Minute || len(rv.sessions) >= ServiceMaxSessions {
+		rv.sessionsCleanAt = now
+		for k, v := range rv.sessions {
+			if now.Sub(v.lastUsedAt) >= ServiceSessionIdleTimeout {
+				delete(rv.sessions, k)
+			}
+		}
+	}
+
+	if _, ok := rv.sessions[id]; !ok && len(rv.sessions) >= ServiceMaxSessions {
+		var oldest uint64
+		var oldestAt time.Time
+		for k, v := range rv.sessions {
+			if oldestAt.IsZero() || v.lastUsedAt.Before(oldestAt) {
+				oldest, oldestAt = k, v.lastUsedAt
+			}
+		}
+		delete(rv.sessions, oldest)
+	}
+	rv.sessions[id] = sk
+}
+
+// rendezvousAddr is a virtual address of the service, reported by ReadFrom in client mode
+var rendezvousAddr = net.UDPAddrFromAddrPort(netip.MustParseAddrPort("255.0.0.2:1"))
+
+// ServiceListener accepts packets of hidden service clients, received through introduction node
+type ServiceListener struct {
+	t *RegularOutTunnel
+}
+
+// RegisterService builds tunnel which last node of chainTo becomes introduction point of the service,
+// clients are reaching service through it, without knowing its ip, and service is not knowing clients ip.
+func (g *Gateway) RegisterService(ctx context.Context, serviceKey ed25519.PrivateKey, chainTo, chainFrom []*SectionInfo, log zerolog.Logger) (*ServiceListener, error) {
+	if len(chainTo) > 0 && chainTo[len(chainTo)-1].PaymentInfo != nil {
+		return nil, fmt.Errorf("introduction node should not require payments")
+	}
+
+	t, err := g.createRegularOutTunnel(ctx, chainTo, chainFrom, newServiceRendezvous(serviceKey), nil, log)
+	if err != nil {
+		return nil, err
+	}
+	return &ServiceListener{t: t}, nil
+}
+
+// ConnectService builds tunnel to the introduction node of service, returned tunnel sends packets
+// only to the service, destination address passed to WriteTo is ignored
+func (g *Gateway) ConnectService(ctx context.Context, servicePub ed25519.PublicKey, chainTo, chainFrom []*SectionInfo, log zerolog.Logger) (*RegularOutTunnel, error) {
+	if len(chainTo) > 0 && chainTo[len(chainTo)-1].PaymentInfo != nil {
+		return nil, fmt.Errorf("introduction node should not require payments")
+	}
+
+	e2e, err := GenerateEncryptionKeys(servicePub)
+	if err != nil {
+		return nil, fmt.Errorf("generate end-to-end key failed: %w", err)
+	}
+	// service is always a new version, so authenticated encryption is used
+	e2e.Mode = CipherModeAEAD
+
+	return g.createRegularOutTunnel(ctx, chainTo, chainFrom, &rendezvous{
+		servicePub: servicePub,
+		e2e:        e2e,
+	}, nil, log)
+}
+
+// Tunnel returns underlying tunnel of the service, to wait for init, check stats or close it
+func (l *ServiceListener) Tunnel() *RegularOutTunnel {
+	return l.t
+}
+
+func (l *ServiceListener) Accept(ctx context.Context) (*ServiceMessage, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-l.t.closerCtx.Done():
+		return nil, l.t.closerCtx.Err()
+	case m := <-l.t.rendezvous.accept:
+		return &m, nil
+	}
+}
+
+// Reply sends packet to the client of session
+func (l *ServiceListener) Reply(session uint64, payload []byte) error {
+	sk := l.t.rendezvous.getSession(session, nil)
+	if sk == nil {
+		return fmt.Errorf("unknown session %d", session)
+	}
+
+	data, err := encryptStream(CipherModeAEAD, sk.crc, sk.key, payload)
+	if err != nil {
+		return fmt.Errorf("encrypt payload failed: %w", err)
+	}
+
+	return l.t.sendPayload(ServiceReplyPayload{
+		Session: session,
+		Payload: data,
+	})
+}
+
+func (l *ServiceListener) Close() error {
+	return l.t.Close()
+}
+
+// rendezvousInstructions returns instructions for introduction node, instead of bind out
+func (t *RegularOutTunnel) rendezvousInstructions(sectionKey []byte, inboundADNL []byte, backMsg *EncryptedMessage) []tl.Serializable {
+	rv := t.rendezvous
+	if rv.serviceKey != nil {
+		return []tl.Serializable{BindServiceInstruction{
+			ServiceKey:           rv.serviceKey.Public().(ed25519.PublicKey),
+			Signature:            ed25519.Sign(rv.serviceKey, sectionKey),
+			InboundNodeADNL:      inboundADNL,
+			InboundSectionPubKey: backMsg.SectionPubKey,
+			InboundInstructions:  backMsg.Instructions,
+			ReceiverPubKey:       t.payloadKeys.SectionPubKey,
+		}, CacheInstruction{
+			Version:      uint64(time.Now().UnixNano()),
+			Instructions: []any{ServiceReplyInstruction{}},
+		}}
+	}
+
+	return []tl.Serializable{BindRendezvousInstruction{
+		ServiceKey:           rv.servicePub,
+		ClientKey:            rv.e2e.SectionPubKey,
+		InboundNodeADNL:      inboundADNL,
+		InboundSectionPubKey: backMsg.SectionPubKey,
+		InboundInstructions:  backMsg.Instructions,
+		ReceiverPubKey:       t.payloadKeys.SectionPubKey,
+	}, CacheInstruction{
+		Version:      uint64(time.Now().UnixNano()),
+		Instructions: []any{DeliverInstruction{}},
+	}}
+}
+
+func (t *RegularOutTunnel) processServiceDeliver(p ServiceDeliverPayload) error {
+	rv := t.rendezvous
+	if rv == nil || rv.serviceKey == nil {
+		return fmt.Errorf("tunnel is not a service")
+	}
+
+	sk := rv.getSession(p.Session, p.ClientKey)
+	isNew := sk == nil
+	if isNew {
+		if rv.newSessions.Add(1) <= 0 {
+			atomic.AddUint64(&t.packetsDropped, 1)
+			return fmt.Errorf("new sessions exceeds rate limit")
+		}
+
+		key, err := keys.SharedKey(rv.serviceKey, p.ClientKey)
+		if err != nil {
+			return fmt.Errorf("calculate client shared key failed: %w", err)
+		}
+
+		sk = &serviceSessionKey{
+			clientKey: append([]byte{}, p.ClientKey...),
+			key:       key,
+			crc:       crc64.Checksum(key, crcTable),
+		}
+	}
+
+	data, err := decryptStream(CipherModeAEAD, sk.crc, sk.key, p.Payload)
+	if err != nil {
+		return fmt.Errorf("decrypt client payload failed: %w", err)
+	}
+
+	if isNew {
+		// session is kept only when client proved it knows the key
+		rv.storeSession(p.Session, sk)
+	}
+
+	select {
+	case rv.accept <- ServiceMessage{
+		Session:   p.Session,
+		ClientKey: p.ClientKey,
+		Payload:   data,
+	}:
+		return nil
+	default:
+		atomic.AddUint64(&t.packetsDropped, 1)
+		return fmt.Errorf("accept channel full")
+	}
+}
+
+func (t *RegularOutTunnel) processServiceReply(p DeliverPayload) error {
+	rv := t.rendezvous
+	if rv == nil || rv.e2e == nil {
+		return fmt.Errorf("tunnel is not a service client")
+	}
+
+	data, err := decryptStream(rv.e2e.Mode, rv.e2e.CipherKeyCRC, rv.e2e.CipherKey, p.Payload)
+	if err != nil {
+		return fmt.Errorf("decrypt service payload failed: %w", err)
+	}
+	atomic.AddUint64(&t.packetsRecv, 1)
+
+	select {
+	case t.read <- DeliverUDPPayload{
+		Seqno:   p.Seqno,
+		IP:      rendezvousAddr.IP,
+		Port:    uint32(rendezvousAddr.Port),
+		Payload: data,
+	}:
+		return nil
+	default:
+		atomic.AddUint64(&t.packetsDropped, 1)
+		return fmt.Errorf("read channel full")
+	}
+}
@@ -0,0 +1,184 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"github.com/rs/zerolog"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"github.com/xssnick/tonutils-go/tl"
+	"testing"
+	"time"
+)
+
+func TestRendezvousEndToEnd(t *testing.T) {
+	servicePub, serviceKey, _ := ed25519.GenerateKey(nil)
+
+	service := &RegularOutTunnel{
+		rendezvous: newServiceRendezvous(serviceKey),
+		closerCtx:  context.Background(),
+	}
+
+	e2e, err := GenerateEncryptionKeys(servicePub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2e.Mode = CipherModeAEAD
+	client := &RegularOutTunnel{
+		rendezvous: &rendezvous{
+			servicePub: servicePub,
+			e2e:        e2e,
+		},
+		read: make(chan DeliverUDPPayload, 1),
+	}
+
+	data, err := e2e.EncryptPayload([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// introduction node splices client packet into service tunnel
+	if err = service.processServiceDeliver(ServiceDeliverPayload{
+		Seqno:     1,
+		Session:   7,
+		ClientKey: e2e.SectionPubKey,
+		Payload:   data,
+	}); err != nil {
+		t.Fatalf("processServiceDeliver() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	m, err := (&ServiceListener{t: service}).Accept(ctx)
+	if err != nil {
+		t.Fatalf("Accept() error = %v", err)
+	}
+
+	if m.Session != 7 || !bytes.Equal(m.Payload, []byte("ping")) {
+		t.Fatalf("unexpected message: %+v", m)
+	}
+
+	sk := service.rendezvous.getSession(7, nil)
+	if sk == nil {
+		t.Fatal("session key is not stored")
+	}
+
+	reply, err := encryptStream(CipherModeAEAD, sk.crc, sk.key, []byte("pong"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = client.processServiceReply(DeliverPayload{Seqno: 1, Payload: reply}); err != nil {
+		t.Fatalf("processServiceReply() error = %v", err)
+	}
+
+	got := <-client.read
+	if !bytes.Equal(got.Payload, []byte("pong")) {
+		t.Fatalf("unexpected reply: %s", got.Payload)
+	}
+}
+
+func TestServiceSessionsBounded(t *testing.T) {
+	_, serviceKey, _ := ed25519.GenerateKey(nil)
+	service := &RegularOutTunnel{rendezvous: newServiceRendezvous(serviceKey)}
+	rv := service.rendezvous
+
+	// garbage payload is not creating session
+	clientPub, _, _ := ed25519.GenerateKey(nil)
+	if err := service.processServiceDeliver(ServiceDeliverPayload{Session: 1, ClientKey: clientPub, Payload: []byte("garbage")}); err == nil {
+		t.Fatal("garbage payload should be rejected")
+	}
+	if len(rv.sessions) != 0 {
+		t.Fatal("session should not be stored before payload is decrypted")
+	}
+
+	// idle sessions are removed, and the least recently used is evicted when full
+	rv.storeSession(1, &serviceSessionKey{})
+	rv.sessions[1].lastUsedAt = time.Now().Add(-ServiceSessionIdleTimeout)
+	rv.sessionsCleanAt = time.Time{}
+	rv.storeSession(2, &serviceSessionKey{})
+	if rv.getSession(1, nil) != nil || rv.getSession(2, nil) == nil {
+		t.Fatal("idle session should be removed")
+	}
+
+	for i := uint64(3); len(rv.sessions) < ServiceMaxSessions; i++ {
+		rv.sessions[i] = &serviceSessionKey{lastUsedAt: time.Now()}
+	}
+	rv.sessions[2].lastUsedAt = time.Now().Add(-time.Minute)
+	rv.storeSession(1<<40, &serviceSessionKey{})
+	if len(rv.sessions) != ServiceMaxSessions || rv.getSession(2, nil) != nil || rv.getSession(1<<40, nil) == nil {
+		t.Fatal("least recently used session should be evicted")
+	}
+
+	// new sessions are rate limited
+	for i := 0; i < ServiceNewSessionsBurst; i++ {
+		rv.newSessions.Add(1)
+	}
+	if err := service.processServiceDeliver(ServiceDeliverPayload{Session: 5, ClientKey: clientPub, Payload: []byte("garbage")}); err == nil || service.packetsDropped != 1 {
+		t.Fatal("new sessions should be rate limited")
+	}
+}
+
+func TestBindServiceSignature(t *testing.T) {
+	_, serviceKey, _ := ed25519.GenerateKey(nil)
+	sectionKey := make([]byte, 32)
+
+	ins := BindServiceInstruction{
+		ServiceKey: serviceKey.Public().(ed25519.PublicKey),
+		Signature:  ed25519.Sign(serviceKey, sectionKey),
+	}
+
+	s := &Section{key: []byte("another section key 32 bytes....."), gw: &Gateway{allowRouting: true}}
+	if err := ins.Execute(context.Background(), s, nil, nil); err == nil {
+		t.Fatal("signature for another section should be rejected")
+	}
+}
+
+func TestBindRendezvousSession(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, addPeer := newTestGateway(t, ctx)
+	g.allowRouting = true
+	g.services = map[string]*serviceIntro{}
+	g.sessions = map[uint64]*rendezvousSession{}
+
+	servicePub, _, _ := ed25519.GenerateKey(nil)
+	g.services[string(servicePub)] = &serviceIntro{key: servicePub}
+
+	inboundPub, _, _ := ed25519.GenerateKey(nil)
+	addPeer(inboundPub)
+	inboundADNL, err := tl.Hash(keys.PublicKeyED25519{Key: inboundPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiverPub, _, _ := ed25519.GenerateKey(nil)
+
+	s := &Section{key: make([]byte, 32), gw: g, log: zerolog.Nop()}
+	bind := func(clientKey []byte) *rendezvousSession {
+		if err := (BindRendezvousInstruction{
+			ServiceKey:           servicePub,
+			ClientKey:            clientKey,
+			InboundNodeADNL:      inboundADNL,
+			InboundSectionPubKey: make([]byte, 32),
+			ReceiverPubKey:       receiverPub,
+		}).Execute(ctx, s, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		return s.session
+	}
+
+	first := bind(make([]byte, 32))
+	if first.id == 0 || first.rate == nil {
+		t.Fatal("session should have random id and rate limit")
+	}
+
+	second := bind(bytes.Repeat([]byte{1}, 32))
+	if second.id == first.id {
+		t.Fatal("rebound session should get new id")
+	}
+	if len(g.sessions) != 1 || g.sessions[second.id] != second {
+		t.Fatal("previous session should be unregistered")
+	}
+}
@@ -0,0 +1,240 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rs/zerolog"
+	"hash/crc64"
+	"math/big"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// SessionMaxAgeSec is how long saved session can be resumed, nodes close inactive sections after this time
+const SessionMaxAgeSec = SectionMaxInactiveSec
+
+// SessionSaveInterval is how often client saves session of active tunnel
+var SessionSaveInterval = 5 * time.Second
+
+// SessionKeys are keys of the section, cipher key is a shared key derived from section private key,
+// it is enough to continue using existing section on node
+type SessionKeys struct {
+	SectionPubKey  []byte
+	ReceiverPubKey []byte
+	CipherKey      []byte
+	Mode           CipherMode
+	Seqno          uint32
+
+	// Prepaid is how many packets of the section are paid and not consumed yet, node keeps this balance
+	Prepaid int64 `json:",omitempty"`
+}
+
+// SessionState is a resumable state of tunnel, it contains secret keys, so should be stored securely
+type SessionState struct {
+	// TunnelKey is a seed of client adnl key, last inbound section is bound to it
+	TunnelKey []byte
+
+	ChainTo   []SessionKeys
+	ChainFrom []SessionKeys
+	Payload   SessionKeys
+
+	SeqnoForward     uint32
+	FragmentSeqno    uint64
+	StatsPacketsSent uint64
+	MessagesRecv     uint64
+
+	ExtIP   net.IP
+	ExtPort uint16
+
+	// Spent is paid amount per currency, tunnel spend budget is continued with it
+	Spent map[string]*big.Int `json:",omitempty"`
+
+	SavedAt int64
+}
+
+// LoadSession reads session from file, nil is returned when there is no session, or it is too old to be resumed
+func LoadSession(path string) (*SessionState, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read session file: %w", err)
+	}
+
+	var st SessionState
+	if err = json.Unmarshal(data, &st); err != nil {
+		return nil, fmt.Errorf("failed to parse session file: %w", err)
+	}
+
+	if st.SavedAt < time.Now().Unix()-SessionMaxAgeSec {
+		return nil, nil
+	}
+	return &st, nil
+}
+
+// Save writes session to file atomically, file is readable only by owner
+func (st *SessionState) Save(path string) error {
+	data, err := json.Marshal(st)
+	if err != nil {
+		return fmt.Errorf("failed to serialize session: %w", err)
+	}
+
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write session file: %w", err)
+	}
+
+	if err = os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to replace session file: %w", err)
+	}
+	return nil
+}
+
+func exportSessionKeys(k *EncryptionKeys) SessionKeys {
+	k.mx.RLock()
+	defer k.mx.RUnlock()
+
+	return SessionKeys{
+		SectionPubKey:  append([]byte{}, k.SectionPubKey...),
+		ReceiverPubKey: append([]byte{}, k.ReceiverPubKey...),
+		CipherKey:      append([]byte{}, k.CipherKey...),
+		Mode:           k.Mode,
+		Seqno:          atomic.LoadUint32(&k.Seqno),
+	}
+}
+
+func (k SessionKeys) restore() (*EncryptionKeys, error) {
+	if len(k.SectionPubKey) != ed25519.PublicKeySize || len(k.ReceiverPubKey) != ed25519.PublicKeySize || len(k.CipherKey) != 32 {
+		return nil, fmt.Errorf("corrupted keys")
+	}
+
+	return &EncryptionKeys{
+		CipherKey:      k.CipherKey,
+		CipherKeyCRC:   crc64.Checksum(k.CipherKey, crcTable),
+		Seqno:          k.Seqno + inheritSeqnoGap, // some seqnos could be used after save
+		SectionPubKey:  k.SectionPubKey,
+		ReceiverPubKey: k.ReceiverPubKey,
+		Mode:           k.Mode,
+	}, nil
+}
+
+// ExportSession returns resumable state of tunnel, nil is returned for rendezvous tunnels
+func (t *RegularOutTunnel) ExportSession() *SessionState {
+	if t.rendezvous != nil {
+		return nil
+	}
+
+	t.mx.RLock()
+	defer t.mx.RUnlock()
+
+	st := &SessionState{
+		Payload:          exportSessionKeys(t.payloadKeys),
+		SeqnoForward:     atomic.LoadUint32(&t.seqnoForward),
+		FragmentSeqno:    atomic.LoadUint64(&t.fragmentSeqno),
+		StatsPacketsSent: atomic.LoadUint64(&t.statsPacketsSent),
+		MessagesRecv:     atomic.LoadUint64(&t.messagesRecv),
+		ExtIP:            t.externalAddr,
+		ExtPort:          t.externalPort,
+		SavedAt:          time.Now().Unix(),
+	}
+
+	if t.spent != nil {
+		st.Spent = map[string]*big.Int{}
+		for key, amount := range t.spent {
+			st.Spent[key] = new(big.Int).Set(amount)
+		}
+	}
+
+	consumedOut := atomic.LoadInt64(&t.packetsConsumedOut)
+	consumedIn := atomic.LoadInt64(&t.packetsConsumedIn)
+	messagesConsumedOut := atomic.LoadInt64(&t.messagesConsumedOut)
+
+	// balances are counted the same way as in control message
+	for i, node := range t.chainTo {
+		k := exportSessionKeys(node.Keys)
+		if node.PaymentInfo != nil {
+			consumed := messagesConsumedOut
+			if i == len(t.chainTo)-1 {
+				consumed = consumedOut
+				if consumed < consumedIn {
+					consumed = consumedIn
+				}
+			}
+			k.Prepaid = node.PaymentInfo.PaidPackets - consumed
+		}
+		st.ChainTo = append(st.ChainTo, k)
+	}
+	for _, node := range t.chainFrom {
+		k := exportSessionKeys(node.Keys)
+		if node.PaymentInfo != nil {
+			k.Prepaid = node.PaymentInfo.PaidPackets - consumedIn
+		}
+		st.ChainFrom = append(st.ChainFrom, k)
+	}
+	return st
+}
+
+// ResumeRegularOutTunnel creates tunnel with the sections of saved session, nodes which still hold them
+// keep routes and out binding, so external address is not changed. Chains should contain the same nodes as session,
+// their payment info is used, keys are replaced with saved ones. Gateway should use the same key as session.
+func (g *Gateway) ResumeRegularOutTunnel(ctx context.Context, st *SessionState, chainTo, chainFrom []*SectionInfo, log zerolog.Logger) (*RegularOutTunnel, error) {
+	if len(chainTo) != len(st.ChainTo) || len(chainFrom) != len(st.ChainFrom) {
+		return nil, fmt.Errorf("chains are not matching session")
+	}
+
+	prev := &RegularOutTunnel{
+		seqnoForward:  st.SeqnoForward,
+		fragmentSeqno: st.FragmentSeqno,
+		spent:         st.Spent,
+	}
+
+	restore := func(chain []*SectionInfo, saved []SessionKeys) ([]*SectionInfo, error) {
+		var res []*SectionInfo
+		for i, node := range chain {
+			if !bytes.Equal(node.Keys.ReceiverPubKey, saved[i].ReceiverPubKey) {
+				return nil, fmt.Errorf("node %d is not matching session", i)
+			}
+
+			k, err := saved[i].restore()
+			if err != nil {
+				return nil, fmt.Errorf("restore keys of section %d failed: %w", i, err)
+			}
+
+			if node.PaymentInfo != nil && saved[i].Prepaid > 0 {
+				// node still has this balance, so it is not paid again
+				node.PaymentInfo.PaidPackets = saved[i].Prepaid
+			}
+			res = append(res, &SectionInfo{Keys: k, PaymentInfo: node.PaymentInfo})
+		}
+		return res, nil
+	}
+
+	var err error
+	if prev.chainTo, err = restore(chainTo, st.ChainTo); err != nil {
+		return nil, fmt.Errorf("chain to: %w", err)
+	}
+	if prev.chainFrom, err = restore(chainFrom, st.ChainFrom); err != nil {
+		return nil, fmt.Errorf("chain from: %w", err)
+	}
+	if prev.payloadKeys, err = st.Payload.restore(); err != nil {
+		return nil, fmt.Errorf("restore payload keys failed: %w", err)
+	}
+
+	t, err := g.createRegularOutTunnel(ctx, prev.chainTo, prev.chainFrom, nil, prev, log)
+	if err != nil {
+		return nil, err
+	}
+
+	// nodes counters are continued, so ours too, to compare them in hop stats
+	atomic.StoreUint64(&t.statsPacketsSent, st.StatsPacketsSent)
+	atomic.StoreUint64(&t.messagesRecv, st.MessagesRecv)
+
+	return t, nil
+}
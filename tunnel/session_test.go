@@ -0,0 +1,108 @@
+package tunnel
+
+import (
+	"context"
+	"crypto/ed25519"
+	"github.com/rs/zerolog"
+	"github.com/xssnick/ton-payment-network/tonpayments"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSessionResume(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, peer := newTestGateway(t, ctx)
+
+	relayPub, _, _ := ed25519.GenerateKey(nil)
+	peer(relayPub)
+	outPub, _, _ := ed25519.GenerateKey(nil)
+	us := g.key.Public().(ed25519.PublicKey)
+
+	tun, err := g.CreateRegularOutTunnel(ctx, []*SectionInfo{testSection(t, relayPub), testSection(t, outPub)},
+		[]*SectionInfo{testSection(t, relayPub), testSection(t, us)}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// control sender is running, so everything is changed the same way as it reads
+	atomic.StoreUint32(&tun.seqnoForward, 500)
+	tun.chainTo[1].Keys.mx.Lock()
+	tun.chainTo[1].Keys.Mode = CipherModeAEAD
+	tun.chainTo[1].Keys.mx.Unlock()
+	atomic.StoreUint32(&tun.chainTo[1].Keys.Seqno, 7)
+
+	tun.mx.Lock()
+	tun.chainTo[1].PaymentInfo = &Payer{PricePerPacket: 1, PaidPackets: 1000}
+	tun.mx.Unlock()
+	atomic.StoreInt64(&tun.packetsConsumedOut, 300)
+
+	path := filepath.Join(t.TempDir(), "session.json")
+	if err = tun.ExportSession().Save(path); err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := LoadSession(path)
+	if err != nil || st == nil {
+		t.Fatal("session should be loaded", err)
+	}
+
+	// chains are built from pool again, with new keys,
+	// payments are not made until tunnel is configured, so service is not used
+	g.payments.Service = &tonpayments.Service{}
+	paid := testSection(t, outPub)
+	paid.PaymentInfo = &Payer{PricePerPacket: 1}
+	res, err := g.ResumeRegularOutTunnel(ctx, st, []*SectionInfo{testSection(t, relayPub), paid},
+		[]*SectionInfo{testSection(t, relayPub), testSection(t, us)}, zerolog.Nop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, saved := range append(append([]SessionKeys{}, st.ChainTo...), st.ChainFrom...) {
+		got := append(append([]*SectionInfo{}, res.chainTo...), res.chainFrom...)[i].Keys
+		got.mx.RLock()
+		mode := got.Mode
+		got.mx.RUnlock()
+
+		if !got.SectionPubKey.Equal(ed25519.PublicKey(saved.SectionPubKey)) || string(got.CipherKey) != string(saved.CipherKey) ||
+			mode != saved.Mode || atomic.LoadUint32(&got.Seqno) <= saved.Seqno {
+			t.Fatalf("section %d is not restored", i)
+		}
+	}
+
+	if st.ChainTo[1].Mode != CipherModeAEAD || st.ChainTo[1].Seqno < 7 {
+		t.Fatal("section state should be saved")
+	}
+
+	if !res.payloadKeys.SectionPubKey.Equal(tun.payloadKeys.SectionPubKey) || atomic.LoadUint32(&res.seqnoForward) <= st.SeqnoForward || st.SeqnoForward < 500 {
+		t.Fatal("payload keys and seqnos should be restored")
+	}
+
+	res.mx.RLock()
+	prepaid := res.chainTo[1].PaymentInfo.PaidPackets
+	res.mx.RUnlock()
+	if prepaid != 700 {
+		t.Fatalf("prepaid balance should be restored, got %d", prepaid)
+	}
+
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	if _, err = g.ResumeRegularOutTunnel(ctx, st, []*SectionInfo{testSection(t, relayPub), testSection(t, otherPub)},
+		[]*SectionInfo{testSection(t, relayPub), testSection(t, us)}, zerolog.Nop()); err == nil {
+		t.Fatal("session should not be resumed with other nodes")
+	}
+
+	st.SavedAt = time.Now().Unix() - SessionMaxAgeSec - 1
+	if err = st.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if st, err = LoadSession(path); err != nil || st != nil {
+		t.Fatal("expired session should not be loaded")
+	}
+
+	if st, err = LoadSession(filepath.Join(t.TempDir(), "none.json")); err != nil || st != nil {
+		t.Fatal("missing session should not be an error")
+	}
+}
@@ -29,6 +29,8 @@ import (
 	"math/big"
 	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	cRand "crypto/rand"
@@ -49,7 +51,8 @@ var AskReroute = func() bool {
 }
 
 type UpdatedEvent struct {
-	Tunnel  *RegularOutTunnel
+	// Tunnel is the same for all updates, it is switched to the new route on reroute
+	Tunnel  *AtomicSwitchableRegularTunnel
 	ExtIP   net.IP
 	ExtPort uint16
 }
@@ -64,36 +67,19 @@ type MsgEvent struct {
 
 type StoppedEvent struct{}
 
+// GatewayStartedEvent is sent once client gateway is started, UI can use it to show nodes health
+type GatewayStartedEvent struct {
+	Gateway *Gateway
+}
+
 func RunTunnel(stopCtx context.Context, cfg *config.ClientConfig, sharedCfg *config.SharedConfig, netCfg *liteclient.GlobalConfig, logger zerolog.Logger, events chan any) {
 	defer func() {
 		events <- StoppedEvent{}
 	}()
 
-	var nodes []config.TunnelRouteSection
-
 	closerCtx, cancel := context.WithCancel(stopCtx)
 	defer cancel()
 
-	if !cfg.PaymentsEnabled {
-		for i, section := range sharedCfg.NodesPool {
-			if section.Payment == nil {
-				nodes = append(nodes, sharedCfg.NodesPool[i])
-			}
-		}
-	} else {
-		nodes = sharedCfg.NodesPool
-	}
-
-	if len(nodes) == 0 {
-		events <- fmt.Errorf("no nodes pool provided, please specify at least one node that match your payment settings in config file")
-		return
-	}
-
-	if uint(len(nodes)) < cfg.TunnelSectionsNum {
-		events <- fmt.Errorf("not enough nodes that match your payment settings in pool to have desired tunnel sections number")
-		return
-	}
-
 	_, dhtKey, err := ed25519.GenerateKey(nil)
 	if err != nil {
 		events <- fmt.Errorf("failed to generate DHT key: %w", err)
@@ -106,6 +92,18 @@ func RunTunnel(stopCtx context.Context, cfg *config.ClientConfig, sharedCfg *con
 		return
 	}
 
+	var session *SessionState
+	if cfg.SessionFile != "" {
+		if session, err = LoadSession(cfg.SessionFile); err != nil {
+			logger.Warn().Err(err).Msg("failed to load tunnel session, new one will be created")
+		} else if session != nil && len(session.TunnelKey) == ed25519.SeedSize {
+			// inbound sections are bound to our key
+			tunKey = ed25519.NewKeyFromSeed(session.TunnelKey)
+		} else {
+			session = nil
+		}
+	}
+
 	conn, err := adnl.DefaultListener(":")
 	if err != nil {
 		events <- fmt.Errorf("failed to bind listener: %w", err)
@@ -162,8 +160,17 @@ func RunTunnel(stopCtx context.Context, cfg *config.ClientConfig, sharedCfg *con
 		}()
 	}
 
-	tGate := NewGateway(gate, dhtClient, tunKey, logger.With().Str("component", "gateway").Logger(), PaymentConfig{
-		Service: pay,
+	budgets, err := LoadSpendBudgets(cfg.Payments.Budgets, cfg.Payments.BudgetsFile)
+	if err != nil {
+		events <- fmt.Errorf("failed to load budgets: %w", err)
+		return
+	}
+
+	tGate := NewGateway(gate, dhtClient, tunKey, logger.With().Str("component", "gateway").Logger(), GatewayOptions{
+		Payments: PaymentConfig{
+			Service: pay,
+			Budgets: budgets,
+		},
 	})
 	go func() {
 		if err = tGate.Start(); err != nil {
@@ -180,15 +187,129 @@ func RunTunnel(stopCtx context.Context, cfg *config.ClientConfig, sharedCfg *con
 		}
 	}()
 
+	var static []config.TunnelRouteSection
+	if sharedCfg != nil {
+		static = sharedCfg.NodesPool
+	}
+
+	pool := static
+	if len(static) == 0 || cfg.DiscoverNodes {
+		events <- MsgEvent{Msg: "Discovering tunnel nodes..."}
+
+		ctxDiscover, cancelDiscover := context.WithTimeout(closerCtx, 60*time.Second)
+		discovered, err := discoverNodesPool(ctxDiscover, tGate)
+		cancelDiscover()
+		if err != nil && len(static) == 0 {
+			events <- fmt.Errorf("failed to discover nodes: %w", err)
+			return
+		}
+		pool = mergeNodesPool(discovered, static)
+	}
+
+	var nodes []config.TunnelRouteSection
+	for i, section := range pool {
+		if cfg.PaymentsEnabled || section.Payment == nil {
+			nodes = append(nodes, pool[i])
+		}
+	}
+
+	if len(nodes) == 0 {
+		events <- fmt.Errorf("no nodes pool provided, please specify at least one node that match your payment settings in config file")
+		return
+	}
+
+	if uint(len(nodes)) < cfg.TunnelSectionsNum {
+		events <- fmt.Errorf("not enough nodes that match your payment settings in pool to have desired tunnel sections number")
+		return
+	}
+
+	probeSample := 0
+	if cfg.ProbePool {
+		probeSample = HealthProbeSample
+	}
+	tGate.ProbeNodes(probeKeys(nodes, nil, nil, probeSample))
+	events <- GatewayStartedEvent{Gateway: tGate}
+
+	resolveNodeRoles(closerCtx, tGate, nodes)
+
+	if cfg.Diversity != nil {
+		resolveNodesIP(closerCtx, tGate, nodes)
+
+		if cfg.Diversity.GeoIPDatabasePath != "" {
+			db, err := LoadGeoIPDatabase(cfg.Diversity.GeoIPDatabasePath)
+			if err != nil {
+				tGate.log.Warn().Err(err).Msg("failed to load geoip database, only countries and asns from nodes pool will be used")
+			} else {
+				db.fillNodesGeo(nodes)
+			}
+		}
+	}
+
+	sw := &AtomicSwitchableRegularTunnel{}
+
+	var guards *EntryGuards
+	if !cfg.DisableEntryGuards {
+		if guards, err = LoadEntryGuards(cfg.EntryGuardsFile); err != nil {
+			tGate.log.Warn().Err(err).Msg("failed to load entry guards, new ones will be selected")
+			guards = &EntryGuards{path: cfg.EntryGuardsFile}
+		}
+	}
+
+	// keep is a stalled tunnel, its out gate is tried to be reused with new relays, to not change external address
+	var keep *RegularOutTunnel
+
 	attempts := map[string]bool{}
 reinit:
 	for {
 		events <- MsgEvent{Msg: "Configuring tunnel route..."}
 
+		// previous tunnel, if any, still carries traffic while the new one is configured
 		var lastAsk int64
-		ctxInit, cancel := context.WithTimeout(closerCtx, 60*time.Second)
-		tun, port, ip, err, retryable := configureRoute(ctxInit, cfg, apiClient, tGate, nodes, attempts, events)
-		cancel()
+		var tun *RegularOutTunnel
+		var port uint16
+		var ip net.IP
+		var retryable bool
+
+		if session != nil {
+			events <- MsgEvent{Msg: "Resuming tunnel session..."}
+
+			ctxInit, cancel := context.WithTimeout(closerCtx, 30*time.Second)
+			tun, port, ip, err = resumeRoute(ctxInit, cfg, apiClient, tGate, nodes, session, events)
+			cancel()
+			session = nil
+
+			if err != nil {
+				tGate.log.Warn().Err(err).Msg("failed to resume tunnel session, configuring new route")
+			}
+		}
+
+		if wait := budgets.WaitTime(); tun == nil && wait > 0 {
+			events <- MsgEvent{Msg: fmt.Sprintf("Spend budget is reached, waiting %s...", wait.Round(time.Second))}
+			tGate.log.Warn().Dur("wait", wait).Msg("spend budget is reached, waiting before configuring a new route")
+
+			select {
+			case <-closerCtx.Done():
+				return
+			case <-time.After(wait):
+			}
+		}
+
+		if tun == nil {
+			timeout := 60 * time.Second
+			if cfg.RouteCandidateTimeoutSec > 0 {
+				timeout = time.Duration(cfg.RouteCandidateTimeoutSec) * time.Second
+			}
+
+			ctxInit, cancel := context.WithTimeout(closerCtx, timeout)
+			tun, port, ip, err, retryable = configureRoute(ctxInit, cfg, apiClient, tGate, nodes, keep, guards, attempts, events)
+			cancel()
+		}
+		if err != nil && keep != nil && !errors.Is(err, ErrRouteCanceled) {
+			tGate.log.Warn().Err(err).Msg("failed to reroute keeping out gateway, building the whole new route")
+			keep = nil
+			continue
+		}
+
 		if err != nil {
 			if errors.Is(err, ErrNoMoreRoutes) {
 				attempts = map[string]bool{}
@@ -206,8 +327,22 @@ reinit:
 			continue
 		}
 
+		if keep != nil {
+			keep.keepOut()
+			keep = nil
+		}
+
+		if sw.Current() != nil {
+			tGate.log.Info().Msg("switching traffic to the new route")
+		} else if cfg.SessionFile != "" {
+			go saveSession(closerCtx, cfg.SessionFile, tunKey, sw, tGate.log)
+		}
+		sw.Replace(closerCtx, tun)
+		// only the first hops of the new route are probed, the rest of the sample is changed
+		tGate.ProbeNodes(probeKeys(nodes, tun.directNodeKeys(), tun.routeNodeKeys(), probeSample))
+
 		events <- UpdatedEvent{
-			Tunnel:  tun,
+			Tunnel:  sw,
 			ExtIP:   ip,
 			ExtPort: port,
 		}
@@ -219,11 +354,21 @@ reinit:
 			case <-closerCtx.Done():
 				return
 			case <-time.After(5 * time.Second):
+				if tun.BudgetReached() {
+					// out gate is not kept, because its tunnel budget would be continued
+					tGate.log.Warn().Msg("spend budget of the tunnel is reached, rerouting...")
+					continue reinit
+				}
+
 				now := time.Now().Unix()
 				if now-tun.lastFullyCheckedAt > 45 && now-lastAsk > 60 {
 					tGate.log.Warn().Msg("tunnel is stalled for too long, asking about rerouting...")
 					if AskReroute() {
-						_ = tun.Stop(closerCtx)
+						if cfg.TunnelSectionsNum > 1 {
+							// relays are replaced first, out gate may still be alive
+							keep = tun
+						}
+						// old tunnel is destroyed after switch to the new one
 						continue reinit
 					} else {
 						tGate.log.Warn().Msg("rerouting denied, waiting 60 seconds before next ask")
@@ -236,17 +381,153 @@ reinit:
 	}
 }
 
+// discoverNodesPool finds tunnel nodes in DHT overlay and builds pool entries from their signed node info
+func discoverNodesPool(ctx context.Context, tGate *Gateway) ([]config.TunnelRouteSection, error) {
+	keysList, err := tGate.DiscoverNodes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to discover nodes: %w", err)
+	}
+
+	var mx sync.Mutex
+	var res []config.TunnelRouteSection
+
+	// known nodes list can be big, so lookups are limited
+	lookupEach(len(keysList), func(i int) {
+		ctxFind, cancel := context.WithTimeout(ctx, 7*time.Second)
+		info, err := tGate.FindNodeInfo(ctxFind, keysList[i])
+		cancel()
+		if err != nil {
+			tGate.log.Debug().Err(err).Str("key", base64.StdEncoding.EncodeToString(keysList[i])).Msg("failed to get info of discovered node, skipping")
+			return
+		}
+
+		sec, err := info.ToRouteSection()
+		if err != nil {
+			tGate.log.Debug().Err(err).Str("key", base64.StdEncoding.EncodeToString(keysList[i])).Msg("invalid info of discovered node, skipping")
+			return
+		}
+
+		mx.Lock()
+		res = append(res, sec)
+		mx.Unlock()
+	})
+
+	if len(res) == 0 {
+		return nil, fmt.Errorf("no nodes with valid info found, %d discovered", len(keysList))
+	}
+
+	tGate.log.Info().Int("discovered", len(keysList)).Int("valid", len(res)).Msg("nodes pool discovered")
+	return res, nil
+}
+
+// mergeNodesPool combines discovered nodes with static ones, static entries override discovered with the same key
+func mergeNodesPool(discovered, static []config.TunnelRouteSection) []config.TunnelRouteSection {
+	res := append([]config.TunnelRouteSection{}, static...)
+
+	known := map[string]bool{}
+	for _, s := range static {
+		known[string(s.Key)] = true
+	}
+
+	for _, s := range discovered {
+		if known[string(s.Key)] {
+			continue
+		}
+		known[string(s.Key)] = true
+		res = append(res, s)
+	}
+	return res
+}
+
+// resolveNodeRoles fills roles of pool nodes, which are not specified in shared config, from their dht records.
+// Info is resolved even when role is configured, because capabilities of the node, like its cipher, are known only from it.
+func resolveNodeRoles(ctx context.Context, tGate *Gateway, nodes []config.TunnelRouteSection) {
+	lookupEach(len(nodes), func(i int) {
+		node := &nodes[i]
+		if node.Role != "" && tGate.nodeCapabilitiesKnown(node.Key) {
+			// discovered node, info is already resolved
+			return
+		}
+
+		ctxFind, cancel := context.WithTimeout(ctx, 7*time.Second)
+		info, err := tGate.FindNodeInfo(ctxFind, node.Key)
+		cancel()
+		if err != nil {
+			// node of older version, or record is not reachable, consider it universal
+			tGate.log.Debug().Err(err).Str("key", base64.StdEncoding.EncodeToString(node.Key)).Msg("failed to resolve node info")
+			return
+		}
+
+		if node.Role == "" {
+			node.Role = info.Role()
+		}
+	})
+}
+
 var ErrRouteCanceled = errors.New("route canceled")
 var ErrRouteIsNotAccepted = errors.New("route is not accepted")
 var ErrNoMoreRoutes = errors.New("no more routes to try")
 
-func configureRoute(ctx context.Context, cfg *config.ClientConfig, apiClient ton.APIClientWrapped, tGate *Gateway, nodes []config.TunnelRouteSection, attempts map[string]bool, events chan any) (*RegularOutTunnel, uint16, net.IP, error, bool) {
-	tGate.log.Info().Msg("initializing adnl tunnel...")
+// routeCandidate is a route selected from pool, but not yet configured and accepted
+type routeCandidate struct {
+	chainTo     []*SectionInfo
+	chainFrom   []*SectionInfo
+	actingNodes []config.TunnelRouteSection
+	str         string
+	// price is a sum of prices per packet of all sections
+	price uint64
+	// firstHopFailed is set when route failed and its first hop was not answering during configuration
+	firstHopFailed bool
+}
+
+// routePriceSamples is how many random routes are compared to pick the cheapest one, when payments are enabled
+const routePriceSamples = 8
+
+// pickRoute selects route which was not tried yet, when payments are enabled, the cheapest of a few random routes is used.
+// When keep is set, its out gate is reused and only relays are replaced.
+func pickRoute(cfg *config.ClientConfig, tGate *Gateway, nodes []config.TunnelRouteSection, keep *RegularOutTunnel, guards [][]byte, attempts map[string]bool) (*routeCandidate, error, bool) {
+	samples := 1
+	if cfg.PaymentsEnabled {
+		samples = routePriceSamples
+	}
+
+	var c *routeCandidate
+	for i := 0; i < samples; i++ {
+		sample, err, retryable := assembleRoute(cfg, tGate, nodes, keep, guards, attempts)
+		if err != nil {
+			if c != nil {
+				break
+			}
+			return nil, err, retryable
+		}
+
+		if c == nil || sample.price < c.price {
+			c = sample
+		}
+	}
 
+	tGate.log.Info().Str("route", c.str).Uint64("price", c.price).Msgf("configuring route...")
+
+	attempts[c.str] = true
+
+	toUs, err := GenerateEncryptionKeys(tGate.key.Public().(ed25519.PublicKey))
+	if err != nil {
+		return nil, fmt.Errorf("generate us encryption keys failed: %w", err), false
+	}
+	c.chainFrom = append(c.chainFrom, &SectionInfo{
+		Keys: toUs,
+	})
+
+	return c, nil, true
+}
+
+// assembleRoute selects random route which was not tried yet and satisfies constraints, it is not marked as tried.
+// When guards are set, the first hop is always one of them.
+func assembleRoute(cfg *config.ClientConfig, tGate *Gateway, nodes []config.TunnelRouteSection, keep *RegularOutTunnel, guards [][]byte, attempts map[string]bool) (*routeCandidate, error, bool) {
 	var tries int
 reassemble:
 	if tries > 50 {
-		return nil, 0, nil, ErrNoMoreRoutes, true
+		return nil, ErrNoMoreRoutes, true
 	}
 
 	tries++
@@ -255,16 +536,80 @@ reassemble:
 
 	var rndInt = make([]byte, 8)
 	if _, err := cRand.Read(rndInt); err != nil {
-		return nil, 0, nil, fmt.Errorf("failed to generate random number: %w", err), false
+		return nil, fmt.Errorf("failed to generate random number: %w", err), false
 	}
 	rnd := rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(rndInt))))
 
-	rnd.Shuffle(len(nodes), func(i, j int) {
-		nodes[i], nodes[j] = nodes[j], nodes[i]
-	})
+	// nodes with lower latency are more likely to be used
+	tGate.latencyShuffle(rnd, nodes)
+
+	outIdx := -1
+	for pass := 0; pass < 2 && outIdx < 0; pass++ {
+		for i := range nodes {
+			if keep != nil {
+				if bytes.Equal(nodes[i].Key, keep.chainTo[len(keep.chainTo)-1].Keys.ReceiverPubKey) {
+					outIdx = i
+					break
+				}
+				continue
+			}
+
+			if !nodes[i].Role.CanOut() || !diversityOutAllowed(cfg.Diversity, &nodes[i]) ||
+				!tGate.payments.Budgets.PriceAllowed(nodes[i].Payment, true) {
+				continue
+			}
+
+			if guards != nil {
+				isG := isGuard(guards, nodes[i].Key)
+				if cfg.TunnelSectionsNum <= 1 && !isG {
+					// out gate is the first hop
+					continue
+				}
+				if cfg.TunnelSectionsNum > 1 && isG && pass == 0 {
+					// guards are preferred for the first relay
+					continue
+				}
+			}
 
-	out := nodes[0]
-	pool := nodes[1:]
+			outIdx = i
+			break
+		}
+	}
+
+	if outIdx < 0 {
+		if keep != nil {
+			return nil, fmt.Errorf("out gateway of the current tunnel is not in pool"), false
+		}
+		return nil, fmt.Errorf("no nodes in pool which can be used as out gateway"), false
+	}
+
+	out := nodes[outIdx]
+	var pool []config.TunnelRouteSection
+	for i := range nodes {
+		if i != outIdx && nodes[i].Role.CanRoute() && tGate.payments.Budgets.PriceAllowed(nodes[i].Payment, false) {
+			pool = append(pool, nodes[i])
+		}
+	}
+
+	if cfg.TunnelSectionsNum > 1 && uint(len(pool)) < cfg.TunnelSectionsNum-1 {
+		return nil, fmt.Errorf("not enough relay nodes in pool to have desired tunnel sections number"), false
+	}
+
+	if guards != nil && cfg.TunnelSectionsNum > 1 {
+		// first relay knows our ip, it is the first in chain to and the last in chain from
+		found := false
+		for i := range pool {
+			if isGuard(guards, pool[i].Key) {
+				pool[0], pool[i] = pool[i], pool[0]
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("no entry guards in pool"), true
+		}
+	}
 
 	var actingNodes = []config.TunnelRouteSection{out}
 
@@ -273,13 +618,13 @@ reassemble:
 		for i := uint(0); i < cfg.TunnelSectionsNum-1; i++ {
 			si, err := paymentConfigToSections(&pool[i], false, tGate.payments.Service)
 			if err != nil {
-				return nil, 0, nil, fmt.Errorf("convert config to section %d in `out` route failed: %w", i, err), false
+				return nil, fmt.Errorf("convert config to section %d in `out` route failed: %w", i, err), false
 			}
 
 			if siBack == nil {
 				siBack, err = paymentConfigToSections(&pool[i], false, tGate.payments.Service)
 				if err != nil {
-					return nil, 0, nil, fmt.Errorf("convert config to section %d in `out` route failed: %w", i, err), false
+					return nil, fmt.Errorf("convert config to section %d in `out` route failed: %w", i, err), false
 				}
 			}
 
@@ -287,14 +632,12 @@ reassemble:
 			actingNodes = append(actingNodes, pool[i])
 		}
 
-		rnd.Shuffle(len(pool), func(i, j int) {
-			pool[i], pool[j] = pool[j], pool[i]
-		})
+		tGate.latencyShuffle(rnd, pool)
 
 		for i := uint(0); i < cfg.TunnelSectionsNum-1; i++ {
 			si, err := paymentConfigToSections(&pool[i], false, tGate.payments.Service)
 			if err != nil {
-				return nil, 0, nil, fmt.Errorf("convert config to section %d in `in` route failed: %w", i, err), false
+				return nil, fmt.Errorf("convert config to section %d in `in` route failed: %w", i, err), false
 			}
 
 			chainFrom = append(chainFrom, si)
@@ -304,7 +647,7 @@ reassemble:
 
 	siGate, err := paymentConfigToSections(&out, true, tGate.payments.Service)
 	if err != nil {
-		return nil, 0, nil, fmt.Errorf("convert config to section out gateway failed: %w", err), false
+		return nil, fmt.Errorf("convert config to section out gateway failed: %w", err), false
 	}
 
 	chainTo = append(chainTo, siGate)
@@ -342,23 +685,309 @@ reassemble:
 		goto reassemble
 	}
 
-	tGate.log.Info().Str("route", strTo).Msgf("configuring route...")
+	route := routeNodes(nodes, chainTo, chainFrom)
+	if err = checkRouteDiversity(cfg.Diversity, route); err != nil {
+		attempts[strTo] = true
+		tGate.log.Debug().Err(err).Str("route", strTo).Msg("route violates diversity constraints")
+		goto reassemble
+	}
+
+	var price uint64
+	for i, node := range route {
+		if node.Payment == nil {
+			continue
+		}
+
+		if i == 0 {
+			price += node.Payment.PricePerPacketOutNano
+		} else {
+			price += node.Payment.PricePerPacketRouteNano
+		}
+	}
+
+	return &routeCandidate{
+		chainTo:     chainTo,
+		chainFrom:   chainFrom,
+		actingNodes: actingNodes,
+		str:         strTo,
+		price:       price,
+	}, nil, true
+}
+
+// configureRoute builds RouteCandidates routes concurrently, and returns the first configured and accepted one, others are stopped.
+// When keep is set, its out gate is reused and only relays are replaced, out section can be bound only once, so single route is built.
+func configureRoute(ctx context.Context, cfg *config.ClientConfig, apiClient ton.APIClientWrapped, tGate *Gateway, nodes []config.TunnelRouteSection, keep *RegularOutTunnel, guards *EntryGuards, attempts map[string]bool, events chan any) (*RegularOutTunnel, uint16, net.IP, error, bool) {
+	tGate.log.Info().Msg("initializing adnl tunnel...")
+
+	var guardKeys [][]byte
+	if guards != nil {
+		num := int(cfg.EntryGuardsNum)
+		if num == 0 {
+			num = DefaultEntryGuardsNum
+		}
+
+		// guards are selected from the whole pool, so short health problems do not rotate them
+		var err error
+		if guardKeys, err = guards.Select(nodes, func(node *config.TunnelRouteSection) bool {
+			if cfg.TunnelSectionsNum > 1 {
+				return node.Role.CanRoute()
+			}
+			return node.Role.CanOut()
+		}, num); err != nil {
+			return nil, 0, nil, fmt.Errorf("failed to select entry guards: %w", err), false
+		}
+	}
+
+	// nodes which not answer to pings are skipped
+	nodes = tGate.aliveNodes(nodes, cfg.TunnelSectionsNum)
+	if guardKeys != nil {
+		// dead guards are skipped only for this route, when all are dead, they are tried anyway
+		var alive [][]byte
+		for i := range nodes {
+			if isGuard(guardKeys, nodes[i].Key) {
+				alive = append(alive, nodes[i].Key)
+			}
+		}
+		if len(alive) > 0 {
+			guardKeys = alive
+		}
+	}
+
+	num := cfg.RouteCandidates
+	if num == 0 || keep != nil {
+		num = 1
+	}
+
+	var candidates []*routeCandidate
+	for uint(len(candidates)) < num {
+		c, err, retryable := pickRoute(cfg, tGate, nodes, keep, guardKeys, attempts)
+		if err != nil {
+			if len(candidates) > 0 && retryable {
+				// configure what we already have
+				break
+			}
+			return nil, 0, nil, err, retryable
+		}
+		candidates = append(candidates, c)
+	}
+
+	type result struct {
+		c         *routeCandidate
+		tun       *RegularOutTunnel
+		err       error
+		retryable bool
+	}
+
+	ctxRace, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(candidates))
+	for _, c := range candidates {
+		go func(c *routeCandidate) {
+			tun, err, retryable := configureCandidate(ctxRace, cfg, tGate, keep, c)
+			results <- result{c, tun, err, retryable}
+		}(c)
+	}
+
+	// stopLeft stops candidates which are not needed anymore, in background
+	stopLeft := func(left int) {
+		cancel()
+		go func() {
+			for ; left > 0; left-- {
+				if r := <-results; r.err == nil {
+					stopTunnel(r.tun)
+				}
+			}
+		}()
+	}
+
+	var err error
+	var retryable bool
+	for left := len(candidates); left > 0; left-- {
+		r := <-results
+		if guards != nil && (r.err == nil || r.c.firstHopFailed) {
+			// failures of other hops are not blamed on guard
+			if gErr := guards.Report(r.c.chainTo[0].Keys.ReceiverPubKey, r.err == nil); gErr != nil {
+				tGate.log.Warn().Err(gErr).Msg("failed to save entry guards")
+			}
+		}
+
+		if r.err == nil {
+			// candidates are configured without payments, so only the winner is accepted and paid
+			if r.err, r.retryable = payCandidate(ctx, apiClient, tGate, r.c, r.tun, events); r.err != nil {
+				stopTunnel(r.tun)
+			}
+		}
+
+		if r.err != nil {
+			if errors.Is(r.err, ErrRouteCanceled) {
+				stopLeft(left - 1)
+				return nil, 0, nil, r.err, false
+			}
+
+			if err == nil || (r.retryable && !retryable) {
+				err, retryable = r.err, r.retryable
+			}
+			continue
+		}
+
+		stopLeft(left - 1)
+		return r.tun, r.tun.externalPort, r.tun.externalAddr, nil, true
+	}
+
+	return nil, 0, nil, err, retryable
+}
+
+// configureCandidate creates tunnel of the route and waits for its configuration, payments are held until it is chosen.
+// Failed tunnel is stopped.
+func configureCandidate(ctx context.Context, cfg *config.ClientConfig, tGate *Gateway, keep *RegularOutTunnel, c *routeCandidate) (*RegularOutTunnel, error, bool) {
+	var tun *RegularOutTunnel
+	var err error
+	if keep != nil {
+		tun, err = tGate.RerouteRegularOutTunnel(ctx, keep, c.chainTo, c.chainFrom, tGate.log.With().Str("component", "tunnel").Logger())
+	} else {
+		tun, err = tGate.CreateRegularOutTunnel(ctx, c.chainTo, c.chainFrom, tGate.log.With().Str("component", "tunnel").Logger())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("create regular out tunnel failed: %w", err), true
+	}
+	// tunnel starts with configuration, which is not paid, so it is set before any payment can be attached
+	atomic.StoreInt32(&tun.paymentsHeld, 1)
+
+	if err = applyClientConfig(tun, cfg); err != nil {
+		stopTunnel(tun)
+		return nil, err, false
+	}
+
+	tGate.log.Info().Str("route", c.str).Msg("waiting adnl tunnel confirmation...")
 
-	attempts[strTo] = true
-	if den := Acceptor(chainTo, chainFrom); den != AcceptorDecisionAccept {
+	startedAt := time.Now().Unix()
+	if err = tun.waitConfigured(ctx); err != nil {
+		c.firstHopFailed = tun.peer.getConn() == nil || atomic.LoadInt64(&tun.peer.LastPacketFromAt) < startedAt
+		stopTunnel(tun)
+		return nil, fmt.Errorf("wait for tunnel init failed: %w", err), true
+	}
 
+	tGate.log.Info().Str("route", c.str).Msg("adnl tunnel is configured")
+
+	return tun, nil, true
+}
+
+// payCandidate asks Acceptor about configured route, deploys payment channels for its nodes and waits until they are paid
+func payCandidate(ctx context.Context, apiClient ton.APIClientWrapped, tGate *Gateway, c *routeCandidate, tun *RegularOutTunnel, events chan any) (error, bool) {
+	if den := Acceptor(c.chainTo, c.chainFrom); den != AcceptorDecisionAccept {
 		if den == AcceptorDecisionCancel {
-			tGate.log.Info().Str("route", strTo).Msgf("route canceled")
-			return nil, 0, nil, ErrRouteCanceled, false
+			tGate.log.Info().Str("route", c.str).Msgf("route canceled")
+			return ErrRouteCanceled, false
+		}
+		tGate.log.Info().Str("route", c.str).Msgf("route denied")
+
+		return ErrRouteIsNotAccepted, true
+	}
+
+	if tGate.payments.Service != nil {
+		if err := checkAndDeployPaymentChannels(ctx, apiClient, tGate.payments.Service, c.actingNodes, events); err != nil {
+			return fmt.Errorf("failed to check payment channels: %w", err), false
 		}
-		tGate.log.Info().Str("route", strTo).Msgf("route denied")
+	}
 
-		return nil, 0, nil, ErrRouteIsNotAccepted, true
+	if err := tun.waitPayments(ctx, func(s string) {
+		events <- MsgEvent{Msg: s}
+	}); err != nil {
+		return fmt.Errorf("wait for tunnel payments failed: %w", err), true
+	}
+
+	tGate.log.Info().Str("route", c.str).Msg("adnl tunnel is ready")
+	return nil, true
+}
+
+// stopTunnel gracefully stops tunnel in background, it is not waited
+func stopTunnel(tun *RegularOutTunnel) {
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+
+		_ = tun.Stop(ctx)
+	}()
+}
+
+// applyClientConfig sets policies from config to the new tunnel
+func applyClientConfig(tun *RegularOutTunnel, cfg *config.ClientConfig) error {
+	if cfg.OutFilter != nil {
+		f, err := outFilterFromConfig(cfg.OutFilter)
+		if err != nil {
+			return fmt.Errorf("invalid out filter config: %w", err)
+		}
+		tun.SetOutFilter(f)
+	}
+
+	if cfg.Padding != nil {
+		p, err := paddingFromConfig(cfg.Padding)
+		if err != nil {
+			return fmt.Errorf("invalid padding config: %w", err)
+		}
+		_ = tun.SetPaddingPolicy(p)
+	}
+
+	if cfg.CoverTraffic != nil {
+		p, err := coverFromConfig(cfg.CoverTraffic)
+		if err != nil {
+			return fmt.Errorf("invalid cover traffic config: %w", err)
+		}
+		_ = tun.SetCoverTraffic(p)
+	}
+	return nil
+}
+
+// resumeRoute rebuilds tunnel of saved session, nodes which still hold its sections continue to use
+// the same routes and out port. Route was accepted before restart, so it is not asked again.
+func resumeRoute(ctx context.Context, cfg *config.ClientConfig, apiClient ton.APIClientWrapped, tGate *Gateway, nodes []config.TunnelRouteSection, st *SessionState, events chan any) (*RegularOutTunnel, uint16, net.IP, error) {
+	find := func(key []byte) *config.TunnelRouteSection {
+		for i := range nodes {
+			if bytes.Equal(nodes[i].Key, key) {
+				return &nodes[i]
+			}
+		}
+		return nil
+	}
+
+	if len(st.ChainTo) == 0 || len(st.ChainFrom) == 0 {
+		return nil, 0, nil, fmt.Errorf("session has no sections")
+	}
+
+	var actingNodes []config.TunnelRouteSection
+	var chainTo, chainFrom []*SectionInfo
+	for i, k := range st.ChainTo {
+		node := find(k.ReceiverPubKey)
+		if node == nil {
+			return nil, 0, nil, fmt.Errorf("node %s of session is not in pool", base64.StdEncoding.EncodeToString(k.ReceiverPubKey))
+		}
+
+		si, err := paymentConfigToSections(node, i == len(st.ChainTo)-1, tGate.payments.Service)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("convert config to section %d in `out` route failed: %w", i, err)
+		}
+		chainTo = append(chainTo, si)
+		actingNodes = append(actingNodes, *node)
+	}
+
+	for i, k := range st.ChainFrom[:len(st.ChainFrom)-1] {
+		node := find(k.ReceiverPubKey)
+		if node == nil {
+			return nil, 0, nil, fmt.Errorf("node %s of session is not in pool", base64.StdEncoding.EncodeToString(k.ReceiverPubKey))
+		}
+
+		si, err := paymentConfigToSections(node, false, tGate.payments.Service)
+		if err != nil {
+			return nil, 0, nil, fmt.Errorf("convert config to section %d in `in` route failed: %w", i, err)
+		}
+		chainFrom = append(chainFrom, si)
+		actingNodes = append(actingNodes, *node)
 	}
 
 	toUs, err := GenerateEncryptionKeys(tGate.key.Public().(ed25519.PublicKey))
 	if err != nil {
-		return nil, 0, nil, fmt.Errorf("generate us encryption keys failed: %w", err), false
+		return nil, 0, nil, fmt.Errorf("generate us encryption keys failed: %w", err)
 	}
 	chainFrom = append(chainFrom, &SectionInfo{
 		Keys: toUs,
@@ -366,28 +995,69 @@ reassemble:
 
 	if tGate.payments.Service != nil {
 		if err = checkAndDeployPaymentChannels(ctx, apiClient, tGate.payments.Service, actingNodes, events); err != nil {
-			return nil, 0, nil, fmt.Errorf("failed to check payment channels: %w", err), false
+			return nil, 0, nil, fmt.Errorf("failed to check payment channels: %w", err)
 		}
 	}
 
-	tun, err := tGate.CreateRegularOutTunnel(ctx, chainTo, chainFrom, tGate.log.With().Str("component", "tunnel").Logger())
+	tun, err := tGate.ResumeRegularOutTunnel(ctx, st, chainTo, chainFrom, tGate.log.With().Str("component", "tunnel").Logger())
 	if err != nil {
-		return nil, 0, nil, fmt.Errorf("create regular out tunnel failed: %w", err), true
+		return nil, 0, nil, fmt.Errorf("resume regular out tunnel failed: %w", err)
 	}
 
-	tGate.log.Info().Str("route", strTo).Msg("waiting adnl tunnel confirmation...")
+	if err = applyClientConfig(tun, cfg); err != nil {
+		_ = tun.Stop(ctx)
+		return nil, 0, nil, err
+	}
 
 	extIP, extPort, err := tun.WaitForInit(ctx, func(s string) {
 		events <- MsgEvent{Msg: s}
 	})
 	if err != nil {
 		_ = tun.Stop(ctx)
-		return nil, 0, nil, fmt.Errorf("wait for tunnel init failed: %w", err), true
+		return nil, 0, nil, fmt.Errorf("wait for tunnel init failed: %w", err)
+	}
+
+	if !extIP.Equal(st.ExtIP) || extPort != st.ExtPort {
+		tGate.log.Warn().Str("was", fmt.Sprintf("%s:%d", st.ExtIP, st.ExtPort)).
+			Str("now", fmt.Sprintf("%s:%d", extIP, extPort)).Msg("session resumed, but external address is changed")
+	} else {
+		tGate.log.Info().Msg("session resumed with the same external address")
+	}
+
+	return tun, extPort, extIP, nil
+}
+
+// saveSession periodically saves session of the current tunnel, until ctx is done
+func saveSession(ctx context.Context, path string, tunKey ed25519.PrivateKey, sw *AtomicSwitchableRegularTunnel, logger zerolog.Logger) {
+	save := func() {
+		tun := sw.Current()
+		if tun == nil {
+			return
+		}
+
+		st := tun.ExportSession()
+		if st == nil {
+			return
+		}
+		st.TunnelKey = tunKey.Seed()
+
+		if err := st.Save(path); err != nil {
+			logger.Warn().Err(err).Msg("failed to save tunnel session")
+		}
 	}
 
-	tGate.log.Info().Str("route", strTo).Msg("adnl tunnel is ready")
+	ticker := time.NewTicker(SessionSaveInterval)
+	defer ticker.Stop()
 
-	return tun, extPort, extIP, nil, true
+	for {
+		select {
+		case <-ctx.Done():
+			save()
+			return
+		case <-ticker.C:
+			save()
+		}
+	}
 }
 
 func preparePayerPayments(ctx context.Context, apiClient ton.APIClientWrapped, dhtClient *dht.Client, cfg *config.ClientConfig, logger zerolog.Logger, manager adnl.NetManager, events chan any) (svc *tonpayments.Service, onCloseExec []func(), err error) {
@@ -0,0 +1,102 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"github.com/ton-blockchain/adnl-tunnel/config"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPickRouteCandidates(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	g, _ := newTestGateway(t, ctx)
+
+	var nodes []config.TunnelRouteSection
+	for i := 0; i < 4; i++ {
+		pub, _, _ := ed25519.GenerateKey(nil)
+		nodes = append(nodes, config.TunnelRouteSection{Key: pub})
+	}
+
+	// only the configured winner is asked, not every candidate
+	asked := 0
+	acceptor := Acceptor
+	Acceptor = func(to, from []*SectionInfo) int {
+		asked++
+		return AcceptorDecisionAccept
+	}
+	defer func() { Acceptor = acceptor }()
+
+	cfg := &config.ClientConfig{TunnelSectionsNum: 2}
+	attempts := map[string]bool{}
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		c, err, _ := pickRoute(cfg, g, nodes, nil, nil, attempts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if seen[c.str] {
+			t.Fatal("candidates should use different routes")
+		}
+		seen[c.str] = true
+
+		if len(c.chainTo) != 2 || len(c.chainFrom) != 2 {
+			t.Fatal("unexpected chains length")
+		}
+
+		if !bytes.Equal(c.chainFrom[1].Keys.ReceiverPubKey, g.key.Public().(ed25519.PublicKey)) {
+			t.Fatal("inbound chain should end on us")
+		}
+	}
+
+	if asked != 0 {
+		t.Fatal("candidates should not be accepted before configuration")
+	}
+
+	// out gate of kept tunnel is always used
+	outKey := nodes[2].Key
+	keep := &RegularOutTunnel{chainTo: []*SectionInfo{testSection(t, outKey)}}
+	attempts = map[string]bool{}
+	for i := 0; i < 3; i++ {
+		c, err, _ := pickRoute(cfg, g, nodes, keep, nil, attempts)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(c.chainTo[1].Keys.ReceiverPubKey, outKey) {
+			t.Fatal("out gate should be kept")
+		}
+	}
+}
+
+func TestLookupEach(t *testing.T) {
+	var active, maxActive int32
+	done := make([]int32, 100)
+
+	lookupEach(len(done), func(i int) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			m := atomic.LoadInt32(&maxActive)
+			if n <= m || atomic.CompareAndSwapInt32(&maxActive, m, n) {
+				break
+			}
+		}
+		time.Sleep(time.Millisecond)
+		atomic.AddInt32(&done[i], 1)
+		atomic.AddInt32(&active, -1)
+	})
+
+	for i := range done {
+		if done[i] != 1 {
+			t.Fatal("each item should be looked up once")
+		}
+	}
+	if maxActive > NodeLookupWorkers {
+		t.Fatal("lookups should be limited, got", maxActive)
+	}
+}
@@ -0,0 +1,614 @@
+package tunnel
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"github.com/xssnick/tonutils-go/adnl/keys"
+	"github.com/xssnick/tonutils-go/tl"
+	"reflect"
+	"sync/atomic"
+	"time"
+)
+
+func init() {
+	tl.Register(StatsMeta{}, "adnlTunnel.statsMeta seqno:long hop:int = adnlTunnel.StatsMeta")
+	tl.Register(StatsReportPayload{}, "adnlTunnel.statsReportPayload seqno:long sectionPubKey:int256 routeId:int routed:long routeDropped:long prepaidRoute:long outSent:long outReceived:long outDroppedIn:long prepaidOut:long prepaidIn:long createdAt:long signature:bytes = adnlTunnel.StatsReportPayload")
+	tl.Register(StatsReportPayloadV2{}, "adnlTunnel.statsReportPayloadV2 seqno:long sectionPubKey:int256 routeId:int routed:long routeDropped:long prepaidRoute:long outSent:long outReceived:long outDroppedIn:long outMessagesIn:long outMessagesBack:long prepaidOut:long prepaidIn:long createdAt:long signature:bytes = adnlTunnel.StatsReportPayload")
+
+	instructionOpcodes[tl.Register(ReportStatsInstruction{}, "adnlTunnel.reportStatsInstruction seqno:long routeId:int inboundNodeADNL:int256 inboundSectionPubKey:int256 inboundInstructions:bytes = adnlTunnel.Instruction")] = reflect.TypeOf(ReportStatsInstruction{})
+	instructionOpcodes[tl.Register(ReportStatsInstructionV2{}, "adnlTunnel.reportStatsInstructionV2 seqno:long routeId:int inboundNodeADNL:int256 inboundSectionPubKey:int256 inboundInstructions:bytes = adnlTunnel.Instruction")] = reflect.TypeOf(ReportStatsInstructionV2{})
+}
+
+const StatsRequestEverySec = 10
+
+// HopStatsMaxAge is how long report of hop is used, hop which stops to answer is checked by global loss again
+const HopStatsMaxAge = 3 * StatsRequestEverySec * time.Second
+
+// HopLossNumAcceptable is a number of lost packets on hop which is always tolerated,
+// on top of it up to 33% loss is accepted, before payments to hop are suspended
+const HopLossNumAcceptable = 5000
+
+// ReportStatsInstruction is used to get network statistics from some node,
+// for example to calc packet loss or align payment amount.
+// Node replies with signed StatsReportPayload over the supplied inbound route.
+type ReportStatsInstruction struct {
+	Seqno                uint64 `tl:"long"`
+	RouteID              uint32 `tl:"int"`
+	InboundNodeADNL      []byte `tl:"int256"`
+	InboundSectionPubKey []byte `tl:"int256"`
+	InboundInstructions  []byte `tl:"bytes"`
+}
+
+// ReportStatsInstructionV2 is the same request, node replies with StatsReportPayloadV2,
+// it is sent only to nodes which support batching, older nodes do not know it
+type ReportStatsInstructionV2 ReportStatsInstruction
+
+type StatsMeta struct {
+	Seqno uint64 `tl:"long"`
+	Hop   uint32 `tl:"int"`
+}
+
+// StatsReportPayload is counters of section and its route, signed by node key,
+// it is encrypted with section key, so only tunnel owner can read it
+type StatsReportPayload struct {
+	Seqno         uint64 `tl:"long"`
+	SectionPubKey []byte `tl:"int256"`
+
+	RouteID      uint32 `tl:"int"`
+	Routed       uint64 `tl:"long"`
+	RouteDropped uint64 `tl:"long"`
+	PrepaidRoute int64  `tl:"long"`
+
+	OutSent      uint64 `tl:"long"`
+	OutReceived  uint64 `tl:"long"`
+	OutDroppedIn uint64 `tl:"long"`
+	PrepaidOut   int64  `tl:"long"`
+	PrepaidIn    int64  `tl:"long"`
+
+	CreatedAt int64  `tl:"long"`
+	Signature []byte `tl:"bytes"`
+}
+
+// StatsReportPayloadV2 is StatsReportPayload with tunnel messages counters of out gate
+type StatsReportPayloadV2 struct {
+	Seqno         uint64 `tl:"long"`
+	SectionPubKey []byte `tl:"int256"`
+
+	RouteID      uint32 `tl:"int"`
+	Routed       uint64 `tl:"long"`
+	RouteDropped uint64 `tl:"long"`
+	PrepaidRoute int64  `tl:"long"`
+
+	OutSent      uint64 `tl:"long"`
+	OutReceived  uint64 `tl:"long"`
+	OutDroppedIn uint64 `tl:"long"`
+	// OutMessagesIn and OutMessagesBack are tunnel messages, single message can carry batch of packets
+	OutMessagesIn   uint64 `tl:"long"`
+	OutMessagesBack uint64 `tl:"long"`
+	PrepaidOut      int64  `tl:"long"`
+	PrepaidIn       int64  `tl:"long"`
+
+	CreatedAt int64  `tl:"long"`
+	Signature []byte `tl:"bytes"`
+}
+
+// HopStats is the latest report of node on the tunnel way
+type HopStats struct {
+	NodeKey    ed25519.PublicKey
+	SectionKey ed25519.PublicKey
+	Report     StatsReportPayload
+	ReceivedAt time.Time
+
+	// OutMessagesIn and OutMessagesBack are tunnel messages of out gate,
+	// nodes which send the first version of report do not batch, so they are equal to packets
+	OutMessagesIn   uint64
+	OutMessagesBack uint64
+
+	// Loss is a share of packets lost on this hop, according to reports of neighbours
+	Loss              float64
+	PaymentsSuspended bool
+
+	// sent is our sent counter when the request was sent, and received is our received counter when report arrived,
+	// they are compared with counters of the report, because report is passing the same way as packets
+	sent     uint64
+	received uint64
+}
+
+func (ins ReportStatsInstruction) Execute(ctx context.Context, s *Section, msg *EncryptedMessage, restInstructions []byte) error {
+	return ins.execute(s, false)
+}
+
+func (ins ReportStatsInstructionV2) Execute(ctx context.Context, s *Section, msg *EncryptedMessage, restInstructions []byte) error {
+	return ReportStatsInstruction(ins).execute(s, true)
+}
+
+func (ins ReportStatsInstruction) execute(s *Section, v2 bool) error {
+	now := time.Now().Unix()
+	last := atomic.LoadInt64(&s.lastStatsReportAt)
+	if now-last < 1 || !atomic.CompareAndSwapInt64(&s.lastStatsReportAt, last, now) {
+		return fmt.Errorf("stats are requested too often")
+	}
+
+	report := s.collectStats(ins.RouteID)
+	report.Seqno = ins.Seqno
+
+	var data []byte
+	var err error
+	if v2 {
+		if err = report.Sign(s.gw.key); err != nil {
+			return fmt.Errorf("sign report failed: %w", err)
+		}
+		data, err = tl.Serialize(report, true)
+	} else {
+		v1 := report.v1()
+		if err = v1.Sign(s.gw.key); err != nil {
+			return fmt.Errorf("sign report failed: %w", err)
+		}
+		data, err = tl.Serialize(v1, true)
+	}
+	if err != nil {
+		return fmt.Errorf("serialize report failed: %w", err)
+	}
+
+	s.mx.RLock()
+	payload, err := encryptStream(s.getCipherMode(), s.cipherKeyCrc, s.cipherKey, data)
+	s.mx.RUnlock()
+	if err != nil {
+		return fmt.Errorf("encrypt report failed: %w", err)
+	}
+
+	go func() {
+		peer := s.gw.addPeer(ins.InboundNodeADNL, nil)
+		peer.AddReference()
+		defer peer.Dereference()
+
+		ctxSend, cancel := context.WithTimeout(s.gw.closerCtx, 10*time.Second)
+		defer cancel()
+
+		if err := peer.waitConnected(ctxSend); err != nil {
+			s.log.Debug().Err(err).Msg("failed to connect to stats receiver")
+			return
+		}
+
+		if err := peer.SendCustomMessage(ctxSend, EncryptedMessage{
+			SectionPubKey: ins.InboundSectionPubKey,
+			Instructions:  ins.InboundInstructions,
+			Payload:       payload,
+		}); err != nil {
+			s.log.Debug().Err(err).Msg("failed to send stats report")
+		}
+	}()
+
+	return nil
+}
+
+func (s *Section) collectStats(routeID uint32) StatsReportPayloadV2 {
+	report := StatsReportPayloadV2{
+		SectionPubKey: s.key,
+		RouteID:       routeID,
+		CreatedAt:     time.Now().Unix(),
+	}
+
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+
+	if r := s.routes[routeID]; r != nil {
+		report.Routed = atomic.LoadUint64(&r.PacketsRouted)
+		report.RouteDropped = atomic.LoadUint64(&r.PacketsDropped)
+		report.PrepaidRoute = atomic.LoadInt64(&r.PrepaidPackets)
+	}
+
+	if s.out != nil {
+		report.OutSent = atomic.LoadUint64(&s.out.PacketsSentOut)
+		report.OutReceived = atomic.LoadUint64(&s.out.PacketsSentIn)
+		report.OutDroppedIn = atomic.LoadUint64(&s.out.PacketsDroppedIn)
+		report.OutMessagesIn = atomic.LoadUint64(&s.out.MessagesIn)
+		report.OutMessagesBack = atomic.LoadUint64(&s.out.MessagesBack)
+		report.PrepaidOut = atomic.LoadInt64(&s.out.PrepaidPacketsOut)
+		report.PrepaidIn = atomic.LoadInt64(&s.out.PrepaidPacketsIn)
+	}
+	return report
+}
+
+// v1 returns counters in the first version layout, for clients which not know messages counters, signature is not copied
+func (r *StatsReportPayloadV2) v1() StatsReportPayload {
+	return StatsReportPayload{
+		Seqno:         r.Seqno,
+		SectionPubKey: r.SectionPubKey,
+		RouteID:       r.RouteID,
+		Routed:        r.Routed,
+		RouteDropped:  r.RouteDropped,
+		PrepaidRoute:  r.PrepaidRoute,
+		OutSent:       r.OutSent,
+		OutReceived:   r.OutReceived,
+		OutDroppedIn:  r.OutDroppedIn,
+		PrepaidOut:    r.PrepaidOut,
+		PrepaidIn:     r.PrepaidIn,
+		CreatedAt:     r.CreatedAt,
+	}
+}
+
+func (r *StatsReportPayloadV2) Sign(key ed25519.PrivateKey) error {
+	r.Signature = nil
+
+	data, err := tl.Serialize(r, true)
+	if err != nil {
+		return fmt.Errorf("failed to serialize report: %w", err)
+	}
+	r.Signature = ed25519.Sign(key, data)
+	return nil
+}
+
+func (r *StatsReportPayloadV2) Verify(key ed25519.PublicKey) error {
+	cp := *r
+	cp.Signature = nil
+
+	data, err := tl.Serialize(&cp, true)
+	if err != nil {
+		return fmt.Errorf("failed to serialize report: %w", err)
+	}
+
+	if !ed25519.Verify(key, data, r.Signature) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+func (r *StatsReportPayload) Sign(key ed25519.PrivateKey) error {
+	r.Signature = nil
+
+	data, err := tl.Serialize(r, true)
+	if err != nil {
+		return fmt.Errorf("failed to serialize report: %w", err)
+	}
+	r.Signature = ed25519.Sign(key, data)
+	return nil
+}
+
+func (r *StatsReportPayload) Verify(key ed25519.PublicKey) error {
+	cp := *r
+	cp.Signature = nil
+
+	data, err := tl.Serialize(&cp, true)
+	if err != nil {
+		return fmt.Errorf("failed to serialize report: %w", err)
+	}
+
+	if !ed25519.Verify(key, data, r.Signature) {
+		return fmt.Errorf("invalid signature")
+	}
+	return nil
+}
+
+// GetHopStats returns latest reports of nodes on the way, in order of packets flow
+func (t *RegularOutTunnel) GetHopStats() []HopStats {
+	t.statsMx.RLock()
+	defer t.statsMx.RUnlock()
+
+	res := make([]HopStats, 0, len(t.hopStats))
+	for _, h := range t.hopStats {
+		if h != nil {
+			res = append(res, *h)
+		}
+	}
+	return res
+}
+
+// hasAllHopStats returns true when every hop has fresh report, so loss is checked per hop
+func (t *RegularOutTunnel) hasAllHopStats() bool {
+	t.mx.RLock()
+	hops := len(t.chainTo) + len(t.chainFrom) - 1
+	t.mx.RUnlock()
+
+	t.statsMx.RLock()
+	defer t.statsMx.RUnlock()
+
+	if len(t.hopStats) != hops {
+		return false
+	}
+
+	now := time.Now()
+	for _, h := range t.hopStats {
+		if !t.hopStatsFresh(h, now) {
+			return false
+		}
+	}
+	return true
+}
+
+// hopStatsFresh returns true when report is for the current or previous request, and not too old,
+// must be called under stats lock
+func (t *RegularOutTunnel) hopStatsFresh(h *HopStats, now time.Time) bool {
+	return h != nil && h.Report.Seqno+1 >= atomic.LoadUint64(&t.statsSeqno) && now.Sub(h.ReceivedAt) <= HopStatsMaxAge
+}
+
+// expireHopStats resumes payments of hops which verdict is based on outdated report,
+// loss of such hops is checked globally until they report again
+func (t *RegularOutTunnel) expireHopStats() {
+	t.mx.RLock()
+	nodes := append([]*SectionInfo{}, t.chainTo...)
+	nodes = append(nodes, t.chainFrom...)
+	t.mx.RUnlock()
+
+	t.statsMx.Lock()
+	defer t.statsMx.Unlock()
+
+	now := time.Now()
+	for i, h := range t.hopStats {
+		if h == nil || !h.PaymentsSuspended || t.hopStatsFresh(h, now) || i >= len(nodes) {
+			continue
+		}
+
+		h.PaymentsSuspended = false
+		if p := nodes[i].PaymentInfo; p != nil {
+			atomic.StoreInt32(&p.suspended, 0)
+		}
+		t.log.Info().Str("node", base64.StdEncoding.EncodeToString(h.NodeKey)).Msg("hop report is outdated, its payments are resumed, loss is checked globally")
+	}
+}
+
+func (t *RegularOutTunnel) sendStatsRequests() {
+	// snapshot is paired with seqno, so reports are compared with what we sent before the request
+	t.statsMx.Lock()
+	seqno := atomic.AddUint64(&t.statsSeqno, 1)
+	atomic.StoreUint64(&t.statsPacketsSent, atomic.LoadUint64(&t.packetsSent))
+	t.statsMx.Unlock()
+
+	t.mx.RLock()
+	hops := len(t.chainTo) + len(t.chainFrom) - 1
+	t.mx.RUnlock()
+
+	for hop := 0; hop < hops; hop++ {
+		msg, err := t.prepareStatsRequestMessage(hop, seqno)
+		if err != nil {
+			t.log.Debug().Err(err).Int("hop", hop).Msg("prepare stats request failed")
+			continue
+		}
+
+		if err = t.peer.SendCustomMessage(context.Background(), msg); err != nil {
+			t.log.Debug().Err(err).Int("hop", hop).Msg("send stats request failed")
+			return
+		}
+	}
+}
+
+func (t *RegularOutTunnel) prepareStatsRequestMessage(hop int, seqno uint64) (*EncryptedMessage, error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+
+	nodes := append([]*SectionInfo{}, t.chainTo...)
+	nodes = append(nodes, t.chainFrom...)
+
+	// route back to us over system routes of inbound chain
+	backMsg := &EncryptedMessage{}
+	for y := len(t.chainFrom) - 1; y >= 0; y-- {
+		if y == len(t.chainFrom)-1 {
+			if err := t.chainFrom[y].Keys.EncryptInstructionsMessage(backMsg, DeliverInitiatorInstruction{
+				From: t.localID,
+				Metadata: StatsMeta{
+					Seqno: seqno,
+					Hop:   uint32(hop),
+				},
+			}); err != nil {
+				return nil, fmt.Errorf("encrypt failed: %w", err)
+			}
+			continue
+		}
+
+		if err := t.chainFrom[y].Keys.EncryptInstructionsMessage(backMsg, RouteInstruction{
+			RouteID: ^binary.LittleEndian.Uint32(t.chainFrom[y+1].Keys.SectionPubKey),
+		}); err != nil {
+			return nil, fmt.Errorf("encrypt failed: %w", err)
+		}
+	}
+
+	inboundID, err := tl.Hash(keys.PublicKeyED25519{Key: t.chainFrom[0].Keys.ReceiverPubKey})
+	if err != nil {
+		return nil, fmt.Errorf("calc inbound adnl id failed: %w", err)
+	}
+
+	msg := &EncryptedMessage{}
+	for i := hop; i >= 0; i-- {
+		if i == hop {
+			var routeId uint32
+			if i != len(t.chainTo)-1 {
+				// out gate has no main route, it reports out counters
+				routeId = binary.LittleEndian.Uint32(nodes[i+1].Keys.SectionPubKey)
+			}
+
+			var ins tl.Serializable = ReportStatsInstruction{
+				Seqno:                seqno,
+				RouteID:              routeId,
+				InboundNodeADNL:      inboundID,
+				InboundSectionPubKey: backMsg.SectionPubKey,
+				InboundInstructions:  backMsg.Instructions,
+			}
+			if t.gateway.nodeHasCapability(nodes[i].Keys.ReceiverPubKey, NodeCapabilityBatch) {
+				ins = ReportStatsInstructionV2(ins.(ReportStatsInstruction))
+			}
+
+			if err = nodes[i].Keys.EncryptInstructionsMessage(msg, ins); err != nil {
+				return nil, fmt.Errorf("encrypt failed: %w", err)
+			}
+			continue
+		}
+
+		if err = nodes[i].Keys.EncryptInstructionsMessage(msg, RouteInstruction{
+			RouteID: ^binary.LittleEndian.Uint32(nodes[i+1].Keys.SectionPubKey), // through system tunnel
+		}); err != nil {
+			return nil, fmt.Errorf("encrypt failed: %w", err)
+		}
+	}
+
+	return msg, nil
+}
+
+func (t *RegularOutTunnel) processStatsReport(payload []byte, m StatsMeta) error {
+	t.mx.RLock()
+	nodes := append([]*SectionInfo{}, t.chainTo...)
+	nodes = append(nodes, t.chainFrom...)
+	t.mx.RUnlock()
+
+	if int(m.Hop) >= len(nodes)-1 {
+		return fmt.Errorf("invalid hop %d", m.Hop)
+	}
+	sec := nodes[m.Hop]
+
+	data, err := sec.Keys.decrypt(payload)
+	if err != nil {
+		return fmt.Errorf("decrypt stats report failed: %w", err)
+	}
+
+	var parsed tl.Serializable
+	if _, err = tl.Parse(&parsed, data, true); err != nil {
+		return fmt.Errorf("parse stats report failed: %w", err)
+	}
+
+	var report StatsReportPayload
+	var messagesIn, messagesBack uint64
+	switch r := parsed.(type) {
+	case StatsReportPayload:
+		err = r.Verify(sec.Keys.ReceiverPubKey)
+		report, messagesIn, messagesBack = r, r.OutSent, r.OutReceived
+	case StatsReportPayloadV2:
+		err = r.Verify(sec.Keys.ReceiverPubKey)
+		report, messagesIn, messagesBack = r.v1(), r.OutMessagesIn, r.OutMessagesBack
+	default:
+		return fmt.Errorf("unexpected stats report type %T", parsed)
+	}
+	if err != nil {
+		return fmt.Errorf("verify stats report failed: %w", err)
+	}
+
+	if report.Seqno != m.Seqno || !bytes.Equal(report.SectionPubKey, sec.Keys.SectionPubKey) {
+		return fmt.Errorf("stats report is not for this request")
+	}
+
+	t.statsMx.Lock()
+	if len(t.hopStats) != len(nodes)-1 {
+		t.hopStats = make([]*HopStats, len(nodes)-1)
+	}
+
+	if report.Seqno != atomic.LoadUint64(&t.statsSeqno) {
+		// our snapshot is already taken for the next request
+		t.statsMx.Unlock()
+		return nil
+	}
+
+	if h := t.hopStats[m.Hop]; h != nil && h.Report.Seqno >= report.Seqno {
+		t.statsMx.Unlock()
+		return nil
+	}
+
+	t.hopStats[m.Hop] = &HopStats{
+		NodeKey:         sec.Keys.ReceiverPubKey,
+		SectionKey:      sec.Keys.SectionPubKey,
+		Report:          report,
+		ReceivedAt:      time.Now(),
+		OutMessagesIn:   messagesIn,
+		OutMessagesBack: messagesBack,
+		sent:            atomic.LoadUint64(&t.statsPacketsSent),
+		received:        atomic.LoadUint64(&t.messagesRecv),
+	}
+	t.statsMx.Unlock()
+
+	t.reconcileHopStats(nodes)
+	return nil
+}
+
+// reconcileHopStats compares counters of neighbour hops, packets which previous hop passed,
+// but current one not, are considered lost by current hop. Payments to hops which lose
+// too many packets are suspended, until they start to deliver again.
+// Only reports of the same request are compared, to not mix counters of different moments.
+func (t *RegularOutTunnel) reconcileHopStats(nodes []*SectionInfo) {
+	outIdx := len(t.chainTo) - 1
+
+	t.statsMx.Lock()
+	defer t.statsMx.Unlock()
+
+	if t.hopStats[0] == nil {
+		return
+	}
+	seqno := t.hopStats[0].Report.Seqno
+
+	// outbound: we -> routes of out chain -> out gate sends
+	prev := t.hopStats[0].sent
+	for i := 0; i <= outIdx; i++ {
+		h := t.hopStats[i]
+		if h == nil || h.Report.Seqno != seqno {
+			break
+		}
+
+		if i == outIdx && t.rendezvous != nil {
+			// introduction node has no out counters
+			return
+		}
+
+		// routes count messages, so out gate is compared by messages too, packets can be batched
+		passed := h.Report.Routed
+		if i == outIdx {
+			passed = h.OutMessagesIn
+		}
+		t.checkHopLoss(nodes[i], h, prev, passed)
+		prev = passed
+	}
+
+	// inbound: out gate receives -> routes of in chain -> we
+	out := t.hopStats[outIdx]
+	if out == nil {
+		return
+	}
+	seqno = out.Report.Seqno
+
+	prev = out.OutMessagesBack
+	for i := outIdx + 1; i < len(t.hopStats); i++ {
+		h := t.hopStats[i]
+		if h == nil || h.Report.Seqno != seqno {
+			return
+		}
+
+		passed := h.Report.Routed
+		if i == len(t.hopStats)-1 {
+			// last hop routes to us, we know what we actually received before its report
+			passed = h.received
+		}
+		t.checkHopLoss(nodes[i], h, prev, passed)
+		prev = h.Report.Routed
+	}
+}
+
+func (t *RegularOutTunnel) checkHopLoss(sec *SectionInfo, h *HopStats, prev, passed uint64) {
+	var lost uint64
+	if prev > passed {
+		lost = prev - passed
+	}
+
+	h.Loss = 0
+	if prev > 0 {
+		h.Loss = float64(lost) / float64(prev)
+	}
+
+	suspend := lost > passed/3+HopLossNumAcceptable
+	if suspend != h.PaymentsSuspended {
+		if suspend {
+			t.log.Warn().Str("node", base64.StdEncoding.EncodeToString(h.NodeKey)).
+				Uint64("lost", lost).Float64("loss", h.Loss).
+				Msg("hop lost more than 33% of packets according to reports, suspending its payments")
+		} else {
+			t.log.Info().Str("node", base64.StdEncoding.EncodeToString(h.NodeKey)).Msg("hop delivers packets again, resuming its payments")
+		}
+	}
+	h.PaymentsSuspended = suspend
+
+	if sec.PaymentInfo != nil {
+		var v int32
+		if suspend {
+			v = 1
+		}
+		atomic.StoreInt32(&sec.PaymentInfo.suspended, v)
+	}
+}
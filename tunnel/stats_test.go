@@ -0,0 +1,140 @@
+package tunnel
+
+import (
+	"crypto/ed25519"
+	"github.com/rs/zerolog"
+	"github.com/xssnick/tonutils-go/tl"
+	"testing"
+	"time"
+)
+
+func TestStatsReportSignature(t *testing.T) {
+	pub, key, _ := ed25519.GenerateKey(nil)
+
+	r := &Route{ID: 7, PacketsRouted: 100, PacketsDropped: 3, PrepaidPackets: 50}
+	s := &Section{key: make([]byte, 32), routes: map[uint32]*Route{7: r}}
+
+	report := s.collectStats(7)
+	if report.Routed != 100 || report.RouteDropped != 3 || report.PrepaidRoute != 50 {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+
+	if err := report.Sign(key); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+
+	data, err := tl.Serialize(report, true)
+	if err != nil {
+		t.Fatalf("Serialize() error = %v", err)
+	}
+
+	var parsed StatsReportPayloadV2
+	if _, err = tl.Parse(&parsed, data, true); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+
+	if err = parsed.Verify(pub); err != nil {
+		t.Fatalf("Verify() error = %v", err)
+	}
+
+	parsed.Routed++
+	if err = parsed.Verify(pub); err == nil {
+		t.Fatal("expected verification failure of modified report")
+	}
+
+	// the first version layout is kept for older clients
+	v1 := report.v1()
+	if err = v1.Sign(key); err != nil {
+		t.Fatalf("Sign() error = %v", err)
+	}
+	if data, err = tl.Serialize(v1, true); err != nil {
+		t.Fatalf("Serialize() error = %v", err)
+	}
+
+	var parsedV1 StatsReportPayload
+	if _, err = tl.Parse(&parsedV1, data, true); err != nil {
+		t.Fatalf("Parse() error = %v", err)
+	}
+	if err = parsedV1.Verify(pub); err != nil || parsedV1.Routed != 100 {
+		t.Fatalf("Verify() error = %v", err)
+	}
+}
+
+func TestReconcileHopStats(t *testing.T) {
+	newSection := func(paid bool) *SectionInfo {
+		pub, _, _ := ed25519.GenerateKey(nil)
+		sec := &SectionInfo{Keys: &EncryptionKeys{ReceiverPubKey: pub}}
+		if paid {
+			sec.PaymentInfo = &Payer{PricePerPacket: 1}
+		}
+		return sec
+	}
+
+	// relay -> out gate -> relay -> we
+	tun := &RegularOutTunnel{
+		chainTo:   []*SectionInfo{newSection(true), newSection(true)},
+		chainFrom: []*SectionInfo{newSection(true), newSection(false)},
+		log:       zerolog.Nop(),
+	}
+	nodes := append(append([]*SectionInfo{}, tun.chainTo...), tun.chainFrom...)
+
+	tun.hopStats = []*HopStats{
+		{Report: StatsReportPayload{Routed: 99000}, sent: 100000},
+		{OutMessagesIn: 98500, OutMessagesBack: 80000},
+		{Report: StatsReportPayload{Routed: 79000}, received: 40000},
+	}
+	tun.reconcileHopStats(nodes)
+
+	if tun.hopStats[0].PaymentsSuspended || tun.hopStats[1].PaymentsSuspended {
+		t.Fatal("hops with small loss should not be suspended")
+	}
+
+	if !tun.hopStats[2].PaymentsSuspended || nodes[2].PaymentInfo.suspended != 1 {
+		t.Fatal("hop which lost half of packets should be suspended")
+	}
+
+	tun.hopStats[2].received = 78000
+	tun.reconcileHopStats(nodes)
+	if tun.hopStats[2].PaymentsSuspended || nodes[2].PaymentInfo.suspended != 0 {
+		t.Fatal("hop payments should be resumed")
+	}
+
+	// report of other request is not compared
+	tun.hopStats[2] = &HopStats{Report: StatsReportPayload{Seqno: 1, Routed: 79000}, received: 40000}
+	tun.reconcileHopStats(nodes)
+	if tun.hopStats[2].PaymentsSuspended {
+		t.Fatal("reports of different requests should not be compared")
+	}
+
+	now := time.Now()
+	for _, h := range tun.hopStats {
+		h.ReceivedAt = now
+	}
+	if !tun.hasAllHopStats() {
+		t.Fatal("all hops reported")
+	}
+
+	// hop which stops to answer is checked globally again, and its verdict is expired
+	tun.hopStats[2].PaymentsSuspended = true
+	nodes[2].PaymentInfo.suspended = 1
+	tun.hopStats[2].ReceivedAt = now.Add(-HopStatsMaxAge - time.Second)
+	if tun.hasAllHopStats() {
+		t.Fatal("outdated report should not be used")
+	}
+	tun.expireHopStats()
+	if tun.hopStats[2].PaymentsSuspended || nodes[2].PaymentInfo.suspended != 0 {
+		t.Fatal("verdict of outdated report should be expired")
+	}
+
+	tun.hopStats[2].ReceivedAt = now
+	tun.statsSeqno = 3
+	if tun.hasAllHopStats() {
+		t.Fatal("report of old request should not be used")
+	}
+
+	tun.statsSeqno = 1
+	tun.hopStats[1] = nil
+	if tun.hasAllHopStats() {
+		t.Fatal("global loss check should be used until all hops report")
+	}
+}